@@ -9,4 +9,7 @@ type RotatingProxyInstance struct {
 	UsedPorts  int    `json:"used_ports"`
 	FreePorts  int    `json:"free_ports"`
 	TotalPorts int    `json:"total_ports"`
+	// Shared gateway listeners of the instance, 0 when disabled.
+	GatewayHTTPPort   int `json:"gateway_http_port,omitempty"`
+	GatewaySOCKS5Port int `json:"gateway_socks5_port,omitempty"`
 }
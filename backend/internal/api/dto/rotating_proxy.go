@@ -3,45 +3,237 @@ package dto
 import "time"
 
 type RotatingProxy struct {
-	ID                      uint64     `json:"id"`
-	Name                    string     `json:"name"`
-	InstanceID              string     `json:"instance_id,omitempty"`
-	InstanceName            string     `json:"instance_name,omitempty"`
-	InstanceRegion          string     `json:"instance_region,omitempty"`
-	Protocol                string     `json:"protocol"`
-	ListenProtocol          string     `json:"listen_protocol,omitempty"`
-	TransportProtocol       string     `json:"transport_protocol,omitempty"`
-	ListenTransportProtocol string     `json:"listen_transport_protocol,omitempty"`
-	UptimeFilterType        string     `json:"uptime_filter_type,omitempty"`
-	UptimePercentage        *float64   `json:"uptime_percentage,omitempty"`
-	AliveProxyCount         int        `json:"alive_proxy_count"`
-	ListenPort              uint16     `json:"listen_port"`
-	AuthRequired            bool       `json:"auth_required"`
-	AuthUsername            string     `json:"auth_username,omitempty"`
-	AuthPassword            string     `json:"auth_password,omitempty"`
-	ListenHost              string     `json:"listen_host,omitempty"`
-	ListenAddress           string     `json:"listen_address,omitempty"`
-	LastRotationAt          *time.Time `json:"last_rotation_at,omitempty"`
-	LastServedProxy         string     `json:"last_served_proxy,omitempty"`
-	ReputationLabels        []string   `json:"reputation_labels,omitempty"`
-	CreatedAt               time.Time  `json:"created_at"`
+	ID                      uint64                       `json:"id"`
+	Name                    string                       `json:"name"`
+	InstanceID              string                       `json:"instance_id,omitempty"`
+	InstanceName            string                       `json:"instance_name,omitempty"`
+	InstanceRegion          string                       `json:"instance_region,omitempty"`
+	Protocol                string                       `json:"protocol"`
+	ListenProtocol          string                       `json:"listen_protocol,omitempty"`
+	TransportProtocol       string                       `json:"transport_protocol,omitempty"`
+	ListenTransportProtocol string                       `json:"listen_transport_protocol,omitempty"`
+	UptimeFilterType        string                       `json:"uptime_filter_type,omitempty"`
+	UptimePercentage        *float64                     `json:"uptime_percentage,omitempty"`
+	AliveProxyCount         int                          `json:"alive_proxy_count"`
+	ActiveTunnels           int                          `json:"active_tunnels"`
+	DrainingTunnels         int                          `json:"draining_tunnels"`
+	DrainDeadline           *time.Time                   `json:"drain_deadline,omitempty"`
+	ListenPort              uint16                       `json:"listen_port"`
+	AuthRequired            bool                         `json:"auth_required"`
+	AuthUsername            string                       `json:"auth_username,omitempty"`
+	AuthPassword            string                       `json:"auth_password,omitempty"`
+	ListenHost              string                       `json:"listen_host,omitempty"`
+	ListenAddress           string                       `json:"listen_address,omitempty"`
+	ListenAddresses         []RotatingProxyListenAddress `json:"listen_addresses,omitempty"`
+	LastRotationAt          *time.Time                   `json:"last_rotation_at,omitempty"`
+	LastServedProxy         string                       `json:"last_served_proxy,omitempty"`
+	ReputationLabels        []string                     `json:"reputation_labels,omitempty"`
+	StickySessionTTLSeconds int                          `json:"sticky_session_ttl_seconds,omitempty"`
+	SelectionStrategy       string                       `json:"selection_strategy"`
+	Countries               []string                     `json:"countries,omitempty"`
+	Types                   []string                     `json:"types,omitempty"`
+	AnonymityLevels         []string                     `json:"anonymity_levels,omitempty"`
+	AllowedClientCIDRs      []string                     `json:"allowed_client_cidrs,omitempty"`
+	ClientAuthMode          string                       `json:"client_auth_mode"`
+	RotationMode            string                       `json:"rotation_mode"`
+	RotationIntervalSeconds int                          `json:"rotation_interval_seconds,omitempty"`
+	RotationRequests        int                          `json:"rotation_requests,omitempty"`
+	ParentProxyProtocol     string                       `json:"parent_proxy_protocol,omitempty"`
+	ParentProxyHost         string                       `json:"parent_proxy_host,omitempty"`
+	ParentProxyPort         uint16                       `json:"parent_proxy_port,omitempty"`
+	ParentProxyUsername     string                       `json:"parent_proxy_username,omitempty"`
+	ParentProxyPassword     string                       `json:"parent_proxy_password,omitempty"`
+	AllowedDestinations     []string                     `json:"allowed_destinations,omitempty"`
+	BlockedDestinations     []string                     `json:"blocked_destinations,omitempty"`
+	MaxTunnels              int                          `json:"max_tunnels,omitempty"`
+	ConnectionsPerSecond    int                          `json:"connections_per_second,omitempty"`
+	RequestsPerSecond       int                          `json:"requests_per_second,omitempty"`
+	LimitScope              string                       `json:"limit_scope"`
+	StripRequestHeaders     []string                     `json:"strip_request_headers,omitempty"`
+	InjectRequestHeaders    []string                     `json:"inject_request_headers,omitempty"`
+	UpstreamIDHeader        string                       `json:"upstream_id_header,omitempty"`
+	PinnedProxyIDs          []uint64                     `json:"pinned_proxy_ids,omitempty"`
+	FallbackTiers           []RotatingProxyTier          `json:"fallback_tiers,omitempty"`
+	UpstreamTierHeader      string                       `json:"upstream_tier_header,omitempty"`
+	ReplicaInstanceIDs      []string                     `json:"replica_instance_ids,omitempty"`
+	ReplicaRegion           string                       `json:"replica_region,omitempty"`
+	HandshakeTimeoutMS      int                          `json:"handshake_timeout_ms,omitempty"`
+	UpstreamTimeoutMS       int                          `json:"upstream_timeout_ms,omitempty"`
+	DNSMode                 string                       `json:"dns_mode"`
+	FailoverRetries         int                          `json:"failover_retries,omitempty"`
+	FailoverCooldownSeconds int                          `json:"failover_cooldown_seconds,omitempty"`
+	CreatedAt               time.Time                    `json:"created_at"`
 }
 
 type RotatingProxyCreateRequest struct {
-	Name                    string   `json:"name"`
-	InstanceID              string   `json:"instance_id,omitempty"`
-	InstanceName            string   `json:"instance_name,omitempty"`
-	InstanceRegion          string   `json:"instance_region,omitempty"`
-	Protocol                string   `json:"protocol"`
-	ListenProtocol          string   `json:"listen_protocol,omitempty"`
-	TransportProtocol       string   `json:"transport_protocol,omitempty"`
-	ListenTransportProtocol string   `json:"listen_transport_protocol,omitempty"`
-	UptimeFilterType        string   `json:"uptime_filter_type,omitempty"`
-	UptimePercentage        *float64 `json:"uptime_percentage,omitempty"`
-	AuthRequired            bool     `json:"auth_required"`
-	AuthUsername            string   `json:"auth_username,omitempty"`
-	AuthPassword            string   `json:"auth_password,omitempty"`
-	ReputationLabels        []string `json:"reputation_labels"`
+	Name                    string              `json:"name"`
+	InstanceID              string              `json:"instance_id,omitempty"`
+	InstanceName            string              `json:"instance_name,omitempty"`
+	InstanceRegion          string              `json:"instance_region,omitempty"`
+	Protocol                string              `json:"protocol"`
+	ListenProtocol          string              `json:"listen_protocol,omitempty"`
+	TransportProtocol       string              `json:"transport_protocol,omitempty"`
+	ListenTransportProtocol string              `json:"listen_transport_protocol,omitempty"`
+	UptimeFilterType        string              `json:"uptime_filter_type,omitempty"`
+	UptimePercentage        *float64            `json:"uptime_percentage,omitempty"`
+	AuthRequired            bool                `json:"auth_required"`
+	AuthUsername            string              `json:"auth_username,omitempty"`
+	AuthPassword            string              `json:"auth_password,omitempty"`
+	ReputationLabels        []string            `json:"reputation_labels"`
+	StickySessionTTLSeconds int                 `json:"sticky_session_ttl_seconds,omitempty"`
+	SelectionStrategy       string              `json:"selection_strategy,omitempty"`
+	Countries               []string            `json:"countries,omitempty"`
+	Types                   []string            `json:"types,omitempty"`
+	AnonymityLevels         []string            `json:"anonymity_levels,omitempty"`
+	AllowedClientCIDRs      []string            `json:"allowed_client_cidrs,omitempty"`
+	ClientAuthMode          string              `json:"client_auth_mode,omitempty"`
+	RotationMode            string              `json:"rotation_mode,omitempty"`
+	RotationIntervalSeconds int                 `json:"rotation_interval_seconds,omitempty"`
+	RotationRequests        int                 `json:"rotation_requests,omitempty"`
+	ParentProxyProtocol     string              `json:"parent_proxy_protocol,omitempty"`
+	ParentProxyHost         string              `json:"parent_proxy_host,omitempty"`
+	ParentProxyPort         uint16              `json:"parent_proxy_port,omitempty"`
+	ParentProxyUsername     string              `json:"parent_proxy_username,omitempty"`
+	ParentProxyPassword     string              `json:"parent_proxy_password,omitempty"`
+	AllowedDestinations     []string            `json:"allowed_destinations,omitempty"`
+	BlockedDestinations     []string            `json:"blocked_destinations,omitempty"`
+	MaxTunnels              int                 `json:"max_tunnels,omitempty"`
+	ConnectionsPerSecond    int                 `json:"connections_per_second,omitempty"`
+	RequestsPerSecond       int                 `json:"requests_per_second,omitempty"`
+	LimitScope              string              `json:"limit_scope,omitempty"`
+	StripRequestHeaders     []string            `json:"strip_request_headers,omitempty"`
+	InjectRequestHeaders    []string            `json:"inject_request_headers,omitempty"`
+	UpstreamIDHeader        string              `json:"upstream_id_header,omitempty"`
+	PinnedProxyIDs          []uint64            `json:"pinned_proxy_ids,omitempty"`
+	FallbackTiers           []RotatingProxyTier `json:"fallback_tiers,omitempty"`
+	UpstreamTierHeader      string              `json:"upstream_tier_header,omitempty"`
+	ReplicaInstanceIDs      []string            `json:"replica_instance_ids,omitempty"`
+	ReplicaRegion           string              `json:"replica_region,omitempty"`
+	HandshakeTimeoutMS      int                 `json:"handshake_timeout_ms,omitempty"`
+	UpstreamTimeoutMS       int                 `json:"upstream_timeout_ms,omitempty"`
+	DNSMode                 string              `json:"dns_mode,omitempty"`
+	FailoverRetries         int                 `json:"failover_retries,omitempty"`
+	FailoverCooldownSeconds int                 `json:"failover_cooldown_seconds,omitempty"`
+}
+
+// RotatingProxyUpdateRequest edits a rotator in place. Nil fields keep their
+// current value, so PATCH sends only what changes while PUT fills every field
+// through RotatingProxyCreateRequest.UpdateRequest. The instance and listen
+// port of a rotator never change; its replicas may.
+type RotatingProxyUpdateRequest struct {
+	Name                    *string              `json:"name,omitempty"`
+	Protocol                *string              `json:"protocol,omitempty"`
+	ListenProtocol          *string              `json:"listen_protocol,omitempty"`
+	TransportProtocol       *string              `json:"transport_protocol,omitempty"`
+	ListenTransportProtocol *string              `json:"listen_transport_protocol,omitempty"`
+	UptimeFilterType        *string              `json:"uptime_filter_type,omitempty"`
+	UptimePercentage        *float64             `json:"uptime_percentage,omitempty"`
+	AuthRequired            *bool                `json:"auth_required,omitempty"`
+	AuthUsername            *string              `json:"auth_username,omitempty"`
+	AuthPassword            *string              `json:"auth_password,omitempty"`
+	RegeneratePassword      bool                 `json:"regenerate_password,omitempty"`
+	ReputationLabels        *[]string            `json:"reputation_labels,omitempty"`
+	StickySessionTTLSeconds *int                 `json:"sticky_session_ttl_seconds,omitempty"`
+	SelectionStrategy       *string              `json:"selection_strategy,omitempty"`
+	Countries               *[]string            `json:"countries,omitempty"`
+	Types                   *[]string            `json:"types,omitempty"`
+	AnonymityLevels         *[]string            `json:"anonymity_levels,omitempty"`
+	AllowedClientCIDRs      *[]string            `json:"allowed_client_cidrs,omitempty"`
+	ClientAuthMode          *string              `json:"client_auth_mode,omitempty"`
+	RotationMode            *string              `json:"rotation_mode,omitempty"`
+	RotationIntervalSeconds *int                 `json:"rotation_interval_seconds,omitempty"`
+	RotationRequests        *int                 `json:"rotation_requests,omitempty"`
+	ParentProxyProtocol     *string              `json:"parent_proxy_protocol,omitempty"`
+	ParentProxyHost         *string              `json:"parent_proxy_host,omitempty"`
+	ParentProxyPort         *uint16              `json:"parent_proxy_port,omitempty"`
+	ParentProxyUsername     *string              `json:"parent_proxy_username,omitempty"`
+	ParentProxyPassword     *string              `json:"parent_proxy_password,omitempty"`
+	AllowedDestinations     *[]string            `json:"allowed_destinations,omitempty"`
+	BlockedDestinations     *[]string            `json:"blocked_destinations,omitempty"`
+	MaxTunnels              *int                 `json:"max_tunnels,omitempty"`
+	ConnectionsPerSecond    *int                 `json:"connections_per_second,omitempty"`
+	RequestsPerSecond       *int                 `json:"requests_per_second,omitempty"`
+	LimitScope              *string              `json:"limit_scope,omitempty"`
+	StripRequestHeaders     *[]string            `json:"strip_request_headers,omitempty"`
+	InjectRequestHeaders    *[]string            `json:"inject_request_headers,omitempty"`
+	UpstreamIDHeader        *string              `json:"upstream_id_header,omitempty"`
+	PinnedProxyIDs          *[]uint64            `json:"pinned_proxy_ids,omitempty"`
+	FallbackTiers           *[]RotatingProxyTier `json:"fallback_tiers,omitempty"`
+	UpstreamTierHeader      *string              `json:"upstream_tier_header,omitempty"`
+	ReplicaInstanceIDs      *[]string            `json:"replica_instance_ids,omitempty"`
+	ReplicaRegion           *string              `json:"replica_region,omitempty"`
+	HandshakeTimeoutMS      *int                 `json:"handshake_timeout_ms,omitempty"`
+	UpstreamTimeoutMS       *int                 `json:"upstream_timeout_ms,omitempty"`
+	DNSMode                 *string              `json:"dns_mode,omitempty"`
+	FailoverRetries         *int                 `json:"failover_retries,omitempty"`
+	FailoverCooldownSeconds *int                 `json:"failover_cooldown_seconds,omitempty"`
+}
+
+// UpdateRequest turns a full rotator definition into an update that replaces
+// every editable field. Empty passwords keep the stored ones.
+func (r RotatingProxyCreateRequest) UpdateRequest() RotatingProxyUpdateRequest {
+	update := RotatingProxyUpdateRequest{
+		Name:                    &r.Name,
+		Protocol:                &r.Protocol,
+		ListenProtocol:          &r.ListenProtocol,
+		TransportProtocol:       &r.TransportProtocol,
+		ListenTransportProtocol: &r.ListenTransportProtocol,
+		UptimeFilterType:        &r.UptimeFilterType,
+		UptimePercentage:        r.UptimePercentage,
+		AuthRequired:            &r.AuthRequired,
+		AuthUsername:            &r.AuthUsername,
+		ReputationLabels:        &r.ReputationLabels,
+		StickySessionTTLSeconds: &r.StickySessionTTLSeconds,
+		SelectionStrategy:       &r.SelectionStrategy,
+		Countries:               &r.Countries,
+		Types:                   &r.Types,
+		AnonymityLevels:         &r.AnonymityLevels,
+		AllowedClientCIDRs:      &r.AllowedClientCIDRs,
+		ClientAuthMode:          &r.ClientAuthMode,
+		RotationMode:            &r.RotationMode,
+		RotationIntervalSeconds: &r.RotationIntervalSeconds,
+		RotationRequests:        &r.RotationRequests,
+		ParentProxyProtocol:     &r.ParentProxyProtocol,
+		ParentProxyHost:         &r.ParentProxyHost,
+		ParentProxyPort:         &r.ParentProxyPort,
+		ParentProxyUsername:     &r.ParentProxyUsername,
+		AllowedDestinations:     &r.AllowedDestinations,
+		BlockedDestinations:     &r.BlockedDestinations,
+		MaxTunnels:              &r.MaxTunnels,
+		ConnectionsPerSecond:    &r.ConnectionsPerSecond,
+		RequestsPerSecond:       &r.RequestsPerSecond,
+		LimitScope:              &r.LimitScope,
+		StripRequestHeaders:     &r.StripRequestHeaders,
+		InjectRequestHeaders:    &r.InjectRequestHeaders,
+		UpstreamIDHeader:        &r.UpstreamIDHeader,
+		PinnedProxyIDs:          &r.PinnedProxyIDs,
+		FallbackTiers:           &r.FallbackTiers,
+		UpstreamTierHeader:      &r.UpstreamTierHeader,
+		ReplicaInstanceIDs:      &r.ReplicaInstanceIDs,
+		ReplicaRegion:           &r.ReplicaRegion,
+		HandshakeTimeoutMS:      &r.HandshakeTimeoutMS,
+		UpstreamTimeoutMS:       &r.UpstreamTimeoutMS,
+		DNSMode:                 &r.DNSMode,
+		FailoverRetries:         &r.FailoverRetries,
+		FailoverCooldownSeconds: &r.FailoverCooldownSeconds,
+	}
+	if r.AuthPassword != "" {
+		update.AuthPassword = &r.AuthPassword
+	}
+	if r.ParentProxyPassword != "" {
+		update.ParentProxyPassword = &r.ParentProxyPassword
+	}
+	return update
+}
+
+// RotatingProxyListenAddress is where one instance of a rotator's placement
+// accepts clients.
+type RotatingProxyListenAddress struct {
+	InstanceID     string `json:"instance_id"`
+	InstanceName   string `json:"instance_name,omitempty"`
+	InstanceRegion string `json:"instance_region,omitempty"`
+	ListenHost     string `json:"listen_host,omitempty"`
+	ListenAddress  string `json:"listen_address"`
 }
 
 type RotatingProxyNext struct {
@@ -52,4 +244,58 @@ type RotatingProxyNext struct {
 	Password string `json:"password,omitempty"`
 	HasAuth  bool   `json:"has_auth"`
 	Protocol string `json:"protocol"`
+	// Tier is the pool the upstream was picked from: 0 for the rotator's own
+	// filters, n for its n-th fallback tier.
+	Tier int `json:"tier"`
+	// Parent is the hop the upstream is dialed through, set by the rotator
+	// runtime. Its IP may hold a host name.
+	Parent *RotatingProxyNext `json:"-"`
+	// HandshakeTimeout, UpstreamTimeout and DNSMode carry the rotator's
+	// upstream options to the dialers, set by the rotator runtime. Zero
+	// timeouts use the process defaults.
+	HandshakeTimeout time.Duration `json:"-"`
+	UpstreamTimeout  time.Duration `json:"-"`
+	DNSMode          string        `json:"-"`
+}
+
+// RotatingProxyCredential is an additional login for a rotator. Zero limits
+// mean unlimited.
+type RotatingProxyCredential struct {
+	ID                  uint64     `json:"id"`
+	RotatingProxyID     uint64     `json:"rotating_proxy_id"`
+	Name                string     `json:"name"`
+	Password            string     `json:"password,omitempty"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty"`
+	Expired             bool       `json:"expired"`
+	MaxConnections      int        `json:"max_connections"`
+	BandwidthQuotaBytes int64      `json:"bandwidth_quota_bytes"`
+	BytesUsed           int64      `json:"bytes_used"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+// RotatingProxyCredentialRequest creates a credential or replaces one with
+// PUT. An empty password generates a new one on create and keeps the stored
+// one on update.
+type RotatingProxyCredentialRequest struct {
+	Name                string     `json:"name"`
+	Password            string     `json:"password,omitempty"`
+	RegeneratePassword  bool       `json:"regenerate_password,omitempty"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty"`
+	MaxConnections      int        `json:"max_connections,omitempty"`
+	BandwidthQuotaBytes int64      `json:"bandwidth_quota_bytes,omitempty"`
+	ResetUsage          bool       `json:"reset_usage,omitempty"`
+}
+
+// RotatingProxyTier is a fallback pool tried when the tiers before it have no
+// usable upstream. Empty lists accept any value.
+type RotatingProxyTier struct {
+	ReputationLabels []string `json:"reputation_labels,omitempty"`
+	Types            []string `json:"types,omitempty"`
+	AnonymityLevels  []string `json:"anonymity_levels,omitempty"`
+}
+
+// RotatingProxyPinnedProxiesRequest adds proxies to or removes them from the
+// pinned set of a rotator.
+type RotatingProxyPinnedProxiesRequest struct {
+	ProxyIDs []uint64 `json:"proxy_ids"`
 }
@@ -0,0 +1,45 @@
+package dto
+
+import "time"
+
+type RotatingProxyUsageFailures struct {
+	NoUpstream int64 `json:"no_upstream"`
+	Connect    int64 `json:"connect"`
+	Timeout    int64 `json:"timeout"`
+	Response   int64 `json:"response"`
+}
+
+type RotatingProxyUsageCounters struct {
+	Connections int64                      `json:"connections"`
+	Requests    int64                      `json:"requests"`
+	BytesUp     int64                      `json:"bytes_up"`
+	BytesDown   int64                      `json:"bytes_down"`
+	Failures    RotatingProxyUsageFailures `json:"failures"`
+}
+
+type RotatingProxyUsageBucket struct {
+	BucketStart time.Time `json:"bucket_start"`
+	RotatingProxyUsageCounters
+}
+
+type RotatingProxyUpstreamUsage struct {
+	ProxyID uint64 `json:"proxy_id"`
+	Proxy   string `json:"proxy,omitempty"`
+	RotatingProxyUsageCounters
+}
+
+type RotatingProxyCredentialUsage struct {
+	CredentialID uint64 `json:"credential_id"`
+	Name         string `json:"name,omitempty"`
+	RotatingProxyUsageCounters
+}
+
+type RotatingProxyUsageReport struct {
+	RotatingProxyID uint64                         `json:"rotating_proxy_id"`
+	From            time.Time                      `json:"from"`
+	To              time.Time                      `json:"to"`
+	Totals          RotatingProxyUsageCounters     `json:"totals"`
+	Buckets         []RotatingProxyUsageBucket     `json:"buckets"`
+	Upstreams       []RotatingProxyUpstreamUsage   `json:"upstreams"`
+	Credentials     []RotatingProxyCredentialUsage `json:"credentials"`
+}
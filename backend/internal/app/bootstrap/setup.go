@@ -147,11 +147,8 @@ func Setup(ctx context.Context) error {
 		startupQueueBootstrapCompleted.Store(true)
 	}
 
+	// Rotators are stopped by the API server on shutdown, before it closes.
 	rotatingproxy.GlobalManager.StartAll()
-	go func() {
-		<-ctx.Done()
-		rotatingproxy.GlobalManager.StopAll()
-	}()
 	syncIntervalSeconds := support.GetEnvInt("ROTATING_PROXY_SYNC_INTERVAL_SECONDS", 10)
 	if syncIntervalSeconds <= 0 {
 		syncIntervalSeconds = 10
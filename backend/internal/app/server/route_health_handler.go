@@ -10,6 +10,7 @@ import (
 	"magpie/internal/app/bootstrap"
 	"magpie/internal/app/version"
 	"magpie/internal/database"
+	"magpie/internal/rotatingproxy"
 	"magpie/internal/support"
 )
 
@@ -19,8 +20,11 @@ const (
 	componentStatusDown         = "down"
 	componentStatusStarting     = "starting"
 	componentStatusDegraded     = "degraded"
+	componentStatusDraining     = "draining"
 )
 
+var rotatorDrainStatusFunc = rotatingproxy.GlobalManager.DrainStatus
+
 type probeComponent struct {
 	Status  string `json:"status"`
 	Details string `json:"details,omitempty"`
@@ -73,12 +77,15 @@ func readyz(w http.ResponseWriter, r *http.Request) {
 			redisComponent,
 			redisRequired,
 		),
+		"rotating_proxies": checkRotatingProxyComponent(),
 	}
 
 	startupReady := components["startup_queue_bootstrap"].Status == componentStatusUp ||
 		components["startup_queue_bootstrap"].Status == componentStatusDegraded
+	draining := components["rotating_proxies"].Status == componentStatusDraining
 	ready := components["database"].Status == componentStatusUp &&
 		startupReady &&
+		!draining &&
 		(components["redis"].Status == componentStatusUp || !redisRequired)
 
 	degraded := components["redis"].Status == componentStatusDegraded ||
@@ -90,6 +97,9 @@ func readyz(w http.ResponseWriter, r *http.Request) {
 		responseStatus = http.StatusServiceUnavailable
 		overallStatus = "not_ready"
 	}
+	if draining {
+		overallStatus = "draining"
+	}
 	if ready && degraded {
 		overallStatus = "degraded"
 	}
@@ -154,6 +164,18 @@ func checkRedisComponent(ctx context.Context) probeComponent {
 	return probeComponent{Status: componentStatusUp, Details: formatRedisComponentDetails(status, nil)}
 }
 
+// checkRotatingProxyComponent reports the open tunnels of this instance's
+// rotators. While the instance shuts down and drains them it is not ready.
+func checkRotatingProxyComponent() probeComponent {
+	status := rotatorDrainStatusFunc()
+	details := fmt.Sprintf("active_tunnels=%d; draining_listeners=%d; draining_tunnels=%d",
+		status.ActiveTunnels, status.DrainingServers, status.DrainingTunnels)
+	if status.ShuttingDown {
+		return probeComponent{Status: componentStatusDraining, Details: details}
+	}
+	return probeComponent{Status: componentStatusUp, Details: details}
+}
+
 func checkStartupBootstrapComponent(redis probeComponent, redisRequired bool) probeComponent {
 	if bootstrap.StartupQueueBootstrapCompleted() {
 		return probeComponent{Status: componentStatusUp}
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"magpie/internal/database"
+	"magpie/internal/rotatingproxy"
 	"magpie/internal/support"
 
 	"gorm.io/driver/sqlite"
@@ -69,6 +70,41 @@ func TestReadyz_FailsWhenDatabaseUnavailable(t *testing.T) {
 	}
 }
 
+func TestReadyz_NotReadyWhileRotatorsDrain(t *testing.T) {
+	original := rotatorDrainStatusFunc
+	rotatorDrainStatusFunc = func() rotatingproxy.DrainStatus {
+		return rotatingproxy.DrainStatus{ShuttingDown: true, DrainingServers: 2, DrainingTunnels: 7}
+	}
+	t.Cleanup(func() { rotatorDrainStatusFunc = original })
+
+	t.Setenv(envReadyzAllowRedisDegraded, "true")
+	_ = support.CloseRedisClient()
+	t.Cleanup(func() {
+		_ = support.CloseRedisClient()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rr := httptest.NewRecorder()
+
+	readyz(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	var payload probeResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	component := payload.Components["rotating_proxies"]
+	if payload.Status != "draining" || component.Status != componentStatusDraining {
+		t.Fatalf("status = %q, rotating_proxies = %+v, want draining", payload.Status, component)
+	}
+	if !strings.Contains(component.Details, "draining_tunnels=7") {
+		t.Fatalf("rotating_proxies details = %q, want draining_tunnels=7", component.Details)
+	}
+}
+
 func TestCheckRedisComponent_ReportsModeAndErrorDetails(t *testing.T) {
 	_ = support.CloseRedisClient()
 	t.Cleanup(func() {
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/auth"
+	"magpie/internal/database"
+	"magpie/internal/rotatingproxy"
+)
+
+func listRotatingProxyCredentials(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rotatorID, ok := parseRotatingProxyPathID(w, r, "id", "rotating proxy")
+	if !ok {
+		return
+	}
+
+	credentials, dbErr := database.ListRotatingProxyCredentials(userID, rotatorID)
+	if dbErr != nil {
+		writeRotatingProxyError(w, dbErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"credentials": credentials})
+}
+
+func createRotatingProxyCredential(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rotatorID, ok := parseRotatingProxyPathID(w, r, "id", "rotating proxy")
+	if !ok {
+		return
+	}
+
+	var payload dto.RotatingProxyCredentialRequest
+	if !decodeJSONBodyLimited(w, r, &payload, resolveJSONMaxBodyBytes()) {
+		return
+	}
+
+	credential, dbErr := database.CreateRotatingProxyCredential(userID, rotatorID, payload)
+	if dbErr != nil {
+		writeRotatingProxyError(w, dbErr)
+		return
+	}
+
+	reloadRotatingProxyCredentials(rotatorID)
+	writeJSON(w, http.StatusCreated, credential)
+}
+
+func updateRotatingProxyCredential(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rotatorID, ok := parseRotatingProxyPathID(w, r, "id", "rotating proxy")
+	if !ok {
+		return
+	}
+	credentialID, ok := parseRotatingProxyPathID(w, r, "credentialId", "credential")
+	if !ok {
+		return
+	}
+
+	var payload dto.RotatingProxyCredentialRequest
+	if !decodeJSONBodyLimited(w, r, &payload, resolveJSONMaxBodyBytes()) {
+		return
+	}
+
+	credential, dbErr := database.UpdateRotatingProxyCredential(userID, rotatorID, credentialID, payload)
+	if dbErr != nil {
+		writeRotatingProxyError(w, dbErr)
+		return
+	}
+
+	reloadRotatingProxyCredentials(rotatorID)
+	writeJSON(w, http.StatusOK, credential)
+}
+
+func deleteRotatingProxyCredential(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rotatorID, ok := parseRotatingProxyPathID(w, r, "id", "rotating proxy")
+	if !ok {
+		return
+	}
+	credentialID, ok := parseRotatingProxyPathID(w, r, "credentialId", "credential")
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteRotatingProxyCredential(userID, rotatorID, credentialID); err != nil {
+		writeRotatingProxyError(w, err)
+		return
+	}
+
+	reloadRotatingProxyCredentials(rotatorID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseRotatingProxyPathID(w http.ResponseWriter, r *http.Request, key string, label string) (uint64, bool) {
+	raw := strings.TrimSpace(r.PathValue(key))
+	if raw == "" {
+		writeError(w, "Missing "+label+" id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		writeError(w, "Invalid "+label+" id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// reloadRotatingProxyCredentials applies credential changes to a listener
+// running on this instance right away. Listeners on other instances pick
+// them up on their next sync.
+func reloadRotatingProxyCredentials(rotatorID uint64) {
+	if err := rotatingproxy.GlobalManager.Update(rotatorID); err != nil && !errors.Is(err, database.ErrRotatingProxyNotFound) {
+		log.Error("rotating proxy: failed to reload credentials", "rotator_id", rotatorID, "error", err)
+	}
+}
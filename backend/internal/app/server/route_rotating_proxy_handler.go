@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 
@@ -34,6 +35,30 @@ func listRotatingProxies(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rotatorHost := resolveRotatorHost(r)
+	activeInstances := discoverPlacementInstances()
+	for idx := range proxies {
+		setRotatorListenAddress(&proxies[idx], rotatorHost)
+		setRotatorListenAddresses(&proxies[idx], activeInstances, rotatorHost)
+		setRotatorTunnels(&proxies[idx])
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"rotating_proxies": proxies})
+}
+
+// setRotatorTunnels adds the open tunnels of the rotator on this instance,
+// including those of listeners that are still draining.
+func setRotatorTunnels(proxy *dto.RotatingProxy) {
+	tunnels := rotatingproxy.GlobalManager.RotatorTunnels(proxy.ID)
+	proxy.ActiveTunnels = tunnels.Active
+	proxy.DrainingTunnels = tunnels.Draining
+	if !tunnels.DrainDeadline.IsZero() {
+		deadline := tunnels.DrainDeadline.UTC()
+		proxy.DrainDeadline = &deadline
+	}
+}
+
+func resolveRotatorHost(r *http.Request) string {
 	rotatorHost := strings.TrimSpace(config.GetCurrentIp())
 	if rotatorHost == "" {
 		rotatorHost = strings.TrimSpace(r.Host)
@@ -43,17 +68,72 @@ func listRotatingProxies(w http.ResponseWriter, r *http.Request) {
 			rotatorHost = parsedHost
 		}
 	}
+	return rotatorHost
+}
 
-	for idx := range proxies {
-		proxies[idx].ListenHost = rotatorHost
-		if rotatorHost != "" {
-			proxies[idx].ListenAddress = fmt.Sprintf("%s:%d", rotatorHost, proxies[idx].ListenPort)
+func setRotatorListenAddress(proxy *dto.RotatingProxy, rotatorHost string) {
+	proxy.ListenHost = rotatorHost
+	if rotatorHost != "" {
+		proxy.ListenAddress = fmt.Sprintf("%s:%d", rotatorHost, proxy.ListenPort)
+	} else {
+		proxy.ListenAddress = fmt.Sprintf("%d", proxy.ListenPort)
+	}
+}
+
+// setRotatorListenAddresses lists the rotator's address on its own instance
+// and on every active instance of its placement. Instances that have not
+// reported a public address yet fall back to fallbackHost.
+func setRotatorListenAddresses(proxy *dto.RotatingProxy, activeInstances []runtime.ActiveInstance, fallbackHost string) {
+	placement := rotatorPlacementOf(proxy)
+	addresses := []dto.RotatingProxyListenAddress{{
+		InstanceID:     proxy.InstanceID,
+		InstanceName:   proxy.InstanceName,
+		InstanceRegion: proxy.InstanceRegion,
+		ListenHost:     fallbackHost,
+	}}
+	for _, instance := range activeInstances {
+		if instance.ID == proxy.InstanceID {
+			if instance.Host != "" {
+				addresses[0].ListenHost = instance.Host
+			}
+			continue
+		}
+		if !placement.Includes(instance.ID, instance.Region) {
+			continue
+		}
+		host := instance.Host
+		if host == "" {
+			host = fallbackHost
+		}
+		addresses = append(addresses, dto.RotatingProxyListenAddress{
+			InstanceID:     instance.ID,
+			InstanceName:   instance.Name,
+			InstanceRegion: instance.Region,
+			ListenHost:     host,
+		})
+	}
+	for idx := range addresses {
+		if addresses[idx].ListenHost != "" {
+			addresses[idx].ListenAddress = net.JoinHostPort(addresses[idx].ListenHost, strconv.Itoa(int(proxy.ListenPort)))
 		} else {
-			proxies[idx].ListenAddress = fmt.Sprintf("%d", proxies[idx].ListenPort)
+			addresses[idx].ListenAddress = strconv.Itoa(int(proxy.ListenPort))
 		}
 	}
+	proxy.ListenAddresses = addresses
+}
+
+func rotatorPlacementOf(proxy *dto.RotatingProxy) database.RotatingProxyPlacement {
+	return database.RotatingProxyPlacement{
+		InstanceID:         proxy.InstanceID,
+		ReplicaInstanceIDs: proxy.ReplicaInstanceIDs,
+		ReplicaRegion:      proxy.ReplicaRegion,
+	}
+}
 
-	writeJSON(w, http.StatusOK, map[string]any{"rotating_proxies": proxies})
+// rotatorPlacedHere reports whether this instance listens for the rotator.
+// Other members start or drain it on their next sync.
+func rotatorPlacedHere(proxy *dto.RotatingProxy) bool {
+	return rotatorPlacementOf(proxy).Includes(support.GetInstanceID(), support.GetInstanceRegion())
 }
 
 func createRotatingProxy(w http.ResponseWriter, r *http.Request) {
@@ -106,7 +186,7 @@ func createRotatingProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if proxy.InstanceID == support.GetInstanceID() {
+	if rotatorPlacedHere(proxy) {
 		if err := rotatingproxy.GlobalManager.Add(proxy.ID); err != nil {
 			log.Error("rotating proxy: failed to start listener", "rotator_id", proxy.ID, "error", err)
 			_ = database.DeleteRotatingProxy(userID, proxy.ID)
@@ -115,9 +195,64 @@ func createRotatingProxy(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	rotatorHost := resolveRotatorHost(r)
+	setRotatorListenAddress(proxy, rotatorHost)
+	setRotatorListenAddresses(proxy, discoverPlacementInstances(), rotatorHost)
 	writeJSON(w, http.StatusCreated, proxy)
 }
 
+// updateRotatingProxy serves PUT, which replaces every editable field, and
+// PATCH, which only changes the fields present in the body.
+func updateRotatingProxy(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rawID := strings.TrimSpace(r.PathValue("id"))
+	if rawID == "" {
+		writeError(w, "Missing rotating proxy id", http.StatusBadRequest)
+		return
+	}
+
+	id, convErr := strconv.ParseUint(rawID, 10, 64)
+	if convErr != nil {
+		writeError(w, "Invalid rotating proxy id", http.StatusBadRequest)
+		return
+	}
+
+	var payload dto.RotatingProxyUpdateRequest
+	if r.Method == http.MethodPut {
+		var full dto.RotatingProxyCreateRequest
+		if !decodeJSONBodyLimited(w, r, &full, resolveJSONMaxBodyBytes()) {
+			return
+		}
+		payload = full.UpdateRequest()
+	} else if !decodeJSONBodyLimited(w, r, &payload, resolveJSONMaxBodyBytes()) {
+		return
+	}
+
+	proxy, updateErr := database.UpdateRotatingProxy(userID, id, payload)
+	if updateErr != nil {
+		writeRotatingProxyError(w, updateErr)
+		return
+	}
+
+	// Update also drains the listener when the new placement left this
+	// instance out.
+	if err := rotatingproxy.GlobalManager.Update(proxy.ID); err != nil {
+		log.Error("rotating proxy: failed to apply update to listener", "rotator_id", proxy.ID, "error", err)
+		writeError(w, "Rotating proxy was saved but its listener could not be updated", http.StatusInternalServerError)
+		return
+	}
+
+	rotatorHost := resolveRotatorHost(r)
+	setRotatorListenAddress(proxy, rotatorHost)
+	setRotatorListenAddresses(proxy, discoverPlacementInstances(), rotatorHost)
+	writeJSON(w, http.StatusOK, proxy)
+}
+
 func listRotatingProxyInstances(w http.ResponseWriter, _ *http.Request) {
 	instances, err := loadAvailableRotatorInstances()
 	if err != nil {
@@ -187,6 +322,55 @@ func getNextRotatingProxy(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, nextProxy)
 }
 
+// getRotatingProxyUsage reports a rotator's traffic between the optional
+// RFC 3339 from/to query parameters, defaulting to the last 24 hours.
+func getRotatingProxyUsage(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rawID := strings.TrimSpace(r.PathValue("id"))
+	if rawID == "" {
+		writeError(w, "Missing rotating proxy id", http.StatusBadRequest)
+		return
+	}
+
+	id, convErr := strconv.ParseUint(rawID, 10, 64)
+	if convErr != nil {
+		writeError(w, "Invalid rotating proxy id", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if raw := strings.TrimSpace(r.URL.Query().Get("to")); raw != "" {
+		parsed, parseErr := time.Parse(time.RFC3339, raw)
+		if parseErr != nil {
+			writeError(w, "Invalid to timestamp", http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-24 * time.Hour)
+	if raw := strings.TrimSpace(r.URL.Query().Get("from")); raw != "" {
+		parsed, parseErr := time.Parse(time.RFC3339, raw)
+		if parseErr != nil {
+			writeError(w, "Invalid from timestamp", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+
+	report, dbErr := database.GetRotatingProxyUsage(userID, id, from, to)
+	if dbErr != nil {
+		writeRotatingProxyError(w, dbErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
 func writeRotatingProxyError(w http.ResponseWriter, err error) {
 	category := "internal"
 	switch {
@@ -199,13 +383,44 @@ func writeRotatingProxyError(w http.ResponseWriter, err error) {
 		errors.Is(err, database.ErrRotatingProxyUptimeTypeInvalid),
 		errors.Is(err, database.ErrRotatingProxyUptimeTypeMissing),
 		errors.Is(err, database.ErrRotatingProxyUptimeValueMissing),
-		errors.Is(err, database.ErrRotatingProxyUptimeOutOfRange):
+		errors.Is(err, database.ErrRotatingProxyUptimeOutOfRange),
+		errors.Is(err, database.ErrRotatingProxySessionTTLInvalid),
+		errors.Is(err, database.ErrRotatingProxyStrategyInvalid),
+		errors.Is(err, database.ErrRotatingProxyCountryInvalid),
+		errors.Is(err, database.ErrRotatingProxyTypeInvalid),
+		errors.Is(err, database.ErrRotatingProxyAnonymityInvalid),
+		errors.Is(err, database.ErrRotatingProxyClientCIDRInvalid),
+		errors.Is(err, database.ErrRotatingProxyAuthModeInvalid),
+		errors.Is(err, database.ErrRotatingProxyRotationInvalid),
+		errors.Is(err, database.ErrRotatingProxyIntervalInvalid),
+		errors.Is(err, database.ErrRotatingProxyRequestsInvalid),
+		errors.Is(err, database.ErrRotatingProxyParentInvalid),
+		errors.Is(err, database.ErrRotatingProxyTLSListenInvalid),
+		errors.Is(err, database.ErrRotatingProxyDestinationInvalid),
+		errors.Is(err, database.ErrRotatingProxyLimitInvalid),
+		errors.Is(err, database.ErrRotatingProxyLimitScopeInvalid),
+		errors.Is(err, database.ErrRotatingProxyHeaderInvalid),
+		errors.Is(err, database.ErrRotatingProxyTierInvalid),
+		errors.Is(err, database.ErrRotatingProxyReplicaInvalid),
+		errors.Is(err, database.ErrRotatingProxyTimeoutInvalid),
+		errors.Is(err, database.ErrRotatingProxyDNSModeInvalid),
+		errors.Is(err, database.ErrRotatingProxyFailoverInvalid),
+		errors.Is(err, database.ErrRotatingProxyPinnedProxyInvalid),
+		errors.Is(err, database.ErrRotatingProxyPinnedProxyLast),
+		errors.Is(err, database.ErrRotatingProxyUsageRangeInvalid),
+		errors.Is(err, database.ErrRotatingProxyCredentialNameInvalid),
+		errors.Is(err, database.ErrRotatingProxyCredentialLimitInvalid),
+		errors.Is(err, database.ErrRotatingProxyCredentialTooMany):
 		category = "validation"
-	case errors.Is(err, database.ErrRotatingProxyNameConflict):
+	case errors.Is(err, database.ErrRotatingProxyNameConflict),
+		errors.Is(err, database.ErrRotatingProxyCredentialNameConflict),
+		errors.Is(err, database.ErrRotatingProxyReplicaPortTaken):
 		category = "conflict"
 	case errors.Is(err, database.ErrRotatingProxyPortExhausted):
 		category = "port_exhausted"
-	case errors.Is(err, database.ErrRotatingProxyNotFound):
+	case errors.Is(err, database.ErrRotatingProxyNotFound),
+		errors.Is(err, database.ErrRotatingProxyCredentialNotFound),
+		errors.Is(err, database.ErrRotatingProxyNotPinned):
 		category = "not_found"
 	case errors.Is(err, database.ErrRotatingProxyNoAliveProxies):
 		category = "no_alive_proxies"
@@ -223,13 +438,44 @@ func writeRotatingProxyError(w http.ResponseWriter, err error) {
 		errors.Is(err, database.ErrRotatingProxyUptimeTypeInvalid),
 		errors.Is(err, database.ErrRotatingProxyUptimeTypeMissing),
 		errors.Is(err, database.ErrRotatingProxyUptimeValueMissing),
-		errors.Is(err, database.ErrRotatingProxyUptimeOutOfRange):
+		errors.Is(err, database.ErrRotatingProxyUptimeOutOfRange),
+		errors.Is(err, database.ErrRotatingProxySessionTTLInvalid),
+		errors.Is(err, database.ErrRotatingProxyStrategyInvalid),
+		errors.Is(err, database.ErrRotatingProxyCountryInvalid),
+		errors.Is(err, database.ErrRotatingProxyTypeInvalid),
+		errors.Is(err, database.ErrRotatingProxyAnonymityInvalid),
+		errors.Is(err, database.ErrRotatingProxyClientCIDRInvalid),
+		errors.Is(err, database.ErrRotatingProxyAuthModeInvalid),
+		errors.Is(err, database.ErrRotatingProxyRotationInvalid),
+		errors.Is(err, database.ErrRotatingProxyIntervalInvalid),
+		errors.Is(err, database.ErrRotatingProxyRequestsInvalid),
+		errors.Is(err, database.ErrRotatingProxyParentInvalid),
+		errors.Is(err, database.ErrRotatingProxyTLSListenInvalid),
+		errors.Is(err, database.ErrRotatingProxyDestinationInvalid),
+		errors.Is(err, database.ErrRotatingProxyLimitInvalid),
+		errors.Is(err, database.ErrRotatingProxyLimitScopeInvalid),
+		errors.Is(err, database.ErrRotatingProxyHeaderInvalid),
+		errors.Is(err, database.ErrRotatingProxyTierInvalid),
+		errors.Is(err, database.ErrRotatingProxyReplicaInvalid),
+		errors.Is(err, database.ErrRotatingProxyTimeoutInvalid),
+		errors.Is(err, database.ErrRotatingProxyDNSModeInvalid),
+		errors.Is(err, database.ErrRotatingProxyFailoverInvalid),
+		errors.Is(err, database.ErrRotatingProxyPinnedProxyInvalid),
+		errors.Is(err, database.ErrRotatingProxyPinnedProxyLast),
+		errors.Is(err, database.ErrRotatingProxyUsageRangeInvalid),
+		errors.Is(err, database.ErrRotatingProxyCredentialNameInvalid),
+		errors.Is(err, database.ErrRotatingProxyCredentialLimitInvalid),
+		errors.Is(err, database.ErrRotatingProxyCredentialTooMany):
 		writeError(w, err.Error(), http.StatusBadRequest)
-	case errors.Is(err, database.ErrRotatingProxyNameConflict):
+	case errors.Is(err, database.ErrRotatingProxyNameConflict),
+		errors.Is(err, database.ErrRotatingProxyCredentialNameConflict),
+		errors.Is(err, database.ErrRotatingProxyReplicaPortTaken):
 		writeError(w, err.Error(), http.StatusConflict)
 	case errors.Is(err, database.ErrRotatingProxyPortExhausted):
 		writeError(w, err.Error(), http.StatusServiceUnavailable)
-	case errors.Is(err, database.ErrRotatingProxyNotFound):
+	case errors.Is(err, database.ErrRotatingProxyNotFound),
+		errors.Is(err, database.ErrRotatingProxyCredentialNotFound),
+		errors.Is(err, database.ErrRotatingProxyNotPinned):
 		writeError(w, err.Error(), http.StatusNotFound)
 	case errors.Is(err, database.ErrRotatingProxyNoAliveProxies):
 		writeError(w, err.Error(), http.StatusConflict)
@@ -295,14 +541,16 @@ func loadAvailableRotatorInstances() ([]dto.RotatingProxyInstance, error) {
 		}
 
 		instances = append(instances, dto.RotatingProxyInstance{
-			ID:         id,
-			Name:       name,
-			Region:     region,
-			PortStart:  start,
-			PortEnd:    end,
-			UsedPorts:  used,
-			FreePorts:  free,
-			TotalPorts: total,
+			ID:                id,
+			Name:              name,
+			Region:            region,
+			PortStart:         start,
+			PortEnd:           end,
+			UsedPorts:         used,
+			FreePorts:         free,
+			TotalPorts:        total,
+			GatewayHTTPPort:   instance.GatewayHTTPPort,
+			GatewaySOCKS5Port: instance.GatewaySOCKS5Port,
 		})
 	}
 
@@ -315,6 +563,17 @@ func loadAvailableRotatorInstances() ([]dto.RotatingProxyInstance, error) {
 	return instances, nil
 }
 
+// discoverPlacementInstances returns the active instances, or only this one
+// when the heartbeats cannot be read.
+func discoverPlacementInstances() []runtime.ActiveInstance {
+	instances, err := discoverActiveInstances()
+	if err != nil {
+		log.Warn("rotating proxy: failed to load active instances", "error", err)
+		return []runtime.ActiveInstance{runtime.CurrentInstance()}
+	}
+	return instances
+}
+
 func discoverActiveInstances() ([]runtime.ActiveInstance, error) {
 	client, err := support.GetRedisClient()
 	if err != nil {
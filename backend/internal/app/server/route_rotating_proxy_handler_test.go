@@ -0,0 +1,46 @@
+package server
+
+import (
+	"testing"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/jobs/runtime"
+)
+
+func TestSetRotatorListenAddresses_ListsPlacementMembers(t *testing.T) {
+	proxy := &dto.RotatingProxy{
+		InstanceID:         "node-a",
+		InstanceName:       "Node A",
+		InstanceRegion:     "us-east",
+		ListenPort:         20001,
+		ReplicaInstanceIDs: []string{"node-b"},
+		ReplicaRegion:      "eu-west",
+	}
+	active := []runtime.ActiveInstance{
+		{ID: "node-a", Name: "Node A", Region: "us-east", Host: "198.51.100.1"},
+		{ID: "node-b", Name: "Node B", Region: "us-west", Host: "198.51.100.2"},
+		{ID: "node-c", Name: "Node C", Region: "EU-West"},
+		{ID: "node-d", Name: "Node D", Region: "ap-south", Host: "198.51.100.4"},
+	}
+
+	setRotatorListenAddresses(proxy, active, "203.0.113.9")
+
+	want := []string{"198.51.100.1:20001", "198.51.100.2:20001", "203.0.113.9:20001"}
+	if len(proxy.ListenAddresses) != len(want) {
+		t.Fatalf("listen addresses = %+v, want %v", proxy.ListenAddresses, want)
+	}
+	for idx, address := range proxy.ListenAddresses {
+		if address.ListenAddress != want[idx] {
+			t.Errorf("address %d = %q, want %q", idx, address.ListenAddress, want[idx])
+		}
+	}
+	if proxy.ListenAddresses[2].InstanceID != "node-c" {
+		t.Fatalf("third address belongs to %q, want node-c", proxy.ListenAddresses[2].InstanceID)
+	}
+
+	// The rotator's own instance is listed even while its heartbeat is missing.
+	setRotatorListenAddresses(proxy, nil, "")
+	if len(proxy.ListenAddresses) != 1 || proxy.ListenAddresses[0].ListenAddress != "20001" {
+		t.Fatalf("listen addresses without heartbeats = %+v", proxy.ListenAddresses)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/auth"
+	"magpie/internal/database"
+	"magpie/internal/rotatingproxy"
+)
+
+func addRotatingProxyPinnedProxies(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rotatorID, ok := parseRotatingProxyPathID(w, r, "id", "rotating proxy")
+	if !ok {
+		return
+	}
+
+	var payload dto.RotatingProxyPinnedProxiesRequest
+	if !decodeJSONBodyLimited(w, r, &payload, resolveJSONMaxBodyBytes()) {
+		return
+	}
+
+	pinned, dbErr := database.AddRotatingProxyPinnedProxies(userID, rotatorID, payload.ProxyIDs)
+	if dbErr != nil {
+		writeRotatingProxyError(w, dbErr)
+		return
+	}
+
+	reloadRotatingProxyPinnedProxies(rotatorID)
+	writeJSON(w, http.StatusOK, map[string]any{"pinned_proxy_ids": pinned})
+}
+
+func removeRotatingProxyPinnedProxy(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromRequest(r)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rotatorID, ok := parseRotatingProxyPathID(w, r, "id", "rotating proxy")
+	if !ok {
+		return
+	}
+	proxyID, ok := parseRotatingProxyPathID(w, r, "proxyId", "proxy")
+	if !ok {
+		return
+	}
+
+	if err := database.RemoveRotatingProxyPinnedProxy(userID, rotatorID, proxyID); err != nil {
+		writeRotatingProxyError(w, err)
+		return
+	}
+
+	reloadRotatingProxyPinnedProxies(rotatorID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reloadRotatingProxyPinnedProxies swaps the candidate pool of a listener
+// running on this instance right away. Listeners on other instances pick the
+// change up on their next sync.
+func reloadRotatingProxyPinnedProxies(rotatorID uint64) {
+	if err := rotatingproxy.GlobalManager.Update(rotatorID); err != nil && !errors.Is(err, database.ErrRotatingProxyNotFound) {
+		log.Error("rotating proxy: failed to reload pinned proxies", "rotator_id", rotatorID, "error", err)
+	}
+}
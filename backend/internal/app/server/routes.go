@@ -10,6 +10,7 @@ import (
 	"github.com/charmbracelet/log"
 
 	"magpie/internal/auth"
+	"magpie/internal/rotatingproxy"
 )
 
 func writeJSON(w http.ResponseWriter, status int, payload any) {
@@ -24,7 +25,7 @@ func writeError(w http.ResponseWriter, msg string, status int) {
 
 func enableCORS(next http.Handler) http.Handler {
 	cors := resolveCORSConfig()
-	allowedMethods := "GET, POST, OPTIONS, PUT, DELETE"
+	allowedMethods := "GET, POST, OPTIONS, PUT, PATCH, DELETE"
 	allowedHeaders := "Content-Type, Authorization, X-Request-ID, X-Observability-Token"
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -100,8 +101,17 @@ func OpenRoutes(ctx context.Context, port int) error {
 	apiMux.Handle("GET /rotatingProxies", auth.RequireAuth(http.HandlerFunc(listRotatingProxies)))
 	apiMux.Handle("GET /rotatingProxies/instances", auth.RequireAuth(http.HandlerFunc(listRotatingProxyInstances)))
 	apiMux.Handle("POST /rotatingProxies", auth.RequireAuth(http.HandlerFunc(createRotatingProxy)))
+	apiMux.Handle("PUT /rotatingProxies/{id}", auth.RequireAuth(http.HandlerFunc(updateRotatingProxy)))
+	apiMux.Handle("PATCH /rotatingProxies/{id}", auth.RequireAuth(http.HandlerFunc(updateRotatingProxy)))
 	apiMux.Handle("DELETE /rotatingProxies/{id}", auth.RequireAuth(http.HandlerFunc(deleteRotatingProxy)))
 	apiMux.Handle("POST /rotatingProxies/{id}/next", auth.RequireAuth(http.HandlerFunc(getNextRotatingProxy)))
+	apiMux.Handle("GET /rotatingProxies/{id}/usage", auth.RequireAuth(http.HandlerFunc(getRotatingProxyUsage)))
+	apiMux.Handle("GET /rotatingProxies/{id}/credentials", auth.RequireAuth(http.HandlerFunc(listRotatingProxyCredentials)))
+	apiMux.Handle("POST /rotatingProxies/{id}/credentials", auth.RequireAuth(http.HandlerFunc(createRotatingProxyCredential)))
+	apiMux.Handle("PUT /rotatingProxies/{id}/credentials/{credentialId}", auth.RequireAuth(http.HandlerFunc(updateRotatingProxyCredential)))
+	apiMux.Handle("DELETE /rotatingProxies/{id}/credentials/{credentialId}", auth.RequireAuth(http.HandlerFunc(deleteRotatingProxyCredential)))
+	apiMux.Handle("POST /rotatingProxies/{id}/proxies", auth.RequireAuth(http.HandlerFunc(addRotatingProxyPinnedProxies)))
+	apiMux.Handle("DELETE /rotatingProxies/{id}/proxies/{proxyId}", auth.RequireAuth(http.HandlerFunc(removeRotatingProxyPinnedProxy)))
 
 	apiMux.Handle("GET /getScrapingSourcesCount", auth.RequireAuth(http.HandlerFunc(getScrapeSourcesCount)))
 	apiMux.Handle("GET /getScrapingSourcesPage/{page}", auth.RequireAuth(http.HandlerFunc(getScrapeSourcePage)))
@@ -151,6 +161,9 @@ func OpenRoutes(ctx context.Context, port int) error {
 	case err := <-serverErrCh:
 		return err
 	case <-ctx.Done():
+		// Rotators drain their open tunnels first. The API stays up meanwhile
+		// so /readyz reports the drain to load balancers.
+		rotatingproxy.GlobalManager.StopAll()
 		log.Info("Shutting down API server")
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), resolveServerShutdownTimeout())
 		defer cancel()
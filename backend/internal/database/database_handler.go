@@ -178,6 +178,9 @@ func defaultMigrations() []any {
 		domain.ProxyDailyCheck{},
 		domain.ProxyDailyCheckProxyBackfill{},
 		domain.RotatingProxy{},
+		domain.RotatingProxyCredential{},
+		domain.RotatingProxyUsage{},
+		domain.ProxyTrafficStat{},
 		domain.ProxyHistory{},
 		domain.ProxySnapshot{},
 		domain.ProxyStatistic{},
@@ -29,6 +29,7 @@ type proxyReputationInput struct {
 	ProxyID       uint64
 	EstimatedType string
 	FailureStreak uint16
+	LiveTraffic   reputation.LiveTraffic
 	Samples       map[string][]reputationSample
 }
 
@@ -190,6 +191,26 @@ func loadProxyReputationInputs(ctx context.Context, proxyIDs []uint64) (map[uint
 		}
 	}
 
+	trafficRows, err := loadProxyTrafficSummaries(ctx, proxyIDs, time.Now().Add(-ProxyTrafficReputationWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range trafficRows {
+		input, ok := inputs[row.ProxyID]
+		if !ok {
+			continue
+		}
+		input.LiveTraffic = reputation.LiveTraffic{
+			Attempts:  int(row.Attempts),
+			Successes: int(row.Successes),
+			TLSErrors: int(row.TLSErrors),
+		}
+		if row.HandshakeSamples > 0 {
+			input.LiveTraffic.AvgHandshakeMS = float64(row.HandshakeMSTotal) / float64(row.HandshakeSamples)
+		}
+	}
+
 	statRows, err := loadReputationSamples(ctx, proxyIDs)
 	if err != nil {
 		return nil, err
@@ -299,6 +320,7 @@ func buildMetrics(samples []reputationSample, input *proxyReputationInput) reput
 		EstimatedType:     input.EstimatedType,
 		FailureStreak:     input.FailureStreak,
 		SampleWindowHours: windowHours,
+		LiveTraffic:       input.LiveTraffic,
 	}
 }
 
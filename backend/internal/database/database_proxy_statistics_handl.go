@@ -99,5 +99,10 @@ func InsertProxyStatistics(ctx context.Context, statistics []domain.ProxyStatist
 		return err
 	}
 
-	return tx.Commit().Error
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	bumpProxyStatusVersion()
+	return nil
 }
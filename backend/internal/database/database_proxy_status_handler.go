@@ -1,15 +1,75 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
+	"github.com/charmbracelet/log"
+	"github.com/redis/go-redis/v9"
+
 	"magpie/internal/domain"
+	"magpie/internal/support"
 
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+const (
+	sharedProxyStatusVersionKey     = "magpie:proxy_status:version"
+	sharedProxyStatusVersionTimeout = 250 * time.Millisecond
+)
+
+// proxyStatusVersion changes whenever this process commits new proxy
+// statistics so in-memory caches of alive proxies know to reload.
+var proxyStatusVersion atomic.Uint64
+
+func ProxyStatusVersion() uint64 {
+	return proxyStatusVersion.Load()
+}
+
+// SharedProxyStatusVersion returns a counter every instance bumps in Redis
+// when it commits proxy statistics, so caches learn about checks that ran
+// elsewhere. It is 0 until the first bump.
+func SharedProxyStatusVersion() (uint64, error) {
+	client, err := support.GetRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedProxyStatusVersionTimeout)
+	defer cancel()
+
+	value, err := client.Get(ctx, sharedProxyStatusVersionKey).Uint64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return value, err
+}
+
+// bumpProxyStatusVersion marks committed proxy statistics for this process
+// and, in the background, for the other instances.
+func bumpProxyStatusVersion() {
+	proxyStatusVersion.Add(1)
+	go publishProxyStatusVersion()
+}
+
+func publishProxyStatusVersion() {
+	client, err := support.GetRedisClient()
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedProxyStatusVersionTimeout)
+	defer cancel()
+
+	if err := client.Incr(ctx, sharedProxyStatusVersionKey).Err(); err != nil {
+		log.Debug("proxy status: failed to publish version", "error", err)
+	}
+}
+
 type proxyProtocolKey struct {
 	ProxyID    uint64
 	ProtocolID int
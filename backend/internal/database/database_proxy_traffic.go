@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"magpie/internal/domain"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ProxyTrafficBucketSize = time.Hour
+	// ProxyTrafficReputationWindow is how far back live traffic counts
+	// towards reputation scores.
+	ProxyTrafficReputationWindow = 24 * time.Hour
+)
+
+// ProxyTrafficBucketStart returns the bucket a traffic observation at t is
+// counted in.
+func ProxyTrafficBucketStart(t time.Time) time.Time {
+	return t.UTC().Truncate(ProxyTrafficBucketSize)
+}
+
+// AddProxyTrafficStats adds the given counter deltas to their buckets.
+// Callers drop entries of deleted proxies first, see GetExistingProxyIDSet.
+func AddProxyTrafficStats(ctx context.Context, entries []domain.ProxyTrafficStat) error {
+	if DB == nil {
+		return fmt.Errorf("proxy traffic: database connection was not initialised")
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	increment := func(column string) clause.Expr {
+		return gorm.Expr(fmt.Sprintf("proxy_traffic_stats.%s + EXCLUDED.%s", column, column))
+	}
+
+	err := DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "proxy_id"}, {Name: "bucket_start"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"attempts":           increment("attempts"),
+			"successes":          increment("successes"),
+			"tls_errors":         increment("tls_errors"),
+			"handshake_samples":  increment("handshake_samples"),
+			"handshake_ms_total": increment("handshake_ms_total"),
+		}),
+	}).Create(&entries).Error
+	if err != nil {
+		return fmt.Errorf("proxy traffic: upsert counters: %w", err)
+	}
+	return nil
+}
+
+func PruneProxyTrafficStats(cutoff time.Time) (int64, error) {
+	if DB == nil {
+		return 0, fmt.Errorf("proxy traffic: database connection was not initialised")
+	}
+
+	res := DB.Where("bucket_start < ?", cutoff.UTC()).Delete(&domain.ProxyTrafficStat{})
+	return res.RowsAffected, res.Error
+}
+
+// MarkProxiesUnhealthy flags the latest statistics of proxies that kept
+// failing in live traffic as not alive, which removes them from rotating
+// proxy pools until the next check reports them alive again. It returns the
+// affected proxies so callers can schedule that check.
+func MarkProxiesUnhealthy(ctx context.Context, proxyIDs []uint64) ([]domain.Proxy, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("proxy traffic: database connection was not initialised")
+	}
+	if len(proxyIDs) == 0 {
+		return nil, nil
+	}
+
+	var proxies []domain.Proxy
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id IN ?", proxyIDs).Find(&proxies).Error; err != nil {
+			return err
+		}
+		if len(proxies) == 0 {
+			return nil
+		}
+
+		// checked_at is kept, so the next check result replaces the flag.
+		if err := tx.Model(&domain.ProxyLatestStatistic{}).
+			Where("proxy_id IN ? AND alive = ?", proxyIDs, true).
+			Updates(map[string]any{"alive": false, "updated_at": time.Now()}).Error; err != nil {
+			return err
+		}
+		return upsertProxyOverallStatuses(tx, proxyIDs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bumpProxyStatusVersion()
+	return proxies, nil
+}
+
+type proxyTrafficSummaryRow struct {
+	ProxyID          uint64
+	Attempts         int64
+	Successes        int64
+	TLSErrors        int64
+	HandshakeSamples int64
+	HandshakeMSTotal int64
+}
+
+func loadProxyTrafficSummaries(ctx context.Context, proxyIDs []uint64, since time.Time) ([]proxyTrafficSummaryRow, error) {
+	var rows []proxyTrafficSummaryRow
+	err := DB.WithContext(ctx).
+		Model(&domain.ProxyTrafficStat{}).
+		Select("proxy_id, SUM(attempts) AS attempts, SUM(successes) AS successes, SUM(tls_errors) AS tls_errors, "+
+			"SUM(handshake_samples) AS handshake_samples, SUM(handshake_ms_total) AS handshake_ms_total").
+		Where("proxy_id IN ? AND bucket_start >= ?", proxyIDs, ProxyTrafficBucketStart(since)).
+		Group("proxy_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("load proxy traffic for reputation: %w", err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"magpie/internal/domain"
+)
+
+func TestProxyTrafficStats_FeedReputationAndDemotion(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+	ctx := context.Background()
+
+	user := domain.User{Email: "traffic@example.com", Password: "password123", SOCKS5Protocol: true}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	protocol := domain.Protocol{Name: "socks5"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+	judge := domain.Judge{FullString: "http://judge-traffic.example.com"}
+	if err := db.Create(&judge).Error; err != nil {
+		t.Fatalf("create judge: %v", err)
+	}
+	proxy := domain.Proxy{IP: "10.30.0.1", Port: 1080, Country: "DE", EstimatedType: "residential"}
+	if err := db.Create(&proxy).Error; err != nil {
+		t.Fatalf("create proxy: %v", err)
+	}
+	if err := db.Create(&domain.UserProxy{UserID: user.ID, ProxyID: proxy.ID}).Error; err != nil {
+		t.Fatalf("link proxy: %v", err)
+	}
+
+	now := time.Now().UTC()
+	stats := make([]domain.ProxyStatistic, 0, 5)
+	for i := range 5 {
+		stat := domain.ProxyStatistic{
+			Alive:        true,
+			Attempt:      1,
+			ResponseTime: 150,
+			ProtocolID:   protocol.ID,
+			ProxyID:      proxy.ID,
+			JudgeID:      judge.ID,
+			CreatedAt:    now.Add(-time.Duration(i) * time.Minute),
+		}
+		if err := db.Create(&stat).Error; err != nil {
+			t.Fatalf("create proxy stat: %v", err)
+		}
+		stats = append(stats, stat)
+	}
+	if err := updateProxyStatusCaches(db, stats); err != nil {
+		t.Fatalf("update proxy status cache: %v", err)
+	}
+
+	overallScore := func() (float32, map[string]any) {
+		t.Helper()
+		if err := RecalculateProxyReputations(ctx, []uint64{proxy.ID}); err != nil {
+			t.Fatalf("recalculate reputations: %v", err)
+		}
+		var rep domain.ProxyReputation
+		if err := db.Where("proxy_id = ? AND kind = ?", proxy.ID, domain.ProxyReputationKindOverall).First(&rep).Error; err != nil {
+			t.Fatalf("load overall reputation: %v", err)
+		}
+		var signals struct {
+			Combined map[string]any `json:"combined"`
+		}
+		if err := json.Unmarshal(rep.Signals, &signals); err != nil {
+			t.Fatalf("decode signals: %v", err)
+		}
+		return rep.Score, signals.Combined
+	}
+	checksOnly, _ := overallScore()
+
+	bucket := ProxyTrafficBucketStart(now)
+	for range 2 {
+		if err := AddProxyTrafficStats(ctx, []domain.ProxyTrafficStat{{
+			ProxyID:          proxy.ID,
+			BucketStart:      bucket,
+			Attempts:         10,
+			Successes:        1,
+			HandshakeSamples: 1,
+			HandshakeMSTotal: 400,
+		}}); err != nil {
+			t.Fatalf("add traffic stats: %v", err)
+		}
+	}
+	var stored domain.ProxyTrafficStat
+	if err := db.Where("proxy_id = ?", proxy.ID).First(&stored).Error; err != nil {
+		t.Fatalf("load traffic stats: %v", err)
+	}
+	if stored.Attempts != 20 || stored.Successes != 2 || stored.HandshakeMSTotal != 800 {
+		t.Fatalf("traffic counters were not added up: %+v", stored)
+	}
+
+	withTraffic, signals := overallScore()
+	if withTraffic >= checksOnly {
+		t.Fatalf("score with failing live traffic = %v, want below %v", withTraffic, checksOnly)
+	}
+	if signals["live_attempts"] != float64(20) {
+		t.Fatalf("expected live_attempts signal of 20, got %v", signals["live_attempts"])
+	}
+
+	version := ProxyStatusVersion()
+	demoted, err := MarkProxiesUnhealthy(ctx, []uint64{proxy.ID})
+	if err != nil {
+		t.Fatalf("mark proxies unhealthy: %v", err)
+	}
+	if len(demoted) != 1 || demoted[0].ID != proxy.ID || len(demoted[0].Hash) == 0 {
+		t.Fatalf("unexpected demoted proxies: %+v", demoted)
+	}
+	if ProxyStatusVersion() == version {
+		t.Fatal("expected the proxy status version to change")
+	}
+	var latest domain.ProxyLatestStatistic
+	if err := db.Where("proxy_id = ?", proxy.ID).First(&latest).Error; err != nil {
+		t.Fatalf("load latest statistic: %v", err)
+	}
+	if latest.Alive {
+		t.Fatal("expected the latest statistic to be marked not alive")
+	}
+
+	removed, err := PruneProxyTrafficStats(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("prune traffic stats: %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("pruned %d buckets, want 1", removed)
+	}
+}
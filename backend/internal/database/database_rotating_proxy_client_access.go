@@ -0,0 +1,79 @@
+package database
+
+import (
+	"net/netip"
+	"strings"
+)
+
+const (
+	// RotatingProxyClientAuthIPAndCredentials only admits allowlisted clients,
+	// which must still authenticate when the rotator requires credentials.
+	RotatingProxyClientAuthIPAndCredentials = "ip_and_credentials"
+	// RotatingProxyClientAuthIPOrCredentials admits allowlisted clients without
+	// credentials and everyone else with valid credentials.
+	RotatingProxyClientAuthIPOrCredentials = "ip_or_credentials"
+
+	maxRotatorAllowedClientCIDRs = 64
+)
+
+// validateRotatorClientAccess normalises the client allowlist to canonical
+// CIDR ranges; single addresses become /32 or /128 ranges.
+func validateRotatorClientAccess(cidrs []string, mode string) ([]string, string, error) {
+	authMode := strings.ToLower(strings.TrimSpace(mode))
+	switch authMode {
+	case "":
+		authMode = RotatingProxyClientAuthIPAndCredentials
+	case RotatingProxyClientAuthIPAndCredentials, RotatingProxyClientAuthIPOrCredentials:
+	default:
+		return nil, "", ErrRotatingProxyAuthModeInvalid
+	}
+
+	normalized := make([]string, 0, len(cidrs))
+	seen := make(map[string]struct{}, len(cidrs))
+	for _, raw := range cidrs {
+		value := strings.TrimSpace(raw)
+		if value == "" {
+			continue
+		}
+		prefix, err := parseClientPrefix(value)
+		if err != nil {
+			return nil, "", ErrRotatingProxyClientCIDRInvalid
+		}
+		canonical := prefix.String()
+		if _, ok := seen[canonical]; ok {
+			continue
+		}
+		seen[canonical] = struct{}{}
+		normalized = append(normalized, canonical)
+	}
+	if len(normalized) > maxRotatorAllowedClientCIDRs {
+		return nil, "", ErrRotatingProxyClientCIDRInvalid
+	}
+	return normalized, authMode, nil
+}
+
+func normalizeRotatorClientAuthMode(raw string) string {
+	if strings.EqualFold(strings.TrimSpace(raw), RotatingProxyClientAuthIPOrCredentials) {
+		return RotatingProxyClientAuthIPOrCredentials
+	}
+	return RotatingProxyClientAuthIPAndCredentials
+}
+
+func parseClientPrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
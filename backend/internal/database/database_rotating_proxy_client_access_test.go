@@ -0,0 +1,31 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestValidateRotatorClientAccess(t *testing.T) {
+	cidrs, mode, err := validateRotatorClientAccess([]string{" 203.0.113.7 ", "198.51.100.99/24", "::ffff:192.0.2.1", "2001:db8::1/32", "198.51.100.0/24", ""}, "")
+	if err != nil {
+		t.Fatalf("validateRotatorClientAccess: %v", err)
+	}
+	want := []string{"203.0.113.7/32", "198.51.100.0/24", "192.0.2.1/32", "2001:db8::/32"}
+	if !slices.Equal(cidrs, want) {
+		t.Fatalf("cidrs = %v, want %v", cidrs, want)
+	}
+	if mode != RotatingProxyClientAuthIPAndCredentials {
+		t.Fatalf("mode = %q, want %q", mode, RotatingProxyClientAuthIPAndCredentials)
+	}
+
+	if _, mode, err := validateRotatorClientAccess(nil, " IP_OR_CREDENTIALS "); err != nil || mode != RotatingProxyClientAuthIPOrCredentials {
+		t.Fatalf("mode = %q, err = %v, want ip_or_credentials", mode, err)
+	}
+	if _, _, err := validateRotatorClientAccess([]string{"not-an-ip"}, ""); !errors.Is(err, ErrRotatingProxyClientCIDRInvalid) {
+		t.Fatalf("invalid address: err = %v, want ErrRotatingProxyClientCIDRInvalid", err)
+	}
+	if _, _, err := validateRotatorClientAccess(nil, "either"); !errors.Is(err, ErrRotatingProxyAuthModeInvalid) {
+		t.Fatalf("invalid mode: err = %v, want ErrRotatingProxyAuthModeInvalid", err)
+	}
+}
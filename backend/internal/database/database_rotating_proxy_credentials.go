@@ -0,0 +1,254 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxRotatingProxyCredentials = 1000
+
+var (
+	ErrRotatingProxyCredentialNotFound     = errors.New("rotating proxy credential not found")
+	ErrRotatingProxyCredentialNameInvalid  = errors.New("credential name is required, at most 120 characters and must not contain spaces or colons")
+	ErrRotatingProxyCredentialNameConflict = errors.New("credential name is already used by this rotating proxy")
+	ErrRotatingProxyCredentialLimitInvalid = errors.New("credential connection limit and bandwidth quota must not be negative")
+	ErrRotatingProxyCredentialTooMany      = errors.New("rotating proxy has too many credentials")
+)
+
+// ListRotatingProxyCredentials returns the credentials of a rotator ordered
+// by name.
+func ListRotatingProxyCredentials(userID uint, rotatingProxyID uint64) ([]dto.RotatingProxyCredential, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	var rotator domain.RotatingProxy
+	if err := DB.Select("id").Where("user_id = ? AND id = ?", userID, rotatingProxyID).First(&rotator).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRotatingProxyNotFound
+		}
+		return nil, err
+	}
+
+	var rows []domain.RotatingProxyCredential
+	if err := DB.Where("rotating_proxy_id = ?", rotatingProxyID).Order("name").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := make([]dto.RotatingProxyCredential, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, newRotatingProxyCredentialDTO(row, now))
+	}
+	return result, nil
+}
+
+// CreateRotatingProxyCredential adds a credential to a rotator. Without a
+// password a random one is generated and returned.
+func CreateRotatingProxyCredential(userID uint, rotatingProxyID uint64, payload dto.RotatingProxyCredentialRequest) (*dto.RotatingProxyCredential, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	var result *dto.RotatingProxyCredential
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		rotator, err := lockRotatingProxy(tx, userID, rotatingProxyID)
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&domain.RotatingProxyCredential{}).Where("rotating_proxy_id = ?", rotator.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= maxRotatingProxyCredentials {
+			return ErrRotatingProxyCredentialTooMany
+		}
+
+		entity := domain.RotatingProxyCredential{RotatingProxyID: rotator.ID, UserID: userID}
+		if payload.Password == "" {
+			payload.RegeneratePassword = true
+		}
+		if err := applyRotatingProxyCredentialRequest(rotator, &entity, payload); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&entity).Error; err != nil {
+			if isUniqueConstraintError(err) {
+				return ErrRotatingProxyCredentialNameConflict
+			}
+			return err
+		}
+		if err := touchRotatingProxy(tx, rotator.ID); err != nil {
+			return err
+		}
+
+		credential := newRotatingProxyCredentialDTO(entity, time.Now())
+		result = &credential
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateRotatingProxyCredential replaces the settings of a credential. An
+// empty password keeps the stored one and ResetUsage clears the bytes counted
+// against the bandwidth quota.
+func UpdateRotatingProxyCredential(userID uint, rotatingProxyID uint64, credentialID uint64, payload dto.RotatingProxyCredentialRequest) (*dto.RotatingProxyCredential, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	var result *dto.RotatingProxyCredential
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		rotator, err := lockRotatingProxy(tx, userID, rotatingProxyID)
+		if err != nil {
+			return err
+		}
+
+		var entity domain.RotatingProxyCredential
+		if err := tx.Where("rotating_proxy_id = ? AND id = ?", rotator.ID, credentialID).First(&entity).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRotatingProxyCredentialNotFound
+			}
+			return err
+		}
+
+		if err := applyRotatingProxyCredentialRequest(rotator, &entity, payload); err != nil {
+			return err
+		}
+		if payload.ResetUsage {
+			entity.BytesUsed = 0
+		}
+
+		if err := tx.Save(&entity).Error; err != nil {
+			if isUniqueConstraintError(err) {
+				return ErrRotatingProxyCredentialNameConflict
+			}
+			return err
+		}
+		if err := touchRotatingProxy(tx, rotator.ID); err != nil {
+			return err
+		}
+
+		credential := newRotatingProxyCredentialDTO(entity, time.Now())
+		result = &credential
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func DeleteRotatingProxyCredential(userID uint, rotatingProxyID uint64, credentialID uint64) error {
+	if DB == nil {
+		return fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		rotator, err := lockRotatingProxy(tx, userID, rotatingProxyID)
+		if err != nil {
+			return err
+		}
+
+		res := tx.Where("rotating_proxy_id = ? AND id = ?", rotator.ID, credentialID).Delete(&domain.RotatingProxyCredential{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrRotatingProxyCredentialNotFound
+		}
+		return touchRotatingProxy(tx, rotator.ID)
+	})
+}
+
+func applyRotatingProxyCredentialRequest(rotator *domain.RotatingProxy, entity *domain.RotatingProxyCredential, payload dto.RotatingProxyCredentialRequest) error {
+	name := strings.TrimSpace(payload.Name)
+	if !validRotatingProxyCredentialName(name) || name == rotator.AuthUsername {
+		return ErrRotatingProxyCredentialNameInvalid
+	}
+	if payload.MaxConnections < 0 || payload.BandwidthQuotaBytes < 0 {
+		return ErrRotatingProxyCredentialLimitInvalid
+	}
+
+	entity.Name = name
+	entity.MaxConnections = payload.MaxConnections
+	entity.BandwidthQuotaBytes = payload.BandwidthQuotaBytes
+	entity.ExpiresAt = nil
+	if payload.ExpiresAt != nil {
+		expiresAt := payload.ExpiresAt.UTC()
+		entity.ExpiresAt = &expiresAt
+	}
+
+	switch {
+	case payload.RegeneratePassword:
+		password, err := generateRotatingProxyPassword()
+		if err != nil {
+			return err
+		}
+		entity.Password = password
+	case payload.Password != "":
+		entity.Password = payload.Password
+	}
+	return nil
+}
+
+// validRotatingProxyCredentialName rejects names clients could not send:
+// SOCKS4 separates user and password with a colon.
+func validRotatingProxyCredentialName(name string) bool {
+	if name == "" || len(name) > rotatingProxyNameMaxLength {
+		return false
+	}
+	return !strings.ContainsFunc(name, func(r rune) bool {
+		return r == ':' || unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+}
+
+func lockRotatingProxy(tx *gorm.DB, userID uint, rotatingProxyID uint64) (*domain.RotatingProxy, error) {
+	var rotator domain.RotatingProxy
+	if err := tx.
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND id = ?", userID, rotatingProxyID).
+		First(&rotator).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRotatingProxyNotFound
+		}
+		return nil, err
+	}
+	return &rotator, nil
+}
+
+// touchRotatingProxy bumps updated_at so running listeners reload the
+// rotator's credentials on their next sync.
+func touchRotatingProxy(tx *gorm.DB, rotatingProxyID uint64) error {
+	return tx.Model(&domain.RotatingProxy{}).
+		Where("id = ?", rotatingProxyID).
+		UpdateColumn("updated_at", time.Now()).Error
+}
+
+func newRotatingProxyCredentialDTO(row domain.RotatingProxyCredential, now time.Time) dto.RotatingProxyCredential {
+	return dto.RotatingProxyCredential{
+		ID:                  row.ID,
+		RotatingProxyID:     row.RotatingProxyID,
+		Name:                row.Name,
+		Password:            row.Password,
+		ExpiresAt:           row.ExpiresAt,
+		Expired:             row.Expired(now),
+		MaxConnections:      row.MaxConnections,
+		BandwidthQuotaBytes: row.BandwidthQuotaBytes,
+		BytesUsed:           row.BytesUsed,
+		CreatedAt:           row.CreatedAt,
+	}
+}
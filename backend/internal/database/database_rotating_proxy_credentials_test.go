@@ -0,0 +1,97 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+func TestRotatingProxyCredentials_ManageAndAttributeUsage(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{Email: "credentials@example.com", Password: "password123"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+	rotator := domain.RotatingProxy{UserID: user.ID, Name: "credential-rotator", ProtocolID: protocol.ID, ListenPort: 10610, AuthUsername: "owner"}
+	if err := db.Create(&rotator).Error; err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+
+	created, err := CreateRotatingProxyCredential(user.ID, rotator.ID, dto.RotatingProxyCredentialRequest{
+		Name:                "team-a",
+		MaxConnections:      2,
+		BandwidthQuotaBytes: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("CreateRotatingProxyCredential: %v", err)
+	}
+	if created.Password == "" || created.Expired {
+		t.Fatalf("created credential = %+v, want a generated password and not expired", created)
+	}
+
+	for name, payload := range map[string]dto.RotatingProxyCredentialRequest{
+		"duplicate name":   {Name: "team-a", Password: "secret"},
+		"rotator username": {Name: "owner", Password: "secret"},
+		"colon in name":    {Name: "team:b", Password: "secret"},
+		"negative limit":   {Name: "team-b", Password: "secret", MaxConnections: -1},
+	} {
+		if _, err := CreateRotatingProxyCredential(user.ID, rotator.ID, payload); err == nil {
+			t.Fatalf("%s: CreateRotatingProxyCredential succeeded, want an error", name)
+		}
+	}
+	if _, err := CreateRotatingProxyCredential(user.ID+1, rotator.ID, dto.RotatingProxyCredentialRequest{Name: "x"}); !errors.Is(err, ErrRotatingProxyNotFound) {
+		t.Fatalf("credential on another user's rotator: err = %v, want ErrRotatingProxyNotFound", err)
+	}
+
+	bucket := RotatingProxyUsageBucketStart(time.Now())
+	if err := AddRotatingProxyUsage([]domain.RotatingProxyUsage{
+		{RotatingProxyID: rotator.ID, CredentialID: created.ID, BucketStart: bucket, UserID: user.ID, Requests: 2, BytesUp: 300, BytesDown: 700},
+		{RotatingProxyID: rotator.ID, BucketStart: bucket, UserID: user.ID, Requests: 1, BytesUp: 10, BytesDown: 20},
+	}); err != nil {
+		t.Fatalf("AddRotatingProxyUsage: %v", err)
+	}
+
+	report, err := GetRotatingProxyUsage(user.ID, rotator.ID, bucket, bucket.Add(RotatingProxyUsageBucketSize))
+	if err != nil {
+		t.Fatalf("GetRotatingProxyUsage: %v", err)
+	}
+	if len(report.Credentials) != 1 || report.Credentials[0].Name != "team-a" || report.Credentials[0].Requests != 2 {
+		t.Fatalf("credential usage = %+v, want 2 requests for team-a", report.Credentials)
+	}
+
+	credentials, err := ListRotatingProxyCredentials(user.ID, rotator.ID)
+	if err != nil {
+		t.Fatalf("ListRotatingProxyCredentials: %v", err)
+	}
+	if len(credentials) != 1 || credentials[0].BytesUsed != 1000 || credentials[0].Password != created.Password {
+		t.Fatalf("credentials = %+v, want team-a with 1000 bytes used", credentials)
+	}
+
+	expiresAt := time.Now().Add(-time.Hour)
+	updated, err := UpdateRotatingProxyCredential(user.ID, rotator.ID, created.ID, dto.RotatingProxyCredentialRequest{
+		Name:       "team-a",
+		ExpiresAt:  &expiresAt,
+		ResetUsage: true,
+	})
+	if err != nil {
+		t.Fatalf("UpdateRotatingProxyCredential: %v", err)
+	}
+	if updated.BytesUsed != 0 || !updated.Expired || updated.Password != created.Password || updated.MaxConnections != 0 {
+		t.Fatalf("updated credential = %+v, want reset usage, expired, same password and no connection limit", updated)
+	}
+
+	if err := DeleteRotatingProxyCredential(user.ID, rotator.ID, created.ID); err != nil {
+		t.Fatalf("DeleteRotatingProxyCredential: %v", err)
+	}
+	if err := DeleteRotatingProxyCredential(user.ID, rotator.ID, created.ID); !errors.Is(err, ErrRotatingProxyCredentialNotFound) {
+		t.Fatalf("second delete: err = %v, want ErrRotatingProxyCredentialNotFound", err)
+	}
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"errors"
+	"net/netip"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxRotatorDestinationRules = 64
+
+var (
+	errDestinationRuleInvalid = errors.New("invalid destination rule")
+
+	destinationGlobPattern = regexp.MustCompile(`^[a-z0-9*._-]{1,253}$`)
+)
+
+// DestinationRule is one entry of a rotator's allowed or blocked
+// destinations, written as <host>[:<ports>]. The host is "*", a domain glob
+// such as "*.example.com", an IP address or a CIDR range; IPv6 hosts need
+// brackets when ports follow. Ports are a single port or a range such as
+// 8000-8999, e.g. "*:25" or "[2001:db8::/32]:443".
+type DestinationRule struct {
+	// Glob is the lower-case domain pattern, empty for address rules.
+	Glob    string
+	Prefix  netip.Prefix
+	MinPort uint16
+	MaxPort uint16
+}
+
+// ParseDestinationRule parses a destination rule. Single addresses become
+// /32 or /128 ranges.
+func ParseDestinationRule(raw string) (DestinationRule, error) {
+	value := strings.ToLower(strings.TrimSpace(raw))
+	host, ports := value, ""
+	hasPorts := false
+	switch {
+	case strings.HasPrefix(value, "["):
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return DestinationRule{}, errDestinationRuleInvalid
+		}
+		host = value[1:end]
+		if rest := value[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return DestinationRule{}, errDestinationRuleInvalid
+			}
+			ports, hasPorts = rest[1:], true
+		}
+	case strings.Count(value, ":") == 1:
+		host, ports, hasPorts = strings.Cut(value, ":")
+	}
+
+	var rule DestinationRule
+	if hasPorts {
+		minPort, maxPort, err := parseDestinationPorts(ports)
+		if err != nil {
+			return DestinationRule{}, err
+		}
+		rule.MinPort, rule.MaxPort = minPort, maxPort
+	}
+
+	if prefix, err := parseClientPrefix(host); err == nil {
+		rule.Prefix = prefix
+		return rule, nil
+	}
+	if !destinationGlobPattern.MatchString(host) || strings.Contains(host, "..") {
+		return DestinationRule{}, errDestinationRuleInvalid
+	}
+	rule.Glob = host
+	return rule, nil
+}
+
+func parseDestinationPorts(value string) (uint16, uint16, error) {
+	low, high, isRange := strings.Cut(value, "-")
+	if !isRange {
+		high = low
+	}
+	minPort, err := strconv.ParseUint(low, 10, 16)
+	if err != nil || minPort == 0 {
+		return 0, 0, errDestinationRuleInvalid
+	}
+	maxPort, err := strconv.ParseUint(high, 10, 16)
+	if err != nil || maxPort < minPort {
+		return 0, 0, errDestinationRuleInvalid
+	}
+	return uint16(minPort), uint16(maxPort), nil
+}
+
+// String returns the canonical form of the rule.
+func (r DestinationRule) String() string {
+	host := r.Glob
+	if r.Prefix.IsValid() {
+		host = r.Prefix.String()
+		if r.Prefix.Addr().Is6() && r.MinPort != 0 {
+			host = "[" + host + "]"
+		}
+	}
+	switch {
+	case r.MinPort == 0:
+		return host
+	case r.MinPort == r.MaxPort:
+		return host + ":" + strconv.Itoa(int(r.MinPort))
+	default:
+		return host + ":" + strconv.Itoa(int(r.MinPort)) + "-" + strconv.Itoa(int(r.MaxPort))
+	}
+}
+
+// Matches reports whether the rule covers a connection to host and port.
+// Address rules only match IP literals and domain globs only match host
+// names. Rotators in local DNS mode check resolved addresses again.
+func (r DestinationRule) Matches(host string, port uint16) bool {
+	if r.MinPort != 0 && (port < r.MinPort || port > r.MaxPort) {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if r.Glob == "*" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err == nil {
+		return r.Prefix.IsValid() && r.Prefix.Contains(addr.Unmap().WithZone(""))
+	}
+	if r.Glob == "" {
+		return false
+	}
+	matched, err := path.Match(r.Glob, host)
+	return err == nil && matched
+}
+
+// validateRotatorDestinations normalises the allowed and blocked destination
+// lists to canonical rules.
+func validateRotatorDestinations(allowed, blocked []string) ([]string, []string, error) {
+	normalizedAllowed, err := normalizeRotatorDestinationRules(allowed)
+	if err != nil {
+		return nil, nil, err
+	}
+	normalizedBlocked, err := normalizeRotatorDestinationRules(blocked)
+	if err != nil {
+		return nil, nil, err
+	}
+	return normalizedAllowed, normalizedBlocked, nil
+}
+
+func normalizeRotatorDestinationRules(rules []string) ([]string, error) {
+	normalized := make([]string, 0, len(rules))
+	seen := make(map[string]struct{}, len(rules))
+	for _, raw := range rules {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		rule, err := ParseDestinationRule(raw)
+		if err != nil {
+			return nil, ErrRotatingProxyDestinationInvalid
+		}
+		canonical := rule.String()
+		if _, ok := seen[canonical]; ok {
+			continue
+		}
+		seen[canonical] = struct{}{}
+		normalized = append(normalized, canonical)
+	}
+	if len(normalized) > maxRotatorDestinationRules {
+		return nil, ErrRotatingProxyDestinationInvalid
+	}
+	return normalized, nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestValidateRotatorDestinations(t *testing.T) {
+	allowed, blocked, err := validateRotatorDestinations(
+		[]string{" *.Example.COM ", "203.0.113.7", "198.51.100.99/24:8000-8999", "[2001:db8::1]:443", "*.example.com", ""},
+		[]string{"*:25"},
+	)
+	if err != nil {
+		t.Fatalf("validateRotatorDestinations: %v", err)
+	}
+	wantAllowed := []string{"*.example.com", "203.0.113.7/32", "198.51.100.0/24:8000-8999", "[2001:db8::1/128]:443"}
+	if !slices.Equal(allowed, wantAllowed) {
+		t.Fatalf("allowed = %v, want %v", allowed, wantAllowed)
+	}
+	if !slices.Equal(blocked, []string{"*:25"}) {
+		t.Fatalf("blocked = %v, want [*:25]", blocked)
+	}
+
+	for _, invalid := range []string{"exa mple.com", "example.com:0", "example.com:90-80", "example.com:http", "[2001:db8::1", "a..b", "2001:db8::1:80:x"} {
+		if _, _, err := validateRotatorDestinations(nil, []string{invalid}); !errors.Is(err, ErrRotatingProxyDestinationInvalid) {
+			t.Errorf("%q: err = %v, want ErrRotatingProxyDestinationInvalid", invalid, err)
+		}
+	}
+
+	tooMany := make([]string, maxRotatorDestinationRules+1)
+	for i := range tooMany {
+		tooMany[i] = "host" + strconv.Itoa(i) + ".example.com"
+	}
+	if _, _, err := validateRotatorDestinations(tooMany, nil); !errors.Is(err, ErrRotatingProxyDestinationInvalid) {
+		t.Fatalf("too many rules: err = %v, want ErrRotatingProxyDestinationInvalid", err)
+	}
+}
+
+func TestDestinationRule_Matches(t *testing.T) {
+	tests := []struct {
+		rule string
+		host string
+		port uint16
+		want bool
+	}{
+		{rule: "*.example.com", host: "www.example.com", port: 443, want: true},
+		{rule: "*.example.com", host: "example.com", port: 443, want: false},
+		{rule: "example.com:80-443", host: "EXAMPLE.com.", port: 443, want: true},
+		{rule: "example.com:80-443", host: "example.com", port: 8080, want: false},
+		{rule: "*", host: "anything.test", port: 1, want: true},
+		{rule: "10.0.0.0/8", host: "10.1.2.3", port: 22, want: true},
+		{rule: "10.0.0.0/8", host: "intranet.test", port: 22, want: false},
+		{rule: "[2001:db8::/32]:443", host: "[2001:db8::5]", port: 443, want: true},
+	}
+	for _, tc := range tests {
+		rule, err := ParseDestinationRule(tc.rule)
+		if err != nil {
+			t.Fatalf("ParseDestinationRule(%q): %v", tc.rule, err)
+		}
+		if got := rule.Matches(tc.host, tc.port); got != tc.want {
+			t.Errorf("%q matches %s:%d = %v, want %v", tc.rule, tc.host, tc.port, got, tc.want)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,9 +33,36 @@ var (
 	ErrRotatingProxyUptimeTypeMissing  = errors.New("uptime filter type is required when uptime percentage is set")
 	ErrRotatingProxyUptimeValueMissing = errors.New("uptime percentage is required when uptime filter type is set")
 	ErrRotatingProxyUptimeOutOfRange   = errors.New("uptime percentage must be between 0 and 100")
+	ErrRotatingProxySessionTTLInvalid  = errors.New("sticky session ttl must be between 0 and 86400 seconds")
+	ErrRotatingProxyCountryInvalid     = errors.New("country filters must be names or ISO codes of at most 56 characters")
+	ErrRotatingProxyTypeInvalid        = errors.New("type filters support residential, datacenter and isp")
+	ErrRotatingProxyAnonymityInvalid   = errors.New("anonymity filters support elite, anonymous and transparent")
+	ErrRotatingProxyStrategyInvalid    = errors.New("selection strategy must be one of round_robin, random, lowest_latency, reputation_weighted or least_connections")
+	ErrRotatingProxyClientCIDRInvalid  = errors.New("allowed client addresses must be up to 64 IP addresses or CIDR ranges")
+	ErrRotatingProxyAuthModeInvalid    = errors.New("client auth mode must be either ip_and_credentials or ip_or_credentials")
+	ErrRotatingProxyRotationInvalid    = errors.New("rotation mode must be one of per_request, interval or request_count")
+	ErrRotatingProxyIntervalInvalid    = errors.New("rotation interval must be between 1 and 86400 seconds")
+	ErrRotatingProxyRequestsInvalid    = errors.New("rotation request count must be between 1 and 1000000")
+	ErrRotatingProxyParentInvalid      = errors.New("parent proxy needs a protocol of http, https, socks4 or socks5, a host and a port")
+	ErrRotatingProxyTLSListenInvalid   = errors.New("tls listen transport is only available for http and https rotators")
+	ErrRotatingProxyLimitInvalid       = errors.New("traffic limits must be between 0 and 1000000")
+	ErrRotatingProxyLimitScopeInvalid  = errors.New("limit scope must be either rotator or client_ip")
+	ErrRotatingProxyTierInvalid        = errors.New("a rotating proxy supports at most 8 fallback tiers")
+	ErrRotatingProxyHeaderInvalid      = errors.New("header rules must be up to 32 header names or Name: value lines and cannot change hop or framing headers")
+	ErrRotatingProxyDestinationInvalid = errors.New("destination rules must be up to 64 domains, IP addresses or CIDR ranges with an optional port or port range")
 )
 
 var (
+	rotatorProxyTypeSet = map[string]struct{}{
+		"residential": {},
+		"datacenter":  {},
+		"isp":         {},
+	}
+	rotatorAnonymityLevelSet = map[string]struct{}{
+		"elite":       {},
+		"anonymous":   {},
+		"transparent": {},
+	}
 	reputationLabelOrder = []string{"good", "neutral", "poor"}
 	reputationLabelSet   = map[string]struct{}{
 		"good":    {},
@@ -47,8 +76,101 @@ const (
 	uptimeFilterMin            = "min"
 	uptimeFilterMax            = "max"
 	defaultInstanceRegion      = "Unknown"
+	maxStickySessionTTLSeconds = 86400
+	maxCountryFilterLength     = 56
 )
 
+// rotatorAttributeFilters restricts a rotator to proxies with matching
+// country, estimated type and anonymity level. Values are lower-cased.
+// ProxyIDs further limits the rotator to the proxies pinned to it.
+type rotatorAttributeFilters struct {
+	Countries       []string
+	Types           []string
+	AnonymityLevels []string
+	ProxyIDs        []uint64
+}
+
+func rotatorAttributeFiltersOf(rotator domain.RotatingProxy) rotatorAttributeFilters {
+	return rotatorAttributeFilters{
+		Countries:       normalizeFilterValues(rotator.Countries),
+		Types:           normalizeFilterValues(rotator.ProxyTypes),
+		AnonymityLevels: normalizeFilterValues(rotator.AnonymityLevels),
+		ProxyIDs:        rotator.PinnedProxyIDs.Clone(),
+	}
+}
+
+func validateRotatorAttributeFilters(countries, types, anonymityLevels []string) (rotatorAttributeFilters, error) {
+	filters := rotatorAttributeFilters{
+		Countries:       normalizeFilterValues(countries),
+		Types:           normalizeFilterValues(types),
+		AnonymityLevels: normalizeFilterValues(anonymityLevels),
+	}
+	for _, country := range filters.Countries {
+		if len(country) > maxCountryFilterLength {
+			return rotatorAttributeFilters{}, ErrRotatingProxyCountryInvalid
+		}
+	}
+	for _, proxyType := range filters.Types {
+		if _, ok := rotatorProxyTypeSet[proxyType]; !ok {
+			return rotatorAttributeFilters{}, ErrRotatingProxyTypeInvalid
+		}
+	}
+	for _, level := range filters.AnonymityLevels {
+		if _, ok := rotatorAnonymityLevelSet[level]; !ok {
+			return rotatorAttributeFilters{}, ErrRotatingProxyAnonymityInvalid
+		}
+	}
+	return filters, nil
+}
+
+func (f rotatorAttributeFilters) cacheKey() string {
+	proxyIDs := make([]string, 0, len(f.ProxyIDs))
+	for _, id := range f.ProxyIDs {
+		proxyIDs = append(proxyIDs, strconv.FormatUint(id, 10))
+	}
+	return strings.Join([]string{
+		strings.Join(f.Countries, ","),
+		strings.Join(f.Types, ","),
+		strings.Join(f.AnonymityLevels, ","),
+		strings.Join(proxyIDs, ","),
+	}, "|")
+}
+
+// RotatingProxySelection narrows the candidate pool for a single rotation,
+// e.g. from the parameters a client encoded in its proxy username.
+// ActiveConnections holds the caller's open connections per upstream and is
+// only consulted by the least_connections strategy.
+type RotatingProxySelection struct {
+	Country           string
+	Type              string
+	ExcludeProxyIDs   []uint64
+	ActiveConnections map[uint64]int
+}
+
+func (s RotatingProxySelection) IsEmpty() bool {
+	return strings.TrimSpace(s.Country) == "" && strings.TrimSpace(s.Type) == "" && len(s.ExcludeProxyIDs) == 0
+}
+
+// Matches applies the selection to an already loaded proxy, mirroring
+// applyRotatingProxySelection.
+func (s RotatingProxySelection) Matches(proxy *domain.Proxy) bool {
+	if proxy == nil || slices.Contains(s.ExcludeProxyIDs, proxy.ID) {
+		return false
+	}
+	if countries := support.CountryMatchValues(s.Country); len(countries) > 0 {
+		country := strings.ToLower(proxy.Country)
+		if !slices.Contains(countries, country) {
+			return false
+		}
+	}
+	if proxyType := strings.ToLower(strings.TrimSpace(s.Type)); proxyType != "" {
+		if strings.ToLower(proxy.EstimatedType) != proxyType {
+			return false
+		}
+	}
+	return true
+}
+
 func CreateRotatingProxy(userID uint, payload dto.RotatingProxyCreateRequest) (*dto.RotatingProxy, error) {
 	if DB == nil {
 		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
@@ -71,10 +193,13 @@ func CreateRotatingProxy(userID uint, payload dto.RotatingProxyCreateRequest) (*
 		listenProtocolName = protocolName
 	}
 	transportProtocol := support.NormalizeTransportProtocol(payload.TransportProtocol)
-	listenTransportProtocol := support.NormalizeTransportProtocol(payload.ListenTransportProtocol)
+	listenTransportProtocol := support.NormalizeListenTransportProtocol(payload.ListenTransportProtocol)
 	if strings.TrimSpace(payload.ListenTransportProtocol) == "" {
 		listenTransportProtocol = transportProtocol
 	}
+	if err := validateRotatorListenTransport(listenProtocolName, listenTransportProtocol); err != nil {
+		return nil, err
+	}
 	instanceID := strings.TrimSpace(payload.InstanceID)
 	if instanceID == "" {
 		instanceID = support.GetInstanceID()
@@ -102,6 +227,91 @@ func CreateRotatingProxy(userID uint, payload dto.RotatingProxyCreateRequest) (*
 		return nil, err
 	}
 
+	if payload.StickySessionTTLSeconds < 0 || payload.StickySessionTTLSeconds > maxStickySessionTTLSeconds {
+		return nil, ErrRotatingProxySessionTTLInvalid
+	}
+
+	strategy, err := validateRotatorSelectionStrategy(payload.SelectionStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err := validateRotatorAttributeFilters(payload.Countries, payload.Types, payload.AnonymityLevels)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedClientCIDRs, clientAuthMode, err := validateRotatorClientAccess(payload.AllowedClientCIDRs, payload.ClientAuthMode)
+	if err != nil {
+		return nil, err
+	}
+
+	rotation, err := validateRotatorRotation(payload.RotationMode, payload.RotationIntervalSeconds, payload.RotationRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := validateRotatorParentProxy(rotatorParentProxy{
+		Protocol: payload.ParentProxyProtocol,
+		Host:     payload.ParentProxyHost,
+		Port:     payload.ParentProxyPort,
+		Username: payload.ParentProxyUsername,
+		Password: payload.ParentProxyPassword,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	allowedDestinations, blockedDestinations, err := validateRotatorDestinations(payload.AllowedDestinations, payload.BlockedDestinations)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := validateRotatorTrafficLimits(rotatorTrafficLimits{
+		MaxTunnels:           payload.MaxTunnels,
+		ConnectionsPerSecond: payload.ConnectionsPerSecond,
+		RequestsPerSecond:    payload.RequestsPerSecond,
+		Scope:                payload.LimitScope,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	headerRules, err := validateRotatorHeaderRules(rotatorHeaderRules{
+		Strip:              payload.StripRequestHeaders,
+		Inject:             payload.InjectRequestHeaders,
+		UpstreamIDHeader:   payload.UpstreamIDHeader,
+		UpstreamTierHeader: payload.UpstreamTierHeader,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackTiers, err := validateRotatorFallbackTiers(payload.FallbackTiers)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamOptions, err := validateRotatorUpstreamOptions(rotatorUpstreamOptions{
+		HandshakeTimeoutMS:      payload.HandshakeTimeoutMS,
+		UpstreamTimeoutMS:       payload.UpstreamTimeoutMS,
+		DNSMode:                 payload.DNSMode,
+		FailoverRetries:         payload.FailoverRetries,
+		FailoverCooldownSeconds: payload.FailoverCooldownSeconds,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	placement, err := validateRotatorPlacement(RotatingProxyPlacement{
+		InstanceID:         instanceID,
+		ReplicaInstanceIDs: payload.ReplicaInstanceIDs,
+		ReplicaRegion:      payload.ReplicaRegion,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	var result *dto.RotatingProxy
 
 	err = DB.Transaction(func(tx *gorm.DB) error {
@@ -131,6 +341,11 @@ func CreateRotatingProxy(userID uint, payload dto.RotatingProxyCreateRequest) (*
 			}
 			return err
 		}
+		pinned, err := validateRotatorPinnedProxies(tx, userID, payload.PinnedProxyIDs)
+		if err != nil {
+			return err
+		}
+		attributes.ProxyIDs = pinned
 		filters := sanitizeRotatorReputationLabels(payload.ReputationLabels)
 
 		entity := domain.RotatingProxy{
@@ -149,9 +364,28 @@ func CreateRotatingProxy(userID uint, payload dto.RotatingProxyCreateRequest) (*
 			AuthUsername:            strings.TrimSpace(payload.AuthUsername),
 			AuthPassword:            payload.AuthPassword,
 			ReputationLabels:        domain.StringList(filters),
+			StickySessionTTLSeconds: payload.StickySessionTTLSeconds,
+			SelectionStrategy:       strategy,
+			Countries:               domain.StringList(attributes.Countries),
+			ProxyTypes:              domain.StringList(attributes.Types),
+			AnonymityLevels:         domain.StringList(attributes.AnonymityLevels),
+			AllowedClientCIDRs:      domain.StringList(allowedClientCIDRs),
+			ClientAuthMode:          clientAuthMode,
+			RotationMode:            rotation.Mode,
+			RotationIntervalSeconds: rotation.IntervalSeconds,
+			RotationRequests:        rotation.Requests,
+			AllowedDestinations:     domain.StringList(allowedDestinations),
+			BlockedDestinations:     domain.StringList(blockedDestinations),
+			PinnedProxyIDs:          domain.IDList(pinned),
+			FallbackTiers:           fallbackTiers,
 		}
+		parent.apply(&entity)
+		limits.apply(&entity)
+		headerRules.apply(&entity)
+		placement.apply(&entity)
+		upstreamOptions.apply(&entity)
 
-		listenPort, err := allocateListenPort(tx, instanceID)
+		listenPort, err := allocateListenPort(tx, placement)
 		if err != nil {
 			return err
 		}
@@ -164,7 +398,9 @@ func CreateRotatingProxy(userID uint, payload dto.RotatingProxyCreateRequest) (*
 			return err
 		}
 
-		aliveProxies, err := aliveProxiesForProtocol(tx, userID, proxyProtocol.ID, filters, uptimeFilterType, uptimePercentage)
+		aliveProxyCount, err := countAliveRotatorProxies(entity, func(tier rotatorTier) ([]domain.Proxy, error) {
+			return aliveProxiesForProtocol(tx, userID, proxyProtocol.ID, tier.Labels, uptimeFilterType, uptimePercentage, tier.Attributes)
+		})
 		if err != nil {
 			return err
 		}
@@ -181,12 +417,46 @@ func CreateRotatingProxy(userID uint, payload dto.RotatingProxyCreateRequest) (*
 			ListenTransportProtocol: listenTransportProtocol,
 			UptimeFilterType:        uptimeFilterType,
 			UptimePercentage:        cloneFloat64Ptr(uptimePercentage),
-			AliveProxyCount:         len(aliveProxies),
+			AliveProxyCount:         aliveProxyCount,
 			ListenPort:              entity.ListenPort,
 			AuthRequired:            entity.AuthRequired,
 			AuthUsername:            entity.AuthUsername,
 			AuthPassword:            strings.TrimSpace(payload.AuthPassword),
 			ReputationLabels:        filters,
+			StickySessionTTLSeconds: entity.StickySessionTTLSeconds,
+			SelectionStrategy:       entity.SelectionStrategy,
+			Countries:               attributes.Countries,
+			Types:                   attributes.Types,
+			AnonymityLevels:         attributes.AnonymityLevels,
+			AllowedClientCIDRs:      allowedClientCIDRs,
+			ClientAuthMode:          clientAuthMode,
+			RotationMode:            rotation.Mode,
+			RotationIntervalSeconds: rotation.IntervalSeconds,
+			RotationRequests:        rotation.Requests,
+			ParentProxyProtocol:     parent.Protocol,
+			ParentProxyHost:         parent.Host,
+			ParentProxyPort:         parent.Port,
+			ParentProxyUsername:     parent.Username,
+			ParentProxyPassword:     parent.Password,
+			AllowedDestinations:     allowedDestinations,
+			BlockedDestinations:     blockedDestinations,
+			MaxTunnels:              limits.MaxTunnels,
+			ConnectionsPerSecond:    limits.ConnectionsPerSecond,
+			RequestsPerSecond:       limits.RequestsPerSecond,
+			LimitScope:              limits.Scope,
+			StripRequestHeaders:     headerRules.Strip,
+			InjectRequestHeaders:    headerRules.Inject,
+			UpstreamIDHeader:        headerRules.UpstreamIDHeader,
+			PinnedProxyIDs:          pinned,
+			FallbackTiers:           newRotatingProxyTierDTOs(fallbackTiers),
+			UpstreamTierHeader:      headerRules.UpstreamTierHeader,
+			ReplicaInstanceIDs:      placement.ReplicaInstanceIDs,
+			ReplicaRegion:           placement.ReplicaRegion,
+			HandshakeTimeoutMS:      upstreamOptions.HandshakeTimeoutMS,
+			UpstreamTimeoutMS:       upstreamOptions.UpstreamTimeoutMS,
+			DNSMode:                 upstreamOptions.DNSMode,
+			FailoverRetries:         upstreamOptions.FailoverRetries,
+			FailoverCooldownSeconds: upstreamOptions.FailoverCooldownSeconds,
 			CreatedAt:               entity.CreatedAt,
 		}
 
@@ -227,28 +497,9 @@ func ListRotatingProxies(userID uint) ([]dto.RotatingProxy, error) {
 
 	for _, row := range rows {
 		normalizeRotatingProxyProtocols(&row)
-		protocolName := row.Protocol.Name
-		listenProtocol := row.ListenProtocol.Name
-		transportProtocol := support.NormalizeTransportProtocol(row.TransportProtocol)
-		listenTransportProtocol := support.NormalizeTransportProtocol(row.ListenTransportProtocol)
-		if strings.TrimSpace(row.ListenTransportProtocol) == "" {
-			listenTransportProtocol = transportProtocol
-		}
-		labels := sanitizeRotatorReputationLabels(row.ReputationLabels.Clone())
-		uptimeFilterType, uptimePercentage := normalizeRotatorUptimeFilter(row.UptimeFilterType, row.UptimePercentage)
-		instanceID := strings.TrimSpace(row.InstanceID)
-		if instanceID == "" {
-			instanceID = support.GetInstanceID()
-		}
-		instanceName := strings.TrimSpace(row.InstanceName)
-		if instanceName == "" {
-			instanceName = instanceID
-		}
-		instanceRegion := strings.TrimSpace(row.InstanceRegion)
-		if instanceRegion == "" {
-			instanceRegion = defaultInstanceRegion
-		}
-		proxies, err := getAliveProxiesCached(userID, row.ProtocolID, labels, uptimeFilterType, uptimePercentage, protocolCache)
+		aliveProxyCount, err := countAliveRotatorProxies(row, func(tier rotatorTier) ([]domain.Proxy, error) {
+			return getAliveProxiesCached(userID, row.ProtocolID, tier.Labels, row.UptimeFilterType, row.UptimePercentage, tier.Attributes, protocolCache)
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -261,33 +512,76 @@ func ListRotatingProxies(userID uint) ([]dto.RotatingProxy, error) {
 			}
 		}
 
-		result = append(result, dto.RotatingProxy{
-			ID:                      row.ID,
-			Name:                    row.Name,
-			InstanceID:              instanceID,
-			InstanceName:            instanceName,
-			InstanceRegion:          instanceRegion,
-			Protocol:                protocolName,
-			ListenProtocol:          listenProtocol,
-			TransportProtocol:       transportProtocol,
-			ListenTransportProtocol: listenTransportProtocol,
-			UptimeFilterType:        uptimeFilterType,
-			UptimePercentage:        cloneFloat64Ptr(uptimePercentage),
-			AliveProxyCount:         len(proxies),
-			ListenPort:              row.ListenPort,
-			AuthRequired:            row.AuthRequired,
-			AuthUsername:            row.AuthUsername,
-			AuthPassword:            row.AuthPassword,
-			LastRotationAt:          row.LastRotationAt,
-			LastServedProxy:         lastProxy,
-			ReputationLabels:        labels,
-			CreatedAt:               row.CreatedAt,
-		})
+		item := newRotatingProxyDTO(row, aliveProxyCount)
+		item.LastServedProxy = lastProxy
+		result = append(result, item)
 	}
 
 	return result, nil
 }
 
+// newRotatingProxyDTO converts a rotator whose protocols were normalised by
+// normalizeRotatingProxyProtocols into its API representation.
+func newRotatingProxyDTO(row domain.RotatingProxy, aliveProxyCount int) dto.RotatingProxy {
+	attributes := rotatorAttributeFiltersOf(row)
+	rotation := RotatingProxyRotationOf(row)
+	return dto.RotatingProxy{
+		ID:                      row.ID,
+		Name:                    row.Name,
+		InstanceID:              row.InstanceID,
+		InstanceName:            row.InstanceName,
+		InstanceRegion:          row.InstanceRegion,
+		Protocol:                row.Protocol.Name,
+		ListenProtocol:          row.ListenProtocol.Name,
+		TransportProtocol:       row.TransportProtocol,
+		ListenTransportProtocol: row.ListenTransportProtocol,
+		UptimeFilterType:        row.UptimeFilterType,
+		UptimePercentage:        cloneFloat64Ptr(row.UptimePercentage),
+		AliveProxyCount:         aliveProxyCount,
+		ListenPort:              row.ListenPort,
+		AuthRequired:            row.AuthRequired,
+		AuthUsername:            row.AuthUsername,
+		AuthPassword:            row.AuthPassword,
+		LastRotationAt:          row.LastRotationAt,
+		ReputationLabels:        sanitizeRotatorReputationLabels(row.ReputationLabels.Clone()),
+		StickySessionTTLSeconds: row.StickySessionTTLSeconds,
+		SelectionStrategy:       normalizeRotatorSelectionStrategy(row.SelectionStrategy),
+		Countries:               attributes.Countries,
+		Types:                   attributes.Types,
+		AnonymityLevels:         attributes.AnonymityLevels,
+		AllowedClientCIDRs:      row.AllowedClientCIDRs.Clone(),
+		ClientAuthMode:          normalizeRotatorClientAuthMode(row.ClientAuthMode),
+		RotationMode:            rotation.Mode,
+		RotationIntervalSeconds: rotation.IntervalSeconds,
+		RotationRequests:        rotation.Requests,
+		ParentProxyProtocol:     row.ParentProtocol,
+		ParentProxyHost:         row.ParentHost,
+		ParentProxyPort:         row.ParentPort,
+		ParentProxyUsername:     row.ParentUsername,
+		ParentProxyPassword:     row.ParentPassword,
+		AllowedDestinations:     row.AllowedDestinations.Clone(),
+		BlockedDestinations:     row.BlockedDestinations.Clone(),
+		MaxTunnels:              row.MaxTunnels,
+		ConnectionsPerSecond:    row.ConnectionsPerSecond,
+		RequestsPerSecond:       row.RequestsPerSecond,
+		LimitScope:              normalizeRotatorLimitScope(row.LimitScope),
+		StripRequestHeaders:     row.StripRequestHeaders.Clone(),
+		InjectRequestHeaders:    row.InjectRequestHeaders.Clone(),
+		UpstreamIDHeader:        row.UpstreamIDHeader,
+		PinnedProxyIDs:          attributes.ProxyIDs,
+		FallbackTiers:           newRotatingProxyTierDTOs(row.FallbackTiers),
+		UpstreamTierHeader:      row.UpstreamTierHeader,
+		ReplicaInstanceIDs:      row.ReplicaInstanceIDs.Clone(),
+		ReplicaRegion:           row.ReplicaRegion,
+		HandshakeTimeoutMS:      row.HandshakeTimeoutMS,
+		UpstreamTimeoutMS:       row.UpstreamTimeoutMS,
+		DNSMode:                 normalizeRotatorDNSMode(row.DNSMode),
+		FailoverRetries:         row.FailoverRetries,
+		FailoverCooldownSeconds: row.FailoverCooldownSeconds,
+		CreatedAt:               row.CreatedAt,
+	}
+}
+
 func DeleteRotatingProxy(userID uint, rotatingProxyID uint64) error {
 	if DB == nil {
 		return fmt.Errorf("rotating proxy: database connection was not initialised")
@@ -304,6 +598,10 @@ func DeleteRotatingProxy(userID uint, rotatingProxyID uint64) error {
 }
 
 func GetNextRotatingProxy(userID uint, rotatingProxyID uint64) (*dto.RotatingProxyNext, error) {
+	return GetNextRotatingProxyWithSelection(userID, rotatingProxyID, RotatingProxySelection{})
+}
+
+func GetNextRotatingProxyWithSelection(userID uint, rotatingProxyID uint64, selection RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 	if DB == nil {
 		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
 	}
@@ -323,9 +621,19 @@ func GetNextRotatingProxy(userID uint, rotatingProxyID uint64) (*dto.RotatingPro
 			return err
 		}
 
-		labels := sanitizeRotatorReputationLabels(entity.ReputationLabels.Clone())
 		uptimeFilterType, uptimePercentage := normalizeRotatorUptimeFilter(entity.UptimeFilterType, entity.UptimePercentage)
-		selected, err := nextAliveProxyForProtocol(tx, userID, entity.ProtocolID, labels, uptimeFilterType, uptimePercentage, entity.LastProxyID)
+		strategy := normalizeRotatorSelectionStrategy(entity.SelectionStrategy)
+		var selected *domain.Proxy
+		var selectedTier int
+		var err error
+		for tier, filters := range rotatorTiersOf(entity) {
+			cacheKey := rankedCandidatesKey{rotatorID: entity.ID, tier: tier, updatedAt: entity.UpdatedAt}
+			selected, err = nextAliveProxyForProtocol(tx, userID, entity.ProtocolID, filters.Labels, uptimeFilterType, uptimePercentage, filters.Attributes, strategy, selection, entity.LastProxyID, cacheKey)
+			if !errors.Is(err, ErrRotatingProxyNoAliveProxies) {
+				selectedTier = tier
+				break
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -339,19 +647,12 @@ func GetNextRotatingProxy(userID uint, rotatingProxyID uint64) (*dto.RotatingPro
 
 		if err := tx.Model(&domain.RotatingProxy{}).
 			Where("id = ?", entity.ID).
-			Updates(updatePayload).Error; err != nil {
+			UpdateColumns(updatePayload).Error; err != nil {
 			return err
 		}
 
-		result = &dto.RotatingProxyNext{
-			ProxyID:  selected.ID,
-			IP:       selected.GetIp(),
-			Port:     selected.Port,
-			Username: selected.Username,
-			Password: selected.Password,
-			HasAuth:  selected.HasAuth(),
-			Protocol: entity.Protocol.Name,
-		}
+		result = newRotatingProxyNext(selected, entity.Protocol.Name)
+		result.Tier = selectedTier
 
 		return nil
 	})
@@ -363,15 +664,65 @@ func GetNextRotatingProxy(userID uint, rotatingProxyID uint64) (*dto.RotatingPro
 	return result, nil
 }
 
-func getAliveProxiesCached(userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64, cache map[string][]domain.Proxy) ([]domain.Proxy, error) {
+// LoadRotatingProxyCandidates returns every upstream the rotator may currently
+// serve, without taking a lock on the rotator row. Callers cache the result
+// and pick locally with FirstRotatingProxyTier and PickRotatingProxyCandidate.
+func LoadRotatingProxyCandidates(rotator domain.RotatingProxy) ([]RotatingProxyCandidate, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	uptimeFilterType, uptimePercentage := normalizeRotatorUptimeFilter(rotator.UptimeFilterType, rotator.UptimePercentage)
+	tiers := rotatorTiersOf(rotator)
+	perTier := make([][]RotatingProxyCandidate, 0, len(tiers))
+	for _, tier := range tiers {
+		query := buildAliveProxyQuery(DB, rotator.UserID, rotator.ProtocolID, tier.Labels, uptimeFilterType, uptimePercentage, tier.Attributes)
+		candidates, err := loadRotatingProxyCandidates(query, DB, rotator.ProtocolID)
+		if err != nil {
+			return nil, err
+		}
+		perTier = append(perTier, candidates)
+	}
+	return mergeRotatorTierCandidates(perTier), nil
+}
+
+// RecordRotatingProxyRotation stores the last served upstream of a rotator
+// whose rotation state is kept in memory. updated_at is left alone because it
+// tracks configuration changes for rotatingproxy.Manager.
+func RecordRotatingProxyRotation(rotatorID uint64, proxyID uint64, rotatedAt time.Time) error {
+	if DB == nil {
+		return fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	return DB.Model(&domain.RotatingProxy{}).
+		Where("id = ?", rotatorID).
+		UpdateColumns(map[string]interface{}{
+			"last_proxy_id":    proxyID,
+			"last_rotation_at": rotatedAt,
+		}).Error
+}
+
+func newRotatingProxyNext(proxy *domain.Proxy, protocol string) *dto.RotatingProxyNext {
+	return &dto.RotatingProxyNext{
+		ProxyID:  proxy.ID,
+		IP:       proxy.GetIp(),
+		Port:     proxy.Port,
+		Username: proxy.Username,
+		Password: proxy.Password,
+		HasAuth:  proxy.HasAuth(),
+		Protocol: protocol,
+	}
+}
+
+func getAliveProxiesCached(userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64, attributes rotatorAttributeFilters, cache map[string][]domain.Proxy) ([]domain.Proxy, error) {
 	normLabels := sanitizeRotatorReputationLabels(labels)
-	cacheKey := buildAliveProxyCacheKey(protocolID, normLabels, uptimeFilterType, uptimePercentage)
+	cacheKey := buildAliveProxyCacheKey(protocolID, normLabels, uptimeFilterType, uptimePercentage, attributes)
 
 	if proxies, ok := cache[cacheKey]; ok {
 		return proxies, nil
 	}
 
-	proxies, err := aliveProxiesForProtocol(DB, userID, protocolID, normLabels, uptimeFilterType, uptimePercentage)
+	proxies, err := aliveProxiesForProtocol(DB, userID, protocolID, normLabels, uptimeFilterType, uptimePercentage, attributes)
 	if err != nil {
 		return nil, err
 	}
@@ -399,8 +750,8 @@ func getProxyAddressCached(userID uint, proxyID uint64, cache map[uint64]string)
 	return address, nil
 }
 
-func aliveProxiesForProtocol(tx *gorm.DB, userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64) ([]domain.Proxy, error) {
-	query := buildAliveProxyQuery(tx, userID, protocolID, labels, uptimeFilterType, uptimePercentage)
+func aliveProxiesForProtocol(tx *gorm.DB, userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64, attributes rotatorAttributeFilters) ([]domain.Proxy, error) {
+	query := buildAliveProxyQuery(tx, userID, protocolID, labels, uptimeFilterType, uptimePercentage, attributes)
 
 	var proxies []domain.Proxy
 	err := query.
@@ -413,7 +764,7 @@ func aliveProxiesForProtocol(tx *gorm.DB, userID uint, protocolID int, labels []
 	return proxies, nil
 }
 
-func buildAliveProxyQuery(tx *gorm.DB, userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64) *gorm.DB {
+func buildAliveProxyQuery(tx *gorm.DB, userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64, attributes rotatorAttributeFilters) *gorm.DB {
 	filterLabels := sanitizeRotatorReputationLabels(labels)
 
 	query := tx.
@@ -424,12 +775,39 @@ func buildAliveProxyQuery(tx *gorm.DB, userID uint, protocolID int, labels []str
 
 	query = applyReputationFilter(query, filterLabels)
 	query = applyUptimeFilter(query, tx, protocolID, uptimeFilterType, uptimePercentage)
+	query = applyRotatorAttributeFilters(query, attributes)
 	return query
 }
 
-func nextAliveProxyForProtocol(tx *gorm.DB, userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64, lastProxyID *uint64) (*domain.Proxy, error) {
-	baseQuery := buildAliveProxyQuery(tx, userID, protocolID, labels, uptimeFilterType, uptimePercentage)
+func nextAliveProxyForProtocol(tx *gorm.DB, userID uint, protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64, attributes rotatorAttributeFilters, strategy string, selection RotatingProxySelection, lastProxyID *uint64, cacheKey rankedCandidatesKey) (*domain.Proxy, error) {
+	baseQuery := buildAliveProxyQuery(tx, userID, protocolID, labels, uptimeFilterType, uptimePercentage, attributes)
+
+	if strategy != RotatingProxyStrategyRoundRobin {
+		// The ranking strategies need every candidate, so the tier is loaded
+		// once and cached; the selection is applied in memory.
+		candidates, err := rankedCandidates.load(cacheKey, time.Now(), func() ([]RotatingProxyCandidate, error) {
+			return loadRotatingProxyCandidates(baseQuery, tx, protocolID)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !selection.IsEmpty() {
+			filtered := make([]RotatingProxyCandidate, 0, len(candidates))
+			for idx := range candidates {
+				if selection.Matches(&candidates[idx].Proxy) {
+					filtered = append(filtered, candidates[idx])
+				}
+			}
+			candidates = filtered
+		}
+		picked, ok := PickRotatingProxyCandidate(strategy, candidates, lastProxyID, selection.ActiveConnections)
+		if !ok {
+			return nil, ErrRotatingProxyNoAliveProxies
+		}
+		return &picked.Proxy, nil
+	}
 
+	baseQuery = applyRotatingProxySelection(baseQuery, selection)
 	if lastProxyID != nil {
 		nextAfterCursor, err := fetchAliveProxyCandidate(baseQuery, *lastProxyID, true)
 		if err == nil {
@@ -464,6 +842,46 @@ func fetchAliveProxyCandidate(baseQuery *gorm.DB, cursorProxyID uint64, applyCur
 	return &proxy, nil
 }
 
+func applyRotatingProxySelection(query *gorm.DB, selection RotatingProxySelection) *gorm.DB {
+	if countries := support.CountryMatchValues(selection.Country); len(countries) > 0 {
+		query = query.Where("LOWER(proxies.country) IN ?", countries)
+	}
+	if proxyType := strings.ToLower(strings.TrimSpace(selection.Type)); proxyType != "" {
+		query = query.Where("LOWER(proxies.estimated_type) = ?", proxyType)
+	}
+	if len(selection.ExcludeProxyIDs) > 0 {
+		query = query.Where("proxies.id NOT IN ?", selection.ExcludeProxyIDs)
+	}
+	return query
+}
+
+func applyRotatorAttributeFilters(query *gorm.DB, filters rotatorAttributeFilters) *gorm.DB {
+	if len(filters.Countries) > 0 {
+		countries := make([]string, 0, len(filters.Countries))
+		for _, country := range filters.Countries {
+			countries = append(countries, support.CountryMatchValues(country)...)
+		}
+		query = query.Where("LOWER(proxies.country) IN ?", countries)
+	}
+
+	if len(filters.Types) > 0 {
+		query = query.Where("LOWER(proxies.estimated_type) IN ?", filters.Types)
+	}
+
+	if len(filters.AnonymityLevels) > 0 {
+		query = query.
+			Joins("JOIN proxy_statistics pls_stat ON pls_stat.id = pls.statistic_id").
+			Joins("JOIN anonymity_levels al ON al.id = pls_stat.level_id").
+			Where("LOWER(al.name) IN ?", filters.AnonymityLevels)
+	}
+
+	if len(filters.ProxyIDs) > 0 {
+		query = query.Where("proxies.id IN ?", filters.ProxyIDs)
+	}
+
+	return query
+}
+
 func applyReputationFilter(query *gorm.DB, labels []string) *gorm.DB {
 	if !shouldApplyReputationFilter(labels) {
 		return query
@@ -544,7 +962,9 @@ func isUniqueConstraintError(err error) bool {
 	return strings.Contains(strings.ToLower(err.Error()), "duplicate key value violates unique constraint")
 }
 
-func allocateListenPort(tx *gorm.DB, instanceID string) (uint16, error) {
+// allocateListenPort picks a random free port of the configured range that
+// is not taken on any instance of the placement.
+func allocateListenPort(tx *gorm.DB, placement RotatingProxyPlacement) (uint16, error) {
 	start, end := support.GetRotatingProxyPortRange()
 	if start <= 0 || end <= 0 {
 		return 0, ErrRotatingProxyPortExhausted
@@ -566,13 +986,11 @@ func allocateListenPort(tx *gorm.DB, instanceID string) (uint16, error) {
 	})
 
 	for _, port := range ports {
-		var existing int64
-		if err := tx.Model(&domain.RotatingProxy{}).
-			Where("instance_id = ? AND listen_port = ?", instanceID, port).
-			Count(&existing).Error; err != nil {
+		taken, err := rotatorListenPortTaken(tx, placement, uint16(port), 0)
+		if err != nil {
 			return 0, err
 		}
-		if existing == 0 {
+		if !taken {
 			return uint16(port), nil
 		}
 	}
@@ -652,7 +1070,7 @@ func normalizeRotatorUptimeFilter(rawType string, rawPercentage *float64) (strin
 	return filterType, new(math.Round(value*10) / 10)
 }
 
-func buildAliveProxyCacheKey(protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64) string {
+func buildAliveProxyCacheKey(protocolID int, labels []string, uptimeFilterType string, uptimePercentage *float64, attributes rotatorAttributeFilters) string {
 	labelKey := "*"
 	if len(labels) > 0 {
 		labelKey = strings.Join(labels, ",")
@@ -664,7 +1082,7 @@ func buildAliveProxyCacheKey(protocolID int, labels []string, uptimeFilterType s
 		uptimeKey = fmt.Sprintf("%s:%0.1f", uptimeType, *uptimeValue)
 	}
 
-	return fmt.Sprintf("%d:%s:%s", protocolID, labelKey, uptimeKey)
+	return fmt.Sprintf("%d:%s:%s:%s", protocolID, labelKey, uptimeKey, attributes.cacheKey())
 }
 
 func cloneFloat64Ptr(value *float64) *float64 {
@@ -674,6 +1092,9 @@ func cloneFloat64Ptr(value *float64) *float64 {
 	return new(*value)
 }
 
+// GetAllRotatingProxies loads the rotators of this instance together with
+// every replicated rotator; callers keep the replicas whose placement
+// includes this instance.
 func GetAllRotatingProxies() ([]domain.RotatingProxy, error) {
 	if DB == nil {
 		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
@@ -685,7 +1106,8 @@ func GetAllRotatingProxies() ([]domain.RotatingProxy, error) {
 	if err := DB.
 		Preload("Protocol").
 		Preload("ListenProtocol").
-		Where("instance_id = ?", instanceID).
+		Preload("Credentials").
+		Where("instance_id = ? OR replicated = ?", instanceID, true).
 		Order("created_at ASC").
 		Find(&proxies).Error; err != nil {
 		return nil, err
@@ -756,7 +1178,8 @@ func GetRotatingProxyByID(rotatorID uint64) (*domain.RotatingProxy, error) {
 	if err := DB.
 		Preload("Protocol").
 		Preload("ListenProtocol").
-		Where("id = ? AND instance_id = ?", rotatorID, instanceID).
+		Preload("Credentials").
+		Where("id = ? AND (instance_id = ? OR replicated = ?)", rotatorID, instanceID, true).
 		First(&proxy).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrRotatingProxyNotFound
@@ -769,6 +1192,20 @@ func GetRotatingProxyByID(rotatorID uint64) (*domain.RotatingProxy, error) {
 	return &proxy, nil
 }
 
+// validateRotatorListenTransport rejects TLS listeners for SOCKS rotators;
+// only HTTP proxy clients support TLS to the proxy.
+func validateRotatorListenTransport(listenProtocolName, listenTransportProtocol string) error {
+	if listenTransportProtocol != support.TransportTLS {
+		return nil
+	}
+	switch strings.ToLower(strings.TrimSpace(listenProtocolName)) {
+	case "http", "https":
+		return nil
+	default:
+		return ErrRotatingProxyTLSListenInvalid
+	}
+}
+
 func normalizeRotatingProxyProtocols(rotator *domain.RotatingProxy) {
 	if rotator == nil {
 		return
@@ -783,7 +1220,7 @@ func normalizeRotatingProxyProtocols(rotator *domain.RotatingProxy) {
 	}
 
 	transportProtocol := support.NormalizeTransportProtocol(rotator.TransportProtocol)
-	listenTransportProtocol := support.NormalizeTransportProtocol(rotator.ListenTransportProtocol)
+	listenTransportProtocol := support.NormalizeListenTransportProtocol(rotator.ListenTransportProtocol)
 	if strings.TrimSpace(rotator.ListenTransportProtocol) == "" {
 		listenTransportProtocol = transportProtocol
 	}
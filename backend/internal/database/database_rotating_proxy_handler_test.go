@@ -44,6 +44,10 @@ func setupRotatingProxyTestDBWithDSN(t *testing.T, dsn string) *gorm.DB {
 		&domain.UserProxy{},
 		&domain.ProxyReputation{},
 		&domain.RotatingProxy{},
+		&domain.RotatingProxyCredential{},
+		&domain.RotatingProxyUsage{},
+		&domain.ProxyTrafficStat{},
+		&domain.AnonymityLevel{},
 		&domain.ProxyStatistic{},
 		&domain.ProxyLatestStatistic{},
 		&domain.ProxyOverallStatus{},
@@ -295,6 +299,53 @@ func TestCreateRotatingProxy_UptimeFilterValidation(t *testing.T) {
 	}
 }
 
+func TestCreateRotatingProxy_TLSListenTransport(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{
+		Email:          "tls-listen@example.com",
+		Password:       "password123",
+		HTTPProtocol:   true,
+		SOCKS5Protocol: true,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	for _, name := range []string{"http", "socks5"} {
+		if err := db.Create(&domain.Protocol{Name: name}).Error; err != nil {
+			t.Fatalf("create %s protocol: %v", name, err)
+		}
+	}
+
+	_, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:                    "tls-socks",
+		Protocol:                "socks5",
+		ListenTransportProtocol: "tls",
+	})
+	if !errors.Is(err, ErrRotatingProxyTLSListenInvalid) {
+		t.Fatalf("socks5 over tls: expected %v, got %v", ErrRotatingProxyTLSListenInvalid, err)
+	}
+
+	created, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:                    "tls-http",
+		Protocol:                "socks5",
+		ListenProtocol:          "http",
+		ListenTransportProtocol: "TLS",
+	})
+	if err != nil {
+		t.Fatalf("create tls rotator: %v", err)
+	}
+	if created.ListenTransportProtocol != "tls" || created.TransportProtocol != "tcp" {
+		t.Fatalf("transports = %q/%q, want tls listener with tcp upstreams", created.ListenTransportProtocol, created.TransportProtocol)
+	}
+
+	socks := "socks5"
+	_, err = UpdateRotatingProxy(user.ID, created.ID, dto.RotatingProxyUpdateRequest{ListenProtocol: &socks})
+	if !errors.Is(err, ErrRotatingProxyTLSListenInvalid) {
+		t.Fatalf("switch tls rotator to socks5: expected %v, got %v", ErrRotatingProxyTLSListenInvalid, err)
+	}
+}
+
 func TestGetNextRotatingProxy_RotatesAcrossAliveProxies(t *testing.T) {
 	db := setupRotatingProxyTestDB(t)
 
@@ -710,6 +761,310 @@ func TestGetNextRotatingProxy_UptimeFilterApplied(t *testing.T) {
 	}
 }
 
+func TestGetNextRotatingProxyWithSelection_NarrowsByCountryAndType(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{
+		Email:        "selection@example.com",
+		Password:     "password123",
+		HTTPProtocol: true,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+
+	judge := domain.Judge{FullString: "http://judge-selection.example.com"}
+	if err := db.Create(&judge).Error; err != nil {
+		t.Fatalf("create judge: %v", err)
+	}
+
+	proxies := []domain.Proxy{
+		{IP: "10.0.3.10", Port: 9200, Country: "United States", EstimatedType: "Residential"},
+		{IP: "10.0.3.11", Port: 9201, Country: "Germany", EstimatedType: "Residential"},
+		{IP: "10.0.3.12", Port: 9202, Country: "United States", EstimatedType: "Datacenter"},
+	}
+	for idx := range proxies {
+		if err := db.Create(&proxies[idx]).Error; err != nil {
+			t.Fatalf("create proxy %d: %v", idx, err)
+		}
+		if err := db.Create(&domain.UserProxy{
+			UserID:  user.ID,
+			ProxyID: proxies[idx].ID,
+		}).Error; err != nil {
+			t.Fatalf("link proxy %d: %v", idx, err)
+		}
+		stat := domain.ProxyStatistic{
+			Alive:        true,
+			ResponseTime: 150,
+			Attempt:      1,
+			ProtocolID:   protocol.ID,
+			ProxyID:      proxies[idx].ID,
+			JudgeID:      judge.ID,
+			CreatedAt:    time.Unix(int64(idx+1), 0),
+		}
+		if err := db.Create(&stat).Error; err != nil {
+			t.Fatalf("create statistic %d: %v", idx, err)
+		}
+		if err := updateProxyStatusCaches(db, []domain.ProxyStatistic{stat}); err != nil {
+			t.Fatalf("update proxy status cache %d: %v", idx, err)
+		}
+	}
+
+	rotator := domain.RotatingProxy{
+		UserID:     user.ID,
+		Name:       "selection-rotator",
+		ProtocolID: protocol.ID,
+		ListenPort: 10950,
+	}
+	if err := db.Create(&rotator).Error; err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		next, err := GetNextRotatingProxyWithSelection(user.ID, rotator.ID, RotatingProxySelection{Country: "US", Type: "residential"})
+		if err != nil {
+			t.Fatalf("selection attempt %d: %v", attempt, err)
+		}
+		if next.ProxyID != proxies[0].ID {
+			t.Fatalf("selection attempt %d proxy id = %d, want %d", attempt, next.ProxyID, proxies[0].ID)
+		}
+	}
+
+	germany, err := GetNextRotatingProxyWithSelection(user.ID, rotator.ID, RotatingProxySelection{Country: "germany"})
+	if err != nil {
+		t.Fatalf("country name selection: %v", err)
+	}
+	if germany.ProxyID != proxies[1].ID {
+		t.Fatalf("country name selection proxy id = %d, want %d", germany.ProxyID, proxies[1].ID)
+	}
+
+	if _, err := GetNextRotatingProxyWithSelection(user.ID, rotator.ID, RotatingProxySelection{Country: "FR"}); !errors.Is(err, ErrRotatingProxyNoAliveProxies) {
+		t.Fatalf("expected ErrRotatingProxyNoAliveProxies for empty selection pool, got %v", err)
+	}
+
+	// Ranking strategies apply the selection to their cached candidates.
+	ranked := domain.RotatingProxy{
+		UserID:            user.ID,
+		Name:              "selection-ranked-rotator",
+		ProtocolID:        protocol.ID,
+		ListenPort:        10951,
+		SelectionStrategy: RotatingProxyStrategyLowestLatency,
+	}
+	if err := db.Create(&ranked).Error; err != nil {
+		t.Fatalf("create ranked rotating proxy: %v", err)
+	}
+	for _, want := range []uint64{proxies[0].ID, proxies[2].ID} {
+		next, err := GetNextRotatingProxyWithSelection(user.ID, ranked.ID, RotatingProxySelection{Country: "US"})
+		if err != nil {
+			t.Fatalf("ranked selection: %v", err)
+		}
+		if next.ProxyID != want {
+			t.Fatalf("ranked selection proxy id = %d, want %d", next.ProxyID, want)
+		}
+	}
+	if _, err := GetNextRotatingProxyWithSelection(user.ID, ranked.ID, RotatingProxySelection{Country: "FR"}); !errors.Is(err, ErrRotatingProxyNoAliveProxies) {
+		t.Fatalf("expected ErrRotatingProxyNoAliveProxies for empty ranked selection, got %v", err)
+	}
+}
+
+func TestCreateRotatingProxy_AppliesAttributeFilters(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{
+		Email:        "attributes@example.com",
+		Password:     "password123",
+		HTTPProtocol: true,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+
+	judge := domain.Judge{FullString: "http://judge-attributes.example.com"}
+	if err := db.Create(&judge).Error; err != nil {
+		t.Fatalf("create judge: %v", err)
+	}
+
+	elite := domain.AnonymityLevel{Name: "elite"}
+	transparent := domain.AnonymityLevel{Name: "transparent"}
+	if err := db.Create(&elite).Error; err != nil {
+		t.Fatalf("create elite level: %v", err)
+	}
+	if err := db.Create(&transparent).Error; err != nil {
+		t.Fatalf("create transparent level: %v", err)
+	}
+
+	type seed struct {
+		proxy domain.Proxy
+		level int
+	}
+	seeds := []seed{
+		{proxy: domain.Proxy{IP: "10.0.5.10", Port: 9400, Country: "Germany", EstimatedType: "Residential"}, level: elite.ID},
+		{proxy: domain.Proxy{IP: "10.0.5.11", Port: 9401, Country: "Germany", EstimatedType: "Residential"}, level: transparent.ID},
+		{proxy: domain.Proxy{IP: "10.0.5.12", Port: 9402, Country: "Germany", EstimatedType: "Datacenter"}, level: elite.ID},
+		{proxy: domain.Proxy{IP: "10.0.5.13", Port: 9403, Country: "France", EstimatedType: "Residential"}, level: elite.ID},
+	}
+	for idx := range seeds {
+		if err := db.Create(&seeds[idx].proxy).Error; err != nil {
+			t.Fatalf("create proxy %d: %v", idx, err)
+		}
+		if err := db.Create(&domain.UserProxy{UserID: user.ID, ProxyID: seeds[idx].proxy.ID}).Error; err != nil {
+			t.Fatalf("link proxy %d: %v", idx, err)
+		}
+		stat := domain.ProxyStatistic{
+			Alive:        true,
+			Attempt:      1,
+			ResponseTime: 120,
+			ProtocolID:   protocol.ID,
+			LevelID:      &seeds[idx].level,
+			ProxyID:      seeds[idx].proxy.ID,
+			JudgeID:      judge.ID,
+			CreatedAt:    time.Unix(int64(idx+1), 0),
+		}
+		if err := db.Create(&stat).Error; err != nil {
+			t.Fatalf("create statistic %d: %v", idx, err)
+		}
+		if err := updateProxyStatusCaches(db, []domain.ProxyStatistic{stat}); err != nil {
+			t.Fatalf("update proxy status cache %d: %v", idx, err)
+		}
+	}
+
+	created, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:            "elite-residential-de",
+		Protocol:        "http",
+		Countries:       []string{"DE"},
+		Types:           []string{"Residential"},
+		AnonymityLevels: []string{"Elite"},
+	})
+	if err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+	if created.AliveProxyCount != 1 {
+		t.Fatalf("alive proxy count = %d, want 1", created.AliveProxyCount)
+	}
+	if len(created.Types) != 1 || created.Types[0] != "residential" {
+		t.Fatalf("types = %v, want [residential]", created.Types)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		next, err := GetNextRotatingProxy(user.ID, created.ID)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", attempt, err)
+		}
+		if next.ProxyID != seeds[0].proxy.ID {
+			t.Fatalf("attempt %d proxy id = %d, want %d", attempt, next.ProxyID, seeds[0].proxy.ID)
+		}
+	}
+
+	listed, err := ListRotatingProxies(user.ID)
+	if err != nil {
+		t.Fatalf("list rotating proxies: %v", err)
+	}
+	if len(listed) != 1 || listed[0].AliveProxyCount != 1 {
+		t.Fatalf("listed rotators = %+v, want one rotator with a single alive proxy", listed)
+	}
+
+	_, err = CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:            "invalid-anonymity",
+		Protocol:        "http",
+		AnonymityLevels: []string{"stealth"},
+	})
+	if !errors.Is(err, ErrRotatingProxyAnonymityInvalid) {
+		t.Fatalf("expected ErrRotatingProxyAnonymityInvalid, got %v", err)
+	}
+}
+
+func TestUpdateRotatingProxy_EditsInPlace(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{
+		Email:          "update@example.com",
+		Password:       "password123",
+		HTTPProtocol:   true,
+		SOCKS5Protocol: true,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	for _, name := range []string{"http", "socks5"} {
+		if err := db.Create(&domain.Protocol{Name: name}).Error; err != nil {
+			t.Fatalf("create %s protocol: %v", name, err)
+		}
+	}
+
+	created, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:         "editable",
+		Protocol:     "http",
+		AuthRequired: true,
+		AuthUsername: "rot-user",
+		AuthPassword: "initial-pass",
+	})
+	if err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+
+	updated, err := UpdateRotatingProxy(user.ID, created.ID, dto.RotatingProxyUpdateRequest{
+		Name:               new("renamed"),
+		Countries:          &[]string{"DE"},
+		RegeneratePassword: true,
+	})
+	if err != nil {
+		t.Fatalf("patch rotating proxy: %v", err)
+	}
+	if updated.Name != "renamed" || updated.ListenPort != created.ListenPort || updated.Protocol != "http" {
+		t.Fatalf("patched rotator = %+v, want renamed http rotator on port %d", updated, created.ListenPort)
+	}
+	if updated.AuthPassword == "" || updated.AuthPassword == "initial-pass" {
+		t.Fatalf("password = %q, want a regenerated password", updated.AuthPassword)
+	}
+	if len(updated.Countries) != 1 || updated.Countries[0] != "de" {
+		t.Fatalf("countries = %v, want [de]", updated.Countries)
+	}
+
+	stored, err := GetRotatingProxyByID(created.ID)
+	if err != nil {
+		t.Fatalf("reload rotating proxy: %v", err)
+	}
+	if stored.AuthPassword != updated.AuthPassword || stored.AuthUsername != "rot-user" {
+		t.Fatalf("stored credentials = %q/%q, want rot-user/%q", stored.AuthUsername, stored.AuthPassword, updated.AuthPassword)
+	}
+
+	replaced, err := UpdateRotatingProxy(user.ID, created.ID, dto.RotatingProxyCreateRequest{
+		Name:         "replaced",
+		Protocol:     "socks5",
+		AuthRequired: true,
+		AuthUsername: "other-user",
+	}.UpdateRequest())
+	if err != nil {
+		t.Fatalf("put rotating proxy: %v", err)
+	}
+	if replaced.Protocol != "socks5" || replaced.ListenProtocol != "socks5" {
+		t.Fatalf("protocols = %s/%s, want socks5/socks5", replaced.Protocol, replaced.ListenProtocol)
+	}
+	if replaced.AuthPassword != updated.AuthPassword {
+		t.Fatal("put without a password should keep the stored password")
+	}
+	if len(replaced.Countries) != 0 {
+		t.Fatalf("countries = %v, want filters cleared by put", replaced.Countries)
+	}
+
+	if _, err := UpdateRotatingProxy(user.ID, created.ID, dto.RotatingProxyUpdateRequest{AuthUsername: new("")}); !errors.Is(err, ErrRotatingProxyAuthUsernameNeeded) {
+		t.Fatalf("expected ErrRotatingProxyAuthUsernameNeeded, got %v", err)
+	}
+	if _, err := UpdateRotatingProxy(user.ID+1, created.ID, dto.RotatingProxyUpdateRequest{Name: new("other")}); !errors.Is(err, ErrRotatingProxyNotFound) {
+		t.Fatalf("expected ErrRotatingProxyNotFound for another user, got %v", err)
+	}
+}
+
 func TestGetNextRotatingProxy_ConcurrentStress(t *testing.T) {
 	tempDir := t.TempDir()
 	dsn := fmt.Sprintf(
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"magpie/internal/domain"
+)
+
+const (
+	maxRotatorHeaderRules       = 32
+	maxRotatorHeaderValueLength = 1024
+)
+
+var (
+	rotatorHeaderNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]{1,64}$")
+
+	// Headers net/http or the upstream transport manage cannot be stripped
+	// or injected.
+	rotatorReservedHeaders = map[string]struct{}{
+		"Host":                {},
+		"Content-Length":      {},
+		"Transfer-Encoding":   {},
+		"Connection":          {},
+		"Proxy-Authorization": {},
+	}
+)
+
+// rotatorHeaderRules describe how a rotator rewrites the plain HTTP requests
+// it forwards. Stripped headers are removed before injected ones are set, so
+// an injected header replaces whatever the client sent. UpstreamIDHeader and
+// UpstreamTierHeader name the response headers that report the upstream proxy
+// and the tier it was picked from; empty disables them.
+type rotatorHeaderRules struct {
+	Strip              []string
+	Inject             []string
+	UpstreamIDHeader   string
+	UpstreamTierHeader string
+}
+
+func rotatorHeaderRulesOf(rotator domain.RotatingProxy) rotatorHeaderRules {
+	return rotatorHeaderRules{
+		Strip:              rotator.StripRequestHeaders.Clone(),
+		Inject:             rotator.InjectRequestHeaders.Clone(),
+		UpstreamIDHeader:   rotator.UpstreamIDHeader,
+		UpstreamTierHeader: rotator.UpstreamTierHeader,
+	}
+}
+
+// validateRotatorHeaderRules canonicalises header names and stores injected
+// headers as "Name: value" lines.
+func validateRotatorHeaderRules(rules rotatorHeaderRules) (rotatorHeaderRules, error) {
+	strip := make([]string, 0, len(rules.Strip))
+	seen := make(map[string]struct{}, len(rules.Strip))
+	for _, raw := range rules.Strip {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		name, ok := canonicalRotatorHeaderName(raw)
+		if !ok {
+			return rotatorHeaderRules{}, ErrRotatingProxyHeaderInvalid
+		}
+		if _, dup := seen[name]; dup {
+			continue
+		}
+		seen[name] = struct{}{}
+		strip = append(strip, name)
+	}
+
+	inject := make([]string, 0, len(rules.Inject))
+	for _, raw := range rules.Inject {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		name, value, ok := ParseInjectedHeader(raw)
+		if !ok {
+			return rotatorHeaderRules{}, ErrRotatingProxyHeaderInvalid
+		}
+		inject = append(inject, name+": "+value)
+	}
+	if len(strip) > maxRotatorHeaderRules || len(inject) > maxRotatorHeaderRules {
+		return rotatorHeaderRules{}, ErrRotatingProxyHeaderInvalid
+	}
+
+	upstreamIDHeader, ok := optionalRotatorHeaderName(rules.UpstreamIDHeader)
+	if !ok {
+		return rotatorHeaderRules{}, ErrRotatingProxyHeaderInvalid
+	}
+	upstreamTierHeader, ok := optionalRotatorHeaderName(rules.UpstreamTierHeader)
+	if !ok || (upstreamTierHeader != "" && upstreamTierHeader == upstreamIDHeader) {
+		return rotatorHeaderRules{}, ErrRotatingProxyHeaderInvalid
+	}
+
+	return rotatorHeaderRules{
+		Strip:              strip,
+		Inject:             inject,
+		UpstreamIDHeader:   upstreamIDHeader,
+		UpstreamTierHeader: upstreamTierHeader,
+	}, nil
+}
+
+// ParseInjectedHeader splits a "Name: value" line into the canonical header
+// name and the trimmed value.
+func ParseInjectedHeader(raw string) (string, string, bool) {
+	rawName, value, found := strings.Cut(raw, ":")
+	if !found {
+		return "", "", false
+	}
+	name, ok := canonicalRotatorHeaderName(rawName)
+	if !ok {
+		return "", "", false
+	}
+	value = strings.TrimSpace(value)
+	if len(value) > maxRotatorHeaderValueLength || strings.ContainsAny(value, "\r\n\x00") {
+		return "", "", false
+	}
+	return name, value, true
+}
+
+func optionalRotatorHeaderName(raw string) (string, bool) {
+	if strings.TrimSpace(raw) == "" {
+		return "", true
+	}
+	return canonicalRotatorHeaderName(raw)
+}
+
+func canonicalRotatorHeaderName(raw string) (string, bool) {
+	name := strings.TrimSpace(raw)
+	if !rotatorHeaderNamePattern.MatchString(name) {
+		return "", false
+	}
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	if _, reserved := rotatorReservedHeaders[name]; reserved {
+		return "", false
+	}
+	return name, true
+}
+
+func (r rotatorHeaderRules) apply(entity *domain.RotatingProxy) {
+	entity.StripRequestHeaders = domain.StringList(r.Strip)
+	entity.InjectRequestHeaders = domain.StringList(r.Inject)
+	entity.UpstreamIDHeader = r.UpstreamIDHeader
+	entity.UpstreamTierHeader = r.UpstreamTierHeader
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestValidateRotatorHeaderRules(t *testing.T) {
+	rules, err := validateRotatorHeaderRules(rotatorHeaderRules{
+		Strip:            []string{" via ", "x-forwarded-for", "Via", ""},
+		Inject:           []string{"x-team:  scraping ", "X-Empty:"},
+		UpstreamIDHeader: "x-magpie-upstream-id",
+	})
+	if err != nil {
+		t.Fatalf("validateRotatorHeaderRules: %v", err)
+	}
+	if want := []string{"Via", "X-Forwarded-For"}; !slices.Equal(rules.Strip, want) {
+		t.Fatalf("strip = %v, want %v", rules.Strip, want)
+	}
+	if want := []string{"X-Team: scraping", "X-Empty: "}; !slices.Equal(rules.Inject, want) {
+		t.Fatalf("inject = %v, want %v", rules.Inject, want)
+	}
+	if rules.UpstreamIDHeader != "X-Magpie-Upstream-Id" {
+		t.Fatalf("upstream id header = %q, want X-Magpie-Upstream-Id", rules.UpstreamIDHeader)
+	}
+
+	for _, invalid := range []rotatorHeaderRules{
+		{Strip: []string{"Bad Header"}},
+		{Strip: []string{"host"}},
+		{Inject: []string{"X-Team"}},
+		{Inject: []string{"X-Team: a\r\nX-Evil: b"}},
+		{Inject: []string{"Proxy-Authorization: Basic Zm9v"}},
+		{UpstreamIDHeader: "Content-Length"},
+	} {
+		if _, err := validateRotatorHeaderRules(invalid); !errors.Is(err, ErrRotatingProxyHeaderInvalid) {
+			t.Errorf("%+v: err = %v, want ErrRotatingProxyHeaderInvalid", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"strings"
+
+	"magpie/internal/domain"
+)
+
+const (
+	// RotatingProxyLimitScopeRotator shares the traffic limits between every
+	// client of a rotator.
+	RotatingProxyLimitScopeRotator = "rotator"
+	// RotatingProxyLimitScopeClientIP applies the traffic limits to each
+	// client IP address separately.
+	RotatingProxyLimitScopeClientIP = "client_ip"
+
+	maxRotatorTrafficLimit = 1000000
+)
+
+// rotatorTrafficLimits caps the load a rotator accepts. Zero disables a
+// limit.
+type rotatorTrafficLimits struct {
+	MaxTunnels           int
+	ConnectionsPerSecond int
+	RequestsPerSecond    int
+	Scope                string
+}
+
+func rotatorTrafficLimitsOf(rotator domain.RotatingProxy) rotatorTrafficLimits {
+	return rotatorTrafficLimits{
+		MaxTunnels:           rotator.MaxTunnels,
+		ConnectionsPerSecond: rotator.ConnectionsPerSecond,
+		RequestsPerSecond:    rotator.RequestsPerSecond,
+		Scope:                rotator.LimitScope,
+	}
+}
+
+func validateRotatorTrafficLimits(limits rotatorTrafficLimits) (rotatorTrafficLimits, error) {
+	limits.Scope = strings.ToLower(strings.TrimSpace(limits.Scope))
+	switch limits.Scope {
+	case "":
+		limits.Scope = RotatingProxyLimitScopeRotator
+	case RotatingProxyLimitScopeRotator, RotatingProxyLimitScopeClientIP:
+	default:
+		return rotatorTrafficLimits{}, ErrRotatingProxyLimitScopeInvalid
+	}
+
+	for _, value := range []int{limits.MaxTunnels, limits.ConnectionsPerSecond, limits.RequestsPerSecond} {
+		if value < 0 || value > maxRotatorTrafficLimit {
+			return rotatorTrafficLimits{}, ErrRotatingProxyLimitInvalid
+		}
+	}
+	return limits, nil
+}
+
+func (l rotatorTrafficLimits) apply(entity *domain.RotatingProxy) {
+	entity.MaxTunnels = l.MaxTunnels
+	entity.ConnectionsPerSecond = l.ConnectionsPerSecond
+	entity.RequestsPerSecond = l.RequestsPerSecond
+	entity.LimitScope = l.Scope
+}
+
+func normalizeRotatorLimitScope(raw string) string {
+	if strings.EqualFold(strings.TrimSpace(raw), RotatingProxyLimitScopeClientIP) {
+		return RotatingProxyLimitScopeClientIP
+	}
+	return RotatingProxyLimitScopeRotator
+}
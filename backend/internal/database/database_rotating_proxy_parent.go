@@ -0,0 +1,74 @@
+package database
+
+import (
+	"strings"
+
+	"magpie/internal/domain"
+)
+
+const (
+	maxParentProxyHostLength       = 255
+	maxParentProxyCredentialLength = 255
+)
+
+var rotatorParentProtocolSet = map[string]struct{}{
+	"http":   {},
+	"https":  {},
+	"socks4": {},
+	"socks5": {},
+}
+
+// rotatorParentProxy is the fixed hop a rotator dials its upstreams through.
+// The zero value means upstreams are dialed directly.
+type rotatorParentProxy struct {
+	Protocol string
+	Host     string
+	Port     uint16
+	Username string
+	Password string
+}
+
+func rotatorParentProxyOf(rotator domain.RotatingProxy) rotatorParentProxy {
+	return rotatorParentProxy{
+		Protocol: rotator.ParentProtocol,
+		Host:     rotator.ParentHost,
+		Port:     rotator.ParentPort,
+		Username: rotator.ParentUsername,
+		Password: rotator.ParentPassword,
+	}
+}
+
+// validateRotatorParentProxy normalises a parent hop. An empty host removes
+// the hop together with its other settings.
+func validateRotatorParentProxy(parent rotatorParentProxy) (rotatorParentProxy, error) {
+	parent.Host = strings.TrimSpace(parent.Host)
+	if parent.Host == "" {
+		return rotatorParentProxy{}, nil
+	}
+
+	parent.Protocol = strings.ToLower(strings.TrimSpace(parent.Protocol))
+	if _, ok := rotatorParentProtocolSet[parent.Protocol]; !ok {
+		return rotatorParentProxy{}, ErrRotatingProxyParentInvalid
+	}
+	parent.Host = strings.TrimSuffix(strings.TrimPrefix(parent.Host, "["), "]")
+	if len(parent.Host) > maxParentProxyHostLength || strings.ContainsAny(parent.Host, "/ @") || parent.Port == 0 {
+		return rotatorParentProxy{}, ErrRotatingProxyParentInvalid
+	}
+
+	parent.Username = strings.TrimSpace(parent.Username)
+	if parent.Username == "" {
+		parent.Password = ""
+	}
+	if len(parent.Username) > maxParentProxyCredentialLength || len(parent.Password) > maxParentProxyCredentialLength {
+		return rotatorParentProxy{}, ErrRotatingProxyParentInvalid
+	}
+	return parent, nil
+}
+
+func (p rotatorParentProxy) apply(entity *domain.RotatingProxy) {
+	entity.ParentProtocol = p.Protocol
+	entity.ParentHost = p.Host
+	entity.ParentPort = p.Port
+	entity.ParentUsername = p.Username
+	entity.ParentPassword = p.Password
+}
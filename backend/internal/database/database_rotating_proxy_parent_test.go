@@ -0,0 +1,46 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateRotatorParentProxy(t *testing.T) {
+	tests := []struct {
+		name      string
+		parent    rotatorParentProxy
+		expected  rotatorParentProxy
+		expectErr error
+	}{
+		{
+			name:     "no host removes the hop",
+			parent:   rotatorParentProxy{Protocol: "socks5", Port: 1080, Username: "user", Password: "secret"},
+			expected: rotatorParentProxy{},
+		},
+		{
+			name:     "normalised",
+			parent:   rotatorParentProxy{Protocol: " SOCKS5 ", Host: " egress.internal ", Port: 1080, Username: " user ", Password: "secret"},
+			expected: rotatorParentProxy{Protocol: "socks5", Host: "egress.internal", Port: 1080, Username: "user", Password: "secret"},
+		},
+		{
+			name:     "ipv6 brackets and password without username",
+			parent:   rotatorParentProxy{Protocol: "http", Host: "[2001:db8::1]", Port: 3128, Password: "orphan"},
+			expected: rotatorParentProxy{Protocol: "http", Host: "2001:db8::1", Port: 3128},
+		},
+		{name: "unknown protocol", parent: rotatorParentProxy{Protocol: "ftp", Host: "egress", Port: 21}, expectErr: ErrRotatingProxyParentInvalid},
+		{name: "missing port", parent: rotatorParentProxy{Protocol: "http", Host: "egress"}, expectErr: ErrRotatingProxyParentInvalid},
+		{name: "url instead of host", parent: rotatorParentProxy{Protocol: "http", Host: "http://egress", Port: 80}, expectErr: ErrRotatingProxyParentInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, err := validateRotatorParentProxy(tt.parent)
+			if !errors.Is(err, tt.expectErr) {
+				t.Fatalf("err = %v, want %v", err, tt.expectErr)
+			}
+			if parent != tt.expected {
+				t.Fatalf("parent = %+v, want %+v", parent, tt.expected)
+			}
+		})
+	}
+}
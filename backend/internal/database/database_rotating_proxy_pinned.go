@@ -0,0 +1,118 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"magpie/internal/domain"
+
+	"gorm.io/gorm"
+)
+
+const maxRotatorPinnedProxies = 1000
+
+var (
+	ErrRotatingProxyPinnedProxyInvalid = errors.New("pinned proxies must be up to 1000 proxies of your own pool")
+	ErrRotatingProxyPinnedProxyLast    = errors.New("the last pinned proxy cannot be removed; clear pinned_proxy_ids to unpin the rotator")
+	ErrRotatingProxyNotPinned          = errors.New("proxy is not pinned to this rotating proxy")
+)
+
+// validateRotatorPinnedProxies sorts and deduplicates the proxies a rotator is
+// pinned to and checks that each one is in the user's pool. An empty list
+// lets the rotator use the whole pool again.
+func validateRotatorPinnedProxies(tx *gorm.DB, userID uint, proxyIDs []uint64) ([]uint64, error) {
+	if len(proxyIDs) == 0 {
+		return nil, nil
+	}
+
+	ids := slices.Clone(proxyIDs)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if ids[0] == 0 || len(ids) > maxRotatorPinnedProxies {
+		return nil, ErrRotatingProxyPinnedProxyInvalid
+	}
+
+	var owned int64
+	if err := tx.Model(&domain.UserProxy{}).
+		Where("user_id = ? AND proxy_id IN ?", userID, ids).
+		Count(&owned).Error; err != nil {
+		return nil, err
+	}
+	if owned != int64(len(ids)) {
+		return nil, ErrRotatingProxyPinnedProxyInvalid
+	}
+	return ids, nil
+}
+
+// AddRotatingProxyPinnedProxies pins further proxies to a rotator and returns
+// the resulting set.
+func AddRotatingProxyPinnedProxies(userID uint, rotatingProxyID uint64, proxyIDs []uint64) ([]uint64, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+	if len(proxyIDs) == 0 {
+		return nil, ErrRotatingProxyPinnedProxyInvalid
+	}
+
+	var result []uint64
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		rotator, err := lockRotatingProxy(tx, userID, rotatingProxyID)
+		if err != nil {
+			return err
+		}
+
+		pinned, err := validateRotatorPinnedProxies(tx, userID, append(rotator.PinnedProxyIDs.Clone(), proxyIDs...))
+		if err != nil {
+			return err
+		}
+		if err := storeRotatorPinnedProxies(tx, rotator.ID, pinned); err != nil {
+			return err
+		}
+
+		result = pinned
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RemoveRotatingProxyPinnedProxy unpins a single proxy from a rotator. The
+// last pinned proxy is kept so a rotator never silently widens to the whole
+// pool; clearing pinned_proxy_ids through an update does that explicitly.
+func RemoveRotatingProxyPinnedProxy(userID uint, rotatingProxyID uint64, proxyID uint64) error {
+	if DB == nil {
+		return fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		rotator, err := lockRotatingProxy(tx, userID, rotatingProxyID)
+		if err != nil {
+			return err
+		}
+
+		pinned := rotator.PinnedProxyIDs.Clone()
+		index := slices.Index(pinned, proxyID)
+		if index < 0 {
+			return ErrRotatingProxyNotPinned
+		}
+		if len(pinned) == 1 {
+			return ErrRotatingProxyPinnedProxyLast
+		}
+		return storeRotatorPinnedProxies(tx, rotator.ID, slices.Delete(pinned, index, index+1))
+	})
+}
+
+// storeRotatorPinnedProxies also bumps updated_at so running listeners reload
+// their candidate pool on the next sync.
+func storeRotatorPinnedProxies(tx *gorm.DB, rotatingProxyID uint64, proxyIDs []uint64) error {
+	return tx.Model(&domain.RotatingProxy{}).
+		Where("id = ?", rotatingProxyID).
+		UpdateColumns(map[string]interface{}{
+			"pinned_proxy_ids": domain.IDList(proxyIDs),
+			"updated_at":       time.Now(),
+		}).Error
+}
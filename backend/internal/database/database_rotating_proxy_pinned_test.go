@@ -0,0 +1,140 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+func TestRotatingProxyPinnedProxies_RestrictAndManageMembers(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{Email: "pinned@example.com", Password: "password123", HTTPProtocol: true}
+	other := domain.User{Email: "pinned-other@example.com", Password: "password123", HTTPProtocol: true}
+	for _, u := range []*domain.User{&user, &other} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+	judge := domain.Judge{FullString: "http://judge-pinned.example.com"}
+	if err := db.Create(&judge).Error; err != nil {
+		t.Fatalf("create judge: %v", err)
+	}
+
+	proxies := []domain.Proxy{
+		{IP: "10.0.7.10", Port: 9500},
+		{IP: "10.0.7.11", Port: 9501},
+		{IP: "10.0.7.12", Port: 9502},
+		{IP: "10.0.7.13", Port: 9503},
+	}
+	for idx := range proxies {
+		if err := db.Create(&proxies[idx]).Error; err != nil {
+			t.Fatalf("create proxy %d: %v", idx, err)
+		}
+		if err := db.Create(&domain.UserProxy{UserID: user.ID, ProxyID: proxies[idx].ID}).Error; err != nil {
+			t.Fatalf("link proxy %d: %v", idx, err)
+		}
+		stat := domain.ProxyStatistic{
+			Alive:        idx != 2,
+			Attempt:      1,
+			ResponseTime: 120,
+			ProtocolID:   protocol.ID,
+			ProxyID:      proxies[idx].ID,
+			JudgeID:      judge.ID,
+			CreatedAt:    time.Unix(int64(idx+1), 0),
+		}
+		if err := db.Create(&stat).Error; err != nil {
+			t.Fatalf("create statistic %d: %v", idx, err)
+		}
+		if err := updateProxyStatusCaches(db, []domain.ProxyStatistic{stat}); err != nil {
+			t.Fatalf("update proxy status cache %d: %v", idx, err)
+		}
+	}
+	foreign := domain.Proxy{IP: "10.0.7.20", Port: 9510}
+	if err := db.Create(&foreign).Error; err != nil {
+		t.Fatalf("create foreign proxy: %v", err)
+	}
+	if err := db.Create(&domain.UserProxy{UserID: other.ID, ProxyID: foreign.ID}).Error; err != nil {
+		t.Fatalf("link foreign proxy: %v", err)
+	}
+
+	_, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:           "foreign-pin",
+		Protocol:       "http",
+		PinnedProxyIDs: []uint64{proxies[0].ID, foreign.ID},
+	})
+	if !errors.Is(err, ErrRotatingProxyPinnedProxyInvalid) {
+		t.Fatalf("pinning a foreign proxy: err = %v, want ErrRotatingProxyPinnedProxyInvalid", err)
+	}
+
+	created, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:           "premium",
+		Protocol:       "http",
+		PinnedProxyIDs: []uint64{proxies[2].ID, proxies[0].ID, proxies[0].ID},
+	})
+	if err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+	if want := []uint64{proxies[0].ID, proxies[2].ID}; !slices.Equal(created.PinnedProxyIDs, want) {
+		t.Fatalf("pinned proxy ids = %v, want %v", created.PinnedProxyIDs, want)
+	}
+	if created.AliveProxyCount != 1 {
+		t.Fatalf("alive proxy count = %d, want only the alive pinned proxy", created.AliveProxyCount)
+	}
+
+	pinned, err := AddRotatingProxyPinnedProxies(user.ID, created.ID, []uint64{proxies[1].ID})
+	if err != nil {
+		t.Fatalf("add pinned proxy: %v", err)
+	}
+	if want := []uint64{proxies[0].ID, proxies[1].ID, proxies[2].ID}; !slices.Equal(pinned, want) {
+		t.Fatalf("pinned proxy ids after add = %v, want %v", pinned, want)
+	}
+
+	var rotator domain.RotatingProxy
+	if err := db.First(&rotator, created.ID).Error; err != nil {
+		t.Fatalf("load rotator: %v", err)
+	}
+	candidates, err := LoadRotatingProxyCandidates(rotator)
+	if err != nil {
+		t.Fatalf("load candidates: %v", err)
+	}
+	ids := make([]uint64, 0, len(candidates))
+	for _, candidate := range candidates {
+		ids = append(ids, candidate.Proxy.ID)
+	}
+	if want := []uint64{proxies[0].ID, proxies[1].ID}; !slices.Equal(ids, want) {
+		t.Fatalf("candidate ids = %v, want the alive pinned proxies %v", ids, want)
+	}
+
+	if err := RemoveRotatingProxyPinnedProxy(user.ID, created.ID, proxies[3].ID); !errors.Is(err, ErrRotatingProxyNotPinned) {
+		t.Fatalf("removing an unpinned proxy: err = %v, want ErrRotatingProxyNotPinned", err)
+	}
+	for _, proxy := range proxies[:2] {
+		if err := RemoveRotatingProxyPinnedProxy(user.ID, created.ID, proxy.ID); err != nil {
+			t.Fatalf("remove pinned proxy %d: %v", proxy.ID, err)
+		}
+	}
+	if err := RemoveRotatingProxyPinnedProxy(user.ID, created.ID, proxies[2].ID); !errors.Is(err, ErrRotatingProxyPinnedProxyLast) {
+		t.Fatalf("removing the last pinned proxy: err = %v, want ErrRotatingProxyPinnedProxyLast", err)
+	}
+	if _, err := GetNextRotatingProxy(user.ID, created.ID); !errors.Is(err, ErrRotatingProxyNoAliveProxies) {
+		t.Fatalf("rotating over a dead pinned proxy: err = %v, want ErrRotatingProxyNoAliveProxies", err)
+	}
+
+	updated, err := UpdateRotatingProxy(user.ID, created.ID, dto.RotatingProxyUpdateRequest{PinnedProxyIDs: &[]uint64{}})
+	if err != nil {
+		t.Fatalf("unpin rotator: %v", err)
+	}
+	if len(updated.PinnedProxyIDs) != 0 || updated.AliveProxyCount != 3 {
+		t.Fatalf("unpinned rotator = %v pinned, %d alive, want the whole pool", updated.PinnedProxyIDs, updated.AliveProxyCount)
+	}
+}
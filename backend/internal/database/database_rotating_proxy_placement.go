@@ -0,0 +1,122 @@
+package database
+
+import (
+	"errors"
+	"strings"
+
+	"magpie/internal/domain"
+
+	"gorm.io/gorm"
+)
+
+const (
+	maxRotatorReplicaInstances = 32
+	rotatorInstanceIDMaxLength = 191
+	rotatorRegionMaxLength     = 120
+)
+
+var (
+	ErrRotatingProxyReplicaInvalid   = errors.New("replicas must be up to 32 instance ids and an optional region of at most 120 characters")
+	ErrRotatingProxyReplicaPortTaken = errors.New("the listen port of this rotating proxy is already used by another rotator of the new placement")
+)
+
+// RotatingProxyPlacement is the set of instances a rotator listens on: its
+// own instance, the listed replica instances and every instance of the
+// replica region. All of them share the listen port.
+type RotatingProxyPlacement struct {
+	InstanceID         string
+	ReplicaInstanceIDs []string
+	ReplicaRegion      string
+}
+
+func RotatingProxyPlacementOf(rotator domain.RotatingProxy) RotatingProxyPlacement {
+	return RotatingProxyPlacement{
+		InstanceID:         rotator.InstanceID,
+		ReplicaInstanceIDs: rotator.ReplicaInstanceIDs.Clone(),
+		ReplicaRegion:      rotator.ReplicaRegion,
+	}
+}
+
+// Replicated reports whether the rotator runs on more than its own instance.
+func (p RotatingProxyPlacement) Replicated() bool {
+	return p.ReplicaRegion != "" || len(p.ReplicaInstanceIDs) > 0
+}
+
+// Includes reports whether the instance with the given id and region is part
+// of the placement. Regions compare case-insensitively.
+func (p RotatingProxyPlacement) Includes(instanceID, region string) bool {
+	instanceID = strings.TrimSpace(instanceID)
+	if instanceID == "" {
+		return false
+	}
+	if instanceID == p.InstanceID {
+		return true
+	}
+	for _, id := range p.ReplicaInstanceIDs {
+		if id == instanceID {
+			return true
+		}
+	}
+	return p.ReplicaRegion != "" && strings.EqualFold(p.ReplicaRegion, strings.TrimSpace(region))
+}
+
+// validateRotatorPlacement trims and deduplicates the replica instances and
+// drops the rotator's own instance from them.
+func validateRotatorPlacement(placement RotatingProxyPlacement) (RotatingProxyPlacement, error) {
+	region := strings.TrimSpace(placement.ReplicaRegion)
+	if len(region) > rotatorRegionMaxLength {
+		return RotatingProxyPlacement{}, ErrRotatingProxyReplicaInvalid
+	}
+
+	replicas := make([]string, 0, len(placement.ReplicaInstanceIDs))
+	seen := make(map[string]struct{}, len(placement.ReplicaInstanceIDs))
+	for _, raw := range placement.ReplicaInstanceIDs {
+		id := strings.TrimSpace(raw)
+		if id == "" || id == placement.InstanceID {
+			continue
+		}
+		if len(id) > rotatorInstanceIDMaxLength {
+			return RotatingProxyPlacement{}, ErrRotatingProxyReplicaInvalid
+		}
+		if _, dup := seen[id]; dup {
+			continue
+		}
+		seen[id] = struct{}{}
+		replicas = append(replicas, id)
+	}
+	if len(replicas) > maxRotatorReplicaInstances {
+		return RotatingProxyPlacement{}, ErrRotatingProxyReplicaInvalid
+	}
+
+	return RotatingProxyPlacement{
+		InstanceID:         placement.InstanceID,
+		ReplicaInstanceIDs: replicas,
+		ReplicaRegion:      region,
+	}, nil
+}
+
+func (p RotatingProxyPlacement) apply(entity *domain.RotatingProxy) {
+	entity.ReplicaInstanceIDs = domain.StringList(p.ReplicaInstanceIDs)
+	entity.ReplicaRegion = p.ReplicaRegion
+	entity.Replicated = p.Replicated()
+}
+
+// rotatorListenPortTaken reports whether another rotator could listen on port
+// on an instance of the placement. Replica regions gain members as instances
+// join, so a replicated rotator needs a port no other rotator uses, and every
+// rotator avoids the ports of replicated ones.
+func rotatorListenPortTaken(tx *gorm.DB, placement RotatingProxyPlacement, port uint16, excludeID uint64) (bool, error) {
+	query := tx.Model(&domain.RotatingProxy{}).Where("listen_port = ?", port)
+	if excludeID != 0 {
+		query = query.Where("id <> ?", excludeID)
+	}
+	if !placement.Replicated() {
+		query = query.Where("(instance_id = ? OR replicated = ?)", placement.InstanceID, true)
+	}
+
+	var existing int64
+	if err := query.Count(&existing).Error; err != nil {
+		return false, err
+	}
+	return existing > 0, nil
+}
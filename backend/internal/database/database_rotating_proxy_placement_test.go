@@ -0,0 +1,133 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+func TestValidateRotatorPlacement(t *testing.T) {
+	placement, err := validateRotatorPlacement(RotatingProxyPlacement{
+		InstanceID:         "node-a",
+		ReplicaInstanceIDs: []string{" node-b ", "node-a", "", "node-c", "node-b"},
+		ReplicaRegion:      " eu-west ",
+	})
+	if err != nil {
+		t.Fatalf("validateRotatorPlacement: %v", err)
+	}
+	if want := []string{"node-b", "node-c"}; !slices.Equal(placement.ReplicaInstanceIDs, want) {
+		t.Fatalf("replicas = %v, want %v", placement.ReplicaInstanceIDs, want)
+	}
+	if placement.ReplicaRegion != "eu-west" || !placement.Replicated() {
+		t.Fatalf("placement = %+v, want replicated to eu-west", placement)
+	}
+
+	for name, member := range map[string]bool{"node-a": true, "node-c": true, "node-d": false} {
+		if got := placement.Includes(name, "us-east"); got != member {
+			t.Errorf("Includes(%q, us-east) = %v, want %v", name, got, member)
+		}
+	}
+	if !placement.Includes("node-d", "EU-West") {
+		t.Error("instance of the replica region is not included")
+	}
+
+	tooMany := make([]string, maxRotatorReplicaInstances+1)
+	for idx := range tooMany {
+		tooMany[idx] = "node-" + strings.Repeat("x", idx+1)
+	}
+	for _, invalid := range []RotatingProxyPlacement{
+		{InstanceID: "node-a", ReplicaInstanceIDs: tooMany},
+		{InstanceID: "node-a", ReplicaInstanceIDs: []string{strings.Repeat("n", rotatorInstanceIDMaxLength+1)}},
+		{InstanceID: "node-a", ReplicaRegion: strings.Repeat("r", rotatorRegionMaxLength+1)},
+	} {
+		if _, err := validateRotatorPlacement(invalid); !errors.Is(err, ErrRotatingProxyReplicaInvalid) {
+			t.Errorf("err = %v, want ErrRotatingProxyReplicaInvalid", err)
+		}
+	}
+}
+
+func TestRotatorListenPortTaken_SeparatesReplicatedPorts(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{Email: "replicas@example.com", Password: "password123", HTTPProtocol: true}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+
+	rotators := []domain.RotatingProxy{
+		{UserID: user.ID, Name: "local", InstanceID: "node-a", ProtocolID: protocol.ID, ListenPort: 20001},
+		{UserID: user.ID, Name: "regional", InstanceID: "node-b", ReplicaRegion: "eu-west", ProtocolID: protocol.ID, ListenPort: 20002},
+		{UserID: user.ID, Name: "other", InstanceID: "node-c", ProtocolID: protocol.ID, ListenPort: 20003},
+	}
+	for idx := range rotators {
+		if err := db.Create(&rotators[idx]).Error; err != nil {
+			t.Fatalf("create rotator %q: %v", rotators[idx].Name, err)
+		}
+	}
+	if !rotators[1].Replicated || rotators[0].Replicated {
+		t.Fatalf("replicated flags = %v, %v, want false, true", rotators[0].Replicated, rotators[1].Replicated)
+	}
+
+	single := RotatingProxyPlacement{InstanceID: "node-a"}
+	replicated := RotatingProxyPlacement{InstanceID: "node-d", ReplicaInstanceIDs: []string{"node-e"}}
+	cases := []struct {
+		name      string
+		placement RotatingProxyPlacement
+		port      uint16
+		excludeID uint64
+		want      bool
+	}{
+		{"port of the same instance", single, 20001, 0, true},
+		{"port of a replicated rotator", single, 20002, 0, true},
+		{"port of another instance", single, 20003, 0, false},
+		{"own port on update", single, 20001, rotators[0].ID, false},
+		{"replicated rotator and any used port", replicated, 20003, 0, true},
+		{"replicated rotator and a free port", replicated, 20004, 0, false},
+	}
+	for _, tc := range cases {
+		taken, err := rotatorListenPortTaken(db, tc.placement, tc.port, tc.excludeID)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if taken != tc.want {
+			t.Errorf("%s: taken = %v, want %v", tc.name, taken, tc.want)
+		}
+	}
+
+	loaded, err := GetAllRotatingProxies()
+	if err != nil {
+		t.Fatalf("GetAllRotatingProxies: %v", err)
+	}
+	names := make([]string, 0, len(loaded))
+	for _, rotator := range loaded {
+		names = append(names, rotator.Name)
+	}
+	if !slices.Contains(names, "regional") || slices.Contains(names, "other") {
+		t.Fatalf("loaded rotators = %v, want the replicated one and none of other instances", names)
+	}
+
+	region := "eu-west"
+	_, err = UpdateRotatingProxy(user.ID, rotators[2].ID, dto.RotatingProxyUpdateRequest{ReplicaRegion: &region})
+	if err != nil {
+		t.Fatalf("replicate rotator with a unique port: %v", err)
+	}
+	if err := db.Model(&rotators[0]).Update("listen_port", 20004).Error; err != nil {
+		t.Fatalf("move local rotator: %v", err)
+	}
+	if err := db.Create(&domain.RotatingProxy{UserID: user.ID, Name: "clash", InstanceID: "node-f", ProtocolID: protocol.ID, ListenPort: 20004}).Error; err != nil {
+		t.Fatalf("create clashing rotator: %v", err)
+	}
+	replicas := []string{"node-f"}
+	_, err = UpdateRotatingProxy(user.ID, rotators[0].ID, dto.RotatingProxyUpdateRequest{ReplicaInstanceIDs: &replicas})
+	if !errors.Is(err, ErrRotatingProxyReplicaPortTaken) {
+		t.Fatalf("replicate onto a used port: err = %v, want ErrRotatingProxyReplicaPortTaken", err)
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"magpie/internal/domain"
+)
+
+const (
+	// RotatingProxyRotationPerRequest picks a new upstream for every client
+	// connection and HTTP request.
+	RotatingProxyRotationPerRequest = "per_request"
+	// RotatingProxyRotationInterval keeps the current upstream until the
+	// rotation interval elapsed.
+	RotatingProxyRotationInterval = "interval"
+	// RotatingProxyRotationRequestCount keeps the current upstream for a fixed
+	// number of connections and HTTP requests.
+	RotatingProxyRotationRequestCount = "request_count"
+
+	maxRotationIntervalSeconds = 86400
+	maxRotationRequests        = 1000000
+)
+
+// RotatingProxyRotation describes when a rotator moves on to the next
+// upstream. Settings that do not apply to Mode are zero.
+type RotatingProxyRotation struct {
+	Mode            string
+	IntervalSeconds int
+	Requests        int
+}
+
+// RotatingProxyRotationOf returns the normalised rotation settings of a
+// rotator. Invalid stored settings fall back to per-request rotation.
+func RotatingProxyRotationOf(rotator domain.RotatingProxy) RotatingProxyRotation {
+	rotation, err := validateRotatorRotation(rotator.RotationMode, rotator.RotationIntervalSeconds, rotator.RotationRequests)
+	if err != nil {
+		return RotatingProxyRotation{Mode: RotatingProxyRotationPerRequest}
+	}
+	return rotation
+}
+
+// Interval returns the rotation interval, 0 unless Mode is interval.
+func (r RotatingProxyRotation) Interval() time.Duration {
+	return time.Duration(r.IntervalSeconds) * time.Second
+}
+
+// PerRequest reports whether every connection gets a fresh upstream.
+func (r RotatingProxyRotation) PerRequest() bool {
+	return r.Mode == RotatingProxyRotationPerRequest
+}
+
+func validateRotatorRotation(mode string, intervalSeconds, requests int) (RotatingProxyRotation, error) {
+	rotation := RotatingProxyRotation{Mode: strings.ToLower(strings.TrimSpace(mode))}
+	switch rotation.Mode {
+	case "", RotatingProxyRotationPerRequest:
+		rotation.Mode = RotatingProxyRotationPerRequest
+	case RotatingProxyRotationInterval:
+		if intervalSeconds < 1 || intervalSeconds > maxRotationIntervalSeconds {
+			return RotatingProxyRotation{}, ErrRotatingProxyIntervalInvalid
+		}
+		rotation.IntervalSeconds = intervalSeconds
+	case RotatingProxyRotationRequestCount:
+		if requests < 1 || requests > maxRotationRequests {
+			return RotatingProxyRotation{}, ErrRotatingProxyRequestsInvalid
+		}
+		rotation.Requests = requests
+	default:
+		return RotatingProxyRotation{}, ErrRotatingProxyRotationInvalid
+	}
+	return rotation, nil
+}
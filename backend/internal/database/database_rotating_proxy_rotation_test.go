@@ -0,0 +1,45 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"magpie/internal/domain"
+)
+
+func TestValidateRotatorRotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		interval  int
+		requests  int
+		expected  RotatingProxyRotation
+		expectErr error
+	}{
+		{name: "default", expected: RotatingProxyRotation{Mode: RotatingProxyRotationPerRequest}},
+		{name: "per request ignores counts", mode: "per_request", interval: 30, requests: 5, expected: RotatingProxyRotation{Mode: RotatingProxyRotationPerRequest}},
+		{name: "interval", mode: " Interval ", interval: 300, requests: 5, expected: RotatingProxyRotation{Mode: RotatingProxyRotationInterval, IntervalSeconds: 300}},
+		{name: "request count", mode: "request_count", requests: 10, expected: RotatingProxyRotation{Mode: RotatingProxyRotationRequestCount, Requests: 10}},
+		{name: "interval missing", mode: "interval", expectErr: ErrRotatingProxyIntervalInvalid},
+		{name: "interval too long", mode: "interval", interval: 86401, expectErr: ErrRotatingProxyIntervalInvalid},
+		{name: "requests missing", mode: "request_count", expectErr: ErrRotatingProxyRequestsInvalid},
+		{name: "unknown mode", mode: "hourly", expectErr: ErrRotatingProxyRotationInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotation, err := validateRotatorRotation(tt.mode, tt.interval, tt.requests)
+			if !errors.Is(err, tt.expectErr) {
+				t.Fatalf("err = %v, want %v", err, tt.expectErr)
+			}
+			if rotation != tt.expected {
+				t.Fatalf("rotation = %+v, want %+v", rotation, tt.expected)
+			}
+		})
+	}
+
+	stored := domain.RotatingProxy{RotationMode: "interval"}
+	if rotation := RotatingProxyRotationOf(stored); !rotation.PerRequest() {
+		t.Fatalf("invalid stored rotation = %+v, want per_request", rotation)
+	}
+}
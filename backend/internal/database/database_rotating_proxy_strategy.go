@@ -0,0 +1,243 @@
+package database
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RotatingProxyStrategyRoundRobin         = "round_robin"
+	RotatingProxyStrategyRandom             = "random"
+	RotatingProxyStrategyLowestLatency      = "lowest_latency"
+	RotatingProxyStrategyReputationWeighted = "reputation_weighted"
+	RotatingProxyStrategyLeastConnections   = "least_connections"
+
+	// unscoredReputationWeight is used for proxies that have not been scored
+	// yet so they still receive a neutral share of traffic.
+	unscoredReputationWeight = 50.0
+	minimumReputationWeight  = 1.0
+)
+
+var rotatingProxyStrategySet = map[string]struct{}{
+	RotatingProxyStrategyRoundRobin:         {},
+	RotatingProxyStrategyRandom:             {},
+	RotatingProxyStrategyLowestLatency:      {},
+	RotatingProxyStrategyReputationWeighted: {},
+	RotatingProxyStrategyLeastConnections:   {},
+}
+
+// RotatingProxyCandidate is an alive upstream together with the signals the
+// selection strategies rank on. Tier is the first rotator tier it belongs to.
+type RotatingProxyCandidate struct {
+	Proxy           domain.Proxy
+	ResponseTimeMS  uint16
+	ReputationScore *float64
+	Tier            int
+}
+
+func (c *RotatingProxyCandidate) Next(protocol string) *dto.RotatingProxyNext {
+	next := newRotatingProxyNext(&c.Proxy, protocol)
+	next.Tier = c.Tier
+	return next
+}
+
+type rotatingProxyCandidateSignals struct {
+	ProxyID         uint64   `gorm:"column:proxy_id"`
+	ResponseTime    uint16   `gorm:"column:response_time"`
+	ReputationScore *float64 `gorm:"column:reputation_score"`
+}
+
+func validateRotatorSelectionStrategy(raw string) (string, error) {
+	strategy := strings.ToLower(strings.TrimSpace(raw))
+	if strategy == "" {
+		return RotatingProxyStrategyRoundRobin, nil
+	}
+	if _, ok := rotatingProxyStrategySet[strategy]; !ok {
+		return "", ErrRotatingProxyStrategyInvalid
+	}
+	return strategy, nil
+}
+
+func normalizeRotatorSelectionStrategy(raw string) string {
+	strategy, err := validateRotatorSelectionStrategy(raw)
+	if err != nil {
+		return RotatingProxyStrategyRoundRobin
+	}
+	return strategy
+}
+
+// rankedCandidatesTTL bounds how long the ranking strategies of
+// GetNextRotatingProxyWithSelection reuse a loaded tier.
+const rankedCandidatesTTL = 5 * time.Second
+
+// rankedCandidatesCache keeps the candidates of each rotator tier for the
+// ranking strategies, which would otherwise load every alive upstream on each
+// database selection. Entries expire after rankedCandidatesTTL, once proxy
+// statistics change and when the rotator is edited.
+type rankedCandidatesCache struct {
+	mu      sync.Mutex
+	entries map[rankedCandidatesKey]rankedCandidatesEntry
+}
+
+type rankedCandidatesKey struct {
+	rotatorID uint64
+	tier      int
+	updatedAt time.Time
+}
+
+type rankedCandidatesEntry struct {
+	candidates []RotatingProxyCandidate
+	loadedAt   time.Time
+	version    uint64
+}
+
+var rankedCandidates = &rankedCandidatesCache{entries: make(map[rankedCandidatesKey]rankedCandidatesEntry)}
+
+func (c *rankedCandidatesCache) load(key rankedCandidatesKey, now time.Time, fetch func() ([]RotatingProxyCandidate, error)) ([]RotatingProxyCandidate, error) {
+	version := ProxyStatusVersion()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && entry.version == version && now.Sub(entry.loadedAt) < rankedCandidatesTTL {
+		return entry.candidates, nil
+	}
+
+	candidates, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cached, stale := range c.entries {
+		if now.Sub(stale.loadedAt) >= rankedCandidatesTTL || cached.rotatorID == key.rotatorID && cached.tier == key.tier {
+			delete(c.entries, cached)
+		}
+	}
+	c.entries[key] = rankedCandidatesEntry{candidates: candidates, loadedAt: now, version: version}
+	return candidates, nil
+}
+
+func loadRotatingProxyCandidates(baseQuery *gorm.DB, tx *gorm.DB, protocolID int) ([]RotatingProxyCandidate, error) {
+	var proxies []domain.Proxy
+	if err := baseQuery.Session(&gorm.Session{}).Order("proxies.id").Find(&proxies).Error; err != nil {
+		return nil, err
+	}
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+
+	proxyIDs := make([]uint64, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxyIDs = append(proxyIDs, proxy.ID)
+	}
+
+	var signals []rotatingProxyCandidateSignals
+	if err := tx.
+		Table("proxy_latest_statistics pls").
+		Select("pls.proxy_id AS proxy_id, ps.response_time AS response_time, rep.score AS reputation_score").
+		Joins("LEFT JOIN proxy_statistics ps ON ps.id = pls.statistic_id").
+		Joins("LEFT JOIN proxy_reputations rep ON rep.proxy_id = pls.proxy_id AND rep.kind = ?", domain.ProxyReputationKindOverall).
+		Where("pls.protocol_id = ? AND pls.proxy_id IN ?", protocolID, proxyIDs).
+		Scan(&signals).Error; err != nil {
+		return nil, err
+	}
+
+	signalsByProxy := make(map[uint64]rotatingProxyCandidateSignals, len(signals))
+	for _, signal := range signals {
+		signalsByProxy[signal.ProxyID] = signal
+	}
+
+	candidates := make([]RotatingProxyCandidate, 0, len(proxies))
+	for _, proxy := range proxies {
+		signal := signalsByProxy[proxy.ID]
+		candidates = append(candidates, RotatingProxyCandidate{
+			Proxy:           proxy,
+			ResponseTimeMS:  signal.ResponseTime,
+			ReputationScore: signal.ReputationScore,
+		})
+	}
+	return candidates, nil
+}
+
+// PickRotatingProxyCandidate chooses an upstream from candidates ordered by
+// proxy ID. Ties are broken round-robin starting after lastProxyID so equally
+// ranked proxies still share traffic. activeConnections may be nil.
+func PickRotatingProxyCandidate(strategy string, candidates []RotatingProxyCandidate, lastProxyID *uint64, activeConnections map[uint64]int) (*RotatingProxyCandidate, bool) {
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	switch normalizeRotatorSelectionStrategy(strategy) {
+	case RotatingProxyStrategyRandom:
+		return &candidates[rand.IntN(len(candidates))], true
+	case RotatingProxyStrategyReputationWeighted:
+		return pickWeightedByReputation(candidates), true
+	case RotatingProxyStrategyLowestLatency:
+		return pickLowest(candidates, lastProxyID, func(candidate RotatingProxyCandidate) int {
+			if candidate.ResponseTimeMS == 0 {
+				return int(^uint16(0))
+			}
+			return int(candidate.ResponseTimeMS)
+		}), true
+	case RotatingProxyStrategyLeastConnections:
+		return pickLowest(candidates, lastProxyID, func(candidate RotatingProxyCandidate) int {
+			return activeConnections[candidate.Proxy.ID]
+		}), true
+	default:
+		return pickLowest(candidates, lastProxyID, func(RotatingProxyCandidate) int { return 0 }), true
+	}
+}
+
+func pickLowest(candidates []RotatingProxyCandidate, lastProxyID *uint64, rank func(RotatingProxyCandidate) int) *RotatingProxyCandidate {
+	start := 0
+	if lastProxyID != nil {
+		for idx, candidate := range candidates {
+			if candidate.Proxy.ID > *lastProxyID {
+				start = idx
+				break
+			}
+		}
+	}
+
+	best := -1
+	bestRank := 0
+	for offset := range candidates {
+		idx := (start + offset) % len(candidates)
+		value := rank(candidates[idx])
+		if best == -1 || value < bestRank {
+			best = idx
+			bestRank = value
+		}
+	}
+	return &candidates[best]
+}
+
+func pickWeightedByReputation(candidates []RotatingProxyCandidate) *RotatingProxyCandidate {
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for idx, candidate := range candidates {
+		weight := unscoredReputationWeight
+		if candidate.ReputationScore != nil {
+			weight = max(*candidate.ReputationScore, minimumReputationWeight)
+		}
+		weights[idx] = weight
+		total += weight
+	}
+
+	target := rand.Float64() * total
+	for idx, weight := range weights {
+		target -= weight
+		if target < 0 {
+			return &candidates[idx]
+		}
+	}
+	return &candidates[len(candidates)-1]
+}
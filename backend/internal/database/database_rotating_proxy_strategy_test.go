@@ -0,0 +1,194 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"magpie/internal/domain"
+)
+
+func strategyCandidate(id uint64, responseTime uint16, score *float64) RotatingProxyCandidate {
+	return RotatingProxyCandidate{
+		Proxy:           domain.Proxy{ID: id},
+		ResponseTimeMS:  responseTime,
+		ReputationScore: score,
+	}
+}
+
+func TestPickRotatingProxyCandidate_LowestLatencyRotatesTies(t *testing.T) {
+	candidates := []RotatingProxyCandidate{
+		strategyCandidate(1, 300, nil),
+		strategyCandidate(2, 120, nil),
+		strategyCandidate(3, 120, nil),
+		strategyCandidate(4, 0, nil),
+	}
+
+	first, ok := PickRotatingProxyCandidate(RotatingProxyStrategyLowestLatency, candidates, nil, nil)
+	if !ok || first.Proxy.ID != 2 {
+		t.Fatalf("first pick = %+v, want proxy 2", first)
+	}
+
+	last := first.Proxy.ID
+	second, ok := PickRotatingProxyCandidate(RotatingProxyStrategyLowestLatency, candidates, &last, nil)
+	if !ok || second.Proxy.ID != 3 {
+		t.Fatalf("second pick = %+v, want proxy 3", second)
+	}
+
+	last = second.Proxy.ID
+	third, ok := PickRotatingProxyCandidate(RotatingProxyStrategyLowestLatency, candidates, &last, nil)
+	if !ok || third.Proxy.ID != 2 {
+		t.Fatalf("third pick = %+v, want proxy 2 after wrapping", third)
+	}
+}
+
+func TestPickRotatingProxyCandidate_LeastConnections(t *testing.T) {
+	candidates := []RotatingProxyCandidate{
+		strategyCandidate(1, 0, nil),
+		strategyCandidate(2, 0, nil),
+		strategyCandidate(3, 0, nil),
+	}
+	active := map[uint64]int{1: 4, 2: 1, 3: 2}
+
+	picked, ok := PickRotatingProxyCandidate(RotatingProxyStrategyLeastConnections, candidates, nil, active)
+	if !ok || picked.Proxy.ID != 2 {
+		t.Fatalf("picked = %+v, want proxy 2", picked)
+	}
+}
+
+func TestPickRotatingProxyCandidate_ReputationWeighted(t *testing.T) {
+	candidates := []RotatingProxyCandidate{
+		strategyCandidate(1, 0, float64Ptr(95)),
+		strategyCandidate(2, 0, float64Ptr(40)),
+		strategyCandidate(3, 0, float64Ptr(0)),
+	}
+
+	counts := make(map[uint64]int)
+	const draws = 20000
+	for range draws {
+		picked, ok := PickRotatingProxyCandidate(RotatingProxyStrategyReputationWeighted, candidates, nil, nil)
+		if !ok {
+			t.Fatal("expected a candidate")
+		}
+		counts[picked.Proxy.ID]++
+	}
+
+	if counts[1] <= counts[2]*3/2 {
+		t.Fatalf("high score share %d should clearly exceed neutral share %d", counts[1], counts[2])
+	}
+	if counts[3] == 0 || counts[3] >= counts[2] {
+		t.Fatalf("zero score share = %d, want small but non-zero", counts[3])
+	}
+}
+
+func TestPickRotatingProxyCandidate_Empty(t *testing.T) {
+	if _, ok := PickRotatingProxyCandidate(RotatingProxyStrategyRandom, nil, nil, nil); ok {
+		t.Fatal("expected no candidate for empty pool")
+	}
+}
+
+func TestGetNextRotatingProxy_LowestLatencyStrategy(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{
+		Email:        "latency@example.com",
+		Password:     "password123",
+		HTTPProtocol: true,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+
+	judge := domain.Judge{FullString: "http://judge-latency.example.com"}
+	if err := db.Create(&judge).Error; err != nil {
+		t.Fatalf("create judge: %v", err)
+	}
+
+	responseTimes := []uint16{900, 80, 400}
+	proxies := make([]domain.Proxy, len(responseTimes))
+	for idx, responseTime := range responseTimes {
+		proxies[idx] = domain.Proxy{IP: "10.0.4.1", Port: uint16(9300 + idx)}
+		if err := db.Create(&proxies[idx]).Error; err != nil {
+			t.Fatalf("create proxy %d: %v", idx, err)
+		}
+		if err := db.Create(&domain.UserProxy{UserID: user.ID, ProxyID: proxies[idx].ID}).Error; err != nil {
+			t.Fatalf("link proxy %d: %v", idx, err)
+		}
+		stat := domain.ProxyStatistic{
+			Alive:        true,
+			ResponseTime: responseTime,
+			Attempt:      1,
+			ProtocolID:   protocol.ID,
+			ProxyID:      proxies[idx].ID,
+			JudgeID:      judge.ID,
+			CreatedAt:    time.Unix(int64(idx+1), 0),
+		}
+		if err := db.Create(&stat).Error; err != nil {
+			t.Fatalf("create statistic %d: %v", idx, err)
+		}
+		if err := updateProxyStatusCaches(db, []domain.ProxyStatistic{stat}); err != nil {
+			t.Fatalf("update proxy status cache %d: %v", idx, err)
+		}
+	}
+
+	rotator := domain.RotatingProxy{
+		UserID:            user.ID,
+		Name:              "latency-rotator",
+		ProtocolID:        protocol.ID,
+		ListenPort:        10960,
+		SelectionStrategy: RotatingProxyStrategyLowestLatency,
+	}
+	if err := db.Create(&rotator).Error; err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		next, err := GetNextRotatingProxy(user.ID, rotator.ID)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", attempt, err)
+		}
+		if next.ProxyID != proxies[1].ID {
+			t.Fatalf("attempt %d proxy id = %d, want fastest proxy %d", attempt, next.ProxyID, proxies[1].ID)
+		}
+	}
+}
+
+func TestRankedCandidatesCache_ReusesLoadedTiers(t *testing.T) {
+	cache := &rankedCandidatesCache{entries: make(map[rankedCandidatesKey]rankedCandidatesEntry)}
+	fetches := 0
+	fetch := func() ([]RotatingProxyCandidate, error) {
+		fetches++
+		return []RotatingProxyCandidate{strategyCandidate(uint64(fetches), 0, nil)}, nil
+	}
+	now := time.Now()
+	key := rankedCandidatesKey{rotatorID: 1, updatedAt: now}
+
+	for range 3 {
+		if candidates, err := cache.load(key, now, fetch); err != nil || candidates[0].Proxy.ID != 1 {
+			t.Fatalf("load = %v, %v, want the first fetch", candidates, err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("fetches = %d, want 1 within the TTL", fetches)
+	}
+
+	proxyStatusVersion.Add(1)
+	if _, err := cache.load(key, now, fetch); err != nil || fetches != 2 {
+		t.Fatalf("fetches = %d, err = %v, want a reload after statistics changed", fetches, err)
+	}
+	if _, err := cache.load(key, now.Add(rankedCandidatesTTL), fetch); err != nil || fetches != 3 {
+		t.Fatalf("fetches = %d, err = %v, want a reload after the TTL", fetches, err)
+	}
+
+	edited := rankedCandidatesKey{rotatorID: 1, updatedAt: now.Add(time.Second)}
+	if _, err := cache.load(edited, now.Add(rankedCandidatesTTL), fetch); err != nil || fetches != 4 {
+		t.Fatalf("fetches = %d, err = %v, want a reload after the rotator was edited", fetches, err)
+	}
+	if len(cache.entries) != 1 {
+		t.Fatalf("cache holds %d entries, want the edited rotator only", len(cache.entries))
+	}
+}
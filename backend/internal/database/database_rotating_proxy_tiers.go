@@ -0,0 +1,152 @@
+package database
+
+import (
+	"cmp"
+	"slices"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+const maxRotatorFallbackTiers = 8
+
+// rotatorTier is one pool a rotator picks upstreams from. Tier 0 holds the
+// rotator's own filters and the fallback tiers follow in order; a tier is only
+// used when every tier before it has no usable upstream.
+type rotatorTier struct {
+	Labels     []string
+	Attributes rotatorAttributeFilters
+}
+
+// rotatorTiersOf lists the tiers of a rotator. Fallback tiers keep the
+// rotator's countries and pinned proxies.
+func rotatorTiersOf(rotator domain.RotatingProxy) []rotatorTier {
+	primary := rotatorAttributeFiltersOf(rotator)
+	tiers := make([]rotatorTier, 0, 1+len(rotator.FallbackTiers))
+	tiers = append(tiers, rotatorTier{
+		Labels:     sanitizeRotatorReputationLabels(rotator.ReputationLabels.Clone()),
+		Attributes: primary,
+	})
+	for _, fallback := range rotator.FallbackTiers {
+		attributes := primary
+		attributes.Types = normalizeFilterValues(fallback.Types)
+		attributes.AnonymityLevels = normalizeFilterValues(fallback.AnonymityLevels)
+		tiers = append(tiers, rotatorTier{
+			Labels:     sanitizeRotatorReputationLabels(fallback.ReputationLabels),
+			Attributes: attributes,
+		})
+	}
+	return tiers
+}
+
+func validateRotatorFallbackTiers(tiers []dto.RotatingProxyTier) (domain.RotatingProxyTiers, error) {
+	if len(tiers) > maxRotatorFallbackTiers {
+		return nil, ErrRotatingProxyTierInvalid
+	}
+	if len(tiers) == 0 {
+		return nil, nil
+	}
+
+	validated := make(domain.RotatingProxyTiers, 0, len(tiers))
+	for _, tier := range tiers {
+		attributes, err := validateRotatorAttributeFilters(nil, tier.Types, tier.AnonymityLevels)
+		if err != nil {
+			return nil, err
+		}
+		validated = append(validated, domain.RotatingProxyTier{
+			ReputationLabels: sanitizeRotatorReputationLabels(tier.ReputationLabels),
+			Types:            attributes.Types,
+			AnonymityLevels:  attributes.AnonymityLevels,
+		})
+	}
+	return validated, nil
+}
+
+func newRotatingProxyTierDTOs(tiers domain.RotatingProxyTiers) []dto.RotatingProxyTier {
+	if len(tiers) == 0 {
+		return nil
+	}
+	result := make([]dto.RotatingProxyTier, 0, len(tiers))
+	for _, tier := range tiers {
+		result = append(result, dto.RotatingProxyTier{
+			ReputationLabels: slices.Clone(tier.ReputationLabels),
+			Types:            slices.Clone(tier.Types),
+			AnonymityLevels:  slices.Clone(tier.AnonymityLevels),
+		})
+	}
+	return result
+}
+
+// countAliveRotatorProxies counts the distinct alive proxies over every tier
+// of a rotator.
+func countAliveRotatorProxies(rotator domain.RotatingProxy, load func(rotatorTier) ([]domain.Proxy, error)) (int, error) {
+	tiers := rotatorTiersOf(rotator)
+	if len(tiers) == 1 {
+		proxies, err := load(tiers[0])
+		return len(proxies), err
+	}
+
+	seen := make(map[uint64]struct{})
+	for _, tier := range tiers {
+		proxies, err := load(tier)
+		if err != nil {
+			return 0, err
+		}
+		for _, proxy := range proxies {
+			seen[proxy.ID] = struct{}{}
+		}
+	}
+	return len(seen), nil
+}
+
+// mergeRotatorTierCandidates joins the candidates of every tier into one list
+// ordered by proxy ID. A proxy in several tiers keeps the first one.
+func mergeRotatorTierCandidates(perTier [][]RotatingProxyCandidate) []RotatingProxyCandidate {
+	if len(perTier) == 1 {
+		return perTier[0]
+	}
+
+	seen := make(map[uint64]struct{})
+	var merged []RotatingProxyCandidate
+	for tier, candidates := range perTier {
+		for _, candidate := range candidates {
+			if _, dup := seen[candidate.Proxy.ID]; dup {
+				continue
+			}
+			seen[candidate.Proxy.ID] = struct{}{}
+			candidate.Tier = tier
+			merged = append(merged, candidate)
+		}
+	}
+	slices.SortFunc(merged, func(a, b RotatingProxyCandidate) int {
+		return cmp.Compare(a.Proxy.ID, b.Proxy.ID)
+	})
+	return merged
+}
+
+// FirstRotatingProxyTier keeps the candidates of the best tier that has any,
+// so a fallback tier is only used once the tiers before it are empty or
+// exhausted by the selection.
+func FirstRotatingProxyTier(candidates []RotatingProxyCandidate) []RotatingProxyCandidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	best, mixed := candidates[0].Tier, false
+	for _, candidate := range candidates[1:] {
+		if candidate.Tier != best {
+			mixed = true
+			best = min(best, candidate.Tier)
+		}
+	}
+	if !mixed {
+		return candidates
+	}
+
+	filtered := make([]RotatingProxyCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Tier == best {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+func TestRotatingProxyTiers_FallBackWhenHigherTiersAreEmpty(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{Email: "tiers@example.com", Password: "password123", HTTPProtocol: true}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+	judge := domain.Judge{FullString: "http://judge-tiers.example.com"}
+	if err := db.Create(&judge).Error; err != nil {
+		t.Fatalf("create judge: %v", err)
+	}
+
+	proxies := []domain.Proxy{
+		{IP: "10.0.8.10", Port: 9600},
+		{IP: "10.0.8.11", Port: 9601},
+		{IP: "10.0.8.12", Port: 9602},
+	}
+	labels := []string{"good", "neutral", "poor"}
+	for idx := range proxies {
+		if err := db.Create(&proxies[idx]).Error; err != nil {
+			t.Fatalf("create proxy %d: %v", idx, err)
+		}
+		if err := db.Create(&domain.UserProxy{UserID: user.ID, ProxyID: proxies[idx].ID}).Error; err != nil {
+			t.Fatalf("link proxy %d: %v", idx, err)
+		}
+		stat := domain.ProxyStatistic{
+			Alive:        idx != 0,
+			Attempt:      1,
+			ResponseTime: 120,
+			ProtocolID:   protocol.ID,
+			ProxyID:      proxies[idx].ID,
+			JudgeID:      judge.ID,
+			CreatedAt:    time.Unix(int64(idx+1), 0),
+		}
+		if err := db.Create(&stat).Error; err != nil {
+			t.Fatalf("create statistic %d: %v", idx, err)
+		}
+		if err := updateProxyStatusCaches(db, []domain.ProxyStatistic{stat}); err != nil {
+			t.Fatalf("update proxy status cache %d: %v", idx, err)
+		}
+		reputation := domain.ProxyReputation{ProxyID: proxies[idx].ID, Kind: domain.ProxyReputationKindOverall, Label: labels[idx], CalculatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := db.Create(&reputation).Error; err != nil {
+			t.Fatalf("create reputation %d: %v", idx, err)
+		}
+	}
+
+	_, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:          "too-many-tiers",
+		Protocol:      "http",
+		FallbackTiers: make([]dto.RotatingProxyTier, maxRotatorFallbackTiers+1),
+	})
+	if !errors.Is(err, ErrRotatingProxyTierInvalid) {
+		t.Fatalf("too many tiers: err = %v, want ErrRotatingProxyTierInvalid", err)
+	}
+
+	created, err := CreateRotatingProxy(user.ID, dto.RotatingProxyCreateRequest{
+		Name:             "good-first",
+		Protocol:         "http",
+		ReputationLabels: []string{"good"},
+		FallbackTiers: []dto.RotatingProxyTier{
+			{ReputationLabels: []string{"Neutral"}},
+			{},
+		},
+		UpstreamTierHeader: "x-magpie-upstream-tier",
+	})
+	if err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+	if created.AliveProxyCount != 2 || len(created.FallbackTiers) != 2 || created.FallbackTiers[0].ReputationLabels[0] != "neutral" {
+		t.Fatalf("created rotator = %d alive, tiers %+v", created.AliveProxyCount, created.FallbackTiers)
+	}
+	if created.UpstreamTierHeader != "X-Magpie-Upstream-Tier" {
+		t.Fatalf("upstream tier header = %q", created.UpstreamTierHeader)
+	}
+
+	for attempt := range 2 {
+		next, err := GetNextRotatingProxy(user.ID, created.ID)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", attempt, err)
+		}
+		if next.ProxyID != proxies[1].ID || next.Tier != 1 {
+			t.Fatalf("attempt %d served proxy %d from tier %d, want the neutral proxy from tier 1", attempt, next.ProxyID, next.Tier)
+		}
+	}
+
+	var rotator domain.RotatingProxy
+	if err := db.First(&rotator, created.ID).Error; err != nil {
+		t.Fatalf("load rotator: %v", err)
+	}
+	candidates, err := LoadRotatingProxyCandidates(rotator)
+	if err != nil {
+		t.Fatalf("load candidates: %v", err)
+	}
+	if len(candidates) != 2 || candidates[0].Proxy.ID != proxies[1].ID || candidates[0].Tier != 1 || candidates[1].Tier != 2 {
+		t.Fatalf("candidates = %+v, want the neutral proxy in tier 1 and the poor one in tier 2", candidates)
+	}
+	if first := FirstRotatingProxyTier(candidates); len(first) != 1 || first[0].Proxy.ID != proxies[1].ID {
+		t.Fatalf("first tier = %+v, want only the neutral proxy", first)
+	}
+}
@@ -0,0 +1,439 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+	"magpie/internal/support"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const generatedRotatorPasswordBytes = 18
+
+// UpdateRotatingProxy edits a rotator in place. The instance and listen port
+// are kept so clients do not have to be reconfigured; running listeners pick
+// the change up through rotatingproxy.Manager.
+func UpdateRotatingProxy(userID uint, rotatingProxyID uint64, payload dto.RotatingProxyUpdateRequest) (*dto.RotatingProxy, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("rotating proxy: database connection was not initialised")
+	}
+
+	var result *dto.RotatingProxy
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var entity domain.RotatingProxy
+		if err := tx.
+			Preload("Protocol").
+			Preload("ListenProtocol").
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND id = ?", userID, rotatingProxyID).
+			First(&entity).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRotatingProxyNotFound
+			}
+			return err
+		}
+		normalizeRotatingProxyProtocols(&entity)
+
+		if err := applyRotatingProxyUpdate(tx, userID, &entity, payload); err != nil {
+			return err
+		}
+		if entity.AuthUsername != "" {
+			var clashes int64
+			if err := tx.Model(&domain.RotatingProxyCredential{}).
+				Where("rotating_proxy_id = ? AND name = ?", entity.ID, entity.AuthUsername).
+				Count(&clashes).Error; err != nil {
+				return err
+			}
+			if clashes > 0 {
+				return ErrRotatingProxyCredentialNameConflict
+			}
+		}
+
+		if err := tx.Omit(clause.Associations).Save(&entity).Error; err != nil {
+			if isUniqueConstraintError(err) {
+				return ErrRotatingProxyNameConflict
+			}
+			return err
+		}
+
+		aliveProxyCount, err := countAliveRotatorProxies(entity, func(tier rotatorTier) ([]domain.Proxy, error) {
+			return aliveProxiesForProtocol(tx, userID, entity.ProtocolID, tier.Labels, entity.UptimeFilterType, entity.UptimePercentage, tier.Attributes)
+		})
+		if err != nil {
+			return err
+		}
+
+		rotator := newRotatingProxyDTO(entity, aliveProxyCount)
+		result = &rotator
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func applyRotatingProxyUpdate(tx *gorm.DB, userID uint, entity *domain.RotatingProxy, payload dto.RotatingProxyUpdateRequest) error {
+	if payload.Name != nil {
+		name := strings.TrimSpace(*payload.Name)
+		if name == "" {
+			return ErrRotatingProxyNameRequired
+		}
+		if len(name) > rotatingProxyNameMaxLength {
+			return ErrRotatingProxyNameTooLong
+		}
+		entity.Name = name
+	}
+
+	if payload.Protocol != nil {
+		protocolName := strings.ToLower(strings.TrimSpace(*payload.Protocol))
+		if protocolName == "" {
+			return ErrRotatingProxyProtocolMissing
+		}
+
+		var user domain.User
+		if err := tx.First(&user, userID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("rotating proxy: user %d not found", userID)
+			}
+			return err
+		}
+		if !isProtocolEnabledForUser(user, protocolName) {
+			return ErrRotatingProxyProtocolDenied
+		}
+
+		protocol, err := fetchProtocolByName(tx, protocolName)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRotatingProxyProtocolDenied
+			}
+			return err
+		}
+		entity.ProtocolID = protocol.ID
+		entity.Protocol = protocol
+	}
+
+	if payload.ListenProtocol != nil {
+		listenProtocolName := strings.ToLower(strings.TrimSpace(*payload.ListenProtocol))
+		if listenProtocolName == "" {
+			listenProtocolName = entity.Protocol.Name
+		}
+		listenProtocol, err := fetchProtocolByName(tx, listenProtocolName)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRotatingProxyProtocolDenied
+			}
+			return err
+		}
+		entity.ListenProtocolID = listenProtocol.ID
+		entity.ListenProtocol = listenProtocol
+	}
+
+	if payload.TransportProtocol != nil {
+		entity.TransportProtocol = support.NormalizeTransportProtocol(*payload.TransportProtocol)
+	}
+	if payload.ListenTransportProtocol != nil {
+		if strings.TrimSpace(*payload.ListenTransportProtocol) == "" {
+			entity.ListenTransportProtocol = entity.TransportProtocol
+		} else {
+			entity.ListenTransportProtocol = support.NormalizeListenTransportProtocol(*payload.ListenTransportProtocol)
+		}
+	}
+	if payload.ListenProtocol != nil || payload.ListenTransportProtocol != nil {
+		listenProtocolName := entity.ListenProtocol.Name
+		if strings.TrimSpace(listenProtocolName) == "" {
+			listenProtocolName = entity.Protocol.Name
+		}
+		if err := validateRotatorListenTransport(listenProtocolName, entity.ListenTransportProtocol); err != nil {
+			return err
+		}
+	}
+
+	if payload.UptimeFilterType != nil || payload.UptimePercentage != nil {
+		rawType, rawPercentage := entity.UptimeFilterType, entity.UptimePercentage
+		if payload.UptimeFilterType != nil {
+			rawType = *payload.UptimeFilterType
+			if strings.TrimSpace(rawType) == "" && payload.UptimePercentage == nil {
+				rawPercentage = nil
+			}
+		}
+		if payload.UptimePercentage != nil {
+			rawPercentage = payload.UptimePercentage
+		}
+		uptimeFilterType, uptimePercentage, err := validateRotatorUptimeFilter(rawType, rawPercentage)
+		if err != nil {
+			return err
+		}
+		entity.UptimeFilterType = uptimeFilterType
+		entity.UptimePercentage = uptimePercentage
+	}
+
+	if payload.AuthRequired != nil {
+		entity.AuthRequired = *payload.AuthRequired
+	}
+	if payload.AuthUsername != nil {
+		entity.AuthUsername = strings.TrimSpace(*payload.AuthUsername)
+	}
+	if payload.AuthPassword != nil {
+		entity.AuthPassword = *payload.AuthPassword
+	}
+	if payload.RegeneratePassword {
+		password, err := generateRotatingProxyPassword()
+		if err != nil {
+			return err
+		}
+		entity.AuthPassword = password
+	}
+	if entity.AuthRequired {
+		if entity.AuthUsername == "" {
+			return ErrRotatingProxyAuthUsernameNeeded
+		}
+		if strings.TrimSpace(entity.AuthPassword) == "" {
+			return ErrRotatingProxyAuthPasswordNeeded
+		}
+	}
+
+	if payload.ReputationLabels != nil {
+		entity.ReputationLabels = domain.StringList(sanitizeRotatorReputationLabels(*payload.ReputationLabels))
+	}
+
+	if payload.StickySessionTTLSeconds != nil {
+		ttl := *payload.StickySessionTTLSeconds
+		if ttl < 0 || ttl > maxStickySessionTTLSeconds {
+			return ErrRotatingProxySessionTTLInvalid
+		}
+		entity.StickySessionTTLSeconds = ttl
+	}
+
+	if payload.SelectionStrategy != nil {
+		strategy, err := validateRotatorSelectionStrategy(*payload.SelectionStrategy)
+		if err != nil {
+			return err
+		}
+		entity.SelectionStrategy = strategy
+	}
+
+	if payload.Countries != nil || payload.Types != nil || payload.AnonymityLevels != nil {
+		countries, types, anonymityLevels := []string(entity.Countries), []string(entity.ProxyTypes), []string(entity.AnonymityLevels)
+		if payload.Countries != nil {
+			countries = *payload.Countries
+		}
+		if payload.Types != nil {
+			types = *payload.Types
+		}
+		if payload.AnonymityLevels != nil {
+			anonymityLevels = *payload.AnonymityLevels
+		}
+		attributes, err := validateRotatorAttributeFilters(countries, types, anonymityLevels)
+		if err != nil {
+			return err
+		}
+		entity.Countries = domain.StringList(attributes.Countries)
+		entity.ProxyTypes = domain.StringList(attributes.Types)
+		entity.AnonymityLevels = domain.StringList(attributes.AnonymityLevels)
+	}
+
+	if payload.AllowedClientCIDRs != nil || payload.ClientAuthMode != nil {
+		cidrs, mode := []string(entity.AllowedClientCIDRs), entity.ClientAuthMode
+		if payload.AllowedClientCIDRs != nil {
+			cidrs = *payload.AllowedClientCIDRs
+		}
+		if payload.ClientAuthMode != nil {
+			mode = *payload.ClientAuthMode
+		}
+		allowedClientCIDRs, clientAuthMode, err := validateRotatorClientAccess(cidrs, mode)
+		if err != nil {
+			return err
+		}
+		entity.AllowedClientCIDRs = domain.StringList(allowedClientCIDRs)
+		entity.ClientAuthMode = clientAuthMode
+	}
+
+	if payload.RotationMode != nil || payload.RotationIntervalSeconds != nil || payload.RotationRequests != nil {
+		mode, intervalSeconds, requests := entity.RotationMode, entity.RotationIntervalSeconds, entity.RotationRequests
+		if payload.RotationMode != nil {
+			mode = *payload.RotationMode
+		}
+		if payload.RotationIntervalSeconds != nil {
+			intervalSeconds = *payload.RotationIntervalSeconds
+		}
+		if payload.RotationRequests != nil {
+			requests = *payload.RotationRequests
+		}
+		rotation, err := validateRotatorRotation(mode, intervalSeconds, requests)
+		if err != nil {
+			return err
+		}
+		entity.RotationMode = rotation.Mode
+		entity.RotationIntervalSeconds = rotation.IntervalSeconds
+		entity.RotationRequests = rotation.Requests
+	}
+
+	if payload.ParentProxyProtocol != nil || payload.ParentProxyHost != nil || payload.ParentProxyPort != nil ||
+		payload.ParentProxyUsername != nil || payload.ParentProxyPassword != nil {
+		parent := rotatorParentProxyOf(*entity)
+		if payload.ParentProxyProtocol != nil {
+			parent.Protocol = *payload.ParentProxyProtocol
+		}
+		if payload.ParentProxyHost != nil {
+			parent.Host = *payload.ParentProxyHost
+		}
+		if payload.ParentProxyPort != nil {
+			parent.Port = *payload.ParentProxyPort
+		}
+		if payload.ParentProxyUsername != nil {
+			parent.Username = *payload.ParentProxyUsername
+		}
+		if payload.ParentProxyPassword != nil {
+			parent.Password = *payload.ParentProxyPassword
+		}
+		validated, err := validateRotatorParentProxy(parent)
+		if err != nil {
+			return err
+		}
+		validated.apply(entity)
+	}
+
+	if payload.AllowedDestinations != nil || payload.BlockedDestinations != nil {
+		allowed, blocked := []string(entity.AllowedDestinations), []string(entity.BlockedDestinations)
+		if payload.AllowedDestinations != nil {
+			allowed = *payload.AllowedDestinations
+		}
+		if payload.BlockedDestinations != nil {
+			blocked = *payload.BlockedDestinations
+		}
+		allowedDestinations, blockedDestinations, err := validateRotatorDestinations(allowed, blocked)
+		if err != nil {
+			return err
+		}
+		entity.AllowedDestinations = domain.StringList(allowedDestinations)
+		entity.BlockedDestinations = domain.StringList(blockedDestinations)
+	}
+
+	if payload.MaxTunnels != nil || payload.ConnectionsPerSecond != nil || payload.RequestsPerSecond != nil || payload.LimitScope != nil {
+		limits := rotatorTrafficLimitsOf(*entity)
+		if payload.MaxTunnels != nil {
+			limits.MaxTunnels = *payload.MaxTunnels
+		}
+		if payload.ConnectionsPerSecond != nil {
+			limits.ConnectionsPerSecond = *payload.ConnectionsPerSecond
+		}
+		if payload.RequestsPerSecond != nil {
+			limits.RequestsPerSecond = *payload.RequestsPerSecond
+		}
+		if payload.LimitScope != nil {
+			limits.Scope = *payload.LimitScope
+		}
+		validated, err := validateRotatorTrafficLimits(limits)
+		if err != nil {
+			return err
+		}
+		validated.apply(entity)
+	}
+
+	if payload.StripRequestHeaders != nil || payload.InjectRequestHeaders != nil || payload.UpstreamIDHeader != nil || payload.UpstreamTierHeader != nil {
+		rules := rotatorHeaderRulesOf(*entity)
+		if payload.StripRequestHeaders != nil {
+			rules.Strip = *payload.StripRequestHeaders
+		}
+		if payload.InjectRequestHeaders != nil {
+			rules.Inject = *payload.InjectRequestHeaders
+		}
+		if payload.UpstreamIDHeader != nil {
+			rules.UpstreamIDHeader = *payload.UpstreamIDHeader
+		}
+		if payload.UpstreamTierHeader != nil {
+			rules.UpstreamTierHeader = *payload.UpstreamTierHeader
+		}
+		validated, err := validateRotatorHeaderRules(rules)
+		if err != nil {
+			return err
+		}
+		validated.apply(entity)
+	}
+
+	if payload.PinnedProxyIDs != nil {
+		pinned, err := validateRotatorPinnedProxies(tx, userID, *payload.PinnedProxyIDs)
+		if err != nil {
+			return err
+		}
+		entity.PinnedProxyIDs = domain.IDList(pinned)
+	}
+
+	if payload.FallbackTiers != nil {
+		tiers, err := validateRotatorFallbackTiers(*payload.FallbackTiers)
+		if err != nil {
+			return err
+		}
+		entity.FallbackTiers = tiers
+	}
+
+	if payload.HandshakeTimeoutMS != nil || payload.UpstreamTimeoutMS != nil || payload.DNSMode != nil ||
+		payload.FailoverRetries != nil || payload.FailoverCooldownSeconds != nil {
+		options := rotatorUpstreamOptionsOf(*entity)
+		if payload.HandshakeTimeoutMS != nil {
+			options.HandshakeTimeoutMS = *payload.HandshakeTimeoutMS
+		}
+		if payload.UpstreamTimeoutMS != nil {
+			options.UpstreamTimeoutMS = *payload.UpstreamTimeoutMS
+		}
+		if payload.DNSMode != nil {
+			options.DNSMode = *payload.DNSMode
+		}
+		if payload.FailoverRetries != nil {
+			options.FailoverRetries = *payload.FailoverRetries
+		}
+		if payload.FailoverCooldownSeconds != nil {
+			options.FailoverCooldownSeconds = *payload.FailoverCooldownSeconds
+		}
+		validated, err := validateRotatorUpstreamOptions(options)
+		if err != nil {
+			return err
+		}
+		validated.apply(entity)
+	}
+
+	if payload.ReplicaInstanceIDs != nil || payload.ReplicaRegion != nil {
+		placement := RotatingProxyPlacementOf(*entity)
+		if payload.ReplicaInstanceIDs != nil {
+			placement.ReplicaInstanceIDs = *payload.ReplicaInstanceIDs
+		}
+		if payload.ReplicaRegion != nil {
+			placement.ReplicaRegion = *payload.ReplicaRegion
+		}
+		validated, err := validateRotatorPlacement(placement)
+		if err != nil {
+			return err
+		}
+		if validated.Replicated() {
+			taken, err := rotatorListenPortTaken(tx, validated, entity.ListenPort, entity.ID)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrRotatingProxyReplicaPortTaken
+			}
+		}
+		validated.apply(entity)
+	}
+
+	return nil
+}
+
+func generateRotatingProxyPassword() (string, error) {
+	buf := make([]byte, generatedRotatorPasswordBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("rotating proxy: generate password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"errors"
+	"strings"
+
+	"magpie/internal/domain"
+)
+
+const (
+	// RotatingProxyDNSModeRemote sends target host names to the upstream
+	// proxy, which resolves them. The Magpie host never looks them up.
+	RotatingProxyDNSModeRemote = "remote"
+	// RotatingProxyDNSModeLocal resolves target host names on the Magpie host
+	// and hands the upstream an IP address.
+	RotatingProxyDNSModeLocal = "local"
+
+	minRotatorTimeoutMS               = 100
+	maxRotatorTimeoutMS               = 600000
+	maxRotatorFailoverRetries         = 10
+	maxRotatorFailoverCooldownSeconds = 3600
+)
+
+var (
+	ErrRotatingProxyTimeoutInvalid  = errors.New("timeouts must be 0 or between 100 and 600000 milliseconds")
+	ErrRotatingProxyDNSModeInvalid  = errors.New("dns mode must be either remote or local")
+	ErrRotatingProxyFailoverInvalid = errors.New("failover retries must be between 0 and 10 and the failover cooldown between 0 and 3600 seconds")
+)
+
+// rotatorUpstreamOptions tune how a rotator talks to its upstreams. Zero
+// timeouts use ROTATING_PROXY_HANDSHAKE_TIMEOUT_MS and
+// ROTATING_PROXY_UPSTREAM_TIMEOUT_MS, zero failover settings
+// ROTATING_PROXY_FAILOVER_RETRIES and ROTATING_PROXY_FAILOVER_COOLDOWN_SECONDS.
+type rotatorUpstreamOptions struct {
+	HandshakeTimeoutMS      int
+	UpstreamTimeoutMS       int
+	DNSMode                 string
+	FailoverRetries         int
+	FailoverCooldownSeconds int
+}
+
+func rotatorUpstreamOptionsOf(rotator domain.RotatingProxy) rotatorUpstreamOptions {
+	return rotatorUpstreamOptions{
+		HandshakeTimeoutMS:      rotator.HandshakeTimeoutMS,
+		UpstreamTimeoutMS:       rotator.UpstreamTimeoutMS,
+		DNSMode:                 rotator.DNSMode,
+		FailoverRetries:         rotator.FailoverRetries,
+		FailoverCooldownSeconds: rotator.FailoverCooldownSeconds,
+	}
+}
+
+func validateRotatorUpstreamOptions(options rotatorUpstreamOptions) (rotatorUpstreamOptions, error) {
+	for _, value := range []int{options.HandshakeTimeoutMS, options.UpstreamTimeoutMS} {
+		if value != 0 && (value < minRotatorTimeoutMS || value > maxRotatorTimeoutMS) {
+			return rotatorUpstreamOptions{}, ErrRotatingProxyTimeoutInvalid
+		}
+	}
+
+	if options.FailoverRetries < 0 || options.FailoverRetries > maxRotatorFailoverRetries ||
+		options.FailoverCooldownSeconds < 0 || options.FailoverCooldownSeconds > maxRotatorFailoverCooldownSeconds {
+		return rotatorUpstreamOptions{}, ErrRotatingProxyFailoverInvalid
+	}
+
+	options.DNSMode = strings.ToLower(strings.TrimSpace(options.DNSMode))
+	switch options.DNSMode {
+	case "":
+		options.DNSMode = RotatingProxyDNSModeRemote
+	case RotatingProxyDNSModeRemote, RotatingProxyDNSModeLocal:
+	default:
+		return rotatorUpstreamOptions{}, ErrRotatingProxyDNSModeInvalid
+	}
+	return options, nil
+}
+
+func normalizeRotatorDNSMode(raw string) string {
+	if strings.EqualFold(strings.TrimSpace(raw), RotatingProxyDNSModeLocal) {
+		return RotatingProxyDNSModeLocal
+	}
+	return RotatingProxyDNSModeRemote
+}
+
+func (o rotatorUpstreamOptions) apply(entity *domain.RotatingProxy) {
+	entity.HandshakeTimeoutMS = o.HandshakeTimeoutMS
+	entity.UpstreamTimeoutMS = o.UpstreamTimeoutMS
+	entity.DNSMode = o.DNSMode
+	entity.FailoverRetries = o.FailoverRetries
+	entity.FailoverCooldownSeconds = o.FailoverCooldownSeconds
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateRotatorUpstreamOptions(t *testing.T) {
+	options, err := validateRotatorUpstreamOptions(rotatorUpstreamOptions{})
+	if err != nil {
+		t.Fatalf("validate defaults: %v", err)
+	}
+	if options.DNSMode != RotatingProxyDNSModeRemote {
+		t.Fatalf("default dns mode = %q, want remote", options.DNSMode)
+	}
+
+	options, err = validateRotatorUpstreamOptions(rotatorUpstreamOptions{
+		HandshakeTimeoutMS: minRotatorTimeoutMS,
+		UpstreamTimeoutMS:  maxRotatorTimeoutMS,
+		DNSMode:            " Local ",
+	})
+	if err != nil {
+		t.Fatalf("validate bounds: %v", err)
+	}
+	if options.DNSMode != RotatingProxyDNSModeLocal {
+		t.Fatalf("dns mode = %q, want local", options.DNSMode)
+	}
+
+	for _, timeout := range []int{-1, 50, maxRotatorTimeoutMS + 1} {
+		if _, err := validateRotatorUpstreamOptions(rotatorUpstreamOptions{HandshakeTimeoutMS: timeout}); !errors.Is(err, ErrRotatingProxyTimeoutInvalid) {
+			t.Errorf("handshake timeout %d: err = %v, want ErrRotatingProxyTimeoutInvalid", timeout, err)
+		}
+		if _, err := validateRotatorUpstreamOptions(rotatorUpstreamOptions{UpstreamTimeoutMS: timeout}); !errors.Is(err, ErrRotatingProxyTimeoutInvalid) {
+			t.Errorf("upstream timeout %d: err = %v, want ErrRotatingProxyTimeoutInvalid", timeout, err)
+		}
+	}
+	if _, err := validateRotatorUpstreamOptions(rotatorUpstreamOptions{DNSMode: "doh"}); !errors.Is(err, ErrRotatingProxyDNSModeInvalid) {
+		t.Fatalf("dns mode doh: err = %v, want ErrRotatingProxyDNSModeInvalid", err)
+	}
+
+	if _, err := validateRotatorUpstreamOptions(rotatorUpstreamOptions{
+		FailoverRetries:         maxRotatorFailoverRetries,
+		FailoverCooldownSeconds: maxRotatorFailoverCooldownSeconds,
+	}); err != nil {
+		t.Fatalf("validate failover bounds: %v", err)
+	}
+	for _, invalid := range []rotatorUpstreamOptions{
+		{FailoverRetries: -1},
+		{FailoverRetries: maxRotatorFailoverRetries + 1},
+		{FailoverCooldownSeconds: -1},
+		{FailoverCooldownSeconds: maxRotatorFailoverCooldownSeconds + 1},
+	} {
+		if _, err := validateRotatorUpstreamOptions(invalid); !errors.Is(err, ErrRotatingProxyFailoverInvalid) {
+			t.Errorf("%+v: err = %v, want ErrRotatingProxyFailoverInvalid", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	RotatingProxyUsageBucketSize = time.Hour
+	maxRotatingProxyUsageRange   = 90 * 24 * time.Hour
+
+	rotatingProxyUsageSums = "SUM(connections) AS connections, SUM(requests) AS requests, " +
+		"SUM(bytes_up) AS bytes_up, SUM(bytes_down) AS bytes_down, " +
+		"SUM(no_upstream_failures) AS no_upstream_failures, SUM(connect_failures) AS connect_failures, " +
+		"SUM(timeout_failures) AS timeout_failures, SUM(response_failures) AS response_failures"
+)
+
+var ErrRotatingProxyUsageRangeInvalid = errors.New("usage range must end after it starts and span at most 90 days")
+
+type rotatingProxyUsageSumRow struct {
+	BucketStart        time.Time
+	ProxyID            uint64
+	CredentialID       uint64
+	Connections        int64
+	Requests           int64
+	BytesUp            int64
+	BytesDown          int64
+	NoUpstreamFailures int64
+	ConnectFailures    int64
+	TimeoutFailures    int64
+	ResponseFailures   int64
+}
+
+func (r rotatingProxyUsageSumRow) counters() dto.RotatingProxyUsageCounters {
+	return dto.RotatingProxyUsageCounters{
+		Connections: r.Connections,
+		Requests:    r.Requests,
+		BytesUp:     r.BytesUp,
+		BytesDown:   r.BytesDown,
+		Failures: dto.RotatingProxyUsageFailures{
+			NoUpstream: r.NoUpstreamFailures,
+			Connect:    r.ConnectFailures,
+			Timeout:    r.TimeoutFailures,
+			Response:   r.ResponseFailures,
+		},
+	}
+}
+
+// RotatingProxyUsageBucketStart returns the bucket a usage event at t is
+// counted in.
+func RotatingProxyUsageBucketStart(t time.Time) time.Time {
+	return t.UTC().Truncate(RotatingProxyUsageBucketSize)
+}
+
+// AddRotatingProxyUsage adds the given counter deltas to their buckets.
+func AddRotatingProxyUsage(entries []domain.RotatingProxyUsage) error {
+	if DB == nil {
+		return fmt.Errorf("rotating proxy usage: database connection was not initialised")
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	increment := func(column string) clause.Expr {
+		return gorm.Expr(fmt.Sprintf("rotating_proxy_usage.%s + EXCLUDED.%s", column, column))
+	}
+
+	credentialBytes := make(map[uint64]int64)
+	for _, entry := range entries {
+		if entry.CredentialID != 0 {
+			credentialBytes[entry.CredentialID] += entry.BytesUp + entry.BytesDown
+		}
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{
+				{Name: "rotating_proxy_id"},
+				{Name: "proxy_id"},
+				{Name: "credential_id"},
+				{Name: "bucket_start"},
+			},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"connections":          increment("connections"),
+				"requests":             increment("requests"),
+				"bytes_up":             increment("bytes_up"),
+				"bytes_down":           increment("bytes_down"),
+				"no_upstream_failures": increment("no_upstream_failures"),
+				"connect_failures":     increment("connect_failures"),
+				"timeout_failures":     increment("timeout_failures"),
+				"response_failures":    increment("response_failures"),
+			}),
+		}).Create(&entries).Error; err != nil {
+			return fmt.Errorf("rotating proxy usage: upsert counters: %w", err)
+		}
+
+		// UpdateColumn leaves updated_at alone, which running listeners use to
+		// detect credential edits.
+		for credentialID, bytes := range credentialBytes {
+			if bytes == 0 {
+				continue
+			}
+			if err := tx.Model(&domain.RotatingProxyCredential{}).
+				Where("id = ?", credentialID).
+				UpdateColumn("bytes_used", gorm.Expr("bytes_used + ?", bytes)).Error; err != nil {
+				return fmt.Errorf("rotating proxy usage: add credential bytes: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetRotatingProxyUsage sums a rotator's usage in [from, to) per bucket and
+// per upstream.
+func GetRotatingProxyUsage(userID uint, rotatingProxyID uint64, from, to time.Time) (*dto.RotatingProxyUsageReport, error) {
+	if DB == nil {
+		return nil, fmt.Errorf("rotating proxy usage: database connection was not initialised")
+	}
+	if !to.After(from) || to.Sub(from) > maxRotatingProxyUsageRange {
+		return nil, ErrRotatingProxyUsageRangeInvalid
+	}
+
+	var owned int64
+	if err := DB.Model(&domain.RotatingProxy{}).
+		Where("user_id = ? AND id = ?", userID, rotatingProxyID).
+		Count(&owned).Error; err != nil {
+		return nil, err
+	}
+	if owned == 0 {
+		return nil, ErrRotatingProxyNotFound
+	}
+
+	scope := func() *gorm.DB {
+		return DB.Model(&domain.RotatingProxyUsage{}).
+			Where("user_id = ? AND rotating_proxy_id = ?", userID, rotatingProxyID).
+			Where("bucket_start >= ? AND bucket_start < ?", RotatingProxyUsageBucketStart(from), to.UTC())
+	}
+
+	var bucketRows []rotatingProxyUsageSumRow
+	if err := scope().
+		Select("bucket_start, " + rotatingProxyUsageSums).
+		Group("bucket_start").
+		Order("bucket_start").
+		Scan(&bucketRows).Error; err != nil {
+		return nil, err
+	}
+
+	var upstreamRows []rotatingProxyUsageSumRow
+	if err := scope().
+		Select("proxy_id, "+rotatingProxyUsageSums).
+		Where("proxy_id <> ?", 0).
+		Group("proxy_id").
+		Order("requests DESC, proxy_id").
+		Scan(&upstreamRows).Error; err != nil {
+		return nil, err
+	}
+
+	var credentialRows []rotatingProxyUsageSumRow
+	if err := scope().
+		Select("credential_id, "+rotatingProxyUsageSums).
+		Where("credential_id <> ?", 0).
+		Group("credential_id").
+		Order("credential_id").
+		Scan(&credentialRows).Error; err != nil {
+		return nil, err
+	}
+
+	report := &dto.RotatingProxyUsageReport{
+		RotatingProxyID: rotatingProxyID,
+		From:            from.UTC(),
+		To:              to.UTC(),
+		Buckets:         make([]dto.RotatingProxyUsageBucket, 0, len(bucketRows)),
+		Upstreams:       make([]dto.RotatingProxyUpstreamUsage, 0, len(upstreamRows)),
+		Credentials:     make([]dto.RotatingProxyCredentialUsage, 0, len(credentialRows)),
+	}
+
+	var totals rotatingProxyUsageSumRow
+	for _, row := range bucketRows {
+		report.Buckets = append(report.Buckets, dto.RotatingProxyUsageBucket{
+			BucketStart:                row.BucketStart.UTC(),
+			RotatingProxyUsageCounters: row.counters(),
+		})
+		totals.Connections += row.Connections
+		totals.Requests += row.Requests
+		totals.BytesUp += row.BytesUp
+		totals.BytesDown += row.BytesDown
+		totals.NoUpstreamFailures += row.NoUpstreamFailures
+		totals.ConnectFailures += row.ConnectFailures
+		totals.TimeoutFailures += row.TimeoutFailures
+		totals.ResponseFailures += row.ResponseFailures
+	}
+	report.Totals = totals.counters()
+
+	addresses, err := proxyAddressesByID(upstreamRows)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range upstreamRows {
+		report.Upstreams = append(report.Upstreams, dto.RotatingProxyUpstreamUsage{
+			ProxyID:                    row.ProxyID,
+			Proxy:                      addresses[row.ProxyID],
+			RotatingProxyUsageCounters: row.counters(),
+		})
+	}
+
+	names, err := credentialNamesByID(rotatingProxyID, credentialRows)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range credentialRows {
+		report.Credentials = append(report.Credentials, dto.RotatingProxyCredentialUsage{
+			CredentialID:               row.CredentialID,
+			Name:                       names[row.CredentialID],
+			RotatingProxyUsageCounters: row.counters(),
+		})
+	}
+
+	return report, nil
+}
+
+// PruneRotatingProxyUsage deletes usage buckets that started before cutoff.
+func PruneRotatingProxyUsage(cutoff time.Time) (int64, error) {
+	if DB == nil {
+		return 0, fmt.Errorf("rotating proxy usage: database connection was not initialised")
+	}
+
+	res := DB.Where("bucket_start < ?", cutoff.UTC()).Delete(&domain.RotatingProxyUsage{})
+	return res.RowsAffected, res.Error
+}
+
+func proxyAddressesByID(rows []rotatingProxyUsageSumRow) (map[uint64]string, error) {
+	ids := make([]uint64, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ProxyID)
+	}
+	addresses := make(map[uint64]string, len(ids))
+	if len(ids) == 0 {
+		return addresses, nil
+	}
+
+	var proxies []domain.Proxy
+	for chunk := range slices.Chunk(ids, 1000) {
+		proxies = proxies[:0]
+		if err := DB.Select("id", "ip", "port").Where("id IN ?", chunk).Find(&proxies).Error; err != nil {
+			return nil, err
+		}
+		for _, proxy := range proxies {
+			addresses[proxy.ID] = net.JoinHostPort(proxy.GetIp(), strconv.Itoa(int(proxy.Port)))
+		}
+	}
+	return addresses, nil
+}
+
+// credentialNamesByID resolves the names of the credentials in rows. Deleted
+// credentials keep their usage but lose their name.
+func credentialNamesByID(rotatingProxyID uint64, rows []rotatingProxyUsageSumRow) (map[uint64]string, error) {
+	names := make(map[uint64]string, len(rows))
+	if len(rows) == 0 {
+		return names, nil
+	}
+
+	var credentials []domain.RotatingProxyCredential
+	if err := DB.Select("id", "name").
+		Where("rotating_proxy_id = ?", rotatingProxyID).
+		Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	for _, credential := range credentials {
+		names[credential.ID] = credential.Name
+	}
+	return names, nil
+}
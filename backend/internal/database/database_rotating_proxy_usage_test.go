@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"magpie/internal/domain"
+)
+
+func TestRotatingProxyUsage_AccumulatesAndReports(t *testing.T) {
+	db := setupRotatingProxyTestDB(t)
+
+	user := domain.User{Email: "usage@example.com", Password: "password123"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	protocol := domain.Protocol{Name: "http"}
+	if err := db.Create(&protocol).Error; err != nil {
+		t.Fatalf("create protocol: %v", err)
+	}
+	proxy := domain.Proxy{IP: "10.0.0.7", Port: 3128}
+	if err := db.Create(&proxy).Error; err != nil {
+		t.Fatalf("create proxy: %v", err)
+	}
+	rotator := domain.RotatingProxy{UserID: user.ID, Name: "usage-rotator", ProtocolID: protocol.ID, ListenPort: 10600}
+	if err := db.Create(&rotator).Error; err != nil {
+		t.Fatalf("create rotating proxy: %v", err)
+	}
+
+	bucket := RotatingProxyUsageBucketStart(time.Now())
+	previous := bucket.Add(-RotatingProxyUsageBucketSize)
+	entry := func(proxyID uint64, start time.Time, apply func(*domain.RotatingProxyUsage)) domain.RotatingProxyUsage {
+		usage := domain.RotatingProxyUsage{RotatingProxyID: rotator.ID, ProxyID: proxyID, BucketStart: start, UserID: user.ID}
+		apply(&usage)
+		return usage
+	}
+
+	if err := AddRotatingProxyUsage([]domain.RotatingProxyUsage{
+		entry(0, bucket, func(u *domain.RotatingProxyUsage) { u.Connections = 2 }),
+		entry(proxy.ID, bucket, func(u *domain.RotatingProxyUsage) { u.Requests, u.BytesUp, u.BytesDown = 1, 100, 400 }),
+		entry(proxy.ID, previous, func(u *domain.RotatingProxyUsage) { u.ConnectFailures = 1 }),
+	}); err != nil {
+		t.Fatalf("AddRotatingProxyUsage first batch: %v", err)
+	}
+	if err := AddRotatingProxyUsage([]domain.RotatingProxyUsage{
+		entry(proxy.ID, bucket, func(u *domain.RotatingProxyUsage) { u.Requests, u.BytesUp, u.BytesDown = 2, 50, 600 }),
+	}); err != nil {
+		t.Fatalf("AddRotatingProxyUsage second batch: %v", err)
+	}
+
+	report, err := GetRotatingProxyUsage(user.ID, rotator.ID, previous, bucket.Add(RotatingProxyUsageBucketSize))
+	if err != nil {
+		t.Fatalf("GetRotatingProxyUsage: %v", err)
+	}
+
+	totals := report.Totals
+	if totals.Connections != 2 || totals.Requests != 3 || totals.BytesUp != 150 || totals.BytesDown != 1000 || totals.Failures.Connect != 1 {
+		t.Fatalf("totals = %+v, want 2 connections, 3 requests, 150/1000 bytes and 1 connect failure", totals)
+	}
+	if len(report.Buckets) != 2 || !report.Buckets[0].BucketStart.Equal(previous) || report.Buckets[1].Requests != 3 {
+		t.Fatalf("buckets = %+v, want the previous and the current hour", report.Buckets)
+	}
+	if len(report.Upstreams) != 1 || report.Upstreams[0].ProxyID != proxy.ID || report.Upstreams[0].Proxy != "10.0.0.7:3128" {
+		t.Fatalf("upstreams = %+v, want proxy %d at 10.0.0.7:3128", report.Upstreams, proxy.ID)
+	}
+
+	if _, err := GetRotatingProxyUsage(user.ID+1, rotator.ID, previous, bucket); !errors.Is(err, ErrRotatingProxyNotFound) {
+		t.Fatalf("usage of another user's rotator: err = %v, want ErrRotatingProxyNotFound", err)
+	}
+	if _, err := GetRotatingProxyUsage(user.ID, rotator.ID, bucket, previous); !errors.Is(err, ErrRotatingProxyUsageRangeInvalid) {
+		t.Fatalf("reversed range: err = %v, want ErrRotatingProxyUsageRangeInvalid", err)
+	}
+
+	if _, err := PruneRotatingProxyUsage(bucket); err != nil {
+		t.Fatalf("PruneRotatingProxyUsage: %v", err)
+	}
+	var remaining int64
+	if err := db.Model(&domain.RotatingProxyUsage{}).Count(&remaining).Error; err != nil {
+		t.Fatalf("count usage rows: %v", err)
+	}
+	if remaining != 2 {
+		t.Fatalf("remaining usage rows = %d, want 2", remaining)
+	}
+}
@@ -0,0 +1,64 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// IDList stores a slice of record IDs inside a JSON column.
+type IDList []uint64
+
+// Value implements driver.Valuer so IDList can be stored as JSON.
+func (l IDList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return []byte("[]"), nil
+	}
+
+	data, err := json.Marshal([]uint64(l))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Scan implements sql.Scanner to hydrate the IDList from the database.
+func (l *IDList) Scan(value any) error {
+	if value == nil {
+		*l = nil
+		return nil
+	}
+
+	switch v := value.(type) {
+	case []byte:
+		return l.unmarshal(v)
+	case string:
+		return l.unmarshal([]byte(v))
+	default:
+		return fmt.Errorf("domain.IDList: unsupported type %T", value)
+	}
+}
+
+func (l *IDList) unmarshal(data []byte) error {
+	if len(data) == 0 {
+		*l = nil
+		return nil
+	}
+
+	var parsed []uint64
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// Clone returns a copy of the underlying slice to avoid sharing memory.
+func (l IDList) Clone() []uint64 {
+	if len(l) == 0 {
+		return nil
+	}
+	out := make([]uint64, len(l))
+	copy(out, l)
+	return out
+}
@@ -0,0 +1,18 @@
+package domain
+
+import "time"
+
+// ProxyTrafficStat collects what rotating proxies observed while relaying
+// client traffic through a proxy, per hourly UTC bucket. It complements the
+// scheduled checks in ProxyStatistic.
+type ProxyTrafficStat struct {
+	ProxyID          uint64    `gorm:"primaryKey;autoIncrement:false"`
+	BucketStart      time.Time `gorm:"primaryKey;index"`
+	Attempts         int64     `gorm:"not null;default:0"`
+	Successes        int64     `gorm:"not null;default:0"`
+	TLSErrors        int64     `gorm:"not null;default:0"`
+	HandshakeSamples int64     `gorm:"not null;default:0"`
+	HandshakeMSTotal int64     `gorm:"not null;default:0"`
+
+	Proxy Proxy `gorm:"foreignKey:ProxyID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
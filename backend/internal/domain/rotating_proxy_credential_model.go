@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"time"
+
+	"magpie/internal/security"
+
+	"gorm.io/gorm"
+)
+
+// RotatingProxyCredential is an additional username/password pair for a
+// rotator, so clients sharing a rotator can be told apart and limited
+// individually. Zero limits mean unlimited.
+type RotatingProxyCredential struct {
+	ID                  uint64     `gorm:"primaryKey;autoIncrement"`
+	RotatingProxyID     uint64     `gorm:"not null;uniqueIndex:idx_rotating_credential_name,priority:1"`
+	UserID              uint       `gorm:"not null;index"`
+	Name                string     `gorm:"not null;size:120;uniqueIndex:idx_rotating_credential_name,priority:2"`
+	Password            string     `gorm:"-" json:"-"`
+	PasswordEncrypted   string     `gorm:"column:password;default:''"`
+	ExpiresAt           *time.Time `gorm:"index"`
+	MaxConnections      int        `gorm:"not null;default:0"`
+	BandwidthQuotaBytes int64      `gorm:"not null;default:0"`
+	BytesUsed           int64      `gorm:"not null;default:0"`
+	CreatedAt           time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt           time.Time  `gorm:"autoUpdateTime"`
+}
+
+func (RotatingProxyCredential) TableName() string {
+	return "rotating_proxy_credentials"
+}
+
+// Expired reports whether the credential can no longer be used at now.
+func (c *RotatingProxyCredential) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+func (c *RotatingProxyCredential) BeforeSave(_ *gorm.DB) error {
+	if c.Password == "" {
+		c.PasswordEncrypted = ""
+		return nil
+	}
+	encrypted, err := security.EncryptProxySecret(c.Password)
+	if err != nil {
+		return err
+	}
+	c.PasswordEncrypted = encrypted
+	return nil
+}
+
+func (c *RotatingProxyCredential) AfterFind(_ *gorm.DB) error {
+	if c.PasswordEncrypted == "" {
+		c.Password = ""
+		return nil
+	}
+
+	password, _, err := security.DecryptProxySecret(c.PasswordEncrypted)
+	if err != nil {
+		return err
+	}
+	c.Password = password
+	return nil
+}
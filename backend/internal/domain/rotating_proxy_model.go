@@ -11,27 +11,64 @@ import (
 )
 
 type RotatingProxy struct {
-	ID                      uint64     `gorm:"primaryKey;autoIncrement"`
-	UserID                  uint       `gorm:"not null;index:idx_rotating_user_name,priority:1"`
-	Name                    string     `gorm:"not null;size:120;index:idx_rotating_user_name,priority:2"`
-	InstanceID              string     `gorm:"size:191;index:idx_rotating_instance_port,priority:1"`
-	InstanceName            string     `gorm:"size:120;default:''"`
-	InstanceRegion          string     `gorm:"size:120;default:''"`
-	ProtocolID              int        `gorm:"not null;index"`
-	Protocol                Protocol   `gorm:"foreignKey:ProtocolID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
-	ListenProtocolID        int        `gorm:"index"`
-	ListenProtocol          Protocol   `gorm:"foreignKey:ListenProtocolID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
-	TransportProtocol       string     `gorm:"not null;default:'tcp'"`
-	ListenTransportProtocol string     `gorm:"not null;default:'tcp'"`
-	UptimeFilterType        string     `gorm:"size:8;default:''"`
-	UptimePercentage        *float64   `gorm:"type:numeric(5,2)"`
-	ListenPort              uint16     `gorm:"uniqueIndex:idx_rotating_instance_port,priority:2"`
-	AuthRequired            bool       `gorm:"not null;default:false"`
-	AuthUsername            string     `gorm:"size:120;default:''"`
-	AuthPassword            string     `gorm:"-" json:"-"`
-	AuthPasswordEncrypted   string     `gorm:"column:auth_password;default:''"`
-	ReputationLabels        StringList `gorm:"type:jsonb;default:'[]'"`
-	LastProxyID             *uint64    `gorm:"column:last_proxy_id"`
+	ID                      uint64                    `gorm:"primaryKey;autoIncrement"`
+	UserID                  uint                      `gorm:"not null;index:idx_rotating_user_name,priority:1"`
+	Name                    string                    `gorm:"not null;size:120;index:idx_rotating_user_name,priority:2"`
+	InstanceID              string                    `gorm:"size:191;index:idx_rotating_instance_port,priority:1"`
+	InstanceName            string                    `gorm:"size:120;default:''"`
+	InstanceRegion          string                    `gorm:"size:120;default:''"`
+	ReplicaInstanceIDs      StringList                `gorm:"type:jsonb;default:'[]'"`
+	ReplicaRegion           string                    `gorm:"size:120;default:''"`
+	Replicated              bool                      `gorm:"not null;default:false;index"`
+	HandshakeTimeoutMS      int                       `gorm:"not null;default:0"`
+	UpstreamTimeoutMS       int                       `gorm:"not null;default:0"`
+	DNSMode                 string                    `gorm:"size:16;not null;default:'remote'"`
+	FailoverRetries         int                       `gorm:"not null;default:0"`
+	FailoverCooldownSeconds int                       `gorm:"not null;default:0"`
+	ProtocolID              int                       `gorm:"not null;index"`
+	Protocol                Protocol                  `gorm:"foreignKey:ProtocolID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
+	ListenProtocolID        int                       `gorm:"index"`
+	ListenProtocol          Protocol                  `gorm:"foreignKey:ListenProtocolID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
+	TransportProtocol       string                    `gorm:"not null;default:'tcp'"`
+	ListenTransportProtocol string                    `gorm:"not null;default:'tcp'"`
+	UptimeFilterType        string                    `gorm:"size:8;default:''"`
+	UptimePercentage        *float64                  `gorm:"type:numeric(5,2)"`
+	ListenPort              uint16                    `gorm:"uniqueIndex:idx_rotating_instance_port,priority:2"`
+	AuthRequired            bool                      `gorm:"not null;default:false"`
+	AuthUsername            string                    `gorm:"size:120;default:''"`
+	AuthPassword            string                    `gorm:"-" json:"-"`
+	AuthPasswordEncrypted   string                    `gorm:"column:auth_password;default:''"`
+	ReputationLabels        StringList                `gorm:"type:jsonb;default:'[]'"`
+	StickySessionTTLSeconds int                       `gorm:"not null;default:0"`
+	SelectionStrategy       string                    `gorm:"size:32;not null;default:'round_robin'"`
+	Countries               StringList                `gorm:"type:jsonb;default:'[]'"`
+	ProxyTypes              StringList                `gorm:"type:jsonb;default:'[]'"`
+	AnonymityLevels         StringList                `gorm:"type:jsonb;default:'[]'"`
+	AllowedClientCIDRs      StringList                `gorm:"type:jsonb;default:'[]'"`
+	ClientAuthMode          string                    `gorm:"size:32;not null;default:'ip_and_credentials'"`
+	RotationMode            string                    `gorm:"size:32;not null;default:'per_request'"`
+	RotationIntervalSeconds int                       `gorm:"not null;default:0"`
+	RotationRequests        int                       `gorm:"not null;default:0"`
+	ParentProtocol          string                    `gorm:"size:16;default:''"`
+	ParentHost              string                    `gorm:"size:255;default:''"`
+	ParentPort              uint16                    `gorm:"not null;default:0"`
+	ParentUsername          string                    `gorm:"size:255;default:''"`
+	ParentPassword          string                    `gorm:"-" json:"-"`
+	ParentPasswordEncrypted string                    `gorm:"column:parent_password;default:''"`
+	AllowedDestinations     StringList                `gorm:"type:jsonb;default:'[]'"`
+	BlockedDestinations     StringList                `gorm:"type:jsonb;default:'[]'"`
+	MaxTunnels              int                       `gorm:"not null;default:0"`
+	ConnectionsPerSecond    int                       `gorm:"not null;default:0"`
+	RequestsPerSecond       int                       `gorm:"not null;default:0"`
+	LimitScope              string                    `gorm:"size:16;not null;default:'rotator'"`
+	StripRequestHeaders     StringList                `gorm:"type:jsonb;default:'[]'"`
+	InjectRequestHeaders    StringList                `gorm:"type:jsonb;default:'[]'"`
+	UpstreamIDHeader        string                    `gorm:"size:64;default:''"`
+	PinnedProxyIDs          IDList                    `gorm:"type:jsonb;default:'[]'"`
+	FallbackTiers           RotatingProxyTiers        `gorm:"type:jsonb;default:'[]'"`
+	UpstreamTierHeader      string                    `gorm:"size:64;default:''"`
+	Credentials             []RotatingProxyCredential `gorm:"foreignKey:RotatingProxyID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	LastProxyID             *uint64                   `gorm:"column:last_proxy_id"`
 	LastRotationAt          *time.Time
 	CreatedAt               time.Time `gorm:"autoCreateTime"`
 	UpdatedAt               time.Time `gorm:"autoUpdateTime"`
@@ -51,6 +88,7 @@ func (rp *RotatingProxy) BeforeSave(_ *gorm.DB) error {
 	if strings.TrimSpace(rp.InstanceRegion) == "" {
 		rp.InstanceRegion = "Unknown"
 	}
+	rp.Replicated = strings.TrimSpace(rp.ReplicaRegion) != "" || len(rp.ReplicaInstanceIDs) > 0
 
 	if rp.ListenProtocolID == 0 {
 		rp.ListenProtocolID = rp.ProtocolID
@@ -75,20 +113,37 @@ func (rp *RotatingProxy) BeforeSave(_ *gorm.DB) error {
 	} else {
 		rp.AuthPasswordEncrypted = ""
 	}
+
+	if rp.ParentHost != "" && rp.ParentPassword != "" {
+		encrypted, err := security.EncryptProxySecret(rp.ParentPassword)
+		if err != nil {
+			return err
+		}
+		rp.ParentPasswordEncrypted = encrypted
+	} else {
+		rp.ParentPasswordEncrypted = ""
+	}
 	return nil
 }
 
 func (rp *RotatingProxy) AfterFind(_ *gorm.DB) error {
-	if rp.AuthPasswordEncrypted == "" {
-		rp.AuthPassword = ""
-		return nil
+	rp.AuthPassword = ""
+	if rp.AuthPasswordEncrypted != "" {
+		password, _, err := security.DecryptProxySecret(rp.AuthPasswordEncrypted)
+		if err != nil {
+			return err
+		}
+		rp.AuthPassword = password
 	}
 
-	password, _, err := security.DecryptProxySecret(rp.AuthPasswordEncrypted)
-	if err != nil {
-		return err
+	rp.ParentPassword = ""
+	if rp.ParentPasswordEncrypted != "" {
+		password, _, err := security.DecryptProxySecret(rp.ParentPasswordEncrypted)
+		if err != nil {
+			return err
+		}
+		rp.ParentPassword = password
 	}
-	rp.AuthPassword = password
 	return nil
 }
 
@@ -0,0 +1,65 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// RotatingProxyTier is a fallback pool of a rotator. Its filters replace the
+// rotator's own reputation, type and anonymity filters; empty lists accept
+// any value.
+type RotatingProxyTier struct {
+	ReputationLabels []string `json:"reputation_labels,omitempty"`
+	Types            []string `json:"types,omitempty"`
+	AnonymityLevels  []string `json:"anonymity_levels,omitempty"`
+}
+
+// RotatingProxyTiers stores the ordered fallback tiers of a rotator inside a
+// JSON column.
+type RotatingProxyTiers []RotatingProxyTier
+
+// Value implements driver.Valuer so RotatingProxyTiers can be stored as JSON.
+func (t RotatingProxyTiers) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return []byte("[]"), nil
+	}
+
+	data, err := json.Marshal([]RotatingProxyTier(t))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Scan implements sql.Scanner to hydrate the RotatingProxyTiers from the
+// database.
+func (t *RotatingProxyTiers) Scan(value any) error {
+	if value == nil {
+		*t = nil
+		return nil
+	}
+
+	switch v := value.(type) {
+	case []byte:
+		return t.unmarshal(v)
+	case string:
+		return t.unmarshal([]byte(v))
+	default:
+		return fmt.Errorf("domain.RotatingProxyTiers: unsupported type %T", value)
+	}
+}
+
+func (t *RotatingProxyTiers) unmarshal(data []byte) error {
+	if len(data) == 0 {
+		*t = nil
+		return nil
+	}
+
+	var parsed []RotatingProxyTier
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
@@ -0,0 +1,29 @@
+package domain
+
+import "time"
+
+// RotatingProxyUsage stores the traffic of one rotator through one upstream
+// per hourly UTC bucket. ProxyID 0 collects what cannot be tied to an
+// upstream, such as accepted client connections and selection failures.
+// CredentialID attributes the traffic to one of the rotator's credentials;
+// 0 stands for the rotator's own username and unauthenticated clients.
+// UserID is kept so usage stays attributable after the rotator is deleted.
+type RotatingProxyUsage struct {
+	RotatingProxyID    uint64    `gorm:"primaryKey;autoIncrement:false"`
+	ProxyID            uint64    `gorm:"primaryKey;autoIncrement:false"`
+	CredentialID       uint64    `gorm:"primaryKey;autoIncrement:false"`
+	BucketStart        time.Time `gorm:"primaryKey;index"`
+	UserID             uint      `gorm:"not null;index"`
+	Connections        int64     `gorm:"not null;default:0"`
+	Requests           int64     `gorm:"not null;default:0"`
+	BytesUp            int64     `gorm:"not null;default:0"`
+	BytesDown          int64     `gorm:"not null;default:0"`
+	NoUpstreamFailures int64     `gorm:"not null;default:0"`
+	ConnectFailures    int64     `gorm:"not null;default:0"`
+	TimeoutFailures    int64     `gorm:"not null;default:0"`
+	ResponseFailures   int64     `gorm:"not null;default:0"`
+}
+
+func (RotatingProxyUsage) TableName() string {
+	return "rotating_proxy_usage"
+}
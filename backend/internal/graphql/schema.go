@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strconv"
 	"time"
 
 	gql "github.com/graphql-go/graphql"
@@ -19,11 +20,12 @@ type viewerData struct {
 }
 
 const (
-	defaultViewerProxyHistoryLimit = 168
-	maxViewerProxyHistoryLimit     = 720
-	maxViewerProxySnapshotLimit    = 720
-	defaultRecentProxyChecksLimit  = 8
-	maxRecentProxyChecksLimit      = 50
+	defaultViewerProxyHistoryLimit  = 168
+	maxViewerProxyHistoryLimit      = 720
+	maxViewerProxySnapshotLimit     = 720
+	defaultRecentProxyChecksLimit   = 8
+	maxRecentProxyChecksLimit       = 50
+	defaultRotatingProxyUsageWindow = 24 * time.Hour
 )
 
 func NewSchema() (gql.Schema, error) {
@@ -208,6 +210,68 @@ func NewSchema() (gql.Schema, error) {
 		},
 	})
 
+	rotatingProxyUsageFailuresType := gql.NewObject(gql.ObjectConfig{
+		Name: "RotatingProxyUsageFailures",
+		Fields: gql.Fields{
+			"noUpstream": &gql.Field{Type: gql.NewNonNull(gql.Float)},
+			"connect":    &gql.Field{Type: gql.NewNonNull(gql.Float)},
+			"timeout":    &gql.Field{Type: gql.NewNonNull(gql.Float)},
+			"response":   &gql.Field{Type: gql.NewNonNull(gql.Float)},
+		},
+	})
+
+	// Counters are Floats because byte totals quickly outgrow GraphQL's 32-bit Int.
+	rotatingProxyUsageCounterFields := func() gql.Fields {
+		return gql.Fields{
+			"connections": &gql.Field{Type: gql.NewNonNull(gql.Float)},
+			"requests":    &gql.Field{Type: gql.NewNonNull(gql.Float)},
+			"bytesUp":     &gql.Field{Type: gql.NewNonNull(gql.Float)},
+			"bytesDown":   &gql.Field{Type: gql.NewNonNull(gql.Float)},
+			"failures":    &gql.Field{Type: gql.NewNonNull(rotatingProxyUsageFailuresType)},
+		}
+	}
+
+	rotatingProxyUsageCountersType := gql.NewObject(gql.ObjectConfig{
+		Name:   "RotatingProxyUsageCounters",
+		Fields: rotatingProxyUsageCounterFields(),
+	})
+
+	rotatingProxyUsageBucketFields := rotatingProxyUsageCounterFields()
+	rotatingProxyUsageBucketFields["bucketStart"] = &gql.Field{Type: gql.NewNonNull(gql.DateTime)}
+	rotatingProxyUsageBucketType := gql.NewObject(gql.ObjectConfig{
+		Name:   "RotatingProxyUsageBucket",
+		Fields: rotatingProxyUsageBucketFields,
+	})
+
+	rotatingProxyUpstreamUsageFields := rotatingProxyUsageCounterFields()
+	rotatingProxyUpstreamUsageFields["proxyId"] = &gql.Field{Type: gql.NewNonNull(gql.ID)}
+	rotatingProxyUpstreamUsageFields["proxy"] = &gql.Field{Type: gql.String}
+	rotatingProxyUpstreamUsageType := gql.NewObject(gql.ObjectConfig{
+		Name:   "RotatingProxyUpstreamUsage",
+		Fields: rotatingProxyUpstreamUsageFields,
+	})
+
+	rotatingProxyCredentialUsageFields := rotatingProxyUsageCounterFields()
+	rotatingProxyCredentialUsageFields["credentialId"] = &gql.Field{Type: gql.NewNonNull(gql.ID)}
+	rotatingProxyCredentialUsageFields["name"] = &gql.Field{Type: gql.String}
+	rotatingProxyCredentialUsageType := gql.NewObject(gql.ObjectConfig{
+		Name:   "RotatingProxyCredentialUsage",
+		Fields: rotatingProxyCredentialUsageFields,
+	})
+
+	rotatingProxyUsageReportType := gql.NewObject(gql.ObjectConfig{
+		Name: "RotatingProxyUsageReport",
+		Fields: gql.Fields{
+			"rotatingProxyId": &gql.Field{Type: gql.NewNonNull(gql.ID)},
+			"from":            &gql.Field{Type: gql.NewNonNull(gql.DateTime)},
+			"to":              &gql.Field{Type: gql.NewNonNull(gql.DateTime)},
+			"totals":          &gql.Field{Type: gql.NewNonNull(rotatingProxyUsageCountersType)},
+			"buckets":         &gql.Field{Type: gql.NewNonNull(gql.NewList(gql.NewNonNull(rotatingProxyUsageBucketType)))},
+			"upstreams":       &gql.Field{Type: gql.NewNonNull(gql.NewList(gql.NewNonNull(rotatingProxyUpstreamUsageType)))},
+			"credentials":     &gql.Field{Type: gql.NewNonNull(gql.NewList(gql.NewNonNull(rotatingProxyCredentialUsageType)))},
+		},
+	})
+
 	viewerType := gql.NewObject(gql.ObjectConfig{
 		Name: "Viewer",
 		Fields: gql.Fields{
@@ -376,6 +440,38 @@ func NewSchema() (gql.Schema, error) {
 					}, nil
 				},
 			},
+			"rotatingProxyUsage": &gql.Field{
+				Type: rotatingProxyUsageReportType,
+				Args: gql.FieldConfigArgument{
+					"id":   &gql.ArgumentConfig{Type: gql.NewNonNull(gql.ID)},
+					"from": &gql.ArgumentConfig{Type: gql.DateTime},
+					"to":   &gql.ArgumentConfig{Type: gql.DateTime},
+				},
+				Resolve: func(p gql.ResolveParams) (interface{}, error) {
+					data, ok := p.Source.(*viewerData)
+					if !ok {
+						return nil, nil
+					}
+					rawID, _ := p.Args["id"].(string)
+					id, err := strconv.ParseUint(rawID, 10, 64)
+					if err != nil {
+						return nil, fmt.Errorf("invalid rotating proxy id")
+					}
+					to := time.Now()
+					if raw, ok := p.Args["to"].(time.Time); ok {
+						to = raw
+					}
+					from := to.Add(-defaultRotatingProxyUsageWindow)
+					if raw, ok := p.Args["from"].(time.Time); ok {
+						from = raw
+					}
+					report, err := database.GetRotatingProxyUsage(data.user.ID, id, from, to)
+					if err != nil {
+						return nil, err
+					}
+					return buildRotatingProxyUsage(report), nil
+				},
+			},
 			"scrapeSources": &gql.Field{
 				Type: gql.NewNonNull(scrapeSitePageType),
 				Args: gql.FieldConfigArgument{
@@ -739,6 +835,56 @@ func buildDashboard(info dto.DashboardInfo) map[string]interface{} {
 	return result
 }
 
+func buildRotatingProxyUsage(report *dto.RotatingProxyUsageReport) map[string]interface{} {
+	buckets := make([]map[string]interface{}, 0, len(report.Buckets))
+	for _, bucket := range report.Buckets {
+		entry := graphQLUsageCounters(bucket.RotatingProxyUsageCounters)
+		entry["bucketStart"] = bucket.BucketStart
+		buckets = append(buckets, entry)
+	}
+
+	upstreams := make([]map[string]interface{}, 0, len(report.Upstreams))
+	for _, upstream := range report.Upstreams {
+		entry := graphQLUsageCounters(upstream.RotatingProxyUsageCounters)
+		entry["proxyId"] = strconv.FormatUint(upstream.ProxyID, 10)
+		entry["proxy"] = upstream.Proxy
+		upstreams = append(upstreams, entry)
+	}
+
+	credentials := make([]map[string]interface{}, 0, len(report.Credentials))
+	for _, credential := range report.Credentials {
+		entry := graphQLUsageCounters(credential.RotatingProxyUsageCounters)
+		entry["credentialId"] = strconv.FormatUint(credential.CredentialID, 10)
+		entry["name"] = credential.Name
+		credentials = append(credentials, entry)
+	}
+
+	return map[string]interface{}{
+		"rotatingProxyId": strconv.FormatUint(report.RotatingProxyID, 10),
+		"from":            report.From,
+		"to":              report.To,
+		"totals":          graphQLUsageCounters(report.Totals),
+		"buckets":         buckets,
+		"upstreams":       upstreams,
+		"credentials":     credentials,
+	}
+}
+
+func graphQLUsageCounters(counters dto.RotatingProxyUsageCounters) map[string]interface{} {
+	return map[string]interface{}{
+		"connections": float64(counters.Connections),
+		"requests":    float64(counters.Requests),
+		"bytesUp":     float64(counters.BytesUp),
+		"bytesDown":   float64(counters.BytesDown),
+		"failures": map[string]interface{}{
+			"noUpstream": float64(counters.Failures.NoUpstream),
+			"connect":    float64(counters.Failures.Connect),
+			"timeout":    float64(counters.Failures.Timeout),
+			"response":   float64(counters.Failures.Response),
+		},
+	}
+}
+
 func applyUserSettings(ctx context.Context, input map[string]interface{}) error {
 	if input == nil {
 		return fmt.Errorf("missing input")
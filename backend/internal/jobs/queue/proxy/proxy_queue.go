@@ -548,6 +548,53 @@ func (rpq *RedisProxyQueue) RequeueProxy(proxy domain.Proxy, lastCheckTime time.
 	return err
 }
 
+// ExpediteChecks moves queued proxies to the front of the queue so they are
+// checked right away. Proxies that are not queued are left alone.
+func (rpq *RedisProxyQueue) ExpediteChecks(proxies []domain.Proxy) error {
+	if rpq == nil {
+		return errors.New("redis proxy queue is nil")
+	}
+	if len(proxies) == 0 {
+		return nil
+	}
+
+	client, err := rpq.clientOrErr()
+	if err != nil {
+		return err
+	}
+	ctx := rpq.baseContext()
+
+	now := float64(time.Now().UnixMilli())
+	pipe := client.Pipeline()
+	queued := 0
+	for _, proxy := range proxies {
+		if len(proxy.Hash) == 0 {
+			continue
+		}
+		hashKey := string(proxy.Hash)
+		queueKey := rpq.queueKeyForMember(hashKey)
+
+		pipe.ZAddArgs(ctx, queueKey, redis.ZAddArgs{
+			XX:      true,
+			LT:      true,
+			Members: []redis.Z{{Score: now, Member: hashKey}},
+		})
+		pipe.ZAddArgs(ctx, proxyQueueHeadKey, redis.ZAddArgs{
+			LT:      true,
+			Members: []redis.Z{{Score: now, Member: queueKey}},
+		})
+		queued++
+	}
+	if queued == 0 {
+		return nil
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("expedite pipeline exec failed: %w", err)
+	}
+	return nil
+}
+
 func (rpq *RedisProxyQueue) getEffectiveCheckInterval() time.Duration {
 	fallback := config.GetTimeBetweenChecks()
 	client, err := rpq.clientOrErr()
@@ -250,3 +250,42 @@ func TestRequeueAll_ReschedulesQueuedMembersAcrossInterval(t *testing.T) {
 		t.Fatalf("queue head member = %v, want %q", headEntries[0].Member, legacyQueueKey)
 	}
 }
+
+func TestExpediteChecks_MovesQueuedProxiesToFront(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis.Run failed: %v", err)
+	}
+	defer redisServer.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	defer client.Close()
+
+	queue := NewRedisProxyQueue(client)
+	ctx := context.Background()
+
+	queued := domain.Proxy{ID: 1, Hash: []byte("queued-hash")}
+	unqueued := domain.Proxy{ID: 2, Hash: []byte("unqueued-hash")}
+	queueKey := queue.queueKeyForMember(string(queued.Hash))
+	later := float64(time.Now().Add(time.Hour).UnixMilli())
+	if err := client.ZAdd(ctx, queueKey, redis.Z{Score: later, Member: string(queued.Hash)}).Err(); err != nil {
+		t.Fatalf("seed queue: %v", err)
+	}
+
+	if err := queue.ExpediteChecks([]domain.Proxy{queued, unqueued}); err != nil {
+		t.Fatalf("ExpediteChecks failed: %v", err)
+	}
+
+	score, err := client.ZScore(ctx, queueKey, string(queued.Hash)).Result()
+	if err != nil {
+		t.Fatalf("read queued score: %v", err)
+	}
+	if score >= later || score > float64(time.Now().UnixMilli()) {
+		t.Fatalf("queued proxy score = %f, want it due now", score)
+	}
+
+	unqueuedKey := queue.queueKeyForMember(string(unqueued.Hash))
+	if _, err := client.ZScore(ctx, unqueuedKey, string(unqueued.Hash)).Result(); !errors.Is(err, redis.Nil) {
+		t.Fatalf("expected unqueued proxy to stay out of the queue, got err=%v", err)
+	}
+}
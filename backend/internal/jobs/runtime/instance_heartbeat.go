@@ -10,6 +10,7 @@ import (
 	"github.com/charmbracelet/log"
 	"github.com/redis/go-redis/v9"
 
+	"magpie/internal/config"
 	"magpie/internal/support"
 )
 
@@ -28,17 +29,26 @@ type ActiveInstance struct {
 	Region    string `json:"region"`
 	PortStart int    `json:"port_start"`
 	PortEnd   int    `json:"port_end"`
+	// Host is the public address of the instance, empty until it is known.
+	Host string `json:"host,omitempty"`
+	// Gateway ports are 0 when the instance runs no shared gateway.
+	GatewayHTTPPort   int `json:"gateway_http_port,omitempty"`
+	GatewaySOCKS5Port int `json:"gateway_socks5_port,omitempty"`
 }
 
 func currentInstancePayload() ActiveInstance {
 	instanceID := currentInstanceID()
 	start, end := support.GetRotatingProxyPortRange()
+	gatewayHTTP, gatewaySOCKS5 := support.GetRotatingProxyGatewayPorts()
 	return ActiveInstance{
-		ID:        instanceID,
-		Name:      support.GetInstanceName(),
-		Region:    support.GetInstanceRegion(),
-		PortStart: start,
-		PortEnd:   end,
+		ID:                instanceID,
+		Name:              support.GetInstanceName(),
+		Region:            support.GetInstanceRegion(),
+		PortStart:         start,
+		PortEnd:           end,
+		Host:              strings.TrimSpace(config.GetCurrentIp()),
+		GatewayHTTPPort:   gatewayHTTP,
+		GatewaySOCKS5Port: gatewaySOCKS5,
 	}
 }
 
@@ -57,9 +67,11 @@ func StartInstanceHeartbeat(ctx context.Context, client *redis.Client, keyPrefix
 	}
 	instanceID := currentInstanceID()
 	heartbeatKey := heartbeatKeyForInstance(instanceID, keyPrefix)
-	heartbeatValue, _ := json.Marshal(currentInstancePayload())
 
+	// The payload is rebuilt on every beat since the public address is only
+	// discovered after startup.
 	sendHeartbeat := func() {
+		heartbeatValue, _ := json.Marshal(currentInstancePayload())
 		expiresAt := time.Now().Add(ttl).UnixMilli()
 		pipe := client.Pipeline()
 		pipe.SetEx(ctx, heartbeatKey, heartbeatValue, ttl)
@@ -219,6 +231,9 @@ func ListActiveInstances(ctx context.Context, client *redis.Client) ([]ActiveIns
 					instance.Region = strings.TrimSpace(payload.Region)
 					instance.PortStart = payload.PortStart
 					instance.PortEnd = payload.PortEnd
+					instance.Host = strings.TrimSpace(payload.Host)
+					instance.GatewayHTTPPort = payload.GatewayHTTPPort
+					instance.GatewaySOCKS5Port = payload.GatewaySOCKS5Port
 				}
 			} else {
 				staleIDs = append(staleIDs, instance.ID)
@@ -267,6 +267,12 @@ func StartProxyStatisticsRoutine(ctx context.Context) {
 		}()
 	}
 
+	workerWG.Add(1)
+	go func() {
+		defer workerWG.Done()
+		runProxyTrafficWorker(ctx, dirtyProxyIDsQueue)
+	}()
+
 	<-ctx.Done()
 	workerWG.Wait()
 	close(dirtyProxyIDsQueue)
@@ -0,0 +1,194 @@
+package runtime
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	proxyTrafficRetention     = 7 * 24 * time.Hour
+	proxyTrafficPruneInterval = time.Hour
+)
+
+var (
+	addProxyTrafficStatsFunc   = database.AddProxyTrafficStats
+	pruneProxyTrafficStatsFunc = database.PruneProxyTrafficStats
+	existingProxyIDSetFunc     = database.GetExistingProxyIDSet
+
+	proxyTraffic = newProxyTrafficAggregator()
+)
+
+// ProxyTrafficObservation is the outcome of one attempt by a rotating proxy
+// to relay client traffic through a proxy.
+type ProxyTrafficObservation struct {
+	ProxyID uint64
+	Success bool
+	// TLSError reports a failed TLS handshake with the target through an
+	// otherwise working proxy.
+	TLSError  bool
+	Handshake time.Duration
+}
+
+type proxyTrafficKey struct {
+	proxyID uint64
+	bucket  time.Time
+}
+
+// proxyTrafficAggregator sums observations in memory until the statistics
+// routine stores them, so relaying traffic never waits for the database.
+type proxyTrafficAggregator struct {
+	mu        sync.Mutex
+	pending   map[proxyTrafficKey]*domain.ProxyTrafficStat
+	lastPrune time.Time
+}
+
+func newProxyTrafficAggregator() *proxyTrafficAggregator {
+	return &proxyTrafficAggregator{pending: make(map[proxyTrafficKey]*domain.ProxyTrafficStat)}
+}
+
+// AddProxyTrafficObservation records a live traffic outcome. It feeds the
+// proxy_traffic_stats buckets and the reputation of the proxy.
+func AddProxyTrafficObservation(observation ProxyTrafficObservation) {
+	proxyTraffic.add(observation, time.Now())
+}
+
+func (a *proxyTrafficAggregator) add(observation ProxyTrafficObservation, now time.Time) {
+	if observation.ProxyID == 0 {
+		return
+	}
+
+	key := proxyTrafficKey{proxyID: observation.ProxyID, bucket: database.ProxyTrafficBucketStart(now)}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.pending[key]
+	if !ok {
+		entry = &domain.ProxyTrafficStat{ProxyID: key.proxyID, BucketStart: key.bucket}
+		a.pending[key] = entry
+	}
+	entry.Attempts++
+	if observation.Success {
+		entry.Successes++
+	}
+	if observation.TLSError {
+		entry.TLSErrors++
+	}
+	if observation.Handshake > 0 {
+		entry.HandshakeSamples++
+		entry.HandshakeMSTotal += observation.Handshake.Milliseconds()
+	}
+}
+
+// flush stores the pending counters and returns the IDs of the proxies they
+// belong to. Counters that could not be stored are kept for the next flush.
+func (a *proxyTrafficAggregator) flush(ctx context.Context) ([]uint64, bool) {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = make(map[proxyTrafficKey]*domain.ProxyTrafficStat)
+	a.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil, true
+	}
+
+	seen := make(map[uint64]struct{}, len(pending))
+	proxyIDs := make([]uint64, 0, len(pending))
+	for key := range pending {
+		if _, ok := seen[key.proxyID]; !ok {
+			seen[key.proxyID] = struct{}{}
+			proxyIDs = append(proxyIDs, key.proxyID)
+		}
+	}
+
+	existing, err := existingProxyIDSetFunc(ctx, proxyIDs)
+	if err != nil {
+		log.Warn("proxy traffic: failed to load proxies", "error", err)
+		a.restore(pending)
+		return nil, false
+	}
+
+	entries := make([]domain.ProxyTrafficStat, 0, len(pending))
+	storedIDs := make([]uint64, 0, len(existing))
+	for _, proxyID := range proxyIDs {
+		if _, ok := existing[proxyID]; ok {
+			storedIDs = append(storedIDs, proxyID)
+		}
+	}
+	for key, entry := range pending {
+		if _, ok := existing[key.proxyID]; ok {
+			entries = append(entries, *entry)
+		}
+	}
+
+	if err := addProxyTrafficStatsFunc(ctx, entries); err != nil {
+		log.Warn("proxy traffic: failed to store counters", "entries", len(entries), "error", err)
+		a.restore(pending)
+		return nil, false
+	}
+	return storedIDs, true
+}
+
+func (a *proxyTrafficAggregator) restore(pending map[proxyTrafficKey]*domain.ProxyTrafficStat) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, entry := range pending {
+		current, ok := a.pending[key]
+		if !ok {
+			a.pending[key] = entry
+			continue
+		}
+		current.Attempts += entry.Attempts
+		current.Successes += entry.Successes
+		current.TLSErrors += entry.TLSErrors
+		current.HandshakeSamples += entry.HandshakeSamples
+		current.HandshakeMSTotal += entry.HandshakeMSTotal
+	}
+}
+
+func (a *proxyTrafficAggregator) prune(now time.Time) {
+	a.mu.Lock()
+	due := now.Sub(a.lastPrune) >= proxyTrafficPruneInterval
+	if due {
+		a.lastPrune = now
+	}
+	a.mu.Unlock()
+	if !due {
+		return
+	}
+
+	if _, err := pruneProxyTrafficStatsFunc(now.Add(-proxyTrafficRetention)); err != nil {
+		log.Warn("proxy traffic: failed to prune old buckets", "error", err)
+	}
+}
+
+// runProxyTrafficWorker stores live traffic observations alongside the
+// proxy statistics and marks the proxies for a reputation update.
+func runProxyTrafficWorker(ctx context.Context, dirtyProxyIDsQueue chan<- []uint64) {
+	ticker := time.NewTicker(statisticsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), statisticsInsertTimeout)
+			proxyIDs, _ := proxyTraffic.flush(flushCtx)
+			cancel()
+			publishDirtyProxyIDs(dirtyProxyIDsQueue, proxyIDs)
+			return
+		case <-ticker.C:
+			flushCtx, cancel := context.WithTimeout(ctx, statisticsInsertTimeout)
+			proxyIDs, _ := proxyTraffic.flush(flushCtx)
+			cancel()
+			publishDirtyProxyIDs(dirtyProxyIDsQueue, proxyIDs)
+			proxyTraffic.prune(time.Now())
+		}
+	}
+}
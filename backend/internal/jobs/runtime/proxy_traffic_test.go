@@ -0,0 +1,63 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"magpie/internal/domain"
+)
+
+func TestProxyTrafficAggregator_FlushSkipsRemovedProxiesAndRetries(t *testing.T) {
+	origAdd, origExisting := addProxyTrafficStatsFunc, existingProxyIDSetFunc
+	t.Cleanup(func() {
+		addProxyTrafficStatsFunc = origAdd
+		existingProxyIDSetFunc = origExisting
+	})
+
+	existingProxyIDSetFunc = func(_ context.Context, proxyIDs []uint64) (map[uint64]struct{}, error) {
+		return map[uint64]struct{}{7: {}}, nil
+	}
+
+	var stored []domain.ProxyTrafficStat
+	failStore := true
+	addProxyTrafficStatsFunc = func(_ context.Context, entries []domain.ProxyTrafficStat) error {
+		if failStore {
+			return errors.New("database unavailable")
+		}
+		stored = append(stored, entries...)
+		return nil
+	}
+
+	aggregator := newProxyTrafficAggregator()
+	now := time.Now()
+	aggregator.add(ProxyTrafficObservation{ProxyID: 7, Success: true, Handshake: 120 * time.Millisecond}, now)
+	aggregator.add(ProxyTrafficObservation{ProxyID: 7, Success: true, TLSError: true, Handshake: 80 * time.Millisecond}, now)
+	aggregator.add(ProxyTrafficObservation{ProxyID: 7}, now)
+	aggregator.add(ProxyTrafficObservation{ProxyID: 9, Success: true}, now)
+
+	if _, ok := aggregator.flush(context.Background()); ok {
+		t.Fatal("expected flush to fail")
+	}
+
+	failStore = false
+	proxyIDs, ok := aggregator.flush(context.Background())
+	if !ok {
+		t.Fatal("expected flush to succeed")
+	}
+	if len(proxyIDs) != 1 || proxyIDs[0] != 7 {
+		t.Fatalf("dirty proxy ids = %v, want [7]", proxyIDs)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("stored %d entries, want 1: %+v", len(stored), stored)
+	}
+
+	got := stored[0]
+	if got.ProxyID != 7 || got.Attempts != 3 || got.Successes != 2 || got.TLSErrors != 1 {
+		t.Fatalf("unexpected counters: %+v", got)
+	}
+	if got.HandshakeSamples != 2 || got.HandshakeMSTotal != 200 {
+		t.Fatalf("unexpected handshake counters: %+v", got)
+	}
+}
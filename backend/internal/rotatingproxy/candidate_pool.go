@@ -0,0 +1,312 @@
+package rotatingproxy
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+	"magpie/internal/support"
+)
+
+const (
+	envRotatingProxyPoolRefreshSeconds  = "ROTATING_PROXY_POOL_REFRESH_SECONDS"
+	envRotatingProxySharedRotationState = "ROTATING_PROXY_SHARED_ROTATION_STATE"
+	defaultCandidatePoolRefreshInterval = 30 * time.Second
+	candidatePoolMinRefreshInterval     = 2 * time.Second
+	rotationPersistInterval             = 5 * time.Second
+	sharedRotationStateTimeout          = 250 * time.Millisecond
+	sharedRotationCursorKeyPrefix       = "magpie:rotating_proxy:cursor:"
+)
+
+var (
+	loadRotatingProxyCandidatesFunc  = database.LoadRotatingProxyCandidates
+	recordRotatingProxyRotationFunc  = database.RecordRotatingProxyRotation
+	proxyStatusVersionFunc           = database.ProxyStatusVersion
+	sharedProxyStatusVersionFunc     = database.SharedProxyStatusVersion
+	sharedRotationCursorFunc         = nextSharedRotationCursor
+	candidatePoolRefreshInterval     = loadCandidatePoolRefreshInterval()
+	sharedRotationStateEnabled       = support.GetEnvBool(envRotatingProxySharedRotationState, false)
+	candidatePoolRotationPersistWait = rotationPersistInterval
+)
+
+// candidatePool caches the alive upstreams of one rotator so connections are
+// served without a database round trip. The pool reloads in the background
+// once it is older than the refresh interval or proxy statistics changed.
+// Pools of replicated rotators also follow statistics committed by other
+// instances.
+type candidatePool struct {
+	rotator domain.RotatingProxy
+
+	mu         sync.RWMutex
+	candidates []database.RotatingProxyCandidate
+	loaded     bool
+	loadedAt   time.Time
+	version    uint64
+
+	refreshMu  sync.Mutex
+	refreshing atomic.Bool
+
+	cursorMu    sync.Mutex
+	lastProxyID *uint64
+
+	persistMu      sync.Mutex
+	pendingProxyID uint64
+	pendingAt      time.Time
+	persistArmed   bool
+}
+
+func newCandidatePool(rotator domain.RotatingProxy) *candidatePool {
+	pool := &candidatePool{rotator: rotator}
+	if rotator.LastProxyID != nil {
+		pool.lastProxyID = new(*rotator.LastProxyID)
+	}
+	return pool
+}
+
+func (p *candidatePool) next(selection database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+	candidates, err := p.snapshot(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if !selection.IsEmpty() {
+		filtered := make([]database.RotatingProxyCandidate, 0, len(candidates))
+		for idx := range candidates {
+			if selection.Matches(&candidates[idx].Proxy) {
+				filtered = append(filtered, candidates[idx])
+			}
+		}
+		candidates = filtered
+	}
+	candidates = database.FirstRotatingProxyTier(candidates)
+	if len(candidates) == 0 {
+		return nil, database.ErrRotatingProxyNoAliveProxies
+	}
+
+	picked := p.pick(candidates, selection, candidates[0].Tier)
+	p.recordRotation(picked.Proxy.ID, time.Now())
+	return picked.Next(p.rotator.Protocol.Name), nil
+}
+
+func (p *candidatePool) pick(candidates []database.RotatingProxyCandidate, selection database.RotatingProxySelection, tier int) *database.RotatingProxyCandidate {
+	strategy := p.rotator.SelectionStrategy
+	// Every instance of a replicated rotator advances the same cursor so the
+	// members do not hand out the same upstreams in lockstep. Each selection
+	// and tier has a cursor of its own, since they index different lists.
+	if (sharedRotationStateEnabled || p.rotator.Replicated) && (strategy == "" || strategy == database.RotatingProxyStrategyRoundRobin) {
+		cursor, err := sharedRotationCursorFunc(p.rotator.ID, sharedRotationScope(selection, tier))
+		if err == nil {
+			return &candidates[cursor%uint64(len(candidates))]
+		}
+		log.Debug("rotating proxy pool: shared rotation state unavailable", "rotator_id", p.rotator.ID, "error", err)
+	}
+
+	p.cursorMu.Lock()
+	defer p.cursorMu.Unlock()
+
+	picked, _ := database.PickRotatingProxyCandidate(strategy, candidates, p.lastProxyID, selection.ActiveConnections)
+	p.lastProxyID = new(picked.Proxy.ID)
+	return picked
+}
+
+// contains reports whether proxyID is one of the loaded candidates, which
+// are ordered by proxy ID. Before the first load every upstream is assumed
+// to qualify.
+func (p *candidatePool) contains(proxyID uint64) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if !p.loaded {
+		return true
+	}
+	_, found := slices.BinarySearchFunc(p.candidates, proxyID, func(candidate database.RotatingProxyCandidate, id uint64) int {
+		return cmp.Compare(candidate.Proxy.ID, id)
+	})
+	return found
+}
+
+func (p *candidatePool) cursor() *uint64 {
+	p.cursorMu.Lock()
+	defer p.cursorMu.Unlock()
+
+	if p.lastProxyID == nil {
+		return nil
+	}
+	return new(*p.lastProxyID)
+}
+
+func (p *candidatePool) snapshot(now time.Time) ([]database.RotatingProxyCandidate, error) {
+	p.mu.RLock()
+	candidates, loaded, loadedAt, version := p.candidates, p.loaded, p.loadedAt, p.version
+	p.mu.RUnlock()
+
+	if !loaded {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+		p.mu.RLock()
+		candidates = p.candidates
+		p.mu.RUnlock()
+		return candidates, nil
+	}
+
+	age := now.Sub(loadedAt)
+	if age >= candidatePoolRefreshInterval || (age >= candidatePoolMinRefreshInterval && p.statusVersion(now) != version) {
+		p.refreshAsync()
+	}
+	return candidates, nil
+}
+
+func (p *candidatePool) refreshAsync() {
+	if !p.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer p.refreshing.Store(false)
+		if err := p.refresh(); err != nil {
+			log.Warn("rotating proxy pool: refresh failed", "rotator_id", p.rotator.ID, "error", err)
+		}
+	}()
+}
+
+func (p *candidatePool) refresh() error {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+
+	started := time.Now()
+	p.mu.RLock()
+	fresh := p.loaded && started.Sub(p.loadedAt) < candidatePoolMinRefreshInterval && p.statusVersion(started) == p.version
+	p.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	version := p.statusVersion(started)
+	candidates, err := loadRotatingProxyCandidatesFunc(p.rotator)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.candidates = candidates
+	p.loaded = true
+	p.loadedAt = started
+	p.version = version
+	p.mu.Unlock()
+	return nil
+}
+
+// statusVersion changes whenever proxy statistics the pool depends on
+// changed: those of this process and, for replicated rotators, those
+// committed by other instances.
+func (p *candidatePool) statusVersion(now time.Time) uint64 {
+	version := proxyStatusVersionFunc()
+	if p.rotator.Replicated {
+		version += sharedProxyStatus.load(now)
+	}
+	return version
+}
+
+// sharedStatusVersion caches the proxy status version published in Redis.
+// It is fetched in the background at most every
+// candidatePoolMinRefreshInterval, so pools never wait for Redis.
+type sharedStatusVersion struct {
+	value     atomic.Uint64
+	checkedAt atomic.Int64
+	checking  atomic.Bool
+}
+
+var sharedProxyStatus sharedStatusVersion
+
+func (v *sharedStatusVersion) load(now time.Time) uint64 {
+	if now.Sub(time.Unix(0, v.checkedAt.Load())) >= candidatePoolMinRefreshInterval && v.checking.CompareAndSwap(false, true) {
+		fetch := sharedProxyStatusVersionFunc
+		go func() {
+			defer v.checking.Store(false)
+			if value, err := fetch(); err == nil {
+				v.value.Store(value)
+			}
+			v.checkedAt.Store(time.Now().UnixNano())
+		}()
+	}
+	return v.value.Load()
+}
+
+func (p *candidatePool) recordRotation(proxyID uint64, at time.Time) {
+	p.persistMu.Lock()
+	defer p.persistMu.Unlock()
+
+	p.pendingProxyID = proxyID
+	p.pendingAt = at
+	if p.persistArmed {
+		return
+	}
+	p.persistArmed = true
+	time.AfterFunc(candidatePoolRotationPersistWait, p.flushRotation)
+}
+
+func (p *candidatePool) flushRotation() {
+	p.persistMu.Lock()
+	proxyID, at, armed := p.pendingProxyID, p.pendingAt, p.persistArmed
+	p.persistArmed = false
+	p.pendingProxyID = 0
+	p.persistMu.Unlock()
+
+	if !armed || proxyID == 0 {
+		return
+	}
+	if err := recordRotatingProxyRotationFunc(p.rotator.ID, proxyID, at); err != nil {
+		log.Warn("rotating proxy pool: failed to persist rotation", "rotator_id", p.rotator.ID, "error", err)
+	}
+}
+
+// sharedRotationScope names the candidate list a shared cursor indexes. The
+// rotator's full first tier keeps the plain rotator key. Upstreams excluded
+// by failover cooldowns are left out, since cooldowns are per instance; they
+// can shift an instance's picks while they last.
+func sharedRotationScope(selection database.RotatingProxySelection, tier int) string {
+	country := strings.Join(support.CountryMatchValues(selection.Country), ",")
+	proxyType := strings.ToLower(strings.TrimSpace(selection.Type))
+	if country == "" && proxyType == "" && tier == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s:%s", tier, country, proxyType)
+}
+
+func nextSharedRotationCursor(rotatorID uint64, scope string) (uint64, error) {
+	client, err := support.GetRedisClient()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedRotationStateTimeout)
+	defer cancel()
+
+	key := fmt.Sprintf("%s%d", sharedRotationCursorKeyPrefix, rotatorID)
+	if scope != "" {
+		key += ":" + scope
+	}
+	value, err := client.Incr(ctx, key).Uint64()
+	if err != nil {
+		return 0, err
+	}
+	return value - 1, nil
+}
+
+func loadCandidatePoolRefreshInterval() time.Duration {
+	seconds := support.GetEnvInt(envRotatingProxyPoolRefreshSeconds, int(defaultCandidatePoolRefreshInterval/time.Second))
+	if seconds <= 0 {
+		return defaultCandidatePoolRefreshInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
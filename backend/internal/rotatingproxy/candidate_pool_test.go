@@ -0,0 +1,250 @@
+package rotatingproxy
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func stubCandidatePool(t *testing.T, candidates []database.RotatingProxyCandidate) *atomic.Int32 {
+	t.Helper()
+
+	var loads atomic.Int32
+	originalLoad := loadRotatingProxyCandidatesFunc
+	originalRecord := recordRotatingProxyRotationFunc
+	originalVersion := proxyStatusVersionFunc
+	originalSharedVersion := sharedProxyStatusVersionFunc
+	loadRotatingProxyCandidatesFunc = func(domain.RotatingProxy) ([]database.RotatingProxyCandidate, error) {
+		loads.Add(1)
+		return candidates, nil
+	}
+	recordRotatingProxyRotationFunc = func(uint64, uint64, time.Time) error { return nil }
+	proxyStatusVersionFunc = func() uint64 { return 0 }
+	sharedProxyStatusVersionFunc = func() (uint64, error) { return 0, nil }
+	t.Cleanup(func() {
+		loadRotatingProxyCandidatesFunc = originalLoad
+		recordRotatingProxyRotationFunc = originalRecord
+		proxyStatusVersionFunc = originalVersion
+		sharedProxyStatusVersionFunc = originalSharedVersion
+	})
+	return &loads
+}
+
+func poolCandidate(id uint64, country string) database.RotatingProxyCandidate {
+	return database.RotatingProxyCandidate{
+		Proxy: domain.Proxy{ID: id, IP: "10.0.0.1", Port: 8080, Country: country},
+	}
+}
+
+func TestCandidatePool_RoundRobinWithoutReloading(t *testing.T) {
+	loads := stubCandidatePool(t, []database.RotatingProxyCandidate{
+		poolCandidate(1, "Germany"),
+		poolCandidate(2, "United States"),
+		poolCandidate(3, "Germany"),
+	})
+
+	lastProxyID := uint64(1)
+	pool := newCandidatePool(domain.RotatingProxy{ID: 9, Protocol: domain.Protocol{Name: "http"}, LastProxyID: &lastProxyID})
+
+	var served []uint64
+	for range 4 {
+		next, err := pool.next(database.RotatingProxySelection{})
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if next.Protocol != "http" {
+			t.Fatalf("protocol = %q, want http", next.Protocol)
+		}
+		served = append(served, next.ProxyID)
+	}
+
+	want := []uint64{2, 3, 1, 2}
+	for idx := range want {
+		if served[idx] != want[idx] {
+			t.Fatalf("served = %v, want %v", served, want)
+		}
+	}
+	if loads.Load() != 1 {
+		t.Fatalf("pool loaded %d times, want 1", loads.Load())
+	}
+
+	germany, err := pool.next(database.RotatingProxySelection{Country: "DE"})
+	if err != nil {
+		t.Fatalf("filtered next: %v", err)
+	}
+	if germany.ProxyID != 3 {
+		t.Fatalf("filtered proxy = %d, want 3", germany.ProxyID)
+	}
+
+	if _, err := pool.next(database.RotatingProxySelection{Country: "FR"}); !errors.Is(err, database.ErrRotatingProxyNoAliveProxies) {
+		t.Fatalf("expected ErrRotatingProxyNoAliveProxies, got %v", err)
+	}
+}
+
+func TestCandidatePool_ReloadsWhenStatisticsChange(t *testing.T) {
+	loads := stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+
+	var version atomic.Uint64
+	proxyStatusVersionFunc = version.Load
+
+	pool := newCandidatePool(domain.RotatingProxy{ID: 3})
+	if _, err := pool.next(database.RotatingProxySelection{}); err != nil {
+		t.Fatalf("next: %v", err)
+	}
+
+	version.Add(1)
+	pool.mu.Lock()
+	pool.loadedAt = time.Now().Add(-candidatePoolMinRefreshInterval)
+	pool.mu.Unlock()
+
+	if _, err := pool.next(database.RotatingProxySelection{}); err != nil {
+		t.Fatalf("next: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for loads.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if loads.Load() != 2 {
+		t.Fatalf("pool loaded %d times, want 2 after statistics changed", loads.Load())
+	}
+}
+
+func TestCandidatePool_ReplicatedPoolFollowsSharedStatusVersion(t *testing.T) {
+	loads := stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+
+	var shared atomic.Uint64
+	sharedProxyStatusVersionFunc = func() (uint64, error) { return shared.Load(), nil }
+	sharedProxyStatus.checkedAt.Store(0)
+
+	pool := newCandidatePool(domain.RotatingProxy{ID: 3, Replicated: true})
+	if _, err := pool.next(database.RotatingProxySelection{}); err != nil {
+		t.Fatalf("next: %v", err)
+	}
+
+	// Another instance committed statistics; the local version stays put.
+	shared.Add(1)
+	sharedProxyStatus.checkedAt.Store(0)
+	deadline := time.Now().Add(time.Second)
+	for loads.Load() < 2 && time.Now().Before(deadline) {
+		pool.mu.Lock()
+		pool.loadedAt = time.Now().Add(-candidatePoolMinRefreshInterval)
+		pool.mu.Unlock()
+		if _, err := pool.next(database.RotatingProxySelection{}); err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if loads.Load() < 2 {
+		t.Fatal("replicated pool did not reload after another instance changed statistics")
+	}
+}
+
+func TestCandidatePool_SharedCursorPerSelectionAndTier(t *testing.T) {
+	fallback := poolCandidate(4, "US")
+	fallback.Tier = 1
+	stubCandidatePool(t, []database.RotatingProxyCandidate{
+		poolCandidate(1, "US"), poolCandidate(2, "DE"), poolCandidate(3, "US"), fallback,
+	})
+
+	cursors := make(map[string]uint64)
+	originalCursor := sharedRotationCursorFunc
+	sharedRotationCursorFunc = func(rotatorID uint64, scope string) (uint64, error) {
+		cursor := cursors[scope]
+		cursors[scope]++
+		return cursor, nil
+	}
+	t.Cleanup(func() { sharedRotationCursorFunc = originalCursor })
+
+	pool := newCandidatePool(domain.RotatingProxy{ID: 3, Replicated: true})
+	var picked []uint64
+	for _, selection := range []database.RotatingProxySelection{{}, {Country: "us"}, {}, {Country: "US"}, {Country: "US", ExcludeProxyIDs: []uint64{1, 3}}} {
+		next, err := pool.next(selection)
+		if err != nil {
+			t.Fatalf("next(%+v): %v", selection, err)
+		}
+		picked = append(picked, next.ProxyID)
+	}
+	if want := []uint64{1, 1, 2, 3, 4}; !slices.Equal(picked, want) {
+		t.Fatalf("picked = %v, want %v", picked, want)
+	}
+	us := database.RotatingProxySelection{Country: "us"}
+	if len(cursors) != 3 || cursors[""] != 2 || cursors[sharedRotationScope(us, 0)] != 2 || cursors[sharedRotationScope(us, 1)] != 1 {
+		t.Fatalf("cursors = %v, want one per selection and tier", cursors)
+	}
+}
+
+func TestCandidatePool_PersistsRotationAsynchronously(t *testing.T) {
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, ""), poolCandidate(2, "")})
+
+	originalWait := candidatePoolRotationPersistWait
+	candidatePoolRotationPersistWait = 20 * time.Millisecond
+	t.Cleanup(func() { candidatePoolRotationPersistWait = originalWait })
+
+	var (
+		mu      sync.Mutex
+		records []uint64
+	)
+	recordRotatingProxyRotationFunc = func(rotatorID uint64, proxyID uint64, _ time.Time) error {
+		mu.Lock()
+		records = append(records, proxyID)
+		mu.Unlock()
+		return nil
+	}
+
+	pool := newCandidatePool(domain.RotatingProxy{ID: 5})
+	for range 3 {
+		if _, err := pool.next(database.RotatingProxySelection{}); err != nil {
+			t.Fatalf("next: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		count := len(records)
+		mu.Unlock()
+		if count > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 1 || records[0] != 1 {
+		t.Fatalf("persisted rotations = %v, want a single write of the latest proxy 1", records)
+	}
+}
+
+func TestCandidatePool_FallsThroughTiers(t *testing.T) {
+	fallback := poolCandidate(2, "")
+	fallback.Tier = 1
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, ""), fallback, poolCandidate(3, "")})
+
+	pool := newCandidatePool(domain.RotatingProxy{ID: 9, Protocol: domain.Protocol{Name: "http"}})
+
+	for range 3 {
+		next, err := pool.next(database.RotatingProxySelection{})
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if next.ProxyID == 2 || next.Tier != 0 {
+			t.Fatalf("served proxy %d from tier %d while tier 0 had upstreams", next.ProxyID, next.Tier)
+		}
+	}
+
+	next, err := pool.next(database.RotatingProxySelection{ExcludeProxyIDs: []uint64{1, 3}})
+	if err != nil {
+		t.Fatalf("next with tier 0 exhausted: %v", err)
+	}
+	if next.ProxyID != 2 || next.Tier != 1 {
+		t.Fatalf("served proxy %d from tier %d, want proxy 2 from tier 1", next.ProxyID, next.Tier)
+	}
+}
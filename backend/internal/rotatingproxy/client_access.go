@@ -0,0 +1,59 @@
+package rotatingproxy
+
+import (
+	"net/netip"
+	"strings"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+// checkClientAccess applies the rotator's client allowlist to a connection
+// from remoteAddr. It reports whether the client may use the rotator at all
+// and whether it still has to present valid credentials.
+//
+// Without an allowlist only AuthRequired counts. With one, the
+// ip_and_credentials mode turns away unlisted clients, while
+// ip_or_credentials lets listed clients in without credentials and asks
+// everyone else for them.
+func checkClientAccess(rotator domain.RotatingProxy, remoteAddr string) (allowed bool, credentialsRequired bool) {
+	if len(rotator.AllowedClientCIDRs) == 0 {
+		return true, rotator.AuthRequired
+	}
+
+	listed := clientAddressListed(rotator.AllowedClientCIDRs, remoteAddr)
+	if strings.EqualFold(rotator.ClientAuthMode, database.RotatingProxyClientAuthIPOrCredentials) {
+		if listed {
+			return true, false
+		}
+		return rotator.AuthRequired, true
+	}
+	return listed, rotator.AuthRequired
+}
+
+func clientAddressListed(cidrs []string, remoteAddr string) bool {
+	addr, ok := parseRemoteAddr(remoteAddr)
+	if !ok {
+		return false
+	}
+	for _, raw := range cidrs {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			continue
+		}
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRemoteAddr(remoteAddr string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	if addr, err := netip.ParseAddr(remoteAddr); err == nil {
+		return addr.Unmap().WithZone(""), true
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,150 @@
+package rotatingproxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func TestCheckClientAccess(t *testing.T) {
+	allowlist := domain.StringList{"203.0.113.0/24", "2001:db8::/32"}
+	tests := []struct {
+		name                string
+		rotator             domain.RotatingProxy
+		remoteAddr          string
+		allowed             bool
+		credentialsRequired bool
+	}{
+		{
+			name:                "no allowlist keeps credential setting",
+			rotator:             domain.RotatingProxy{AuthRequired: true},
+			remoteAddr:          "198.51.100.1:4000",
+			allowed:             true,
+			credentialsRequired: true,
+		},
+		{
+			name:       "allowlist alone admits listed client",
+			rotator:    domain.RotatingProxy{AllowedClientCIDRs: allowlist},
+			remoteAddr: "203.0.113.9:4000",
+			allowed:    true,
+		},
+		{
+			name:       "allowlist alone rejects unlisted client",
+			rotator:    domain.RotatingProxy{AllowedClientCIDRs: allowlist},
+			remoteAddr: "198.51.100.1:4000",
+		},
+		{
+			name:                "ip and credentials still asks listed client to log in",
+			rotator:             domain.RotatingProxy{AllowedClientCIDRs: allowlist, AuthRequired: true},
+			remoteAddr:          "[2001:db8::5]:4000",
+			allowed:             true,
+			credentialsRequired: true,
+		},
+		{
+			name:       "ip or credentials admits listed client without login",
+			rotator:    domain.RotatingProxy{AllowedClientCIDRs: allowlist, AuthRequired: true, ClientAuthMode: database.RotatingProxyClientAuthIPOrCredentials},
+			remoteAddr: "[::ffff:203.0.113.9]:4000",
+			allowed:    true,
+		},
+		{
+			name:                "ip or credentials asks unlisted client to log in",
+			rotator:             domain.RotatingProxy{AllowedClientCIDRs: allowlist, AuthRequired: true, ClientAuthMode: database.RotatingProxyClientAuthIPOrCredentials},
+			remoteAddr:          "198.51.100.1:4000",
+			allowed:             true,
+			credentialsRequired: true,
+		},
+		{
+			name:                "ip or credentials without credentials rejects unlisted client",
+			rotator:             domain.RotatingProxy{AllowedClientCIDRs: allowlist, ClientAuthMode: database.RotatingProxyClientAuthIPOrCredentials},
+			remoteAddr:          "198.51.100.1:4000",
+			credentialsRequired: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, credentialsRequired := checkClientAccess(tc.rotator, tc.remoteAddr)
+			if allowed != tc.allowed || credentialsRequired != tc.credentialsRequired {
+				t.Fatalf("checkClientAccess = (%v, %v), want (%v, %v)", allowed, credentialsRequired, tc.allowed, tc.credentialsRequired)
+			}
+		})
+	}
+}
+
+func TestAuthenticateClient_EnforcesClientAllowlist(t *testing.T) {
+	handler := &proxyHandler{
+		rotator: domain.RotatingProxy{
+			AuthRequired:       true,
+			AuthUsername:       "proxy-user",
+			AuthPassword:       "proxy-pass",
+			AllowedClientCIDRs: domain.StringList{"203.0.113.0/24"},
+			ClientAuthMode:     database.RotatingProxyClientAuthIPOrCredentials,
+		},
+	}
+
+	listed := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	listed.RemoteAddr = "203.0.113.7:51000"
+	if _, ok := handler.authenticateClient(httptest.NewRecorder(), listed); !ok {
+		t.Fatal("authenticateClient rejected an allowlisted client without credentials")
+	}
+
+	recorder := httptest.NewRecorder()
+	unlisted := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	unlisted.RemoteAddr = "198.51.100.7:51000"
+	if _, ok := handler.authenticateClient(recorder, unlisted); ok || recorder.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("unlisted client without credentials: ok=%v status=%d, want 407", ok, recorder.Code)
+	}
+
+	unlisted.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("proxy-user:proxy-pass")))
+	if _, ok := handler.authenticateClient(httptest.NewRecorder(), unlisted); !ok {
+		t.Fatal("authenticateClient rejected an unlisted client with valid credentials")
+	}
+
+	handler.rotator.ClientAuthMode = database.RotatingProxyClientAuthIPAndCredentials
+	recorder = httptest.NewRecorder()
+	if _, ok := handler.authenticateClient(recorder, unlisted); ok || recorder.Code != http.StatusForbidden {
+		t.Fatalf("unlisted client in ip_and_credentials mode: ok=%v status=%d, want 403", ok, recorder.Code)
+	}
+}
+
+func TestSocksHandlers_RejectUnlistedClients(t *testing.T) {
+	// net.Pipe connections have no IP address, so they are never listed.
+	rotator := domain.RotatingProxy{AllowedClientCIDRs: domain.StringList{"203.0.113.0/24"}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&socksProxyHandler{rotator: rotator}).handleSocks5(server)
+
+	if _, err := client.Write([]byte{0x05, 0x02, 0x00, 0x02}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("read greeting response: %v", err)
+	}
+	if reply[1] != 0xff {
+		t.Fatalf("socks5 selected method %#x, want 0xff", reply[1])
+	}
+
+	rotator.ListenProtocol = domain.Protocol{Name: "socks4"}
+	client4, server4 := net.Pipe()
+	defer client4.Close()
+	go (&socksProxyHandler{rotator: rotator}).handleSocks4(server4)
+
+	if _, err := client4.Write([]byte{0x04, 0x01, 0x00, 0x50, 93, 184, 216, 34, 0x00}); err != nil {
+		t.Fatalf("write socks4 request: %v", err)
+	}
+	response := make([]byte, 8)
+	if _, err := io.ReadFull(client4, response); err != nil {
+		t.Fatalf("read socks4 response: %v", err)
+	}
+	if response[1] != 0x5B {
+		t.Fatalf("socks4 status %#x, want 0x5b", response[1])
+	}
+}
@@ -0,0 +1,238 @@
+package rotatingproxy
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"magpie/internal/domain"
+)
+
+var (
+	errCredentialConnectionLimit = errors.New("credential connection limit reached")
+	errCredentialQuotaExceeded   = errors.New("credential bandwidth quota exceeded")
+)
+
+// parseClientUsername parses routing parameters relative to the login the
+// username starts with, so both the rotator's own username and credential
+// names may contain dashes. A rotator parameter naming another rotator is
+// rejected.
+func parseClientUsername(rotator domain.RotatingProxy, raw string) (clientRouting, error) {
+	trimmed := strings.TrimSpace(raw)
+	matches := func(name string) bool {
+		return name != "" && (trimmed == name || strings.HasPrefix(trimmed, name+"-"))
+	}
+
+	base := ""
+	if matches(rotator.AuthUsername) {
+		base = rotator.AuthUsername
+	}
+	for idx := range rotator.Credentials {
+		if name := rotator.Credentials[idx].Name; len(name) > len(base) && matches(name) {
+			base = name
+		}
+	}
+	if base == "" {
+		base = rotator.AuthUsername
+	}
+	routing, err := parseRotatorUsername(raw, base)
+	if err != nil {
+		return clientRouting{}, err
+	}
+	if routing.Rotator != 0 && routing.Rotator != rotator.ID {
+		return clientRouting{}, errInvalidRoutingUsername
+	}
+	return routing, nil
+}
+
+// authorizeLogin checks a username and password against the rotator's own
+// login and its unexpired credentials. It returns the matching credential
+// ID, 0 for the rotator's own login.
+func authorizeLogin(rotator domain.RotatingProxy, username, password string) (uint64, bool) {
+	if username == rotator.AuthUsername && password == rotator.AuthPassword {
+		return 0, true
+	}
+	return matchCredential(rotator, username, password)
+}
+
+// authorizeClient checks a client login. Rotators that do not require
+// credentials still attribute valid credential logins, so their limits and
+// usage apply, and refuse a credential name with a wrong password; any other
+// login passes there unattributed.
+func authorizeClient(rotator domain.RotatingProxy, username, password string, credentialsRequired bool) (uint64, bool) {
+	if credentialsRequired {
+		return authorizeLogin(rotator, username, password)
+	}
+	if credentialID, ok := matchCredential(rotator, username, password); ok {
+		return credentialID, true
+	}
+	for idx := range rotator.Credentials {
+		if rotator.Credentials[idx].Name == username {
+			return 0, false
+		}
+	}
+	return 0, true
+}
+
+func matchCredential(rotator domain.RotatingProxy, username, password string) (uint64, bool) {
+	now := time.Now()
+	for idx := range rotator.Credentials {
+		credential := &rotator.Credentials[idx]
+		if credential.Name == username && credential.Password == password && !credential.Expired(now) {
+			return credential.ID, true
+		}
+	}
+	return 0, false
+}
+
+// credentialLimits enforces the connection limit and bandwidth quota of a
+// rotator's credentials. Bytes are counted locally and merged with the
+// stored usage whenever the rotator is reloaded, so quotas shared by several
+// instances are enforced approximately. Tunnels are charged while they relay
+// and closed once the quota is used up.
+type credentialLimits struct {
+	mu      sync.Mutex
+	entries map[uint64]*credentialUsage
+}
+
+type credentialUsage struct {
+	version time.Time
+	quota   int64
+	bytes   int64
+	active  int
+}
+
+func newCredentialLimits() *credentialLimits {
+	return &credentialLimits{entries: make(map[uint64]*credentialUsage)}
+}
+
+// sync adopts the stored usage of credentials. Locally counted bytes that
+// were not stored yet are kept unless the credential was edited, e.g. to
+// reset its usage. Removed credentials are forgotten.
+func (l *credentialLimits) sync(credentials []domain.RotatingProxyCredential) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := make(map[uint64]struct{}, len(credentials))
+	for idx := range credentials {
+		credential := &credentials[idx]
+		current[credential.ID] = struct{}{}
+		entry := l.entry(credential)
+		entry.quota = credential.BandwidthQuotaBytes
+		if !entry.version.Equal(credential.UpdatedAt) {
+			entry.version = credential.UpdatedAt
+			entry.bytes = credential.BytesUsed
+		} else {
+			entry.bytes = max(entry.bytes, credential.BytesUsed)
+		}
+	}
+	for id, entry := range l.entries {
+		if _, ok := current[id]; !ok && entry.active == 0 {
+			delete(l.entries, id)
+		}
+	}
+}
+
+// acquire takes one of the credential's connection slots. The returned func
+// frees it again.
+func (l *credentialLimits) acquire(credential *domain.RotatingProxyCredential) (func(), error) {
+	if l == nil || credential == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := l.entry(credential)
+	entry.quota = credential.BandwidthQuotaBytes
+	if entry.exhausted() {
+		return nil, errCredentialQuotaExceeded
+	}
+	if credential.MaxConnections > 0 && entry.active >= credential.MaxConnections {
+		return nil, errCredentialConnectionLimit
+	}
+	entry.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			entry.active--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// addBytes charges bytes to a credential and reports whether it is still
+// within its bandwidth quota.
+func (l *credentialLimits) addBytes(credentialID uint64, bytes int64) bool {
+	if l == nil || credentialID == 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[credentialID]
+	if !ok {
+		return true
+	}
+	if bytes > 0 {
+		entry.bytes += bytes
+	}
+	return !entry.exhausted()
+}
+
+// entry must be called with l.mu held.
+func (l *credentialLimits) entry(credential *domain.RotatingProxyCredential) *credentialUsage {
+	entry, ok := l.entries[credential.ID]
+	if !ok {
+		entry = &credentialUsage{version: credential.UpdatedAt, quota: credential.BandwidthQuotaBytes, bytes: credential.BytesUsed}
+		l.entries[credential.ID] = entry
+	}
+	return entry
+}
+
+func (u *credentialUsage) exhausted() bool {
+	return u.quota > 0 && u.bytes >= u.quota
+}
+
+// acquireCredential applies the limits of the credential a client logged in
+// with. Clients using the rotator's own login are not limited.
+func (s *rotatorState) acquireCredential(rotator domain.RotatingProxy, credentialID uint64) (func(), error) {
+	if s == nil || credentialID == 0 {
+		return func() {}, nil
+	}
+	for idx := range rotator.Credentials {
+		if rotator.Credentials[idx].ID == credentialID {
+			return s.credentials.acquire(&rotator.Credentials[idx])
+		}
+	}
+	return func() {}, nil
+}
+
+// recordTraffic accounts one HTTP request in the usage counters and against
+// the bandwidth quota of the client's credential. Tunnels are charged by
+// their meter instead and only record usage once they closed.
+func (s *rotatorState) recordTraffic(rotator domain.RotatingProxy, routing clientRouting, proxyID uint64, up, down int64) {
+	recordUpstreamTraffic(rotator, routing, proxyID, up, down)
+	if s != nil {
+		s.credentials.addBytes(routing.CredentialID, up+down)
+	}
+}
+
+// tunnelMeter charges the bytes a tunnel relays to the client's credential.
+// It returns nil for clients without a credential; the meter returns false
+// once the credential's bandwidth quota is used up.
+func (s *rotatorState) tunnelMeter(routing clientRouting) func(int64) bool {
+	if s == nil || routing.CredentialID == 0 {
+		return nil
+	}
+	return func(bytes int64) bool {
+		return s.credentials.addBytes(routing.CredentialID, bytes)
+	}
+}
@@ -0,0 +1,172 @@
+package rotatingproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"magpie/internal/domain"
+)
+
+func credentialRotator() domain.RotatingProxy {
+	expired := time.Now().Add(-time.Minute)
+	return domain.RotatingProxy{
+		ID:           21,
+		AuthRequired: true,
+		AuthUsername: "owner",
+		AuthPassword: "owner-pass",
+		Credentials: []domain.RotatingProxyCredential{
+			{ID: 5, Name: "team-alice", Password: "alice-pass", MaxConnections: 1},
+			{ID: 6, Name: "bob", Password: "bob-pass", ExpiresAt: &expired},
+		},
+	}
+}
+
+func proxyAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAuthenticateClient_AcceptsRotatorCredentials(t *testing.T) {
+	handler := &proxyHandler{rotator: credentialRotator()}
+
+	request := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	request.Header.Set("Proxy-Authorization", proxyAuthorization("team-alice-session-s1", "alice-pass"))
+	routing, ok := handler.authenticateClient(httptest.NewRecorder(), request)
+	if !ok {
+		t.Fatal("authenticateClient rejected a valid credential")
+	}
+	if routing.CredentialID != 5 || routing.Username != "team-alice" || routing.Session != "s1" {
+		t.Fatalf("routing = %+v, want credential 5 with session s1", routing)
+	}
+
+	request.Header.Set("Proxy-Authorization", proxyAuthorization("owner", "owner-pass"))
+	if routing, ok := handler.authenticateClient(httptest.NewRecorder(), request); !ok || routing.CredentialID != 0 {
+		t.Fatalf("rotator login: ok=%v credential=%d, want accepted as credential 0", ok, routing.CredentialID)
+	}
+
+	for _, login := range [][2]string{{"team-alice", "owner-pass"}, {"bob", "bob-pass"}} {
+		recorder := httptest.NewRecorder()
+		request.Header.Set("Proxy-Authorization", proxyAuthorization(login[0], login[1]))
+		if _, ok := handler.authenticateClient(recorder, request); ok || recorder.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("login %s: ok=%v status=%d, want 407", login[0], ok, recorder.Code)
+		}
+	}
+}
+
+func TestServeHTTP_EnforcesCredentialConnectionLimit(t *testing.T) {
+	rotator := credentialRotator()
+	state := newRotatorState()
+	handler := &proxyHandler{rotator: rotator, state: state}
+
+	release, err := state.acquireCredential(rotator, 5)
+	if err != nil {
+		t.Fatalf("acquire first slot: %v", err)
+	}
+	defer release()
+
+	request := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	request.Header.Set("Proxy-Authorization", proxyAuthorization("team-alice", "alice-pass"))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestAuthenticateClient_AttributesCredentialsWhenAuthIsOptional(t *testing.T) {
+	rotator := credentialRotator()
+	rotator.AuthRequired = false
+	handler := &proxyHandler{rotator: rotator}
+
+	request := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if routing, ok := handler.authenticateClient(httptest.NewRecorder(), request); !ok || routing.CredentialID != 0 {
+		t.Fatalf("anonymous client: ok=%v credential=%d, want accepted as credential 0", ok, routing.CredentialID)
+	}
+
+	request.Header.Set("Proxy-Authorization", proxyAuthorization("team-alice-session-s1", "alice-pass"))
+	if routing, ok := handler.authenticateClient(httptest.NewRecorder(), request); !ok || routing.CredentialID != 5 {
+		t.Fatalf("credential login: ok=%v credential=%d, want credential 5", ok, routing.CredentialID)
+	}
+
+	request.Header.Set("Proxy-Authorization", proxyAuthorization("someone-session-s1", "anything"))
+	if routing, ok := handler.authenticateClient(httptest.NewRecorder(), request); !ok || routing.CredentialID != 0 {
+		t.Fatalf("unknown login: ok=%v credential=%d, want accepted as credential 0", ok, routing.CredentialID)
+	}
+
+	recorder := httptest.NewRecorder()
+	request.Header.Set("Proxy-Authorization", proxyAuthorization("team-alice", "wrong"))
+	if _, ok := handler.authenticateClient(recorder, request); ok || recorder.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("wrong credential password: ok=%v status=%d, want 407", ok, recorder.Code)
+	}
+}
+
+func TestPipeMeteredConnections_ClosesTunnelAtQuota(t *testing.T) {
+	credential := domain.RotatingProxyCredential{ID: 9, BandwidthQuotaBytes: 10}
+	state := newRotatorState()
+	state.credentials.sync([]domain.RotatingProxyCredential{credential})
+
+	client, clientPeer := net.Pipe()
+	upstream, upstreamPeer := net.Pipe()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	go func() {
+		chunk := []byte("01234567")
+		for {
+			if _, err := upstream.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan int64, 1)
+	go func() {
+		_, down := pipeMeteredConnections(clientPeer, upstreamPeer, state.tunnelMeter(clientRouting{CredentialID: credential.ID}))
+		done <- down
+	}()
+	select {
+	case down := <-done:
+		if down != 16 {
+			t.Fatalf("relayed %d bytes, want 16 before the quota closed the tunnel", down)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not closed at the quota")
+	}
+	if _, err := state.credentials.acquire(&credential); !errors.Is(err, errCredentialQuotaExceeded) {
+		t.Fatalf("acquire after tunnel: err = %v, want errCredentialQuotaExceeded", err)
+	}
+}
+
+func TestCredentialLimits_QuotaAndReset(t *testing.T) {
+	updatedAt := time.Now()
+	credential := domain.RotatingProxyCredential{ID: 9, BandwidthQuotaBytes: 100, BytesUsed: 40, UpdatedAt: updatedAt}
+	limits := newCredentialLimits()
+	limits.sync([]domain.RotatingProxyCredential{credential})
+
+	release, err := limits.acquire(&credential)
+	if err != nil {
+		t.Fatalf("acquire below quota: %v", err)
+	}
+	limits.addBytes(credential.ID, 60)
+	release()
+
+	if _, err := limits.acquire(&credential); !errors.Is(err, errCredentialQuotaExceeded) {
+		t.Fatalf("acquire at quota: err = %v, want errCredentialQuotaExceeded", err)
+	}
+
+	// Stored usage lagging behind the local count must not lift the limit.
+	limits.sync([]domain.RotatingProxyCredential{credential})
+	if _, err := limits.acquire(&credential); !errors.Is(err, errCredentialQuotaExceeded) {
+		t.Fatalf("acquire after sync: err = %v, want errCredentialQuotaExceeded", err)
+	}
+
+	credential.BytesUsed = 0
+	credential.UpdatedAt = updatedAt.Add(time.Second)
+	limits.sync([]domain.RotatingProxyCredential{credential})
+	if _, err := limits.acquire(&credential); err != nil {
+		t.Fatalf("acquire after usage reset: %v", err)
+	}
+}
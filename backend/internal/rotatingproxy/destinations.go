@@ -0,0 +1,183 @@
+package rotatingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+// errDestinationBlocked marks targets refused by the rotator's destination
+// rules once their host name was resolved.
+var errDestinationBlocked = errors.New("destination not allowed")
+
+// destinationRules are the parsed destination rules of a rotator. They are
+// parsed once whenever the rotator is loaded or edited. A nil value allows
+// every destination.
+type destinationRules struct {
+	allowed []database.DestinationRule
+	blocked []database.DestinationRule
+	// blockedAddresses is set when a blocked rule is an address or range,
+	// which host names have to be resolved for.
+	blockedAddresses bool
+}
+
+func newDestinationRules(rotator domain.RotatingProxy) *destinationRules {
+	if len(rotator.AllowedDestinations) == 0 && len(rotator.BlockedDestinations) == 0 {
+		return nil
+	}
+	rules := &destinationRules{
+		allowed: parseDestinationRules(rotator.AllowedDestinations),
+		blocked: parseDestinationRules(rotator.BlockedDestinations),
+	}
+	rules.blockedAddresses = slices.ContainsFunc(rules.blocked, func(rule database.DestinationRule) bool {
+		return rule.Prefix.IsValid()
+	})
+	return rules
+}
+
+func parseDestinationRules(raw []string) []database.DestinationRule {
+	rules := make([]database.DestinationRule, 0, len(raw))
+	for _, value := range raw {
+		rule, err := database.ParseDestinationRule(value)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// allows applies the rules to a target. Blocked destinations always lose;
+// with allowed destinations configured the target has to match one of them.
+// Rules are checked before an upstream is picked, so refused requests never
+// reach the pool.
+func (d *destinationRules) allows(host string, port uint16) bool {
+	if d == nil {
+		return true
+	}
+	if destinationListed(d.blocked, host, port) {
+		return false
+	}
+	if len(d.allowed) == 0 {
+		return true
+	}
+	return destinationListed(d.allowed, host, port)
+}
+
+// allowsTarget is allows for a host:port target. Targets without a port
+// default to defaultPort.
+func (d *destinationRules) allowsTarget(target string, defaultPort uint16) bool {
+	if d == nil {
+		return true
+	}
+	host, port, err := splitTargetAddress(target)
+	if err != nil {
+		host, port = target, defaultPort
+	}
+	return d.allows(host, port)
+}
+
+// blocksAddress reports whether a target falls under a blocked address rule.
+// Address rules cannot see host names, so targets are checked again before
+// they are dialed. Host names the upstream resolves itself are looked up on
+// this host just for the check and refused when that fails. Allowed rules
+// already passed for the host name.
+func (d *destinationRules) blocksAddress(target string, next *dto.RotatingProxyNext) (bool, error) {
+	if d == nil || !d.blockedAddresses {
+		return false, nil
+	}
+	host, port, err := splitTargetAddress(target)
+	if err != nil {
+		return false, nil
+	}
+	if net.ParseIP(host) != nil {
+		return destinationListed(d.blocked, host, port), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hopHandshakeTimeout(next))
+	defer cancel()
+	addresses, err := lookupTargetIPsFunc(ctx, host)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s: %w", errTargetUnresolved, host, err)
+	}
+	for _, address := range addresses {
+		if destinationListed(d.blocked, address.IP.String(), port) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkProxied applies blocked address rules to a host:port target of an
+// HTTP upstream. net/http hands those upstreams the target itself, so it
+// never passes through connector. Targets without a port default to
+// defaultPort.
+func (d *destinationRules) checkProxied(target string, defaultPort uint16, next *dto.RotatingProxyNext) error {
+	if d == nil || !d.blockedAddresses || next == nil {
+		return nil
+	}
+	switch strings.ToLower(strings.TrimSpace(next.Protocol)) {
+	case "http", "https":
+	default:
+		return nil
+	}
+
+	host, port, err := splitTargetAddress(target)
+	if err != nil {
+		host, port = target, defaultPort
+	}
+	blocked, err := d.blocksAddress(net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(int(port))), next)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errDestinationBlocked
+	}
+	return nil
+}
+
+// connector wraps connect so that targets are resolved according to the
+// upstream's DNS mode first and refused when their address is blocked.
+func (d *destinationRules) connector(connect upstreamConnectFunc) upstreamConnectFunc {
+	return func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		resolved, err := d.resolve(target, next)
+		if err != nil {
+			return nil, err
+		}
+		return connect(resolved, next)
+	}
+}
+
+// resolve applies the DNS mode of next to target and refuses the target
+// when its address is blocked.
+func (d *destinationRules) resolve(target string, next *dto.RotatingProxyNext) (string, error) {
+	resolved, err := resolveUpstreamTarget(target, next)
+	if err != nil {
+		return "", err
+	}
+	blocked, err := d.blocksAddress(resolved, next)
+	if err != nil {
+		return "", err
+	}
+	if blocked {
+		return "", errDestinationBlocked
+	}
+	return resolved, nil
+}
+
+func destinationListed(rules []database.DestinationRule, host string, port uint16) bool {
+	for _, rule := range rules {
+		if rule.Matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package rotatingproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func TestDestinationAllowed(t *testing.T) {
+	rotator := domain.RotatingProxy{
+		AllowedDestinations: domain.StringList{"*.example.com", "example.com", "203.0.113.0/24:443"},
+		BlockedDestinations: domain.StringList{"*:25", "admin.example.com"},
+	}
+
+	tests := []struct {
+		host string
+		port uint16
+		want bool
+	}{
+		{host: "example.com", port: 443, want: true},
+		{host: "WWW.Example.com.", port: 80, want: true},
+		{host: "203.0.113.9", port: 443, want: true},
+		{host: "203.0.113.9", port: 80, want: false},
+		{host: "mail.example.com", port: 25, want: false},
+		{host: "admin.example.com", port: 443, want: false},
+		{host: "example.org", port: 443, want: false},
+	}
+	rules := newDestinationRules(rotator)
+	for _, tc := range tests {
+		if got := rules.allows(tc.host, tc.port); got != tc.want {
+			t.Errorf("destinationAllowed(%s, %d) = %v, want %v", tc.host, tc.port, got, tc.want)
+		}
+	}
+
+	if !newDestinationRules(domain.RotatingProxy{}).allows("example.org", 25) {
+		t.Fatal("a rotator without destination rules refused a target")
+	}
+	if !rules.allowsTarget("example.com", 443) || rules.allowsTarget("example.com:25", 443) {
+		t.Fatal("allowsTarget did not apply the port of the target")
+	}
+}
+
+func TestHandlers_RejectBlockedDestinations(t *testing.T) {
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, _ *dto.RotatingProxyNext) (net.Conn, error) {
+		t.Errorf("upstream was requested for blocked target %s", target)
+		return nil, errUpstreamUnavailable
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	server := newProxyServer(domain.RotatingProxy{
+		ID:                  1,
+		Protocol:            domain.Protocol{Name: "http"},
+		BlockedDestinations: domain.StringList{"*:25", "blocked.example"},
+	})
+	t.Cleanup(server.Stop)
+
+	httpHandler := server.httpHandler.Load()
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "http://blocked.example/path", nil),
+		httptest.NewRequest(http.MethodConnect, "mail.example.com:25", nil),
+	} {
+		recorder := httptest.NewRecorder()
+		httpHandler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusForbidden {
+			t.Fatalf("%s %s: status = %d, want 403", req.Method, req.Host, recorder.Code)
+		}
+	}
+
+	socksHandler := server.socksHandler.Load()
+	client, conn := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	go socksHandler.handleSocks5(conn)
+
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+		t.Fatalf("read greeting response: %v", err)
+	}
+	request := []byte{0x05, 0x01, 0x00, 0x03, byte(len("blocked.example"))}
+	request = append(request, "blocked.example"...)
+	request = append(request, 0x01, 0xbb)
+	if _, err := client.Write(request); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x02 {
+		t.Fatalf("socks5 reply = %v, err = %v, want code 0x02", reply, err)
+	}
+
+	client4, conn4 := net.Pipe()
+	t.Cleanup(func() { _ = client4.Close() })
+	go socksHandler.handleSocks4(conn4)
+
+	if _, err := client4.Write([]byte{0x04, 0x01, 0x00, 0x19, 192, 0, 2, 1, 0x00}); err != nil {
+		t.Fatalf("write socks4 request: %v", err)
+	}
+	response := make([]byte, 8)
+	if _, err := io.ReadFull(client4, response); err != nil || response[1] != 0x5B {
+		t.Fatalf("socks4 response = %v, err = %v, want status 0x5b", response, err)
+	}
+}
+
+func TestSocks5UDPDestination(t *testing.T) {
+	datagram := []byte{0x00, 0x00, 0x00, 0x03, byte(len("example.com"))}
+	datagram = append(datagram, "example.com"...)
+	datagram = append(datagram, 0x00, 0x35, 'q')
+	headerLen, ok := socks5UDPHeaderLength(datagram)
+	if !ok {
+		t.Fatal("datagram header was rejected")
+	}
+	if host, port := socks5UDPDestination(datagram[:headerLen]); host != "example.com" || port != 53 {
+		t.Fatalf("destination = %s:%d, want example.com:53", host, port)
+	}
+
+	if host, port := socks5UDPDestination([]byte{0x00, 0x00, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb}); host != "192.0.2.1" || port != 443 {
+		t.Fatalf("destination = %s:%d, want 192.0.2.1:443", host, port)
+	}
+}
+
+func TestConnectWithFailover_RejectsHostsResolvedIntoBlockedRanges(t *testing.T) {
+	selections := stubSequentialUpstreams(t)
+	stubTargetLookup(t, func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+	})
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, _ *dto.RotatingProxyNext) (net.Conn, error) {
+		t.Errorf("upstream was asked to connect to blocked address %s", target)
+		return nil, errUpstreamUnavailable
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	rotator := domain.RotatingProxy{
+		ID:                  1,
+		DNSMode:             database.RotatingProxyDNSModeLocal,
+		BlockedDestinations: domain.StringList{"10.0.0.0/8"},
+	}
+	state := newRotatorState()
+	state.rules.Store(newDestinationRules(rotator))
+	if !state.targetAllowed("internal.example:443", 0) {
+		t.Fatal("the host name was refused before it was resolved")
+	}
+	_, _, err := state.connectWithFailover(rotator, clientRouting{}, "internal.example:443")
+	if !errors.Is(err, errDestinationBlocked) {
+		t.Fatalf("err = %v, want errDestinationBlocked", err)
+	}
+	if len(*selections) != 1 {
+		t.Fatalf("upstream selections = %d, want 1 without retries", len(*selections))
+	}
+	if reply := socks5FailureReply(err); reply != 0x02 {
+		t.Fatalf("socks5 reply = %#x, want connection not allowed", reply)
+	}
+}
+
+func TestRotatorState_RejectsHostsResolvingIntoBlockedRangesInRemoteMode(t *testing.T) {
+	stubSequentialUpstreams(t)
+	stubTargetLookup(t, func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host == "internal.example" {
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.7")}, {IP: net.ParseIP("10.1.2.3")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.7")}}, nil
+	})
+	connected := make(chan string, 16)
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, _ *dto.RotatingProxyNext) (net.Conn, error) {
+		connected <- target
+		return nil, errUpstreamUnavailable
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	rotator := domain.RotatingProxy{ID: 1, BlockedDestinations: domain.StringList{"10.0.0.0/8"}}
+	state := newRotatorState()
+	state.rules.Store(newDestinationRules(rotator))
+
+	_, _, err := state.connectWithFailover(rotator, clientRouting{}, "internal.example:443")
+	if !errors.Is(err, errDestinationBlocked) {
+		t.Fatalf("err = %v, want errDestinationBlocked", err)
+	}
+
+	handler := &proxyHandler{rotator: rotator, state: state}
+	recorder := httptest.NewRecorder()
+	handler.handleHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://internal.example/", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("status code = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+	select {
+	case target := <-connected:
+		t.Fatalf("upstream was asked to connect to blocked host %s", target)
+	default:
+	}
+
+	_, _, _ = state.connectWithFailover(rotator, clientRouting{}, "public.example:443")
+	if target := <-connected; target != "public.example:443" {
+		t.Fatalf("upstream was asked for %q, want the host name unchanged", target)
+	}
+
+	// HTTP upstreams get plain requests from net/http without a dial
+	// through the rules.
+	getNextRotatingProxyFunc = func(uint, uint64, database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		return &dto.RotatingProxyNext{ProxyID: 1, IP: "127.0.0.1", Port: 1, Protocol: "http"}, nil
+	}
+	recorder = httptest.NewRecorder()
+	handler.handleHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://internal.example/", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("status code through an HTTP upstream = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,249 @@
+package rotatingproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/support"
+)
+
+const (
+	envRotatingProxyDrainGraceSeconds = "ROTATING_PROXY_DRAIN_GRACE_SECONDS"
+	defaultDrainGracePeriod           = 30 * time.Second
+	drainPollInterval                 = 100 * time.Millisecond
+)
+
+var drainGracePeriod = loadDrainGracePeriod()
+
+// openTunnels registers the connections of a rotator's running tunnels so a
+// draining server can wait for them and cut whatever is left when its grace
+// period ends.
+type openTunnels struct {
+	mu      sync.Mutex
+	tunnels map[*openTunnel]struct{}
+	cut     bool
+}
+
+type openTunnel struct {
+	closers []io.Closer
+}
+
+func (t *openTunnel) close() {
+	for _, closer := range t.closers {
+		_ = closer.Close()
+	}
+}
+
+func newOpenTunnels() *openTunnels {
+	return &openTunnels{tunnels: make(map[*openTunnel]struct{})}
+}
+
+// track registers a tunnel relayed over closers until the returned func is
+// called. Tunnels opened after the rest were cut are closed right away.
+func (t *openTunnels) track(closers ...io.Closer) func() {
+	tunnel := &openTunnel{closers: closers}
+	t.mu.Lock()
+	if t.cut {
+		t.mu.Unlock()
+		tunnel.close()
+		return func() {}
+	}
+	t.tunnels[tunnel] = struct{}{}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.tunnels, tunnel)
+		t.mu.Unlock()
+	}
+}
+
+func (t *openTunnels) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tunnels)
+}
+
+// wait blocks until every tunnel finished or ctx ends.
+func (t *openTunnels) wait(ctx context.Context) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for t.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cutAll closes the connections of every open tunnel and returns how many
+// there were.
+func (t *openTunnels) cutAll() int {
+	t.mu.Lock()
+	t.cut = true
+	tunnels := t.tunnels
+	t.tunnels = make(map[*openTunnel]struct{})
+	t.mu.Unlock()
+
+	for tunnel := range tunnels {
+		tunnel.close()
+	}
+	return len(tunnels)
+}
+
+// trackTunnel registers a tunnel of the rotator; see openTunnels.track.
+func (s *rotatorState) trackTunnel(closers ...io.Closer) func() {
+	if s == nil {
+		return func() {}
+	}
+	return s.tunnels.track(closers...)
+}
+
+func (s *rotatorState) openTunnelCount() int {
+	if s == nil {
+		return 0
+	}
+	return s.tunnels.count()
+}
+
+// stopAccepting closes the server's listener so new clients are refused and
+// the port is free again. Plain HTTP connections are closed once their
+// current request is done; open tunnels keep running.
+func (ps *proxyServer) stopAccepting() {
+	ps.acceptOnce.Do(func() {
+		if ps.httpServer != nil {
+			// With an expired context Shutdown returns right after closing
+			// the listener and idle connections; drain waits for the rest.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_ = ps.httpServer.Shutdown(ctx)
+		}
+		if ps.listener != nil {
+			_ = ps.listener.Close()
+		}
+	})
+}
+
+// drain lets the requests and tunnels that are still open finish until
+// deadline, then cuts whatever is left and releases the server's state.
+func (ps *proxyServer) drain(deadline time.Time) {
+	ps.closeOnce.Do(func() {
+		ps.stopAccepting()
+
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if ps.httpServer != nil {
+			_ = ps.httpServer.Shutdown(ctx)
+		}
+		if ps.http3Server != nil {
+			_ = ps.http3Server.Shutdown(ctx)
+		}
+		ps.state.tunnels.wait(ctx)
+
+		if cut := ps.state.tunnels.cutAll(); cut > 0 {
+			log.Info("rotating proxy server: cut tunnels after drain grace period", "rotator_id", ps.rotator.ID, "tunnels", cut)
+		}
+		if ps.httpServer != nil {
+			if err := ps.httpServer.Close(); err != nil {
+				log.Error("rotating proxy server close", "rotator_id", ps.rotator.ID, "error", err)
+			}
+		}
+		if ps.http3Server != nil {
+			if err := ps.http3Server.Close(); err != nil {
+				log.Error("rotating proxy server http3 close", "rotator_id", ps.rotator.ID, "error", err)
+			}
+		}
+		ps.state.close()
+	})
+}
+
+// RotatorTunnels counts the open tunnels of one rotator on this instance.
+// Active tunnels run on its current listener, draining ones on listeners
+// that were replaced or removed and are cut at DrainDeadline.
+type RotatorTunnels struct {
+	Active        int
+	Draining      int
+	DrainDeadline time.Time
+}
+
+// DrainStatus summarises the tunnels of this instance for readiness probes.
+// ShuttingDown is set once the instance stopped accepting rotator clients.
+type DrainStatus struct {
+	ShuttingDown    bool
+	ActiveTunnels   int
+	DrainingServers int
+	DrainingTunnels int
+}
+
+// retire drains a server that is no longer wanted in the background. The
+// listener is closed before retire returns. With forget the rotator is gone
+// and its usage metrics are dropped once the drain completes. Called with
+// m.mu held.
+func (m *Manager) retire(server *proxyServer, forget bool) {
+	server.stopAccepting()
+	deadline := time.Now().Add(drainGracePeriod)
+	m.draining[server] = deadline
+	m.drains.Add(1)
+	go func() {
+		defer m.drains.Done()
+		server.drain(deadline)
+		m.mu.Lock()
+		delete(m.draining, server)
+		m.mu.Unlock()
+		if forget {
+			forgetUsageMetrics(server.rotator.ID)
+		}
+	}()
+}
+
+// RotatorTunnels reports the open tunnels of rotatorID on this instance.
+func (m *Manager) RotatorTunnels(rotatorID uint64) RotatorTunnels {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var tunnels RotatorTunnels
+	if server, ok := m.servers[rotatorID]; ok {
+		tunnels.Active = server.state.openTunnelCount()
+	}
+	for server, deadline := range m.draining {
+		if server.rotator.ID != rotatorID {
+			continue
+		}
+		tunnels.Draining += server.state.openTunnelCount()
+		if deadline.After(tunnels.DrainDeadline) {
+			tunnels.DrainDeadline = deadline
+		}
+	}
+	return tunnels
+}
+
+// DrainStatus reports the open and draining tunnels of this instance.
+func (m *Manager) DrainStatus() DrainStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := DrainStatus{
+		ShuttingDown:    m.shuttingDown.Load(),
+		DrainingServers: len(m.draining),
+	}
+	for _, server := range m.servers {
+		status.ActiveTunnels += server.state.openTunnelCount()
+	}
+	for server := range m.draining {
+		status.DrainingTunnels += server.state.openTunnelCount()
+	}
+	return status
+}
+
+func loadDrainGracePeriod() time.Duration {
+	seconds := support.GetEnvInt(envRotatingProxyDrainGraceSeconds, int(defaultDrainGracePeriod/time.Second))
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,126 @@
+package rotatingproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func TestManagerRemove_DrainsOpenTunnels(t *testing.T) {
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+	originalGrace := drainGracePeriod
+	drainGracePeriod = 500 * time.Millisecond
+	t.Cleanup(func() { drainGracePeriod = originalGrace })
+
+	upClient, upServer := net.Pipe()
+	t.Cleanup(func() { _ = upClient.Close() })
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(string, *dto.RotatingProxyNext) (net.Conn, error) {
+		return upServer, nil
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve port: %v", err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	_ = probe.Close()
+
+	manager := NewManager()
+	server := newProxyServer(domain.RotatingProxy{ID: 5, ListenPort: uint16(port), Protocol: domain.Protocol{Name: "http"}})
+	if err := server.Start(); err != nil {
+		t.Fatalf("start server: %v", err)
+	}
+	manager.servers[5] = server
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial rotator: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response = %v, err = %v", resp, err)
+	}
+	if tunnels := manager.RotatorTunnels(5); tunnels.Active != 1 {
+		t.Fatalf("active tunnels = %d, want 1", tunnels.Active)
+	}
+
+	manager.Remove(5)
+
+	if conn, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("draining server accepted a new connection")
+	}
+	tunnels := manager.RotatorTunnels(5)
+	if tunnels.Active != 0 || tunnels.Draining != 1 || tunnels.DrainDeadline.IsZero() {
+		t.Fatalf("tunnels while draining = %+v, want one draining tunnel with a deadline", tunnels)
+	}
+	if status := manager.DrainStatus(); status.ShuttingDown || status.DrainingServers != 1 || status.DrainingTunnels != 1 {
+		t.Fatalf("drain status = %+v", status)
+	}
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("write through draining tunnel: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(upClient, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("upstream read = %q, err = %v", buf, err)
+	}
+
+	// The tunnel outlives the grace period and is cut.
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("tunnel was not cut after the grace period")
+	}
+	manager.drains.Wait()
+	if status := manager.DrainStatus(); status.DrainingServers != 0 || status.DrainingTunnels != 0 {
+		t.Fatalf("drain status after the grace period = %+v", status)
+	}
+}
+
+func TestOpenTunnels_TrackAndCut(t *testing.T) {
+	tunnels := newOpenTunnels()
+	first, firstPeer := net.Pipe()
+	t.Cleanup(func() { _ = firstPeer.Close() })
+	second, secondPeer := net.Pipe()
+	t.Cleanup(func() { _ = secondPeer.Close() })
+
+	releaseFirst := tunnels.track(first)
+	tunnels.track(second)
+	if got := tunnels.count(); got != 2 {
+		t.Fatalf("count = %d, want 2", got)
+	}
+	releaseFirst()
+	if got := tunnels.count(); got != 1 {
+		t.Fatalf("count after release = %d, want 1", got)
+	}
+
+	if got := tunnels.cutAll(); got != 1 {
+		t.Fatalf("cutAll = %d, want 1", got)
+	}
+	if _, err := second.Write([]byte("x")); err == nil {
+		t.Fatal("cut tunnel is still writable")
+	}
+
+	late, latePeer := net.Pipe()
+	t.Cleanup(func() { _ = latePeer.Close() })
+	tunnels.track(late)
+	if _, err := late.Write([]byte("x")); err == nil || tunnels.count() != 0 {
+		t.Fatal("tunnel opened after the cut was kept open")
+	}
+}
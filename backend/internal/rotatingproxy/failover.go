@@ -0,0 +1,189 @@
+package rotatingproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+	"magpie/internal/support"
+)
+
+const (
+	envRotatingProxyFailoverRetries         = "ROTATING_PROXY_FAILOVER_RETRIES"
+	envRotatingProxyFailoverCooldownSeconds = "ROTATING_PROXY_FAILOVER_COOLDOWN_SECONDS"
+	defaultFailoverRetries                  = 2
+	maxFailoverRetriesLimit                 = 10
+	defaultFailoverCooldown                 = 30 * time.Second
+)
+
+var (
+	errUpstreamUnavailable = errors.New("failed to acquire upstream proxy")
+	errUnsupportedUpstream = errors.New("upstream protocol not supported by rotator")
+
+	failoverRetries  = loadFailoverRetries()
+	failoverCooldown = loadFailoverCooldown()
+)
+
+// upstreamExclusions keeps upstreams that just failed out of a rotator's
+// selection for a short cooldown.
+type upstreamExclusions struct {
+	mu      sync.Mutex
+	entries map[uint64]time.Time
+}
+
+func newUpstreamExclusions() *upstreamExclusions {
+	return &upstreamExclusions{entries: make(map[uint64]time.Time)}
+}
+
+func (e *upstreamExclusions) exclude(proxyID uint64, now time.Time, cooldown time.Duration) {
+	if e == nil || proxyID == 0 || cooldown <= 0 {
+		return
+	}
+
+	e.mu.Lock()
+	e.entries[proxyID] = now.Add(cooldown)
+	e.mu.Unlock()
+}
+
+func (e *upstreamExclusions) active(now time.Time) []uint64 {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.entries) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(e.entries))
+	for proxyID, until := range e.entries {
+		if !now.Before(until) {
+			delete(e.entries, proxyID)
+			continue
+		}
+		ids = append(ids, proxyID)
+	}
+	return ids
+}
+
+// rotatorFailoverRetries returns how many further upstreams a failed connect
+// or request of the rotator may try.
+func rotatorFailoverRetries(rotator domain.RotatingProxy) int {
+	if rotator.FailoverRetries > 0 {
+		return min(rotator.FailoverRetries, maxFailoverRetriesLimit)
+	}
+	return failoverRetries
+}
+
+// rotatorFailoverCooldown returns how long a failed upstream is skipped by
+// the rotator.
+func rotatorFailoverCooldown(rotator domain.RotatingProxy) time.Duration {
+	if rotator.FailoverCooldownSeconds > 0 {
+		return time.Duration(rotator.FailoverCooldownSeconds) * time.Second
+	}
+	return failoverCooldown
+}
+
+// connectWithFailover dials target through the rotator's upstreams, moving on
+// to a different upstream when the connect fails until the retry budget is
+// used up. Failed upstreams are excluded from the rotator for a cooldown.
+// Targets the upstream could not reach end the attempt at once.
+func (s *rotatorState) connectWithFailover(rotator domain.RotatingProxy, routing clientRouting, target string) (net.Conn, *dto.RotatingProxyNext, error) {
+	connect := s.upstreamConnector()
+	return withFailover(s, rotator, routing, func(next *dto.RotatingProxyNext) (net.Conn, error) {
+		return connect(target, next)
+	})
+}
+
+// withFailover opens a connection or session through the rotator's
+// upstreams with the failover rules of connectWithFailover.
+func withFailover[T any](s *rotatorState, rotator domain.RotatingProxy, routing clientRouting, open func(next *dto.RotatingProxyNext) (T, error)) (T, *dto.RotatingProxyNext, error) {
+	var zero T
+	var tried []uint64
+	var lastErr error
+
+	retries := rotatorFailoverRetries(rotator)
+	for attempt := 0; attempt <= retries; attempt++ {
+		next, err := s.nextUpstream(rotator, routing, tried...)
+		if err != nil {
+			if lastErr != nil {
+				return zero, nil, lastErr
+			}
+			recordUpstreamFailure(rotator, routing, 0, usageFailureNoUpstream)
+			return zero, nil, fmt.Errorf("%w: %w", errUpstreamUnavailable, err)
+		}
+		if !supportedUpstream(next.Protocol) {
+			return zero, next, errUnsupportedUpstream
+		}
+
+		started := time.Now()
+		opened, err := open(next)
+		if err == nil {
+			observeUpstream(next.ProxyID, true, time.Since(started))
+			return opened, next, nil
+		}
+		if errors.Is(err, errDestinationBlocked) {
+			return zero, next, err
+		}
+		if isTargetFailure(err) {
+			observeTargetFailure(next.ProxyID)
+		}
+		if errors.Is(err, errParentProxyFailed) || errors.Is(err, errTargetUnresolved) || isTargetFailure(err) {
+			// Every upstream is reached through the same parent and asks for
+			// the same target, so retrying another one would fail the same
+			// way. None of them is at fault and none is cooled down.
+			recordUpstreamFailure(rotator, routing, 0, connectFailureCategory(err))
+			return zero, next, err
+		}
+
+		// open only dials the upstream and runs its handshake, so whatever
+		// is left failed on the upstream itself.
+		observeUpstream(next.ProxyID, false, 0)
+		s.upstreamFailed(rotator, routing, next.ProxyID)
+		recordUpstreamFailure(rotator, routing, next.ProxyID, connectFailureCategory(err))
+		tried = append(tried, next.ProxyID)
+		lastErr = err
+		log.Debug("rotating proxy: upstream connect failed",
+			"rotator_id", rotator.ID,
+			"upstream", net.JoinHostPort(next.IP, strconv.Itoa(int(next.Port))),
+			"attempt", attempt+1,
+			"error", err,
+		)
+	}
+
+	return zero, nil, lastErr
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func loadFailoverRetries() int {
+	retries := support.GetEnvInt(envRotatingProxyFailoverRetries, defaultFailoverRetries)
+	if retries < 0 {
+		return 0
+	}
+	return min(retries, maxFailoverRetriesLimit)
+}
+
+func loadFailoverCooldown() time.Duration {
+	seconds := support.GetEnvInt(envRotatingProxyFailoverCooldownSeconds, int(defaultFailoverCooldown/time.Second))
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
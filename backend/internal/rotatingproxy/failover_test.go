@@ -0,0 +1,212 @@
+package rotatingproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func stubSequentialUpstreams(t *testing.T) *[]database.RotatingProxySelection {
+	t.Helper()
+
+	var selections []database.RotatingProxySelection
+	originalGetNext := getNextRotatingProxyFunc
+	getNextRotatingProxyFunc = func(_ uint, _ uint64, selection database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		selections = append(selections, selection)
+		return &dto.RotatingProxyNext{
+			ProxyID:  uint64(len(selections)),
+			IP:       "192.0.2.10",
+			Port:     8080,
+			Protocol: "socks5",
+		}, nil
+	}
+	t.Cleanup(func() { getNextRotatingProxyFunc = originalGetNext })
+	return &selections
+}
+
+func TestConnectWithFailover_RetriesOtherUpstreams(t *testing.T) {
+	selections := stubSequentialUpstreams(t)
+
+	upstreamClient, upstreamServer := net.Pipe()
+	t.Cleanup(func() {
+		_ = upstreamClient.Close()
+		_ = upstreamServer.Close()
+	})
+
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		if next.ProxyID < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return upstreamServer, nil
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	state := newRotatorState()
+	conn, next, err := state.connectWithFailover(domain.RotatingProxy{ID: 1}, clientRouting{}, "example.com:443")
+	if err != nil {
+		t.Fatalf("connectWithFailover: %v", err)
+	}
+	if conn != upstreamServer || next.ProxyID != 3 {
+		t.Fatalf("connected through proxy %d, want 3", next.ProxyID)
+	}
+
+	last := (*selections)[len(*selections)-1]
+	if !slices.Contains(last.ExcludeProxyIDs, 1) || !slices.Contains(last.ExcludeProxyIDs, 2) {
+		t.Fatalf("final selection excluded %v, want failed upstreams 1 and 2", last.ExcludeProxyIDs)
+	}
+
+	cooling := state.exclusions.active(time.Now())
+	slices.Sort(cooling)
+	if !slices.Equal(cooling, []uint64{1, 2}) {
+		t.Fatalf("cooling upstreams = %v, want [1 2]", cooling)
+	}
+}
+
+func TestConnectWithFailover_StopsAfterRetryBudget(t *testing.T) {
+	stubSequentialUpstreams(t)
+
+	originalRetries := failoverRetries
+	failoverRetries = 1
+	t.Cleanup(func() { failoverRetries = originalRetries })
+
+	var connectCalls atomic.Int32
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		connectCalls.Add(1)
+		return nil, errors.New("connection refused")
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	_, _, err := newRotatorState().connectWithFailover(domain.RotatingProxy{ID: 1}, clientRouting{}, "example.com:443")
+	if err == nil || errors.Is(err, errUpstreamUnavailable) {
+		t.Fatalf("expected the last connect error, got %v", err)
+	}
+	if calls := connectCalls.Load(); calls != 2 {
+		t.Fatalf("connect calls = %d, want 2", calls)
+	}
+}
+
+func TestConnectWithFailover_UsesRotatorRetriesAndCooldown(t *testing.T) {
+	stubSequentialUpstreams(t)
+
+	var connectCalls atomic.Int32
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		connectCalls.Add(1)
+		return nil, errors.New("connection refused")
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	rotator := domain.RotatingProxy{ID: 1, FailoverRetries: 4, FailoverCooldownSeconds: 600}
+	state := newRotatorState()
+	if _, _, err := state.connectWithFailover(rotator, clientRouting{}, "example.com:443"); err == nil {
+		t.Fatal("expected the connect to fail")
+	}
+	if calls := connectCalls.Load(); calls != 5 {
+		t.Fatalf("connect calls = %d, want 5", calls)
+	}
+	if cooling := state.exclusions.active(time.Now().Add(failoverCooldown + time.Second)); len(cooling) != 5 {
+		t.Fatalf("cooling upstreams after the default cooldown = %v, want all 5 for the rotator's cooldown", cooling)
+	}
+}
+
+func TestConnectWithFailover_DoesNotFailOverTargetFailures(t *testing.T) {
+	selections := stubSequentialUpstreams(t)
+
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		return nil, fmt.Errorf("%w: socks5 command 1 failed with code 5", errTargetFailed)
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	state := newRotatorState()
+	_, _, err := state.connectWithFailover(domain.RotatingProxy{ID: 1}, clientRouting{}, "example.com:25")
+	if !errors.Is(err, errTargetFailed) {
+		t.Fatalf("err = %v, want errTargetFailed", err)
+	}
+	if len(*selections) != 1 {
+		t.Fatalf("upstream selections = %d, want 1 without failover", len(*selections))
+	}
+	if cooling := state.exclusions.active(time.Now()); len(cooling) != 0 {
+		t.Fatalf("cooling upstreams = %v, want none", cooling)
+	}
+}
+
+// stubBrokenThenHealthyUpstream makes the first upstream accept the request and
+// drop the connection, and the second one answer with 200.
+func stubBrokenThenHealthyUpstream(t *testing.T) *atomic.Int32 {
+	t.Helper()
+
+	var connectCalls atomic.Int32
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		connectCalls.Add(1)
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			req, err := http.ReadRequest(bufio.NewReader(client))
+			if err != nil {
+				return
+			}
+			_ = req.Body.Close()
+			if next.ProxyID == 1 {
+				return
+			}
+			_, _ = client.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}()
+		return server, nil
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+	return &connectCalls
+}
+
+func TestHandleHTTP_RetriesIdempotentRequestOnAnotherUpstream(t *testing.T) {
+	stubSequentialUpstreams(t)
+	connectCalls := stubBrokenThenHealthyUpstream(t)
+
+	handler := &proxyHandler{rotator: domain.RotatingProxy{ID: 42, UserID: 7}, state: newRotatorState()}
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Host = "example.com"
+	recorder := httptest.NewRecorder()
+
+	handler.handleHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "ok" {
+		t.Fatalf("response = %d %q, want 200 ok", recorder.Code, recorder.Body.String())
+	}
+	if calls := connectCalls.Load(); calls != 2 {
+		t.Fatalf("connect calls = %d, want 2", calls)
+	}
+}
+
+func TestHandleHTTP_DoesNotReplayNonIdempotentRequest(t *testing.T) {
+	stubSequentialUpstreams(t)
+	connectCalls := stubBrokenThenHealthyUpstream(t)
+
+	handler := &proxyHandler{rotator: domain.RotatingProxy{ID: 42, UserID: 7}, state: newRotatorState()}
+	request := httptest.NewRequest(http.MethodPost, "http://example.com/orders", bytes.NewReader([]byte("order")))
+	request.Host = "example.com"
+	recorder := httptest.NewRecorder()
+
+	handler.handleHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("status code = %d, want %d", recorder.Code, http.StatusBadGateway)
+	}
+	if calls := connectCalls.Load(); calls != 1 {
+		t.Fatalf("connect calls = %d, want 1", calls)
+	}
+}
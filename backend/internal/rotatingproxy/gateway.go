@@ -0,0 +1,303 @@
+package rotatingproxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/domain"
+	"magpie/internal/support"
+)
+
+// gateway is a listener shared by every rotator of this instance. It picks
+// the rotator from the client's login: the username has to be a login of
+// the rotator, i.e. its own username or one of its credentials. Rotators
+// sharing a login are told apart by the password or by a rotator-<id>
+// routing parameter, which also reaches rotators without authentication.
+// A login that fits rotators of several users needs the parameter.
+//
+// The HTTP gateway serves rotators listening for HTTP(S) clients in
+// plaintext, the SOCKS5 gateway those listening for SOCKS5 clients.
+type gateway struct {
+	manager    *Manager
+	socks      bool
+	port       int
+	listener   net.Listener
+	httpServer *http.Server
+
+	socksWorkerSem          chan struct{}
+	lastSocksConcurrencyLog atomic.Int64
+	closeOnce               sync.Once
+}
+
+type gatewayConnKey struct{}
+
+// gatewayConn remembers which rotators a client connection of the HTTP
+// gateway was routed to, so each counts it as one client connection.
+type gatewayConn struct {
+	mu       sync.Mutex
+	rotators map[uint64]struct{}
+}
+
+func (c *gatewayConn) firstRequestFor(rotatorID uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rotators[rotatorID]; ok {
+		return false
+	}
+	c.rotators[rotatorID] = struct{}{}
+	return true
+}
+
+// startGateways opens the gateway listeners configured for this instance.
+func (m *Manager) startGateways() {
+	httpPort, socksPort := support.GetRotatingProxyGatewayPorts()
+	for _, gw := range []*gateway{
+		{manager: m, port: httpPort},
+		{manager: m, socks: true, port: socksPort},
+	} {
+		if gw.port == 0 {
+			continue
+		}
+		if err := gw.Start(); err != nil {
+			log.Error("rotating proxy gateway: failed to start", "port", gw.port, "socks", gw.socks, "error", err)
+			continue
+		}
+		m.mu.Lock()
+		m.gateways = append(m.gateways, gw)
+		m.mu.Unlock()
+		log.Info("rotating proxy gateway started", "port", gw.port, "socks", gw.socks)
+	}
+}
+
+func (g *gateway) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", g.port))
+	if err != nil {
+		return err
+	}
+	g.listener = listener
+
+	if g.socks {
+		if maxSocksConcurrentConnections > 0 {
+			g.socksWorkerSem = make(chan struct{}, maxSocksConcurrentConnections)
+		}
+		go g.acceptSocks()
+		return nil
+	}
+
+	g.httpServer = &http.Server{
+		Handler: g,
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, gatewayConnKey{}, &gatewayConn{rotators: make(map[uint64]struct{})})
+		},
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		ReadHeaderTimeout: 15 * time.Second,
+	}
+	go func() {
+		if err := g.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("rotating proxy gateway: serve error", "port", g.port, "error", err)
+		}
+	}()
+	return nil
+}
+
+func (g *gateway) Stop() {
+	g.closeOnce.Do(func() {
+		if g.httpServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := g.httpServer.Shutdown(ctx); err != nil {
+				log.Error("rotating proxy gateway shutdown", "port", g.port, "error", err)
+			}
+		}
+		if g.listener != nil {
+			_ = g.listener.Close()
+		}
+	})
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		writeProxyAuthRequired(w)
+		return
+	}
+	server, routing, ok := g.manager.routeGatewayClient(false, username, password, r.RemoteAddr)
+	if !ok {
+		writeProxyAuthRequired(w)
+		return
+	}
+
+	handler := server.httpHandler.Load()
+	if conn, ok := r.Context().Value(gatewayConnKey{}).(*gatewayConn); ok && conn.firstRequestFor(handler.rotator.ID) {
+		recordClientConnection(handler.rotator)
+		if !handler.admitNewConnection(w, r) {
+			return
+		}
+	}
+	handler.serve(w, r, routing)
+}
+
+func (g *gateway) acceptSocks() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error("rotating proxy gateway: accept error", "port", g.port, "error", err)
+			continue
+		}
+		applyConnDeadline(conn, handshakeTimeout)
+		if !dispatchLimited(g.socksWorkerSem, conn, g.handleSocks5) {
+			g.logSocksConcurrencyLimit()
+		}
+	}
+}
+
+// handleSocks5 authenticates a SOCKS5 client, which has to log in with a
+// username and password, and hands it to the rotator it belongs to.
+func (g *gateway) handleSocks5(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != 0x05 {
+		_ = writeSocks5Reply(conn, 0x01)
+		return
+	}
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if !slices.Contains(methods, 0x02) {
+		_, _ = conn.Write([]byte{0x05, 0xff})
+		return
+	}
+	if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+		return
+	}
+
+	username, password, err := readSocks5Credentials(conn)
+	if err != nil {
+		return
+	}
+	server, routing, ok := g.manager.routeGatewayClient(true, username, password, conn.RemoteAddr().String())
+	if !ok {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return
+	}
+
+	command, target, err := readSocks5Request(conn)
+	if err != nil {
+		return
+	}
+	handler := server.socksHandler.Load()
+	recordClientConnection(handler.rotator)
+	handler.serveSocks5(conn, command, target, routing)
+}
+
+func (g *gateway) logSocksConcurrencyLimit() {
+	nowUnix := time.Now().Unix()
+	last := g.lastSocksConcurrencyLog.Load()
+	if nowUnix-last < int64(socksConcurrencyLogEvery/time.Second) {
+		return
+	}
+	if !g.lastSocksConcurrencyLog.CompareAndSwap(last, nowUnix) {
+		return
+	}
+
+	log.Warn(
+		"rotating proxy gateway: max SOCKS concurrent connections reached; rejecting connection",
+		"port", g.port,
+		"max_concurrency", cap(g.socksWorkerSem),
+	)
+}
+
+// routeGatewayClient finds the rotator a gateway client logged in to. The
+// rotator's client allowlist and logins apply as on its own port. The login
+// has to identify one user: when it fits rotators of different users the
+// client is refused, since its traffic could not be attributed. Among the
+// rotators of that user the lowest ID wins, so a shared login resolves the
+// same way every time.
+func (m *Manager) routeGatewayClient(socks bool, username, password, remoteAddr string) (*proxyServer, clientRouting, bool) {
+	m.mu.RLock()
+	servers := make([]*proxyServer, 0, len(m.servers))
+	for _, server := range m.servers {
+		if gatewayServes(socks, server.config()) {
+			servers = append(servers, server)
+		}
+	}
+	m.mu.RUnlock()
+	slices.SortFunc(servers, func(a, b *proxyServer) int {
+		return cmp.Compare(a.config().ID, b.config().ID)
+	})
+
+	var (
+		matched        *proxyServer
+		matchedRouting clientRouting
+		owner          uint
+	)
+	for _, server := range servers {
+		rotator := server.config()
+		routing, err := parseClientUsername(rotator, username)
+		if err != nil {
+			continue
+		}
+		allowed, credentialsRequired := checkClientAccess(rotator, remoteAddr)
+		if !allowed {
+			continue
+		}
+		if !credentialsRequired && routing.Rotator == rotator.ID {
+			// The rotator ID names exactly one rotator.
+			credentialID, ok := authorizeClient(rotator, routing.Username, password, false)
+			if !ok {
+				return nil, clientRouting{}, false
+			}
+			routing.CredentialID = credentialID
+			return server, routing, true
+		}
+		if routing.Username == "" {
+			continue
+		}
+		credentialID, ok := authorizeLogin(rotator, routing.Username, password)
+		if !ok {
+			continue
+		}
+		if matched != nil {
+			if rotator.UserID != owner {
+				return nil, clientRouting{}, false
+			}
+			continue
+		}
+		routing.CredentialID = credentialID
+		matched, matchedRouting, owner = server, routing, rotator.UserID
+	}
+	return matched, matchedRouting, matched != nil
+}
+
+func gatewayServes(socks bool, rotator domain.RotatingProxy) bool {
+	name := strings.ToLower(listenProtocolName(rotator))
+	if socks {
+		return name == "socks5"
+	}
+	// Logins of TLS rotators must not cross the plaintext gateway.
+	return !isSocksProtocol(name) && listenTransportProtocolName(rotator) != support.TransportTLS
+}
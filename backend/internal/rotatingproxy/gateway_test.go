@@ -0,0 +1,191 @@
+package rotatingproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func gatewayTestManager(t *testing.T) *Manager {
+	t.Helper()
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+
+	manager := NewManager()
+	for _, rotator := range []domain.RotatingProxy{
+		{ID: 1, AuthRequired: true, AuthUsername: "shared", AuthPassword: "pass-a", Protocol: domain.Protocol{Name: "http"}},
+		{
+			ID: 2, AuthRequired: true, AuthUsername: "shared", AuthPassword: "pass-b", Protocol: domain.Protocol{Name: "http"},
+			Credentials: []domain.RotatingProxyCredential{{ID: 9, Name: "team", Password: "team-pass"}},
+		},
+		{ID: 3, Protocol: domain.Protocol{Name: "http"}},
+		{ID: 4, AuthRequired: true, AuthUsername: "shared", AuthPassword: "pass-a", Protocol: domain.Protocol{Name: "socks5"}},
+		{
+			ID: 5, AuthRequired: true, AuthUsername: "shared", AuthPassword: "pass-a", Protocol: domain.Protocol{Name: "http"},
+			AllowedClientCIDRs: domain.StringList{"10.0.0.0/8"},
+		},
+		{ID: 6, AuthRequired: true, AuthUsername: "secure", AuthPassword: "pass", Protocol: domain.Protocol{Name: "http"}, ListenTransportProtocol: "tls"},
+	} {
+		server := newProxyServer(rotator)
+		t.Cleanup(server.Stop)
+		manager.servers[rotator.ID] = server
+	}
+	return manager
+}
+
+func TestRouteGatewayClient_PicksRotatorByLogin(t *testing.T) {
+	manager := gatewayTestManager(t)
+
+	tests := []struct {
+		name       string
+		socks      bool
+		username   string
+		password   string
+		remoteAddr string
+		rotatorID  uint64
+		credential uint64
+	}{
+		{name: "password picks shared login", username: "shared", password: "pass-b", rotatorID: 2},
+		{name: "lowest id wins for identical logins", username: "shared", password: "pass-a", rotatorID: 1},
+		{name: "socks gateway serves socks5 rotators", socks: true, username: "shared", password: "pass-a", rotatorID: 4},
+		{name: "credential with routing parameters", username: "team-session-s1", password: "team-pass", rotatorID: 2, credential: 9},
+		{name: "rotator parameter selects rotator", username: "shared-rotator-5", password: "pass-a", remoteAddr: "10.1.2.3:4000", rotatorID: 5},
+		{name: "rotator parameter reaches open rotator", username: "rotator-3", rotatorID: 3},
+		{name: "rotator parameter does not skip login", username: "rotator-1"},
+		{name: "rotator parameter must match login", username: "shared-rotator-2", password: "pass-a"},
+		{name: "allowlist applies", username: "shared-rotator-5", password: "pass-a", remoteAddr: "192.0.2.1:4000"},
+		{name: "wrong password", username: "shared", password: "wrong"},
+		{name: "http rotators are not served over socks", socks: true, username: "shared", password: "pass-b"},
+		{name: "tls rotators are not served in plaintext", username: "secure", password: "pass"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			remoteAddr := tc.remoteAddr
+			if remoteAddr == "" {
+				remoteAddr = "192.0.2.1:4000"
+			}
+			server, routing, ok := manager.routeGatewayClient(tc.socks, tc.username, tc.password, remoteAddr)
+			if tc.rotatorID == 0 {
+				if ok {
+					t.Fatalf("routed to rotator %d, want rejection", server.config().ID)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("client was rejected, want rotator %d", tc.rotatorID)
+			}
+			if got := server.config().ID; got != tc.rotatorID {
+				t.Fatalf("rotator = %d, want %d", got, tc.rotatorID)
+			}
+			if routing.CredentialID != tc.credential {
+				t.Fatalf("credential = %d, want %d", routing.CredentialID, tc.credential)
+			}
+		})
+	}
+}
+
+func TestRouteGatewayClient_RejectsLoginsOfSeveralUsers(t *testing.T) {
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+
+	manager := NewManager()
+	for _, rotator := range []domain.RotatingProxy{
+		{ID: 10, UserID: 1, AuthRequired: true, AuthUsername: "scraper", AuthPassword: "secret", Protocol: domain.Protocol{Name: "http"}},
+		{ID: 11, UserID: 2, AuthRequired: true, AuthUsername: "scraper", AuthPassword: "secret", Protocol: domain.Protocol{Name: "http"}},
+		{
+			ID: 12, UserID: 2, AuthRequired: true, AuthUsername: "owner-b", AuthPassword: "pass", Protocol: domain.Protocol{Name: "http"},
+			Credentials: []domain.RotatingProxyCredential{{ID: 21, Name: "team", Password: "team-pass"}},
+		},
+		{
+			ID: 13, UserID: 1, AuthRequired: true, AuthUsername: "owner-a", AuthPassword: "pass", Protocol: domain.Protocol{Name: "http"},
+			Credentials: []domain.RotatingProxyCredential{{ID: 22, Name: "team", Password: "team-pass"}},
+		},
+	} {
+		server := newProxyServer(rotator)
+		t.Cleanup(server.Stop)
+		manager.servers[rotator.ID] = server
+	}
+
+	for _, username := range []string{"scraper", "team"} {
+		password := map[string]string{"scraper": "secret", "team": "team-pass"}[username]
+		if server, _, ok := manager.routeGatewayClient(false, username, password, "192.0.2.1:4000"); ok {
+			t.Fatalf("login %q of two users routed to rotator %d, want rejection", username, server.config().ID)
+		}
+	}
+
+	server, routing, ok := manager.routeGatewayClient(false, "scraper-rotator-11", "secret", "192.0.2.1:4000")
+	if !ok || server.config().ID != 11 {
+		t.Fatalf("rotator parameter: ok = %v, want rotator 11", ok)
+	}
+	server, routing, ok = manager.routeGatewayClient(false, "team-rotator-12", "team-pass", "192.0.2.1:4000")
+	if !ok || server.config().ID != 12 || routing.CredentialID != 21 {
+		t.Fatalf("credential with rotator parameter: ok = %v, routing = %+v, want rotator 12 and credential 21", ok, routing)
+	}
+}
+
+func TestParseClientUsername_RejectsOtherRotator(t *testing.T) {
+	rotator := domain.RotatingProxy{ID: 7, AuthUsername: "owner"}
+
+	routing, err := parseClientUsername(rotator, "owner-rotator-7-session-a")
+	if err != nil || routing.Username != "owner" || routing.Session != "a" || routing.Rotator != 7 {
+		t.Fatalf("routing = %+v, err = %v", routing, err)
+	}
+	if _, err := parseClientUsername(rotator, "owner-rotator-8"); err == nil {
+		t.Fatal("expected a rotator parameter naming another rotator to be rejected")
+	}
+}
+
+func TestGatewaySocks5_TunnelsThroughRoutedRotator(t *testing.T) {
+	manager := gatewayTestManager(t)
+
+	upClient, upServer := net.Pipe()
+	t.Cleanup(func() {
+		_ = upClient.Close()
+		_ = upServer.Close()
+	})
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, _ *dto.RotatingProxyNext) (net.Conn, error) {
+		if target != "example.com:80" {
+			t.Errorf("target = %s, want example.com:80", target)
+		}
+		return upServer, nil
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	gw := &gateway{manager: manager, socks: true}
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { _ = clientConn.Close() })
+	go gw.handleSocks5(serverConn)
+
+	if status := socks5Login(t, clientConn, "shared", "pass-a"); status != 0x00 {
+		t.Fatalf("authentication failed with code %02x", status)
+	}
+	request := []byte{0x05, 0x01, 0x00, 0x03, byte(len("example.com"))}
+	request = append(request, "example.com"...)
+	request = append(request, 0x00, 0x50)
+	if _, err := clientConn.Write(request); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(clientConn, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("connect reply = %v, err = %v", reply, err)
+	}
+
+	if _, err := clientConn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write through tunnel: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(upClient, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("upstream read = %q, err = %v", buf, err)
+	}
+
+	rejectedClient, rejectedServer := net.Pipe()
+	t.Cleanup(func() { _ = rejectedClient.Close() })
+	go gw.handleSocks5(rejectedServer)
+	if status := socks5Login(t, rejectedClient, "shared", "pass-b"); status == 0x00 {
+		t.Fatal("login of an HTTP rotator was accepted by the SOCKS5 gateway")
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -35,7 +36,7 @@ const (
 )
 
 var (
-	getNextRotatingProxyFunc   = database.GetNextRotatingProxy
+	getNextRotatingProxyFunc   = database.GetNextRotatingProxyWithSelection
 	dialUpstreamFunc           = dialUpstream
 	performUpstreamConnectFunc = performUpstreamConnect
 	connectThroughUpstreamFunc = connectThroughUpstream
@@ -46,10 +47,12 @@ var (
 
 type proxyHandler struct {
 	rotator domain.RotatingProxy
+	state   *rotatorState
 }
 
 type socksProxyHandler struct {
 	rotator domain.RotatingProxy
+	state   *rotatorState
 }
 
 func newSocksProxyHandler(rotator domain.RotatingProxy) *socksProxyHandler {
@@ -57,7 +60,7 @@ func newSocksProxyHandler(rotator domain.RotatingProxy) *socksProxyHandler {
 }
 
 func (h *socksProxyHandler) handle(conn net.Conn) {
-	applyConnDeadline(conn, handshakeTimeout)
+	applyConnDeadline(conn, rotatorHandshakeTimeout(h.rotator))
 	switch strings.ToLower(strings.TrimSpace(listenProtocolName(h.rotator))) {
 	case "socks4":
 		h.handleSocks4(conn)
@@ -69,27 +72,43 @@ func (h *socksProxyHandler) handle(conn net.Conn) {
 func (h *socksProxyHandler) handleSocks5(conn net.Conn) {
 	defer conn.Close()
 
-	target, err := h.performSocks5Handshake(conn)
+	command, target, routing, err := h.performSocks5Handshake(conn)
 	if err != nil {
 		return
 	}
+	h.serveSocks5(conn, command, target, routing)
+}
 
-	next, err := getNextRotatingProxyFunc(h.rotator.UserID, h.rotator.ID)
+// serveSocks5 carries out the request of an authenticated SOCKS5 client.
+func (h *socksProxyHandler) serveSocks5(conn net.Conn, command byte, target string, routing clientRouting) {
+	release, err := h.state.acquireCredential(h.rotator, routing.CredentialID)
 	if err != nil {
-		_ = writeSocks5Reply(conn, 0x01)
+		_ = writeSocks5Reply(conn, 0x02)
+		return
+	}
+	defer release()
+	releaseTunnel, err := h.state.acquireSocksConnection(h.rotator, conn.RemoteAddr().String())
+	if err != nil {
+		_ = writeSocks5Reply(conn, 0x02)
 		return
 	}
+	defer releaseTunnel()
 
-	if !supportedUpstream(next.Protocol) {
-		_ = writeSocks5Reply(conn, 0x07)
+	if command == socks5CommandUDPAssociate {
+		h.handleSocks5UDP(conn, routing)
+		return
+	}
+	if !h.state.targetAllowed(target, 0) {
+		_ = writeSocks5Reply(conn, 0x02)
 		return
 	}
 
-	upstreamConn, err := connectThroughUpstreamFunc(target, next)
+	upstreamConn, next, err := h.state.connectWithFailover(h.rotator, routing, target)
 	if err != nil {
-		_ = writeSocks5Reply(conn, 0x05)
+		_ = writeSocks5Reply(conn, socks5FailureReply(err))
 		return
 	}
+	defer h.state.acquireUpstream(next.ProxyID)()
 
 	if err := writeSocks5Success(conn, upstreamConn.LocalAddr()); err != nil {
 		_ = upstreamConn.Close()
@@ -98,33 +117,42 @@ func (h *socksProxyHandler) handleSocks5(conn net.Conn) {
 
 	clearConnDeadline(conn)
 	clearConnDeadline(upstreamConn)
-	pipeConnections(conn, upstreamConn)
+	defer h.state.trackTunnel(conn, upstreamConn)()
+	up, down := pipeMeteredConnections(conn, upstreamConn, h.state.tunnelMeter(routing))
+	recordUpstreamTraffic(h.rotator, routing, next.ProxyID, up, down)
 }
 
-func (h *socksProxyHandler) performSocks5Handshake(conn net.Conn) (string, error) {
+// performSocks5Handshake authenticates the client and reads its CONNECT or
+// UDP ASSOCIATE request.
+func (h *socksProxyHandler) performSocks5Handshake(conn net.Conn) (byte, string, clientRouting, error) {
+	allowed, credentialsRequired := checkClientAccess(h.rotator, conn.RemoteAddr().String())
+
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return "", err
+		return 0, "", clientRouting{}, err
 	}
 	if header[0] != 0x05 {
 		_ = writeSocks5Reply(conn, 0x01)
-		return "", errors.New("unsupported socks version")
+		return 0, "", clientRouting{}, errors.New("unsupported socks version")
 	}
 
 	methods := make([]byte, int(header[1]))
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return "", err
+		return 0, "", clientRouting{}, err
 	}
 
 	selected := byte(0xff)
-	if h.rotator.AuthRequired {
+	switch {
+	case !allowed:
+		// No method is acceptable for clients outside the allowlist.
+	case credentialsRequired:
 		for _, method := range methods {
 			if method == 0x02 {
 				selected = 0x02
 				break
 			}
 		}
-	} else {
+	default:
 		for _, method := range methods {
 			if method == 0x00 {
 				selected = 0x00
@@ -143,60 +171,80 @@ func (h *socksProxyHandler) performSocks5Handshake(conn net.Conn) (string, error
 
 	if selected == 0xff {
 		_, _ = conn.Write([]byte{0x05, 0xff})
-		return "", errors.New("no acceptable authentication methods")
+		return 0, "", clientRouting{}, errors.New("no acceptable authentication methods")
 	}
 
 	if _, err := conn.Write([]byte{0x05, selected}); err != nil {
-		return "", err
+		return 0, "", clientRouting{}, err
 	}
 
+	var routing clientRouting
 	if selected == 0x02 {
-		if err := h.verifySocks5Credentials(conn); err != nil {
-			return "", err
+		var err error
+		routing, err = h.verifySocks5Credentials(conn, credentialsRequired)
+		if err != nil {
+			return 0, "", clientRouting{}, err
 		}
 	}
 
-	target, err := readSocks5Target(conn)
+	command, target, err := readSocks5Request(conn)
 	if err != nil {
-		return "", err
+		return 0, "", clientRouting{}, err
 	}
 
-	return target, nil
+	return command, target, routing, nil
 }
 
-func (h *socksProxyHandler) verifySocks5Credentials(conn net.Conn) error {
+func (h *socksProxyHandler) verifySocks5Credentials(conn net.Conn, credentialsRequired bool) (clientRouting, error) {
+	username, password, err := readSocks5Credentials(conn)
+	if err != nil {
+		return clientRouting{}, err
+	}
+
+	routing, err := parseClientUsername(h.rotator, username)
+	if err != nil {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return clientRouting{}, err
+	}
+
+	credentialID, ok := authorizeClient(h.rotator, routing.Username, password, credentialsRequired)
+	if !ok {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return clientRouting{}, errors.New("invalid socks5 credentials")
+	}
+	routing.CredentialID = credentialID
+
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return routing, err
+}
+
+// readSocks5Credentials reads a username/password authentication request
+// (RFC 1929). The caller replies with the outcome.
+func readSocks5Credentials(conn net.Conn) (string, string, error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return err
+		return "", "", err
 	}
 	if header[0] != 0x01 {
 		_, _ = conn.Write([]byte{0x01, 0x01})
-		return errors.New("invalid socks5 authentication version")
+		return "", "", errors.New("invalid socks5 authentication version")
 	}
 
-	usernameLen := int(header[1])
-	username := make([]byte, usernameLen)
+	username := make([]byte, int(header[1]))
 	if _, err := io.ReadFull(conn, username); err != nil {
-		return err
+		return "", "", err
 	}
 
 	passLen := make([]byte, 1)
 	if _, err := io.ReadFull(conn, passLen); err != nil {
-		return err
+		return "", "", err
 	}
 
 	password := make([]byte, int(passLen[0]))
 	if _, err := io.ReadFull(conn, password); err != nil {
-		return err
+		return "", "", err
 	}
-
-	if h.rotator.AuthRequired && (string(username) != h.rotator.AuthUsername || string(password) != h.rotator.AuthPassword) {
-		_, _ = conn.Write([]byte{0x01, 0x01})
-		return errors.New("invalid socks5 credentials")
-	}
-
-	_, err := conn.Write([]byte{0x01, 0x00})
-	return err
+	return string(username), string(password), nil
 }
 
 func (h *socksProxyHandler) handleSocks4(conn net.Conn) {
@@ -233,31 +281,68 @@ func (h *socksProxyHandler) handleSocks4(conn net.Conn) {
 		targetHost = strings.TrimSuffix(domain, "\x00")
 	}
 
-	if h.rotator.AuthRequired {
-		expected := h.rotator.AuthUsername
-		if h.rotator.AuthPassword != "" {
-			expected = fmt.Sprintf("%s:%s", h.rotator.AuthUsername, h.rotator.AuthPassword)
+	allowed, credentialsRequired := checkClientAccess(h.rotator, conn.RemoteAddr().String())
+	if !allowed {
+		_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
+		return
+	}
+
+	username, password, hasPassword := strings.Cut(userID, ":")
+	routing, err := parseClientUsername(h.rotator, username)
+	if err != nil {
+		_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
+		return
+	}
+
+	if credentialsRequired {
+		validPassword := hasPassword && password == h.rotator.AuthPassword
+		if h.rotator.AuthPassword == "" {
+			validPassword = !hasPassword
 		}
-		if userID != expected {
+		ownLogin := routing.Username == h.rotator.AuthUsername && validPassword
+		credentialID, credentialLogin := matchCredential(h.rotator, routing.Username, password)
+		if !ownLogin && !(hasPassword && credentialLogin) {
 			_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
 			return
 		}
+		if !ownLogin {
+			routing.CredentialID = credentialID
+		}
+	} else if hasPassword {
+		credentialID, ok := authorizeClient(h.rotator, routing.Username, password, false)
+		if !ok {
+			_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
+			return
+		}
+		routing.CredentialID = credentialID
 	}
 
-	port := binary.BigEndian.Uint16(dstPort)
-	target := net.JoinHostPort(targetHost, strconv.Itoa(int(port)))
+	release, err := h.state.acquireCredential(h.rotator, routing.CredentialID)
+	if err != nil {
+		_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
+		return
+	}
+	defer release()
+	releaseTunnel, err := h.state.acquireSocksConnection(h.rotator, conn.RemoteAddr().String())
+	if err != nil {
+		_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
+		return
+	}
+	defer releaseTunnel()
 
-	next, err := getNextRotatingProxyFunc(h.rotator.UserID, h.rotator.ID)
-	if err != nil || !supportedUpstream(next.Protocol) {
+	port := binary.BigEndian.Uint16(dstPort)
+	if !h.state.destinations().allows(targetHost, port) {
 		_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
 		return
 	}
+	target := net.JoinHostPort(targetHost, strconv.Itoa(int(port)))
 
-	upstreamConn, err := connectThroughUpstreamFunc(target, next)
+	upstreamConn, next, err := h.state.connectWithFailover(h.rotator, routing, target)
 	if err != nil {
 		_ = writeSocks4Response(conn, 0x5B, dstPort, dstIP)
 		return
 	}
+	defer h.state.acquireUpstream(next.ProxyID)()
 
 	if err := writeSocks4Response(conn, 0x5A, dstPort, dstIP); err != nil {
 		_ = upstreamConn.Close()
@@ -266,56 +351,106 @@ func (h *socksProxyHandler) handleSocks4(conn net.Conn) {
 
 	clearConnDeadline(conn)
 	clearConnDeadline(upstreamConn)
-	pipeConnections(conn, upstreamConn)
+	defer h.state.trackTunnel(conn, upstreamConn)()
+	up, down := pipeMeteredConnections(conn, upstreamConn, h.state.tunnelMeter(routing))
+	recordUpstreamTraffic(h.rotator, routing, next.ProxyID, up, down)
 }
 func (h *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !h.authenticateClient(w, r) {
+	routing, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if firstClientRequest(r) && !h.admitNewConnection(w, r) {
 		return
 	}
+	h.serve(w, r, routing)
+}
 
-	switch strings.ToUpper(r.Method) {
-	case http.MethodConnect:
+// serve handles the request of an authenticated client.
+func (h *proxyHandler) serve(w http.ResponseWriter, r *http.Request, routing clientRouting) {
+	release, err := h.state.acquireCredential(h.rotator, routing.CredentialID)
+	if err != nil {
+		writeCredentialLimitError(w, err)
+		return
+	}
+	defer release()
+	if err := h.state.admitRequest(h.rotator, r.RemoteAddr); err != nil {
+		writeTrafficLimitError(w, err)
+		return
+	}
+	r = r.WithContext(withClientRouting(r.Context(), routing))
+
+	switch {
+	case strings.EqualFold(r.Method, http.MethodConnect):
 		h.handleConnect(w, r)
+	case isUpgradeRequest(r):
+		h.handleUpgrade(w, r)
 	default:
 		h.handleHTTP(w, r)
 	}
 }
 
-func (h *proxyHandler) authenticateClient(w http.ResponseWriter, r *http.Request) bool {
-	if !h.rotator.AuthRequired {
-		return true
+func (h *proxyHandler) authenticateClient(w http.ResponseWriter, r *http.Request) (clientRouting, bool) {
+	allowed, credentialsRequired := checkClientAccess(h.rotator, r.RemoteAddr)
+	if !allowed {
+		http.Error(w, "Client address not allowed", http.StatusForbidden)
+		return clientRouting{}, false
 	}
 
-	header := strings.TrimSpace(r.Header.Get("Proxy-Authorization"))
-	if header == "" {
-		writeProxyAuthRequired(w)
-		return false
+	username, password, hasCredentials := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !hasCredentials {
+		if credentialsRequired {
+			writeProxyAuthRequired(w)
+			return clientRouting{}, false
+		}
+		return clientRouting{}, true
 	}
 
-	parts := strings.SplitN(header, " ", 2)
-	if len(parts) != 2 || !strings.EqualFold(parts[0], "Basic") {
+	routing, err := parseClientUsername(h.rotator, username)
+	if err != nil {
 		writeProxyAuthRequired(w)
-		return false
+		return clientRouting{}, false
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(parts[1])
-	if err != nil {
+	credentialID, ok := authorizeClient(h.rotator, routing.Username, password, credentialsRequired)
+	if !ok {
 		writeProxyAuthRequired(w)
-		return false
+		return clientRouting{}, false
 	}
+	routing.CredentialID = credentialID
 
-	creds := strings.SplitN(string(decoded), ":", 2)
-	if len(creds) != 2 {
-		writeProxyAuthRequired(w)
-		return false
+	return routing, true
+}
+
+func writeCredentialLimitError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCredentialQuotaExceeded) {
+		http.Error(w, "Bandwidth quota exceeded", http.StatusForbidden)
+		return
 	}
+	http.Error(w, "Too many concurrent connections", http.StatusTooManyRequests)
+}
 
-	if creds[0] != h.rotator.AuthUsername || creds[1] != h.rotator.AuthPassword {
-		writeProxyAuthRequired(w)
-		return false
+func parseProxyAuthorization(header string) (string, string, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Basic") {
+		return "", "", false
 	}
 
-	return true
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	return username, password, true
 }
 
 func writeProxyAuthRequired(w http.ResponseWriter) {
@@ -329,14 +464,13 @@ func (h *proxyHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 	}
 
-	next, err := getNextRotatingProxyFunc(h.rotator.UserID, h.rotator.ID)
-	if err != nil {
-		http.Error(w, "failed to acquire upstream proxy", http.StatusBadGateway)
-		return
+	targetURL := requestTargetURL(r)
+	defaultPort := uint16(80)
+	if strings.EqualFold(targetURL.Scheme, "https") {
+		defaultPort = 443
 	}
-
-	if !supportedUpstream(next.Protocol) {
-		http.Error(w, "upstream protocol not supported by rotator", http.StatusBadGateway)
+	if !h.state.targetAllowed(targetURL.Host, defaultPort) {
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
 		return
 	}
 
@@ -355,71 +489,225 @@ func (h *proxyHandler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	targetURL := r.URL
-	if !targetURL.IsAbs() {
-		scheme := "http"
-		if r.URL != nil && r.URL.Scheme != "" {
-			scheme = r.URL.Scheme
-		} else if r.TLS != nil {
-			scheme = "https"
-		} else if strings.HasPrefix(strings.ToLower(r.Proto), "https") {
-			scheme = "https"
-		}
-		targetURL = &url.URL{
-			Scheme:   scheme,
-			Host:     r.Host,
-			Path:     r.URL.Path,
-			RawQuery: r.URL.RawQuery,
-		}
+	var body *failoverRequestBody
+	if upstreamBody != nil && upstreamContentLength != 0 {
+		body = &failoverRequestBody{body: upstreamBody}
 	}
 
 	ctx := r.Context()
-	if upstreamTimeout > 0 {
+	if timeout := rotatorUpstreamTimeout(h.rotator); timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, upstreamTimeout)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
 
-	newReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL.String(), upstreamBody)
-	if err != nil {
-		http.Error(w, "failed to build upstream request", http.StatusInternalServerError)
-		return
-	}
-	if upstreamContentLength >= 0 {
-		newReq.ContentLength = upstreamContentLength
-	}
+	routing := clientRoutingFromContext(r.Context())
+	var tried []uint64
+	for attempt := 0; ; attempt++ {
+		next, err := h.state.nextUpstream(h.rotator, routing, tried...)
+		if err != nil {
+			if attempt == 0 {
+				recordUpstreamFailure(h.rotator, routing, 0, usageFailureNoUpstream)
+			}
+			http.Error(w, "failed to acquire upstream proxy", http.StatusBadGateway)
+			return
+		}
 
-	newReq.Header = r.Header.Clone()
-	newReq.Header.Del("Proxy-Authorization")
+		if !supportedUpstream(next.Protocol) {
+			http.Error(w, "upstream protocol not supported by rotator", http.StatusBadGateway)
+			return
+		}
 
-	connectFn := connectThroughUpstreamFunc
-	transport := buildHTTPTransportWithConnector(next, connectFn)
-	resp, err := transport.RoundTrip(newReq)
-	if err != nil {
+		if err := h.state.checkProxiedTarget(targetURL.Host, defaultPort, next); err != nil {
+			if errors.Is(err, errDestinationBlocked) {
+				http.Error(w, "Destination not allowed", http.StatusForbidden)
+				return
+			}
+			recordUpstreamFailure(h.rotator, routing, 0, usageFailureConnect)
+			http.Error(w, "failed to resolve target host", http.StatusBadGateway)
+			return
+		}
+
+		newReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL.String(), body.reader())
+		if err != nil {
+			http.Error(w, "failed to build upstream request", http.StatusInternalServerError)
+			return
+		}
+		if upstreamContentLength >= 0 {
+			newReq.ContentLength = upstreamContentLength
+		}
+
+		newReq.Header = r.Header.Clone()
+		newReq.Header.Del("Proxy-Authorization")
+		applyRequestHeaderRules(h.rotator, newReq.Header)
+
+		release := h.state.acquireUpstream(next.ProxyID)
+		resp, dialed, handshake, err := roundTripUpstream(newReq, h.state.upstreamTransport(next))
+		if err == nil {
+			observeUpstream(next.ProxyID, true, handshake)
+			defer release()
+			defer resp.Body.Close()
+
+			copyHeaders(w.Header(), resp.Header)
+			setUpstreamHeaders(h.rotator, w.Header(), next)
+			w.WriteHeader(resp.StatusCode)
+			down, err := io.Copy(w, resp.Body)
+			if err != nil {
+				log.Warn("rotating proxy: failed to copy response body", "rotator_id", h.rotator.ID, "error", err)
+			}
+			h.state.recordTraffic(h.rotator, routing, next.ProxyID, body.bytesRead(), down)
+			return
+		}
+		release()
+
+		if r.Context().Err() != nil {
+			// The client left. Neither the upstream nor the target failed.
+			return
+		}
 		if isRequestBodyTooLarge(err) {
 			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
 			return
 		}
+		if errors.Is(err, errParentProxyFailed) {
+			recordUpstreamFailure(h.rotator, routing, 0, connectFailureCategory(err))
+			log.Warn("rotating proxy: parent proxy failed", "rotator_id", h.rotator.ID, "error", err)
+			http.Error(w, "parent proxy request failed", http.StatusBadGateway)
+			return
+		}
+		if errors.Is(err, errTargetUnresolved) {
+			recordUpstreamFailure(h.rotator, routing, 0, usageFailureConnect)
+			http.Error(w, "failed to resolve target host", http.StatusBadGateway)
+			return
+		}
+		if errors.Is(err, errDestinationBlocked) {
+			http.Error(w, "Destination not allowed", http.StatusForbidden)
+			return
+		}
+		if isTargetFailure(err) {
+			observeTargetFailure(next.ProxyID)
+			recordUpstreamFailure(h.rotator, routing, 0, usageFailureConnect)
+			setUpstreamHeaders(h.rotator, w.Header(), next)
+			http.Error(w, "upstream could not reach the target", http.StatusBadGateway)
+			return
+		}
+		if isUpstreamTimeout(ctx, err, dialed) {
+			recordUpstreamFailure(h.rotator, routing, next.ProxyID, usageFailureTimeout)
+			setUpstreamHeaders(h.rotator, w.Header(), next)
+			http.Error(w, "upstream proxy timed out", http.StatusGatewayTimeout)
+			return
+		}
+		if isTargetTLSError(err) {
+			observeTargetTLSError(next.ProxyID)
+		} else if !dialed {
+			observeUpstream(next.ProxyID, false, 0)
+		}
+		h.state.upstreamFailed(h.rotator, routing, next.ProxyID)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			recordUpstreamFailure(h.rotator, routing, next.ProxyID, usageFailureTimeout)
+		case dialed:
+			recordUpstreamFailure(h.rotator, routing, next.ProxyID, usageFailureResponse)
+		default:
+			recordUpstreamFailure(h.rotator, routing, next.ProxyID, connectFailureCategory(err))
+		}
 		if errors.Is(err, context.DeadlineExceeded) {
+			setUpstreamHeaders(h.rotator, w.Header(), next)
 			http.Error(w, "upstream proxy timed out", http.StatusGatewayTimeout)
 			return
 		}
+
+		// A request may only be replayed on another upstream when its body is
+		// untouched and either the method is idempotent or nothing reached the
+		// upstream yet.
+		retryable := attempt < rotatorFailoverRetries(h.rotator) &&
+			ctx.Err() == nil &&
+			!body.consumed() &&
+			(isIdempotentMethod(r.Method) || !dialed)
+		if retryable {
+			tried = append(tried, next.ProxyID)
+			continue
+		}
+
 		log.Warn("rotating proxy: upstream request failed",
 			"rotator_id", h.rotator.ID,
 			"upstream_protocol", next.Protocol,
 			"upstream", net.JoinHostPort(next.IP, strconv.Itoa(int(next.Port))),
+			"attempts", attempt+1,
 			"error", err,
 		)
+		setUpstreamHeaders(h.rotator, w.Header(), next)
 		http.Error(w, "upstream proxy request failed", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
+}
+
+// requestTargetURL returns the absolute URL a proxied request is meant for.
+func requestTargetURL(r *http.Request) *url.URL {
+	if r.URL.IsAbs() {
+		return r.URL
+	}
+	scheme := "http"
+	if r.URL.Scheme != "" {
+		scheme = r.URL.Scheme
+	} else if r.TLS != nil {
+		scheme = "https"
+	} else if strings.HasPrefix(strings.ToLower(r.Proto), "https") {
+		scheme = "https"
+	}
+	return &url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+}
+
+// roundTripUpstream sends req through transport and reports whether any
+// bytes may have reached the upstream, and how long dialing it took. The
+// handshake is zero when a kept-alive connection was reused.
+func roundTripUpstream(req *http.Request, transport *http.Transport) (*http.Response, bool, time.Duration, error) {
+	req, trip := withUpstreamRoundTrip(req)
+	resp, err := transport.RoundTrip(req)
+	return resp, trip.sent.Load(), time.Duration(trip.handshake.Load()), err
+}
+
+// failoverRequestBody lets one request body be offered to several upstream
+// attempts. The transport closes request bodies on failure, so Close is a
+// no-op and the handler closes the client body itself.
+type failoverRequestBody struct {
+	body io.Reader
+	read atomic.Bool
+	n    atomic.Int64
+}
+
+func (b *failoverRequestBody) reader() io.Reader {
+	if b == nil {
+		return nil
+	}
+	return b
+}
+
+func (b *failoverRequestBody) consumed() bool {
+	return b != nil && b.read.Load()
+}
 
-	copyHeaders(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Warn("rotating proxy: failed to copy response body", "rotator_id", h.rotator.ID, "error", err)
+// bytesRead reports how much of the body was sent upstream.
+func (b *failoverRequestBody) bytesRead() int64 {
+	if b == nil {
+		return 0
 	}
+	return b.n.Load()
+}
+
+func (b *failoverRequestBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	n, err := b.body.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func (b *failoverRequestBody) Close() error {
+	return nil
 }
 
 var errRequestBodyTooLarge = errors.New("request body too large")
@@ -601,6 +889,17 @@ func connectThroughUpstreamWithContext(ctx context.Context, target string, next
 }
 
 func (h *proxyHandler) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if !h.state.targetAllowed(r.Host, 443) {
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return
+	}
+	releaseTunnel, err := h.state.acquireTunnel(h.rotator, r.RemoteAddr)
+	if err != nil {
+		writeTrafficLimitError(w, err)
+		return
+	}
+	defer releaseTunnel()
+
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
@@ -619,39 +918,41 @@ func (h *proxyHandler) handleConnect(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	next, err := getNextRotatingProxyFunc(h.rotator.UserID, h.rotator.ID)
+	routing := clientRoutingFromContext(r.Context())
+	upConn, next, err := h.state.connectWithFailover(h.rotator, routing, r.Host)
 	if err != nil {
-		writeHijackedResponse(buf, http.StatusBadGateway, "Failed to acquire upstream proxy")
-		return
-	}
-
-	if !supportedUpstream(next.Protocol) {
-		writeHijackedResponse(buf, http.StatusBadGateway, "Upstream protocol not supported by rotator")
-		return
-	}
-
-	upConn, err := connectThroughUpstreamFunc(r.Host, next)
-	if err != nil {
-		log.Warn("rotating proxy: upstream connect failed",
-			"rotator_id", h.rotator.ID,
-			"upstream_protocol", next.Protocol,
-			"upstream", net.JoinHostPort(next.IP, strconv.Itoa(int(next.Port))),
-			"target", r.Host,
-			"error", err,
-		)
-		writeHijackedResponse(buf, http.StatusBadGateway, "Upstream CONNECT failed")
+		switch {
+		case errors.Is(err, errUpstreamUnavailable):
+			writeHijackedResponse(buf, http.StatusBadGateway, "Failed to acquire upstream proxy")
+		case errors.Is(err, errUnsupportedUpstream):
+			writeHijackedResponse(buf, http.StatusBadGateway, "Upstream protocol not supported by rotator")
+		case errors.Is(err, errTargetUnresolved):
+			writeHijackedResponse(buf, http.StatusBadGateway, "Failed to resolve target host")
+		case errors.Is(err, errDestinationBlocked):
+			writeHijackedResponse(buf, http.StatusForbidden, "Destination not allowed")
+		default:
+			log.Warn("rotating proxy: upstream connect failed",
+				"rotator_id", h.rotator.ID,
+				"target", r.Host,
+				"error", err,
+			)
+			writeHijackedResponse(buf, http.StatusBadGateway, "Upstream CONNECT failed")
+		}
 		return
 	}
+	defer h.state.acquireUpstream(next.ProxyID)()
 
-	applyConnDeadline(clientConn, handshakeTimeout)
-	if _, err := clientConn.Write([]byte(connectEstablishedResponse)); err != nil {
+	applyConnDeadline(clientConn, rotatorHandshakeTimeout(h.rotator))
+	if _, err := clientConn.Write([]byte(connectEstablishedResponseFor(h.rotator, next))); err != nil {
 		_ = upConn.Close()
 		return
 	}
 
 	clearConnDeadline(clientConn)
 	clearConnDeadline(upConn)
-	pipeConnections(clientConn, upConn)
+	defer h.state.trackTunnel(clientConn, upConn)()
+	up, down := pipeMeteredConnections(clientConn, upConn, h.state.tunnelMeter(routing))
+	recordUpstreamTraffic(h.rotator, routing, next.ProxyID, up, down)
 }
 
 func writeHijackedResponse(buf *bufio.ReadWriter, status int, message string) {
@@ -690,8 +991,8 @@ func buildHTTPTransportWithConnector(next *dto.RotatingProxyNext, connectFn upst
 		DisableKeepAlives:     true,
 		MaxIdleConns:          0,
 		IdleConnTimeout:       0,
-		TLSHandshakeTimeout:   handshakeTimeout,
-		ResponseHeaderTimeout: upstreamTimeout,
+		TLSHandshakeTimeout:   hopHandshakeTimeout(next),
+		ResponseHeaderTimeout: hopUpstreamTimeout(next),
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
@@ -708,6 +1009,12 @@ func buildHTTPTransportWithConnector(next *dto.RotatingProxyNext, connectFn upst
 		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return dialProxyWithFallback(ctx, network, addr, next)
 		}
+		transport.OnProxyConnectResponse = func(_ context.Context, _ *url.URL, _ *http.Request, resp *http.Response) error {
+			if isTargetFailureStatus(resp.StatusCode) {
+				return fmt.Errorf("%w: upstream returned status %d", errTargetFailed, resp.StatusCode)
+			}
+			return nil
+		}
 	case "socks4", "socks5":
 		transport.Proxy = nil
 		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -721,12 +1028,11 @@ func buildHTTPTransportWithConnector(next *dto.RotatingProxyNext, connectFn upst
 
 func dialUpstream(next *dto.RotatingProxyNext) (net.Conn, error) {
 	address := net.JoinHostPort(next.IP, strconv.Itoa(int(next.Port)))
-	dialer := &net.Dialer{Timeout: 10 * time.Second}
-	return dialer.Dial("tcp", address)
+	return dialProxyAddress(context.Background(), address, next)
 }
 
 func performUpstreamConnect(conn net.Conn, targetHost string, next *dto.RotatingProxyNext) error {
-	applyConnDeadline(conn, handshakeTimeout)
+	applyConnDeadline(conn, hopHandshakeTimeout(next))
 	defer clearConnDeadline(conn)
 
 	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: Keep-Alive\r\n", targetHost, targetHost)
@@ -749,59 +1055,125 @@ func performUpstreamConnect(conn net.Conn, targetHost string, next *dto.Rotating
 
 	if resp.StatusCode != http.StatusOK {
 		io.Copy(io.Discard, resp.Body)
+		if isTargetFailureStatus(resp.StatusCode) {
+			return fmt.Errorf("%w: upstream returned status %d", errTargetFailed, resp.StatusCode)
+		}
 		return fmt.Errorf("upstream returned status %d", resp.StatusCode)
 	}
 
 	return nil
 }
 
-func pipeConnections(left, right net.Conn) {
-	errCh := make(chan error, 2)
+// pipeConnections relays between the client and the upstream until either
+// side closes and returns the bytes sent by the client (up) and by the
+// upstream (down).
+func pipeConnections(client net.Conn, upstream io.ReadWriteCloser) (up int64, down int64) {
+	return pipeMeteredConnections(client, upstream, nil)
+}
+
+// pipeMeteredConnections is pipeConnections with every relayed chunk passed
+// to meter. The tunnel is closed as soon as meter returns false.
+func pipeMeteredConnections(client net.Conn, upstream io.ReadWriteCloser, meter func(int64) bool) (up int64, down int64) {
+	done := make(chan struct{}, 2)
+	toClient, toUpstream := io.Writer(client), io.Writer(upstream)
+	if meter != nil {
+		toClient = meteredWriter{Writer: client, meter: meter}
+		toUpstream = meteredWriter{Writer: upstream, meter: meter}
+	}
 
 	go func() {
-		_, err := io.Copy(left, right)
-		errCh <- err
+		down, _ = io.Copy(toClient, upstream)
+		done <- struct{}{}
 	}()
 
 	go func() {
-		_, err := io.Copy(right, left)
-		errCh <- err
+		up, _ = io.Copy(toUpstream, client)
+		done <- struct{}{}
 	}()
 
-	<-errCh
-	left.Close()
-	right.Close()
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+	return up, down
+}
+
+// meteredWriter fails writes with errCredentialQuotaExceeded once meter
+// returns false.
+type meteredWriter struct {
+	io.Writer
+	meter func(int64) bool
+}
+
+func (w meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 && !w.meter(int64(n)) && err == nil {
+		err = errCredentialQuotaExceeded
+	}
+	return n, err
 }
 
 func dialProxyWithFallback(ctx context.Context, network, addr string, next *dto.RotatingProxyNext) (net.Conn, error) {
-	_ = next
-	dialer := &net.Dialer{Timeout: 10 * time.Second}
-	return dialer.DialContext(ctx, network, addr)
+	if next == nil || next.Parent == nil {
+		dialer := &net.Dialer{Timeout: hopHandshakeTimeout(next)}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return dialProxyAddress(ctx, addr, next)
 }
 
 func readSocks5Target(conn net.Conn) (string, error) {
+	command, target, err := readSocks5Request(conn)
+	if err != nil {
+		return "", err
+	}
+	if command != socks5CommandConnect {
+		_ = writeSocks5Reply(conn, 0x07)
+		return "", errors.New("unsupported socks5 command")
+	}
+	return target, nil
+}
+
+// readSocks5Request reads a CONNECT or UDP ASSOCIATE request and answers
+// anything else with "command not supported".
+func readSocks5Request(conn net.Conn) (byte, string, error) {
 	header := make([]byte, 4)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return "", err
+		return 0, "", err
 	}
 
 	if header[0] != 0x05 {
 		_ = writeSocks5Reply(conn, 0x01)
-		return "", errors.New("invalid socks version")
+		return 0, "", errors.New("invalid socks version")
 	}
 
-	if header[1] != 0x01 {
+	if header[1] != socks5CommandConnect && header[1] != socks5CommandUDPAssociate {
 		_ = writeSocks5Reply(conn, 0x07)
-		return "", errors.New("unsupported socks5 command")
+		return 0, "", errors.New("unsupported socks5 command")
 	}
 
 	target, err := readSocksAddress(conn, header[3])
 	if err != nil {
 		_ = writeSocks5Reply(conn, 0x08)
-		return "", err
+		return 0, "", err
 	}
 
-	return target, nil
+	return header[1], target, nil
+}
+
+// socks5FailureReply maps an upstream failure to a SOCKS5 reply code.
+func socks5FailureReply(err error) byte {
+	switch {
+	case errors.Is(err, errUpstreamUnavailable):
+		return 0x01
+	case errors.Is(err, errUnsupportedUpstream):
+		return 0x07
+	case errors.Is(err, errTargetUnresolved):
+		return 0x04
+	case errors.Is(err, errDestinationBlocked):
+		return 0x02
+	default:
+		return 0x05
+	}
 }
 
 func readSocksAddress(conn net.Conn, atyp byte) (string, error) {
@@ -848,14 +1220,22 @@ func writeSocks5Reply(conn net.Conn, rep byte) error {
 }
 
 func writeSocks5Success(conn net.Conn, addr net.Addr) error {
-	if tcp, ok := addr.(*net.TCPAddr); ok && tcp != nil {
-		ip := tcp.IP
-		if ip == nil {
-			ip = net.IPv4zero
+	var ip net.IP
+	var port int
+	switch bound := addr.(type) {
+	case *net.TCPAddr:
+		if bound != nil {
+			ip, port = bound.IP, bound.Port
+		}
+	case *net.UDPAddr:
+		if bound != nil {
+			ip, port = bound.IP, bound.Port
 		}
-		return writeSocks5BoundReply(conn, 0x00, ip, uint16(tcp.Port))
 	}
-	return writeSocks5BoundReply(conn, 0x00, net.IPv4zero, 0)
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	return writeSocks5BoundReply(conn, 0x00, ip, uint16(port))
 }
 
 func writeSocks5BoundReply(conn net.Conn, rep byte, ip net.IP, port uint16) error {
@@ -897,38 +1277,32 @@ func writeSocks4Response(conn net.Conn, status byte, port []byte, ip []byte) err
 }
 
 func connectThroughUpstream(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+	target, err := resolveUpstreamTarget(target, next)
+	if err != nil {
+		return nil, err
+	}
+
 	upConn, err := dialUpstreamFunc(next)
 	if err != nil {
 		return nil, err
 	}
 
-	switch strings.ToLower(next.Protocol) {
-	case "http", "https":
-		if err := performUpstreamConnectFunc(upConn, target, next); err != nil {
-			_ = upConn.Close()
-			return nil, err
-		}
-		return upConn, nil
-	case "socks5":
-		if err := performSocks5UpstreamConnect(upConn, target, next); err != nil {
-			_ = upConn.Close()
-			return nil, err
-		}
-		return upConn, nil
-	case "socks4":
-		if err := performSocks4UpstreamConnect(upConn, target, next); err != nil {
-			_ = upConn.Close()
-			return nil, err
-		}
-		return upConn, nil
-	default:
+	if err := performProxyHandshake(upConn, target, next); err != nil {
 		_ = upConn.Close()
-		return nil, fmt.Errorf("unsupported upstream protocol %s", next.Protocol)
+		return nil, err
 	}
+	return upConn, nil
 }
 
 func performSocks5UpstreamConnect(conn net.Conn, target string, next *dto.RotatingProxyNext) error {
-	applyConnDeadline(conn, handshakeTimeout)
+	_, err := performSocks5UpstreamRequest(conn, socks5CommandConnect, target, next)
+	return err
+}
+
+// performSocks5UpstreamRequest authenticates with an upstream SOCKS5 proxy,
+// sends command for target and returns the bound address of the reply.
+func performSocks5UpstreamRequest(conn net.Conn, command byte, target string, next *dto.RotatingProxyNext) (string, error) {
+	applyConnDeadline(conn, hopHandshakeTimeout(next))
 	defer clearConnDeadline(conn)
 
 	greeting := []byte{0x05, 0x01, 0x00}
@@ -936,63 +1310,66 @@ func performSocks5UpstreamConnect(conn net.Conn, target string, next *dto.Rotati
 		greeting[2] = 0x02
 	}
 	if _, err := conn.Write(greeting); err != nil {
-		return err
+		return "", err
 	}
 
 	resp := make([]byte, 2)
 	if _, err := io.ReadFull(conn, resp); err != nil {
-		return err
+		return "", err
 	}
 	if resp[0] != 0x05 {
-		return errors.New("invalid socks5 response from upstream")
+		return "", errors.New("invalid socks5 response from upstream")
 	}
 	if resp[1] == 0xff {
-		return errors.New("upstream socks5 proxy offered no acceptable authentication methods")
+		return "", errors.New("upstream socks5 proxy offered no acceptable authentication methods")
 	}
 
 	if next.HasAuth && resp[1] != 0x02 {
-		return errors.New("upstream socks5 proxy does not accept username/password authentication")
+		return "", errors.New("upstream socks5 proxy does not accept username/password authentication")
 	}
 	if next.HasAuth && resp[1] == 0x02 {
 		if err := sendSocks5Credentials(conn, next.Username, next.Password); err != nil {
-			return err
+			return "", err
 		}
 	}
 
 	host, port, err := splitTargetAddress(target)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	atyp, addrBytes, portBytes, err := encodeSocksAddress(host, port)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	req := []byte{0x05, 0x01, 0x00, atyp}
+	req := []byte{0x05, command, 0x00, atyp}
 	req = append(req, addrBytes...)
 	req = append(req, portBytes...)
 
 	if _, err := conn.Write(req); err != nil {
-		return err
+		return "", err
 	}
 
 	reply := make([]byte, 4)
 	if _, err := io.ReadFull(conn, reply); err != nil {
-		return err
+		return "", err
 	}
 	if reply[0] != 0x05 {
-		return errors.New("invalid socks5 connect reply")
+		return "", errors.New("invalid socks5 reply")
+	}
+	if isTargetFailureReply(reply[1]) {
+		return "", fmt.Errorf("%w: socks5 command %d failed with code %d", errTargetFailed, command, reply[1])
 	}
 	if reply[1] != 0x00 {
-		return fmt.Errorf("socks5 connect failed with code %d", reply[1])
+		return "", fmt.Errorf("socks5 command %d failed with code %d", command, reply[1])
 	}
 
-	return discardSocks5Address(conn, reply[3])
+	return readSocksAddress(conn, reply[3])
 }
 
 func performSocks4UpstreamConnect(conn net.Conn, target string, next *dto.RotatingProxyNext) error {
-	applyConnDeadline(conn, handshakeTimeout)
+	applyConnDeadline(conn, hopHandshakeTimeout(next))
 	defer clearConnDeadline(conn)
 
 	host, port, err := splitTargetAddress(target)
@@ -1089,29 +1466,6 @@ func encodeSocksAddress(host string, port uint16) (byte, []byte, []byte, error)
 	return 0x03, addr, []byte{byte(port >> 8), byte(port)}, nil
 }
 
-func discardSocks5Address(conn net.Conn, atyp byte) error {
-	var addrLen int
-
-	switch atyp {
-	case 0x01:
-		addrLen = 4
-	case 0x04:
-		addrLen = 16
-	case 0x03:
-		lenBuf := make([]byte, 1)
-		if _, err := io.ReadFull(conn, lenBuf); err != nil {
-			return err
-		}
-		addrLen = int(lenBuf[0])
-	default:
-		return errors.New("unsupported address type in socks5 reply")
-	}
-
-	buf := make([]byte, addrLen+2)
-	_, err := io.ReadFull(conn, buf)
-	return err
-}
-
 func splitTargetAddress(target string) (string, uint16, error) {
 	host, portStr, err := net.SplitHostPort(target)
 	if err != nil {
@@ -10,11 +10,13 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"magpie/internal/api/dto"
+	"magpie/internal/database"
 	"magpie/internal/domain"
 )
 
@@ -33,7 +35,7 @@ func TestAuthenticateClient_SucceedsWithValidCredentials(t *testing.T) {
 
 	recorder := httptest.NewRecorder()
 
-	if ok := handler.authenticateClient(recorder, request); !ok {
+	if _, ok := handler.authenticateClient(recorder, request); !ok {
 		t.Fatal("authenticateClient returned false for valid credentials")
 	}
 	if recorder.Result().StatusCode != http.StatusOK && recorder.Code != 0 {
@@ -53,7 +55,7 @@ func TestAuthenticateClient_RejectsMissingOrInvalidCredentials(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
 
-	if ok := handler.authenticateClient(recorder, request); ok {
+	if _, ok := handler.authenticateClient(recorder, request); ok {
 		t.Fatal("authenticateClient should reject missing credentials")
 	}
 	if recorder.Code != http.StatusProxyAuthRequired {
@@ -68,7 +70,7 @@ func TestAuthenticateClient_RejectsMissingOrInvalidCredentials(t *testing.T) {
 	cred := base64.StdEncoding.EncodeToString([]byte("proxy-user:bad-pass"))
 	request.Header.Set("Proxy-Authorization", "Basic "+cred)
 
-	if ok := handler.authenticateClient(recorder, request); ok {
+	if _, ok := handler.authenticateClient(recorder, request); ok {
 		t.Fatal("authenticateClient should reject invalid credentials")
 	}
 	if recorder.Code != http.StatusProxyAuthRequired {
@@ -86,7 +88,7 @@ func TestAuthenticateClient_AllowsUnauthenticatedAccessWhenDisabled(t *testing.T
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
 
-	if ok := handler.authenticateClient(recorder, request); !ok {
+	if _, ok := handler.authenticateClient(recorder, request); !ok {
 		t.Fatal("authenticateClient rejected request when authentication is disabled")
 	}
 	if recorder.Code != 0 && recorder.Code != http.StatusOK {
@@ -233,7 +235,7 @@ func TestHandleConnect_ProxiesDataThroughUpstream(t *testing.T) {
 	}
 
 	originalGetNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		if userID != 7 || rotatorID != 42 {
 			t.Fatalf("unexpected identifiers: userID=%d rotatorID=%d", userID, rotatorID)
 		}
@@ -321,7 +323,7 @@ func TestHandleHTTP_RejectsOversizedRequestBody(t *testing.T) {
 	}
 
 	originalGetNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		return &dto.RotatingProxyNext{
 			ProxyID:  1,
 			IP:       "192.0.2.10",
@@ -367,7 +369,7 @@ func TestHandleHTTP_RejectsOversizedUnknownLengthBodyWithoutDialing(t *testing.T
 	}
 
 	originalGetNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		return &dto.RotatingProxyNext{
 			ProxyID:  1,
 			IP:       "192.0.2.10",
@@ -413,7 +415,7 @@ func TestHandleHTTP_ForwardsBodyWithinLimit(t *testing.T) {
 	}
 
 	originalGetNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		return &dto.RotatingProxyNext{
 			ProxyID:  1,
 			IP:       "192.0.2.10",
@@ -491,7 +493,7 @@ func TestHandleHTTP_ReturnsGatewayTimeoutWhenUpstreamHangs(t *testing.T) {
 	}
 
 	originalGetNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		return &dto.RotatingProxyNext{
 			ProxyID:  1,
 			IP:       "192.0.2.10",
@@ -544,7 +546,7 @@ func TestHandleHTTP_ReturnsGatewayTimeoutWhenSocksDialBlocks(t *testing.T) {
 	}
 
 	originalGetNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		return &dto.RotatingProxyNext{
 			ProxyID:  1,
 			IP:       "192.0.2.10",
@@ -618,7 +620,7 @@ func TestSocks5Handler_WithAuthenticationAndPiping(t *testing.T) {
 	})
 
 	origNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		if userID != 5 || rotatorID != 10 {
 			t.Fatalf("unexpected identifiers: userID=%d rotatorID=%d", userID, rotatorID)
 		}
@@ -729,6 +731,179 @@ func TestSocks5Handler_WithAuthenticationAndPiping(t *testing.T) {
 	}
 }
 
+func TestSocks5Handler_UDPAssociateRelaysDatagrams(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp echo: %v", err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	upstreamHost, upstreamPort := serveUDPSocks5Proxy(t)
+
+	handler := newSocksProxyHandler(domain.RotatingProxy{
+		ID:       31,
+		UserID:   5,
+		Protocol: domain.Protocol{Name: "socks5"},
+	})
+
+	origNext := getNextRotatingProxyFunc
+	getNextRotatingProxyFunc = func(uint, uint64, database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		return &dto.RotatingProxyNext{ProxyID: 77, IP: upstreamHost, Port: upstreamPort, Protocol: "socks5"}, nil
+	}
+	t.Cleanup(func() { getNextRotatingProxyFunc = origNext })
+
+	host, port := serveTestListener(t, handler.handle)
+	control, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatalf("dial rotator: %v", err)
+	}
+	defer control.Close()
+	_ = control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := control.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	greetResp := make([]byte, 2)
+	if _, err := io.ReadFull(control, greetResp); err != nil || greetResp[1] != 0x00 {
+		t.Fatalf("greeting response = %v, %v", greetResp, err)
+	}
+
+	if _, err := control.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("write udp associate: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatalf("read associate reply: %v", err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("expected success reply, got %02x", reply[1])
+	}
+	relayAddr, err := readSocksAddress(control, reply[3])
+	if err != nil {
+		t.Fatalf("read relay address: %v", err)
+	}
+
+	client, err := net.Dial("udp", relayAddr)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write(socks5UDPDatagram(echo.LocalAddr().(*net.UDPAddr), []byte("ping"))); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("read datagram: %v", err)
+	}
+	headerLen, ok := socks5UDPHeaderLength(buf[:n])
+	if !ok {
+		t.Fatalf("reply datagram has an invalid header: %v", buf[:n])
+	}
+	if got := string(buf[headerLen:n]); got != "ping" {
+		t.Fatalf("echoed payload = %q, want ping", got)
+	}
+}
+
+func TestSocks5Handler_UDPAssociateRequiresSocks5Upstreams(t *testing.T) {
+	handler := newSocksProxyHandler(domain.RotatingProxy{
+		ID:       32,
+		UserID:   5,
+		Protocol: domain.Protocol{Name: "http"},
+	})
+
+	clientConn, serverConn := net.Pipe()
+	go handler.handle(serverConn)
+	defer clientConn.Close()
+
+	if _, err := clientConn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	greetResp := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, greetResp); err != nil {
+		t.Fatalf("read greeting response: %v", err)
+	}
+	if _, err := clientConn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("write udp associate: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, reply); err != nil {
+		t.Fatalf("read associate reply: %v", err)
+	}
+	if reply[1] != 0x07 {
+		t.Fatalf("expected command not supported reply, got %02x", reply[1])
+	}
+}
+
+// serveUDPSocks5Proxy runs an unauthenticated SOCKS5 proxy that serves UDP
+// ASSOCIATE for IPv4 targets.
+func serveUDPSocks5Proxy(t *testing.T) (string, uint16) {
+	return serveTestListener(t, func(conn net.Conn) {
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0x00})
+
+		command, _, err := readSocks5Request(conn)
+		if err != nil || command != socks5CommandUDPAssociate {
+			_ = writeSocks5Reply(conn, 0x07)
+			return
+		}
+
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			_ = writeSocks5Reply(conn, 0x01)
+			return
+		}
+		defer relay.Close()
+		if err := writeSocks5Success(conn, relay.LocalAddr()); err != nil {
+			return
+		}
+
+		go func() {
+			buf := make([]byte, 1024)
+			var client *net.UDPAddr
+			for {
+				n, addr, err := relay.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if client == nil || addr.String() == client.String() {
+					client = addr
+					if n < 10 || buf[3] != 0x01 {
+						continue
+					}
+					target := &net.UDPAddr{IP: net.IP(append([]byte(nil), buf[4:8]...)), Port: int(buf[8])<<8 | int(buf[9])}
+					_, _ = relay.WriteToUDP(buf[10:n], target)
+					continue
+				}
+				_, _ = relay.WriteToUDP(socks5UDPDatagram(addr, buf[:n]), client)
+			}
+		}()
+		_, _ = io.Copy(io.Discard, conn)
+	})
+}
+
+func socks5UDPDatagram(addr *net.UDPAddr, payload []byte) []byte {
+	datagram := []byte{0x00, 0x00, 0x00, 0x01}
+	datagram = append(datagram, addr.IP.To4()...)
+	datagram = append(datagram, byte(addr.Port>>8), byte(addr.Port))
+	return append(datagram, payload...)
+}
+
 func TestSocks4Handler_WithUserIDAuth(t *testing.T) {
 	handler := newSocksProxyHandler(domain.RotatingProxy{
 		ID:           22,
@@ -740,7 +915,7 @@ func TestSocks4Handler_WithUserIDAuth(t *testing.T) {
 	})
 
 	origNext := getNextRotatingProxyFunc
-	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64) (*dto.RotatingProxyNext, error) {
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, _ database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
 		if userID != 9 || rotatorID != 22 {
 			t.Fatalf("unexpected identifiers: userID=%d rotatorID=%d", userID, rotatorID)
 		}
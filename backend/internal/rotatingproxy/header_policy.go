@@ -0,0 +1,64 @@
+package rotatingproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+// applyRequestHeaderRules strips and injects the rotator's configured headers
+// on a request about to be forwarded.
+func applyRequestHeaderRules(rotator domain.RotatingProxy, header http.Header) {
+	for _, name := range rotator.StripRequestHeaders {
+		header.Del(name)
+	}
+	for _, raw := range rotator.InjectRequestHeaders {
+		name, value, ok := database.ParseInjectedHeader(raw)
+		if !ok {
+			continue
+		}
+		header.Set(name, value)
+	}
+}
+
+// setUpstreamHeaders names the upstream proxy that served a response and the
+// tier it was picked from, if the rotator reports them.
+func setUpstreamHeaders(rotator domain.RotatingProxy, header http.Header, next *dto.RotatingProxyNext) {
+	for _, field := range upstreamHeaderFields(rotator, next) {
+		header.Set(field[0], field[1])
+	}
+}
+
+// connectEstablishedResponseFor is the reply to a successful CONNECT,
+// carrying the upstream headers when the rotator reports them.
+func connectEstablishedResponseFor(rotator domain.RotatingProxy, next *dto.RotatingProxyNext) string {
+	fields := upstreamHeaderFields(rotator, next)
+	if len(fields) == 0 {
+		return connectEstablishedResponse
+	}
+	var response strings.Builder
+	response.WriteString(strings.TrimSuffix(connectEstablishedResponse, "\r\n"))
+	for _, field := range fields {
+		response.WriteString(field[0] + ": " + field[1] + "\r\n")
+	}
+	response.WriteString("\r\n")
+	return response.String()
+}
+
+func upstreamHeaderFields(rotator domain.RotatingProxy, next *dto.RotatingProxyNext) [][2]string {
+	if next == nil || next.ProxyID == 0 {
+		return nil
+	}
+	var fields [][2]string
+	if rotator.UpstreamIDHeader != "" {
+		fields = append(fields, [2]string{rotator.UpstreamIDHeader, strconv.FormatUint(next.ProxyID, 10)})
+	}
+	if rotator.UpstreamTierHeader != "" {
+		fields = append(fields, [2]string{rotator.UpstreamTierHeader, strconv.Itoa(next.Tier)})
+	}
+	return fields
+}
@@ -0,0 +1,103 @@
+package rotatingproxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func TestHandleHTTP_AppliesHeaderRules(t *testing.T) {
+	handler := &proxyHandler{
+		rotator: domain.RotatingProxy{
+			ID:                   42,
+			UserID:               7,
+			StripRequestHeaders:  domain.StringList{"Via", "X-Forwarded-For", "Forwarded"},
+			InjectRequestHeaders: domain.StringList{"X-Team: scraping", "User-Agent: magpie-crawler"},
+			UpstreamIDHeader:     "X-Magpie-Upstream-Id",
+		},
+	}
+
+	originalGetNext := getNextRotatingProxyFunc
+	getNextRotatingProxyFunc = func(uint, uint64, database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		return &dto.RotatingProxyNext{ProxyID: 17, IP: "192.0.2.10", Port: 1080, Protocol: "socks5"}, nil
+	}
+	t.Cleanup(func() { getNextRotatingProxyFunc = originalGetNext })
+
+	upstreamClient, upstreamServer := net.Pipe()
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(string, *dto.RotatingProxyNext) (net.Conn, error) {
+		return upstreamServer, nil
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	upstreamDone := make(chan http.Header, 1)
+	go func() {
+		defer upstreamClient.Close()
+		req, err := http.ReadRequest(bufio.NewReader(upstreamClient))
+		if err != nil {
+			t.Errorf("read upstream request: %v", err)
+			close(upstreamDone)
+			return
+		}
+		upstreamDone <- req.Header
+		_, _ = upstreamClient.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	}()
+
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Header.Set("Via", "1.1 client-gateway")
+	request.Header.Set("X-Forwarded-For", "198.51.100.7")
+	request.Header.Set("Forwarded", "for=198.51.100.7")
+	request.Header.Set("User-Agent", "curl/8.0")
+	request.Header.Set("Accept", "text/html")
+	recorder := httptest.NewRecorder()
+
+	handler.handleHTTP(recorder, request)
+
+	var forwarded http.Header
+	select {
+	case forwarded = <-upstreamDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream test server did not receive the request")
+	}
+	for _, name := range []string{"Via", "X-Forwarded-For", "Forwarded"} {
+		if value := forwarded.Get(name); value != "" {
+			t.Errorf("%s = %q was forwarded, want it stripped", name, value)
+		}
+	}
+	if forwarded.Get("X-Team") != "scraping" || forwarded.Get("User-Agent") != "magpie-crawler" || forwarded.Get("Accept") != "text/html" {
+		t.Fatalf("forwarded headers = %v", forwarded)
+	}
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want 200", recorder.Code)
+	}
+	if got := recorder.Header().Get("X-Magpie-Upstream-Id"); got != "17" {
+		t.Fatalf("X-Magpie-Upstream-Id = %q, want 17", got)
+	}
+}
+
+func TestConnectEstablishedResponseFor(t *testing.T) {
+	next := &dto.RotatingProxyNext{ProxyID: 17, Tier: 2}
+	if got := connectEstablishedResponseFor(domain.RotatingProxy{}, next); got != connectEstablishedResponse {
+		t.Fatalf("response without upstream id header = %q", got)
+	}
+
+	rotator := domain.RotatingProxy{UpstreamIDHeader: "X-Magpie-Upstream-Id"}
+	want := "HTTP/1.1 200 Connection Established\r\nProxy-Agent: Magpie Rotator\r\nX-Magpie-Upstream-Id: 17\r\n\r\n"
+	if got := connectEstablishedResponseFor(rotator, next); got != want {
+		t.Fatalf("response = %q, want %q", got, want)
+	}
+
+	rotator.UpstreamTierHeader = "X-Magpie-Upstream-Tier"
+	want = "HTTP/1.1 200 Connection Established\r\nProxy-Agent: Magpie Rotator\r\nX-Magpie-Upstream-Id: 17\r\nX-Magpie-Upstream-Tier: 2\r\n\r\n"
+	if got := connectEstablishedResponseFor(rotator, next); got != want {
+		t.Fatalf("response with tier header = %q, want %q", got, want)
+	}
+}
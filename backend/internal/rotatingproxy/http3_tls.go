@@ -15,6 +15,8 @@ var (
 	rotatorTLSErr   error
 )
 
+// The certificate is shared by HTTP/3 and TLS listeners; the variables keep
+// their original HTTP/3 names.
 const (
 	envRotatingProxyHTTP3TLSCertFile = "ROTATING_PROXY_HTTP3_TLS_CERT_FILE"
 	envRotatingProxyHTTP3TLSKeyFile  = "ROTATING_PROXY_HTTP3_TLS_KEY_FILE"
@@ -26,7 +28,7 @@ func rotatorTLSConfig() (*tls.Config, error) {
 		keyFile := strings.TrimSpace(support.GetEnv(envRotatingProxyHTTP3TLSKeyFile, ""))
 		if certFile == "" && keyFile == "" {
 			rotatorTLSErr = fmt.Errorf(
-				"HTTP/3 rotators require TLS certificate files; set %s and %s",
+				"HTTP/3 and TLS rotators require TLS certificate files; set %s and %s",
 				envRotatingProxyHTTP3TLSCertFile,
 				envRotatingProxyHTTP3TLSKeyFile,
 			)
@@ -34,7 +36,7 @@ func rotatorTLSConfig() (*tls.Config, error) {
 		}
 		if certFile == "" || keyFile == "" {
 			rotatorTLSErr = fmt.Errorf(
-				"HTTP/3 rotator TLS configuration is incomplete; both %s and %s must be set",
+				"rotator TLS configuration is incomplete; both %s and %s must be set",
 				envRotatingProxyHTTP3TLSCertFile,
 				envRotatingProxyHTTP3TLSKeyFile,
 			)
@@ -43,7 +45,7 @@ func rotatorTLSConfig() (*tls.Config, error) {
 
 		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
-			rotatorTLSErr = fmt.Errorf("failed to load HTTP/3 rotator TLS cert/key pair: %w", err)
+			rotatorTLSErr = fmt.Errorf("failed to load rotator TLS cert/key pair: %w", err)
 			return
 		}
 
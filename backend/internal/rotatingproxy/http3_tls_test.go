@@ -1,6 +1,7 @@
 package rotatingproxy
 
 import (
+	"bufio"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -8,13 +9,21 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"io"
 	"math/big"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
 )
 
 func TestRotatorTLSConfig_RequiresConfiguredCertAndKey(t *testing.T) {
@@ -89,6 +98,82 @@ func TestRotatorTLSConfig_LoadsConfiguredCertAndKey(t *testing.T) {
 	}
 }
 
+func TestProxyServer_TLSListenerTunnelsConnect(t *testing.T) {
+	resetRotatorTLSConfigState()
+	t.Cleanup(resetRotatorTLSConfigState)
+	certPath, keyPath := createSelfSignedRotatorTLSFiles(t, t.TempDir())
+	t.Setenv(envRotatingProxyHTTP3TLSCertFile, certPath)
+	t.Setenv(envRotatingProxyHTTP3TLSKeyFile, keyPath)
+
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+	target := serveEcho(t)
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(address string, _ *dto.RotatingProxyNext) (net.Conn, error) {
+		return net.Dial("tcp", address)
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve port: %v", err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	_ = probe.Close()
+
+	ps := newProxyServer(domain.RotatingProxy{
+		ID:                      8,
+		ListenPort:              uint16(port),
+		AuthRequired:            true,
+		AuthUsername:            "tls-user",
+		AuthPassword:            "tls-pass",
+		Protocol:                domain.Protocol{Name: "http"},
+		ListenTransportProtocol: "tls",
+	})
+	if err := ps.Start(); err != nil {
+		t.Fatalf("start tls listener: %v", err)
+	}
+	t.Cleanup(ps.Stop)
+
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls handshake with rotator: %v", err)
+	}
+	defer conn.Close()
+
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: " +
+		proxyAuthorization("tls-user", "tls-pass") + "\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read connect response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("connect status = %d, want 200", response.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write through tunnel: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, err = %v", buf, err)
+	}
+
+	plain, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dial rotator: %v", err)
+	}
+	defer plain.Close()
+	_ = plain.SetDeadline(time.Now().Add(2 * time.Second))
+	_, _ = plain.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+	if response, err := http.ReadResponse(bufio.NewReader(plain), nil); err == nil && response.StatusCode == http.StatusOK {
+		t.Fatal("plaintext CONNECT was accepted by a tls listener")
+	}
+}
+
 func createSelfSignedRotatorTLSFiles(t *testing.T, dir string) (string, string) {
 	t.Helper()
 
@@ -2,6 +2,7 @@ package rotatingproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -26,14 +27,25 @@ const (
 	socksConcurrencyLogEvery                      = 15 * time.Second
 )
 
+// Manager runs the rotator listeners of this instance, including replicated
+// rotators whose placement includes it. Servers that are removed or replaced
+// are drained: they refuse new clients at once, while their open tunnels may
+// run until the drain grace period ends.
 type Manager struct {
-	mu      sync.RWMutex
-	servers map[uint64]*proxyServer
+	mu           sync.RWMutex
+	servers      map[uint64]*proxyServer
+	draining     map[*proxyServer]time.Time
+	drains       sync.WaitGroup
+	shuttingDown atomic.Bool
+	gateways     []*gateway
 }
 
+var errManagerShuttingDown = errors.New("rotating proxy manager is shutting down")
+
 func NewManager() *Manager {
 	return &Manager{
-		servers: make(map[uint64]*proxyServer),
+		servers:  make(map[uint64]*proxyServer),
+		draining: make(map[*proxyServer]time.Time),
 	}
 }
 
@@ -42,6 +54,7 @@ var maxSocksConcurrentConnections = loadMaxSocksConcurrentConnections()
 
 func (m *Manager) StartAll() {
 	m.Reconcile()
+	m.startGateways()
 }
 
 func (m *Manager) Reconcile() {
@@ -54,6 +67,9 @@ func (m *Manager) Reconcile() {
 
 	desired := make(map[uint64]domain.RotatingProxy, len(rotators))
 	for _, rotator := range rotators {
+		if !placedHere(rotator) {
+			continue
+		}
 		if rotator.ListenPort == 0 || int(rotator.ListenPort) < start || int(rotator.ListenPort) > end {
 			log.Warn("rotating proxy manager: skipping rotator without valid port", "rotator_id", rotator.ID, "listen_port", rotator.ListenPort)
 			continue
@@ -66,20 +82,20 @@ func (m *Manager) Reconcile() {
 		if _, ok := desired[id]; ok {
 			continue
 		}
-		server.Stop()
+		m.retire(server, true)
 		delete(m.servers, id)
-		log.Info("rotating proxy server stopped", "rotator_id", id)
+		log.Info("rotating proxy server draining", "rotator_id", id, "grace_period", drainGracePeriod)
 	}
 	m.mu.Unlock()
 
 	for _, rotator := range desired {
 		m.mu.RLock()
-		_, alreadyRunning := m.servers[rotator.ID]
+		server, alreadyRunning := m.servers[rotator.ID]
 		m.mu.RUnlock()
-		if alreadyRunning {
+		if alreadyRunning && server.config().UpdatedAt.Equal(rotator.UpdatedAt) {
 			continue
 		}
-		if err := m.startServer(rotator); err != nil {
+		if err := m.apply(rotator); err != nil {
 			log.Error("rotating proxy manager: failed to start server", "rotator_id", rotator.ID, "port", rotator.ListenPort, "error", err)
 		}
 	}
@@ -113,9 +129,12 @@ func (m *Manager) startServer(rotator domain.RotatingProxy) error {
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.shuttingDown.Load() {
+		return errManagerShuttingDown
+	}
 
 	if existing, ok := m.servers[rotator.ID]; ok {
-		existing.Stop()
+		m.retire(existing, false)
 		delete(m.servers, rotator.ID)
 	}
 
@@ -137,6 +156,44 @@ func (m *Manager) Add(rotatorID uint64) error {
 	return m.startServer(*rotator)
 }
 
+// Update applies an edited rotator to its running server. Filters, auth and
+// upstream settings are swapped in place so open tunnels keep running; the
+// listener is only restarted when the listen protocol or transport changed.
+// A rotator whose placement no longer includes this instance is drained.
+func (m *Manager) Update(rotatorID uint64) error {
+	rotator, err := database.GetRotatingProxyByID(rotatorID)
+	if errors.Is(err, database.ErrRotatingProxyNotFound) {
+		m.Remove(rotatorID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !placedHere(*rotator) {
+		m.Remove(rotatorID)
+		return nil
+	}
+	return m.apply(*rotator)
+}
+
+func (m *Manager) apply(rotator domain.RotatingProxy) error {
+	m.mu.RLock()
+	server, running := m.servers[rotator.ID]
+	m.mu.RUnlock()
+
+	if running && server.canReconfigure(rotator) {
+		server.reconfigure(rotator)
+		log.Info("rotating proxy server reconfigured", "rotator_id", rotator.ID, "port", rotator.ListenPort)
+		return nil
+	}
+	return m.startServer(rotator)
+}
+
+// placedHere reports whether this instance listens for the rotator.
+func placedHere(rotator domain.RotatingProxy) bool {
+	return database.RotatingProxyPlacementOf(rotator).Includes(support.GetInstanceID(), support.GetInstanceRegion())
+}
+
 func (m *Manager) Remove(rotatorID uint64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -145,38 +202,92 @@ func (m *Manager) Remove(rotatorID uint64) {
 	if !ok {
 		return
 	}
-	server.Stop()
+	m.retire(server, true)
 	delete(m.servers, rotatorID)
-	log.Info("rotating proxy server stopped", "rotator_id", rotatorID)
+	log.Info("rotating proxy server draining", "rotator_id", rotatorID, "grace_period", drainGracePeriod)
 }
 
+// StopAll drains every server of this instance and returns once their
+// tunnels finished or were cut.
 func (m *Manager) StopAll() {
+	m.shuttingDown.Store(true)
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	for _, gw := range m.gateways {
+		gw.Stop()
+	}
+	m.gateways = nil
 	for id, server := range m.servers {
-		server.Stop()
+		m.retire(server, false)
 		delete(m.servers, id)
 	}
+	m.mu.Unlock()
+
+	m.drains.Wait()
+	usage.flush()
 }
 
 type proxyServer struct {
 	rotator                 domain.RotatingProxy
+	state                   *rotatorState
+	httpHandler             atomic.Pointer[proxyHandler]
+	socksHandler            atomic.Pointer[socksProxyHandler]
 	listener                net.Listener
 	httpServer              *http.Server
 	http3Server             *http3.Server
 	socksWorkerSem          chan struct{}
 	lastSocksConcurrencyLog atomic.Int64
+	acceptOnce              sync.Once
 	closeOnce               sync.Once
 }
 
 func newProxyServer(rotator domain.RotatingProxy) *proxyServer {
-	server := &proxyServer{rotator: rotator}
+	server := &proxyServer{rotator: rotator, state: newPooledRotatorState(rotator)}
+	server.storeHandlers(rotator)
 	if maxSocksConcurrentConnections > 0 {
 		server.socksWorkerSem = make(chan struct{}, maxSocksConcurrentConnections)
 	}
 	return server
 }
 
+// storeHandlers publishes the handlers for rotator. Every new request or
+// connection loads the current handler, while connections that are already
+// being served keep the handler they started with.
+func (ps *proxyServer) storeHandlers(rotator domain.RotatingProxy) {
+	socks := newSocksProxyHandler(rotator)
+	socks.state = ps.state
+	ps.httpHandler.Store(&proxyHandler{rotator: rotator, state: ps.state})
+	ps.socksHandler.Store(socks)
+}
+
+// config returns the rotator the server currently serves.
+func (ps *proxyServer) config() domain.RotatingProxy {
+	return ps.httpHandler.Load().rotator
+}
+
+// canReconfigure reports whether rotator can be applied without rebinding
+// the listener.
+func (ps *proxyServer) canReconfigure(rotator domain.RotatingProxy) bool {
+	current := ps.config()
+	return current.ListenPort == rotator.ListenPort &&
+		strings.EqualFold(listenProtocolName(current), listenProtocolName(rotator)) &&
+		listenTransportProtocolName(current) == listenTransportProtocolName(rotator)
+}
+
+func (ps *proxyServer) reconfigure(rotator domain.RotatingProxy) {
+	ps.state.reconfigure(rotator)
+	ps.storeHandlers(rotator)
+}
+
+func (ps *proxyServer) trackConnState(_ net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		recordClientConnection(ps.config())
+	}
+}
+
+func (ps *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.httpHandler.Load().ServeHTTP(w, r)
+}
+
 func (ps *proxyServer) Start() error {
 	transport := listenTransportProtocolName(ps.rotator)
 	switch transport {
@@ -185,6 +296,11 @@ func (ps *proxyServer) Start() error {
 			return fmt.Errorf("socks rotators require tcp transport")
 		}
 		return ps.startHTTP3Server(transport)
+	case support.TransportTLS:
+		if isSocksProtocol(listenProtocolName(ps.rotator)) {
+			return fmt.Errorf("tls listeners are only available for http rotators")
+		}
+		return ps.startHTTPServer()
 	default:
 		if isSocksProtocol(listenProtocolName(ps.rotator)) {
 			return ps.startSocksServer()
@@ -193,16 +309,35 @@ func (ps *proxyServer) Start() error {
 	}
 }
 
+// startHTTPServer serves HTTP proxy clients over TCP, wrapped in TLS for the
+// tls transport so credentials never cross the network in clear text.
 func (ps *proxyServer) startHTTPServer() error {
+	var tlsConfig *tls.Config
+	if listenTransportProtocolName(ps.rotator) == support.TransportTLS {
+		base, err := rotatorTLSConfig()
+		if err != nil {
+			return err
+		}
+		// CONNECT tunnels hijack the connection, which HTTP/2 does not allow.
+		tlsConfig = base.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+
 	address := fmt.Sprintf(":%d", ps.rotator.ListenPort)
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
-	handler := &proxyHandler{rotator: ps.rotator}
 	server := &http.Server{
-		Handler:           handler,
+		Handler:   ps,
+		ConnState: ps.trackConnState,
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return withClientConn(ctx)
+		},
 		ReadTimeout:       30 * time.Second,
 		WriteTimeout:      30 * time.Second,
 		ReadHeaderTimeout: 15 * time.Second,
@@ -227,7 +362,6 @@ func (ps *proxyServer) startSocksServer() error {
 		return err
 	}
 
-	handler := newSocksProxyHandler(ps.rotator)
 	ps.listener = listener
 
 	go func() {
@@ -240,8 +374,10 @@ func (ps *proxyServer) startSocksServer() error {
 				log.Error("rotating proxy server: accept error", "rotator_id", ps.rotator.ID, "error", err)
 				continue
 			}
-			applyConnDeadline(conn, handshakeTimeout)
-			if !ps.dispatchSocksConnection(conn, handler.handle) {
+			rotator := ps.config()
+			recordClientConnection(rotator)
+			applyConnDeadline(conn, rotatorHandshakeTimeout(rotator))
+			if !ps.dispatchSocksConnection(conn, ps.socksHandler.Load().handle) {
 				ps.logSocksConcurrencyLimit()
 			}
 		}
@@ -258,13 +394,12 @@ func (ps *proxyServer) startHTTP3Server(transport string) error {
 	}
 
 	enableDatagrams := transport == support.TransportQUIC
-	handler := &proxyHandler{rotator: ps.rotator}
 	httpHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodConnect {
 			http.Error(w, "CONNECT is not supported for HTTP/3 rotators", http.StatusMethodNotAllowed)
 			return
 		}
-		handler.ServeHTTP(w, r)
+		ps.ServeHTTP(w, r)
 	})
 
 	server := &http3.Server{
@@ -275,6 +410,10 @@ func (ps *proxyServer) startHTTP3Server(transport string) error {
 		EnableDatagrams: enableDatagrams,
 		IdleTimeout:     30 * time.Second,
 		MaxHeaderBytes:  http.DefaultMaxHeaderBytes,
+		ConnContext: func(ctx context.Context, _ *quic.Conn) context.Context {
+			recordClientConnection(ps.config())
+			return withClientConn(ctx)
+		},
 	}
 
 	ps.http3Server = server
@@ -288,24 +427,9 @@ func (ps *proxyServer) startHTTP3Server(transport string) error {
 	return nil
 }
 
+// Stop closes the server and cuts its open tunnels without a grace period.
 func (ps *proxyServer) Stop() {
-	ps.closeOnce.Do(func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if ps.httpServer != nil {
-			if err := ps.httpServer.Shutdown(ctx); err != nil {
-				log.Error("rotating proxy server shutdown", "rotator_id", ps.rotator.ID, "error", err)
-			}
-		}
-		if ps.http3Server != nil {
-			if err := ps.http3Server.Close(); err != nil {
-				log.Error("rotating proxy server http3 close", "rotator_id", ps.rotator.ID, "error", err)
-			}
-		}
-		if ps.listener != nil {
-			_ = ps.listener.Close()
-		}
-	})
+	ps.drain(time.Now())
 }
 
 func isSocksProtocol(name string) bool {
@@ -326,7 +450,7 @@ func listenProtocolName(rotator domain.RotatingProxy) string {
 
 func listenTransportProtocolName(rotator domain.RotatingProxy) string {
 	if name := strings.TrimSpace(rotator.ListenTransportProtocol); name != "" {
-		return support.NormalizeTransportProtocol(name)
+		return support.NormalizeListenTransportProtocol(name)
 	}
 	if name := strings.TrimSpace(rotator.TransportProtocol); name != "" {
 		return support.NormalizeTransportProtocol(name)
@@ -343,15 +467,21 @@ func loadMaxSocksConcurrentConnections() int {
 }
 
 func (ps *proxyServer) dispatchSocksConnection(conn net.Conn, handle func(net.Conn)) bool {
-	if ps.socksWorkerSem == nil {
+	return dispatchLimited(ps.socksWorkerSem, conn, handle)
+}
+
+// dispatchLimited serves conn in a new goroutine unless all of the workers
+// allowed by sem are busy, in which case conn is closed.
+func dispatchLimited(sem chan struct{}, conn net.Conn, handle func(net.Conn)) bool {
+	if sem == nil {
 		go handle(conn)
 		return true
 	}
 
 	select {
-	case ps.socksWorkerSem <- struct{}{}:
+	case sem <- struct{}{}:
 		go func() {
-			defer func() { <-ps.socksWorkerSem }()
+			defer func() { <-sem }()
 			handle(conn)
 		}()
 		return true
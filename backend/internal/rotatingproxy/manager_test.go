@@ -5,6 +5,10 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
 )
 
 func TestDispatchSocksConnection_LimitsConcurrentWorkers(t *testing.T) {
@@ -62,3 +66,103 @@ func TestDispatchSocksConnection_LimitsConcurrentWorkers(t *testing.T) {
 		t.Fatal("worker semaphore token was not released after handler exit")
 	}
 }
+
+// socks5Login runs the greeting and username/password exchange and returns
+// the authentication status byte.
+func socks5Login(t *testing.T, conn net.Conn, username, password string) byte {
+	t.Helper()
+
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x02}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatalf("read greeting response: %v", err)
+	}
+
+	payload := []byte{0x01, byte(len(username))}
+	payload = append(payload, username...)
+	payload = append(payload, byte(len(password)))
+	payload = append(payload, password...)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("write auth payload: %v", err)
+	}
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		t.Fatalf("read auth response: %v", err)
+	}
+	return status[1]
+}
+
+func TestProxyServerReconfigure_KeepsOpenTunnels(t *testing.T) {
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+
+	upClient, upServer := net.Pipe()
+	t.Cleanup(func() {
+		_ = upClient.Close()
+		_ = upServer.Close()
+	})
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(string, *dto.RotatingProxyNext) (net.Conn, error) {
+		return upServer, nil
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	rotator := domain.RotatingProxy{
+		ID:           3,
+		ListenPort:   20001,
+		AuthRequired: true,
+		AuthUsername: "rot-user",
+		AuthPassword: "old-pass",
+		Protocol:     domain.Protocol{Name: "socks5"},
+	}
+	ps := newProxyServer(rotator)
+	t.Cleanup(ps.Stop)
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { _ = clientConn.Close() })
+	go ps.socksHandler.Load().handle(serverConn)
+
+	if status := socks5Login(t, clientConn, "rot-user", "old-pass"); status != 0x00 {
+		t.Fatalf("authentication failed with code %02x", status)
+	}
+	request := []byte{0x05, 0x01, 0x00, 0x03, byte(len("example.com"))}
+	request = append(request, "example.com"...)
+	request = append(request, 0x00, 0x50)
+	if _, err := clientConn.Write(request); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(clientConn, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("connect reply = %v, err = %v", reply, err)
+	}
+
+	updated := rotator
+	updated.AuthPassword = "new-pass"
+	updated.UpdatedAt = time.Now()
+	if !ps.canReconfigure(updated) {
+		t.Fatal("auth change should not require a listener restart")
+	}
+	ps.reconfigure(updated)
+
+	if _, err := clientConn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write through open tunnel: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(upClient, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("upstream read = %q, err = %v", buf, err)
+	}
+
+	staleClient, staleServer := net.Pipe()
+	t.Cleanup(func() { _ = staleClient.Close() })
+	go ps.socksHandler.Load().handle(staleServer)
+	if status := socks5Login(t, staleClient, "rot-user", "old-pass"); status == 0x00 {
+		t.Fatal("old password was accepted after the update")
+	}
+
+	moved := updated
+	moved.ListenProtocol = domain.Protocol{Name: "http"}
+	if ps.canReconfigure(moved) {
+		t.Fatal("listen protocol change must restart the listener")
+	}
+}
@@ -0,0 +1,113 @@
+package rotatingproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+// errParentProxyFailed marks failures of the rotator's parent hop. They are
+// not the fault of the selected upstream, which therefore is not cooled down.
+var errParentProxyFailed = errors.New("parent proxy failed")
+
+// parentTLSRootCAs verifies the certificates of https parent proxies. nil
+// uses the system roots.
+var parentTLSRootCAs *x509.CertPool
+
+// parentHop describes the rotator's parent proxy in the shape of an upstream
+// so the upstream handshakes can be reused for it. It is nil without one.
+func parentHop(rotator domain.RotatingProxy) *dto.RotatingProxyNext {
+	if rotator.ParentHost == "" || rotator.ParentPort == 0 {
+		return nil
+	}
+	return &dto.RotatingProxyNext{
+		IP:       rotator.ParentHost,
+		Port:     rotator.ParentPort,
+		Username: rotator.ParentUsername,
+		Password: rotator.ParentPassword,
+		HasAuth:  rotator.ParentUsername != "",
+		Protocol: rotator.ParentProtocol,
+	}
+}
+
+// viaParent returns a copy of next that is dialed through the rotator's
+// parent proxy. Cached upstreams are shared, so next itself is left alone.
+func viaParent(rotator domain.RotatingProxy, next *dto.RotatingProxyNext) *dto.RotatingProxyNext {
+	parent := parentHop(rotator)
+	if next == nil || parent == nil {
+		return next
+	}
+	chained := *next
+	chained.Parent = parent
+	return &chained
+}
+
+// dialProxyAddress opens a TCP connection to address, the proxy next
+// describes, through its parent when one is set. The dial is bounded by the
+// hop's handshake timeout.
+func dialProxyAddress(ctx context.Context, address string, next *dto.RotatingProxyNext) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: hopHandshakeTimeout(next)}
+	var parent *dto.RotatingProxyNext
+	if next != nil {
+		parent = next.Parent
+	}
+	if parent == nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(parent.IP, strconv.Itoa(int(parent.Port))))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errParentProxyFailed, err)
+	}
+	if strings.EqualFold(parent.Protocol, "https") {
+		if conn, err = startParentTLS(ctx, conn, parent); err != nil {
+			return nil, fmt.Errorf("%w: %w", errParentProxyFailed, err)
+		}
+	}
+	if err := performProxyHandshake(conn, address, parent); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %w", errParentProxyFailed, err)
+	}
+	return conn, nil
+}
+
+// startParentTLS secures the connection to an https parent before its
+// credentials are sent. The certificate has to be valid for the parent's
+// host.
+func startParentTLS(ctx context.Context, conn net.Conn, parent *dto.RotatingProxyNext) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: parent.IP,
+		RootCAs:    parentTLSRootCAs,
+		MinVersion: tls.VersionTLS12,
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, hopHandshakeTimeout(parent))
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// performProxyHandshake asks the proxy behind conn to open a tunnel to target.
+func performProxyHandshake(conn net.Conn, target string, hop *dto.RotatingProxyNext) error {
+	switch strings.ToLower(hop.Protocol) {
+	case "http", "https":
+		return performUpstreamConnectFunc(conn, target, hop)
+	case "socks5":
+		return performSocks5UpstreamConnect(conn, target, hop)
+	case "socks4":
+		return performSocks4UpstreamConnect(conn, target, hop)
+	default:
+		return fmt.Errorf("unsupported upstream protocol %s", hop.Protocol)
+	}
+}
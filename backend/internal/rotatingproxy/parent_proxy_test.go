@@ -0,0 +1,280 @@
+package rotatingproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+// serveTestListener accepts connections on a local port until the test ends.
+func serveTestListener(t *testing.T, handle func(net.Conn)) (string, uint16) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), uint16(addr.Port)
+}
+
+// serveConnectProxy runs an HTTP CONNECT proxy that requires the given
+// Proxy-Authorization header and records the tunnel targets it opened.
+func serveConnectProxy(t *testing.T, authorization string, targets chan<- string) (string, uint16) {
+	return serveTestListener(t, connectProxyHandler(authorization, targets))
+}
+
+// serveTLSConnectProxy is serveConnectProxy behind TLS. It returns the pool
+// that trusts its certificate.
+func serveTLSConnectProxy(t *testing.T, authorization string, targets chan<- string) (string, uint16, *x509.CertPool) {
+	t.Helper()
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	handle := connectProxyHandler(authorization, targets)
+	host, port := serveTestListener(t, func(conn net.Conn) {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: server.TLS.Certificates})
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		handle(tlsConn)
+	})
+	return host, port, roots
+}
+
+func connectProxyHandler(authorization string, targets chan<- string) func(net.Conn) {
+	return func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != authorization {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		targets <- req.Host
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+		pipeConnections(conn, upstream)
+	}
+}
+
+// serveSocks5Proxy runs a SOCKS5 proxy that requires username/password
+// authentication and records the tunnel targets it opened.
+func serveSocks5Proxy(t *testing.T, username, password string, targets chan<- string) (string, uint16) {
+	return serveTestListener(t, func(conn net.Conn) {
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil || greeting[2] != 0x02 {
+			_, _ = conn.Write([]byte{0x05, 0xff})
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0x02})
+
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		user := make([]byte, header[1])
+		_, _ = io.ReadFull(conn, user)
+		passLen := make([]byte, 1)
+		_, _ = io.ReadFull(conn, passLen)
+		pass := make([]byte, passLen[0])
+		_, _ = io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+
+		target, err := readSocks5Target(conn)
+		if err != nil {
+			return
+		}
+		targets <- target
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			_ = writeSocks5Reply(conn, 0x05)
+			return
+		}
+		_ = writeSocks5BoundReply(conn, 0x00, net.IPv4zero, 0)
+		pipeConnections(conn, upstream)
+	})
+}
+
+func serveEcho(t *testing.T) string {
+	host, port := serveTestListener(t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+func TestConnectThroughUpstream_ChainsThroughParentProxy(t *testing.T) {
+	target := serveEcho(t)
+
+	tests := []struct {
+		name           string
+		parentProtocol string
+		poolProtocol   string
+	}{
+		{name: "http parent, socks5 upstream", parentProtocol: "http", poolProtocol: "socks5"},
+		{name: "socks5 parent, http upstream", parentProtocol: "socks5", poolProtocol: "http"},
+	}
+
+	serve := func(protocol, username, password string, targets chan<- string) (string, uint16) {
+		if protocol == "socks5" {
+			return serveSocks5Proxy(t, username, password, targets)
+		}
+		return serveConnectProxy(t, proxyAuthorization(username, password), targets)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parentTargets := make(chan string, 1)
+			poolTargets := make(chan string, 1)
+			parentHost, parentPort := serve(tt.parentProtocol, "parent-user", "parent-pass", parentTargets)
+			poolHost, poolPort := serve(tt.poolProtocol, "pool-user", "pool-pass", poolTargets)
+
+			rotator := domain.RotatingProxy{
+				ParentProtocol: tt.parentProtocol,
+				ParentHost:     parentHost,
+				ParentPort:     parentPort,
+				ParentUsername: "parent-user",
+				ParentPassword: "parent-pass",
+			}
+			next := viaParent(rotator, &dto.RotatingProxyNext{
+				ProxyID:  1,
+				IP:       poolHost,
+				Port:     poolPort,
+				Username: "pool-user",
+				Password: "pool-pass",
+				HasAuth:  true,
+				Protocol: tt.poolProtocol,
+			})
+
+			conn, err := connectThroughUpstream(target, next)
+			if err != nil {
+				t.Fatalf("connectThroughUpstream: %v", err)
+			}
+			defer conn.Close()
+
+			if got, want := <-parentTargets, net.JoinHostPort(poolHost, strconv.Itoa(int(poolPort))); got != want {
+				t.Fatalf("parent tunnelled to %q, want the upstream %q", got, want)
+			}
+			if got := <-poolTargets; got != target {
+				t.Fatalf("upstream tunnelled to %q, want %q", got, target)
+			}
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+				t.Fatalf("echo = %q, err = %v, want ping", reply, err)
+			}
+		})
+	}
+}
+
+func TestConnectThroughUpstream_SpeaksTLSToHTTPSParents(t *testing.T) {
+	target := serveEcho(t)
+	parentTargets := make(chan string, 1)
+	poolTargets := make(chan string, 1)
+	parentHost, parentPort, roots := serveTLSConnectProxy(t, proxyAuthorization("parent-user", "parent-pass"), parentTargets)
+	poolHost, poolPort := serveSocks5Proxy(t, "pool-user", "pool-pass", poolTargets)
+
+	rotator := domain.RotatingProxy{
+		ParentProtocol: "https",
+		ParentHost:     parentHost,
+		ParentPort:     parentPort,
+		ParentUsername: "parent-user",
+		ParentPassword: "parent-pass",
+	}
+	next := viaParent(rotator, &dto.RotatingProxyNext{
+		ProxyID: 1, IP: poolHost, Port: poolPort, Username: "pool-user", Password: "pool-pass", HasAuth: true, Protocol: "socks5",
+	})
+
+	// Without the parent's certificate in the roots the handshake fails
+	// before the credentials are sent.
+	if _, err := connectThroughUpstream(target, next); !errors.Is(err, errParentProxyFailed) {
+		t.Fatalf("untrusted parent: err = %v, want errParentProxyFailed", err)
+	}
+	if len(parentTargets) != 0 {
+		t.Fatal("the untrusted parent received a CONNECT request")
+	}
+
+	parentTLSRootCAs = roots
+	t.Cleanup(func() { parentTLSRootCAs = nil })
+	conn, err := connectThroughUpstream(target, next)
+	if err != nil {
+		t.Fatalf("trusted parent: %v", err)
+	}
+	defer conn.Close()
+	if got := <-poolTargets; got != target {
+		t.Fatalf("upstream tunnelled to %q, want %q", got, target)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo = %q, err = %v, want ping", reply, err)
+	}
+}
+
+func TestConnectWithFailover_DoesNotBlameUpstreamsForParentFailure(t *testing.T) {
+	selections := stubSequentialUpstreams(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedPort := uint16(ln.Addr().(*net.TCPAddr).Port)
+	_ = ln.Close()
+
+	rotator := domain.RotatingProxy{ID: 1, ParentProtocol: "http", ParentHost: "127.0.0.1", ParentPort: closedPort}
+	state := newRotatorState()
+	_, _, err = state.connectWithFailover(rotator, clientRouting{}, "example.com:443")
+	if !errors.Is(err, errParentProxyFailed) {
+		t.Fatalf("err = %v, want errParentProxyFailed", err)
+	}
+	if len(*selections) != 1 {
+		t.Fatalf("upstream selections = %d, want 1 without retries", len(*selections))
+	}
+	if cooling := state.exclusions.active(time.Now()); len(cooling) != 0 {
+		t.Fatalf("cooling upstreams = %v, want none", cooling)
+	}
+}
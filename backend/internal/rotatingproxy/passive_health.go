@@ -0,0 +1,199 @@
+package rotatingproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+	proxyqueue "magpie/internal/jobs/queue/proxy"
+	"magpie/internal/jobs/runtime"
+	"magpie/internal/support"
+)
+
+const (
+	envRotatingProxyPassiveFailureThreshold = "ROTATING_PROXY_PASSIVE_FAILURE_THRESHOLD"
+	defaultPassiveFailureThreshold          = 5
+	passiveDemotionTimeout                  = 10 * time.Second
+)
+
+// errTargetFailed marks handshakes the upstream answered but could not
+// complete because the target was unreachable or refused the connection. The
+// upstream itself works, so these never count against it.
+var errTargetFailed = errors.New("upstream could not reach the target")
+
+var (
+	markProxiesUnhealthyFunc = database.MarkProxiesUnhealthy
+	expediteProxyChecksFunc  = func(proxies []domain.Proxy) error {
+		return proxyqueue.PublicProxyQueue.ExpediteChecks(proxies)
+	}
+
+	passiveHealth = newPassiveHealthTracker(
+		support.GetEnvInt(envRotatingProxyPassiveFailureThreshold, defaultPassiveFailureThreshold),
+		runtime.AddProxyTrafficObservation,
+		demoteUpstream,
+	)
+)
+
+// passiveHealthTracker forwards live traffic outcomes to the proxy
+// statistics and counts consecutive failures per upstream across every
+// rotator of this instance. Upstreams reaching the threshold are demoted.
+type passiveHealthTracker struct {
+	threshold int
+	record    func(runtime.ProxyTrafficObservation)
+	demote    func(proxyID uint64)
+
+	mu       sync.Mutex
+	failures map[uint64]int
+}
+
+func newPassiveHealthTracker(threshold int, record func(runtime.ProxyTrafficObservation), demote func(proxyID uint64)) *passiveHealthTracker {
+	return &passiveHealthTracker{
+		threshold: threshold,
+		record:    record,
+		demote:    demote,
+		failures:  make(map[uint64]int),
+	}
+}
+
+// observe records an outcome. Target TLS errors lower the upstream's
+// reputation but do not count towards the threshold, since the target may be
+// at fault. The count starts over after a demotion.
+func (t *passiveHealthTracker) observe(observation runtime.ProxyTrafficObservation) {
+	if observation.ProxyID == 0 {
+		return
+	}
+	t.record(observation)
+	if observation.TLSError || t.threshold <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	reached := false
+	if observation.Success {
+		delete(t.failures, observation.ProxyID)
+	} else {
+		t.failures[observation.ProxyID]++
+		if t.failures[observation.ProxyID] >= t.threshold {
+			delete(t.failures, observation.ProxyID)
+			reached = true
+		}
+	}
+	t.mu.Unlock()
+
+	if reached {
+		go t.demote(observation.ProxyID)
+	}
+}
+
+// observeUpstream feeds the outcome of connecting through an upstream into
+// its statistics. Upstreams that keep failing are pulled from the pools and
+// checked again right away instead of waiting for their scheduled check.
+func observeUpstream(proxyID uint64, success bool, handshake time.Duration) {
+	passiveHealth.observe(runtime.ProxyTrafficObservation{
+		ProxyID:   proxyID,
+		Success:   success,
+		Handshake: handshake,
+	})
+}
+
+// observeTargetTLSError records a TLS failure with the target behind a
+// working upstream.
+func observeTargetTLSError(proxyID uint64) {
+	passiveHealth.observe(runtime.ProxyTrafficObservation{
+		ProxyID:  proxyID,
+		Success:  true,
+		TLSError: true,
+	})
+}
+
+// isTargetFailure reports whether err blames the target rather than the
+// upstream. Parent hop failures wrap the parent's handshake error and blame
+// the parent instead.
+func isTargetFailure(err error) bool {
+	return errors.Is(err, errTargetFailed) && !errors.Is(err, errParentProxyFailed)
+}
+
+// observeTargetFailure records a connect that the upstream relayed but the
+// target refused. It counts as a working upstream.
+func observeTargetFailure(proxyID uint64) {
+	passiveHealth.observe(runtime.ProxyTrafficObservation{
+		ProxyID: proxyID,
+		Success: true,
+	})
+}
+
+// isUpstreamTimeout reports whether a round trip ran out of the rotator's
+// own upstream timeout, or whether the target was too slow to answer once
+// the upstream was connected. Neither blames the upstream; timeouts while
+// dialing or during the handshake still do.
+func isUpstreamTimeout(ctx context.Context, err error, dialed bool) bool {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return dialed && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isTargetFailureStatus reports whether an upstream answered a CONNECT with a
+// gateway error, i.e. it could not reach the target.
+func isTargetFailureStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// isTargetFailureReply reports whether a SOCKS5 reply code blames the target:
+// network unreachable, host unreachable or connection refused.
+func isTargetFailureReply(rep byte) bool {
+	return rep >= 0x03 && rep <= 0x05
+}
+
+func demoteUpstream(proxyID uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), passiveDemotionTimeout)
+	defer cancel()
+
+	proxies, err := markProxiesUnhealthyFunc(ctx, []uint64{proxyID})
+	if err != nil {
+		log.Warn("rotating proxy: failed to pull failing upstream from pools", "proxy_id", proxyID, "error", err)
+		return
+	}
+	if len(proxies) == 0 {
+		return
+	}
+	if err := expediteProxyChecksFunc(proxies); err != nil {
+		log.Warn("rotating proxy: failed to requeue failing upstream", "proxy_id", proxyID, "error", err)
+		return
+	}
+	log.Info("rotating proxy: upstream failed repeatedly in live traffic, requeued for a check", "proxy_id", proxyID)
+}
+
+// isTargetTLSError reports whether err comes from the TLS handshake with the
+// target rather than from the upstream connection.
+func isTargetTLSError(err error) bool {
+	var (
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
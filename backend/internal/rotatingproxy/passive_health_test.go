@@ -0,0 +1,170 @@
+package rotatingproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+	"magpie/internal/jobs/runtime"
+)
+
+func TestPassiveHealthTracker_DemotesAfterConsecutiveFailures(t *testing.T) {
+	var recorded []runtime.ProxyTrafficObservation
+	demoted := make(chan uint64, 4)
+	tracker := newPassiveHealthTracker(3,
+		func(observation runtime.ProxyTrafficObservation) { recorded = append(recorded, observation) },
+		func(proxyID uint64) { demoted <- proxyID },
+	)
+
+	failure := runtime.ProxyTrafficObservation{ProxyID: 7}
+	tracker.observe(failure)
+	tracker.observe(failure)
+	tracker.observe(runtime.ProxyTrafficObservation{ProxyID: 7, Success: true, Handshake: time.Millisecond})
+	tracker.observe(failure)
+	tracker.observe(failure)
+	tracker.observe(runtime.ProxyTrafficObservation{ProxyID: 7, Success: true, TLSError: true})
+	select {
+	case proxyID := <-demoted:
+		t.Fatalf("proxy %d demoted before reaching the threshold", proxyID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tracker.observe(failure)
+	select {
+	case proxyID := <-demoted:
+		if proxyID != 7 {
+			t.Fatalf("demoted proxy %d, want 7", proxyID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected proxy to be demoted after three consecutive failures")
+	}
+
+	if len(recorded) != 7 {
+		t.Fatalf("recorded %d observations, want 7", len(recorded))
+	}
+}
+
+func TestIsTargetTLSError(t *testing.T) {
+	tlsErr := &url.Error{Op: "Get", URL: "https://example.com", Err: x509.UnknownAuthorityError{}}
+	if !isTargetTLSError(tlsErr) {
+		t.Fatal("expected certificate errors to count as target TLS errors")
+	}
+	if isTargetTLSError(fmt.Errorf("dial tcp: connection refused")) {
+		t.Fatal("expected connect errors not to count as target TLS errors")
+	}
+}
+
+func TestConnectWithFailover_TargetRefusalsDoNotDemoteUpstream(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	target := closed.Addr().String()
+	_ = closed.Close()
+
+	targets := make(chan string, 64)
+	proxyHost, proxyPort := serveSocks5Proxy(t, "user", "pass", targets)
+	originalGetNext := getNextRotatingProxyFunc
+	getNextRotatingProxyFunc = func(uint, uint64, database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		return &dto.RotatingProxyNext{
+			ProxyID: 9, IP: proxyHost, Port: proxyPort, Username: "user", Password: "pass", HasAuth: true, Protocol: "socks5",
+		}, nil
+	}
+	t.Cleanup(func() { getNextRotatingProxyFunc = originalGetNext })
+
+	const threshold = 3
+	demoted := make(chan uint64, 1)
+	var recorded []runtime.ProxyTrafficObservation
+	originalHealth := passiveHealth
+	passiveHealth = newPassiveHealthTracker(threshold,
+		func(observation runtime.ProxyTrafficObservation) { recorded = append(recorded, observation) },
+		func(proxyID uint64) { demoted <- proxyID },
+	)
+	t.Cleanup(func() { passiveHealth = originalHealth })
+
+	for range threshold * 2 {
+		_, _, err := newRotatorState().connectWithFailover(domain.RotatingProxy{ID: 1}, clientRouting{}, target)
+		if !errors.Is(err, errTargetFailed) {
+			t.Fatalf("err = %v, want errTargetFailed", err)
+		}
+	}
+
+	select {
+	case proxyID := <-demoted:
+		t.Fatalf("proxy %d demoted for connections the target refused", proxyID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for _, observation := range recorded {
+		if !observation.Success {
+			t.Fatalf("observation %+v counted the refusal against the upstream", observation)
+		}
+	}
+}
+
+func TestHandleHTTP_ClientCancellationsAndSlowTargetsDoNotBlameUpstream(t *testing.T) {
+	stubSequentialUpstreams(t)
+
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			reader := bufio.NewReader(client)
+			if _, err := http.ReadRequest(reader); err != nil {
+				return
+			}
+			// The target never answers; wait for the rotator to give up.
+			_, _ = reader.ReadByte()
+		}()
+		return server, nil
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+
+	var failures atomic.Int32
+	originalHealth := passiveHealth
+	passiveHealth = newPassiveHealthTracker(1,
+		func(observation runtime.ProxyTrafficObservation) {
+			if !observation.Success {
+				failures.Add(1)
+			}
+		},
+		func(proxyID uint64) { t.Errorf("proxy %d demoted", proxyID) },
+	)
+	t.Cleanup(func() { passiveHealth = originalHealth })
+
+	handler := &proxyHandler{
+		rotator: domain.RotatingProxy{ID: 42, UserID: 7, UpstreamTimeoutMS: 100},
+		state:   newRotatorState(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+	handler.handleHTTP(httptest.NewRecorder(), cancelled)
+
+	slow := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	recorder := httptest.NewRecorder()
+	handler.handleHTTP(recorder, slow)
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status code = %d, want %d", recorder.Code, http.StatusGatewayTimeout)
+	}
+
+	if count := failures.Load(); count != 0 {
+		t.Fatalf("recorded %d failures against the upstream, want 0", count)
+	}
+	if cooling := handler.state.exclusions.active(time.Now()); len(cooling) != 0 {
+		t.Fatalf("cooling upstreams = %v, want none", cooling)
+	}
+}
@@ -0,0 +1,111 @@
+package rotatingproxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+)
+
+const (
+	rotationHoldIdleTimeout   = 10 * time.Minute
+	rotationHoldSweepInterval = time.Minute
+)
+
+type heldUpstream struct {
+	upstream *dto.RotatingProxyNext
+	pickedAt time.Time
+	usedAt   time.Time
+	served   int
+}
+
+// rotationHolds keeps serving the upstream last picked for a login and its
+// routing filters until the rotator's rotation mode asks for a new one.
+type rotationHolds struct {
+	mu        sync.Mutex
+	entries   map[string]*heldUpstream
+	lastSweep time.Time
+}
+
+func newRotationHolds() *rotationHolds {
+	return &rotationHolds{entries: make(map[string]*heldUpstream)}
+}
+
+// take returns the held upstream for key and counts it as served, unless the
+// rotation is due or usable rejects the upstream.
+func (h *rotationHolds) take(rotation database.RotatingProxyRotation, key string, now time.Time, usable func(proxyID uint64) bool) (*dto.RotatingProxyNext, bool) {
+	if h == nil || rotation.PerRequest() {
+		return nil, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entry, ok := h.entries[key]
+	if !ok {
+		return nil, false
+	}
+	due := (rotation.Mode == database.RotatingProxyRotationInterval && now.Sub(entry.pickedAt) >= rotation.Interval()) ||
+		(rotation.Mode == database.RotatingProxyRotationRequestCount && entry.served >= rotation.Requests)
+	if due || !usable(entry.upstream.ProxyID) {
+		delete(h.entries, key)
+		return nil, false
+	}
+
+	entry.served++
+	entry.usedAt = now
+	return entry.upstream, true
+}
+
+func (h *rotationHolds) hold(rotation database.RotatingProxyRotation, key string, upstream *dto.RotatingProxyNext, now time.Time) {
+	if h == nil || rotation.PerRequest() || upstream == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now.Sub(h.lastSweep) >= rotationHoldSweepInterval {
+		for existingKey, entry := range h.entries {
+			if now.Sub(entry.usedAt) >= rotationHoldIdleTimeout {
+				delete(h.entries, existingKey)
+			}
+		}
+		h.lastSweep = now
+	}
+
+	h.entries[key] = &heldUpstream{upstream: upstream, pickedAt: now, usedAt: now, served: 1}
+}
+
+// forget releases every hold on an upstream that failed.
+func (h *rotationHolds) forget(proxyID uint64) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	for key, entry := range h.entries {
+		if entry.upstream.ProxyID == proxyID {
+			delete(h.entries, key)
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *rotationHolds) clear() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	clear(h.entries)
+	h.mu.Unlock()
+}
+
+// rotationKey groups clients that share a held upstream: the same login with
+// the same country and type parameters.
+func (r clientRouting) rotationKey() string {
+	return strings.Join([]string{r.Username, strings.ToLower(r.Country), strings.ToLower(r.Type)}, "|")
+}
@@ -0,0 +1,94 @@
+package rotatingproxy
+
+import (
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func servedProxyIDs(t *testing.T, state *rotatorState, rotator domain.RotatingProxy, routing clientRouting, count int) []uint64 {
+	t.Helper()
+
+	ids := make([]uint64, 0, count)
+	for range count {
+		next, err := state.nextUpstream(rotator, routing)
+		if err != nil {
+			t.Fatalf("nextUpstream: %v", err)
+		}
+		ids = append(ids, next.ProxyID)
+	}
+	return ids
+}
+
+func TestNextUpstream_RotationModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		rotator  domain.RotatingProxy
+		expected []uint64
+	}{
+		{
+			name:     "per request",
+			rotator:  domain.RotatingProxy{ID: 1},
+			expected: []uint64{1, 2, 3, 4, 5},
+		},
+		{
+			name:     "every two requests",
+			rotator:  domain.RotatingProxy{ID: 1, RotationMode: database.RotatingProxyRotationRequestCount, RotationRequests: 2},
+			expected: []uint64{1, 1, 2, 2, 3},
+		},
+		{
+			name:     "interval",
+			rotator:  domain.RotatingProxy{ID: 1, RotationMode: database.RotatingProxyRotationInterval, RotationIntervalSeconds: 60},
+			expected: []uint64{1, 1, 1, 1, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubSequentialUpstreams(t)
+			got := servedProxyIDs(t, newRotatorState(), tt.rotator, clientRouting{Username: "user"}, len(tt.expected))
+			for idx := range tt.expected {
+				if got[idx] != tt.expected[idx] {
+					t.Fatalf("served upstreams = %v, want %v", got, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestNextUpstream_HeldUpstreamIsReplacedAfterFailure(t *testing.T) {
+	stubSequentialUpstreams(t)
+	rotator := domain.RotatingProxy{ID: 1, RotationMode: database.RotatingProxyRotationInterval, RotationIntervalSeconds: 600}
+	state := newRotatorState()
+	routing := clientRouting{Username: "user"}
+
+	if got := servedProxyIDs(t, state, rotator, routing, 2); got[0] != 1 || got[1] != 1 {
+		t.Fatalf("served upstreams = %v, want upstream 1 twice", got)
+	}
+	if next, err := state.nextUpstream(rotator, clientRouting{Username: "user", Country: "DE"}); err != nil || next.ProxyID != 2 {
+		t.Fatalf("other filters: next = %+v, err = %v, want a separate upstream", next, err)
+	}
+
+	state.upstreamFailed(rotator, routing, 1)
+	if got := servedProxyIDs(t, state, rotator, routing, 2); got[0] != 3 || got[1] != 3 {
+		t.Fatalf("served upstreams after failure = %v, want upstream 3 twice", got)
+	}
+}
+
+func TestRotationHolds_IntervalElapses(t *testing.T) {
+	holds := newRotationHolds()
+	rotation := database.RotatingProxyRotation{Mode: database.RotatingProxyRotationInterval, IntervalSeconds: 30}
+	usable := func(uint64) bool { return true }
+	now := time.Now()
+
+	holds.hold(rotation, "user||", &dto.RotatingProxyNext{ProxyID: 7}, now)
+	if next, ok := holds.take(rotation, "user||", now.Add(29*time.Second), usable); !ok || next.ProxyID != 7 {
+		t.Fatalf("take before interval: next = %+v, ok = %v, want upstream 7", next, ok)
+	}
+	if _, ok := holds.take(rotation, "user||", now.Add(30*time.Second), usable); ok {
+		t.Fatal("take after interval returned the held upstream")
+	}
+}
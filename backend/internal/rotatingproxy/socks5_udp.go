@@ -0,0 +1,333 @@
+package rotatingproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/domain"
+)
+
+const (
+	socks5CommandConnect      = 0x01
+	socks5CommandUDPAssociate = 0x03
+
+	udpRelayBufferSize = 64 * 1024
+)
+
+var associateUpstreamUDPFunc = associateUpstreamUDP
+
+// upstreamUDPAssociation is a UDP ASSOCIATE session on an upstream SOCKS5
+// proxy. It lasts as long as its control connection stays open.
+type upstreamUDPAssociation struct {
+	control net.Conn
+	relay   *net.UDPAddr
+}
+
+func (a *upstreamUDPAssociation) Close() error {
+	return a.control.Close()
+}
+
+// udpRelaySupported reports whether the rotator can relay UDP: upstreams
+// must speak SOCKS5 and be reached directly, since a parent hop only
+// forwards TCP.
+func udpRelaySupported(rotator domain.RotatingProxy) bool {
+	return strings.EqualFold(rotator.Protocol.Name, "socks5") && parentHop(rotator) == nil
+}
+
+func associateUpstreamUDP(next *dto.RotatingProxyNext) (*upstreamUDPAssociation, error) {
+	if !strings.EqualFold(next.Protocol, "socks5") || next.Parent != nil {
+		return nil, errUnsupportedUpstream
+	}
+
+	conn, err := dialUpstreamFunc(next)
+	if err != nil {
+		return nil, err
+	}
+
+	bound, err := performSocks5UpstreamRequest(conn, socks5CommandUDPAssociate, "0.0.0.0:0", next)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		// The upstream relays on the address the association was opened on.
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = remote.IP
+		}
+	}
+	return &upstreamUDPAssociation{control: conn, relay: relay}, nil
+}
+
+// handleSocks5UDP serves a UDP ASSOCIATE request. Client datagrams keep
+// their SOCKS5 UDP header and are relayed as they are to an association on
+// an upstream SOCKS5 proxy; its replies travel back the same way. In local
+// DNS mode datagrams addressed to host names are resolved here first. The
+// association ends when the client closes its control connection.
+func (h *socksProxyHandler) handleSocks5UDP(conn net.Conn, routing clientRouting) {
+	if !udpRelaySupported(h.rotator) {
+		_ = writeSocks5Reply(conn, 0x07)
+		return
+	}
+
+	association, next, err := withFailover(h.state, h.rotator, routing, associateUpstreamUDPFunc)
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5FailureReply(err))
+		return
+	}
+	defer association.Close()
+	defer h.state.acquireUpstream(next.ProxyID)()
+
+	var localIP net.IP
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = local.IP
+	}
+	clientSide, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		_ = writeSocks5Reply(conn, 0x01)
+		return
+	}
+	defer clientSide.Close()
+
+	upstreamSide, err := net.DialUDP("udp", nil, association.relay)
+	if err != nil {
+		_ = writeSocks5Reply(conn, 0x01)
+		return
+	}
+	defer upstreamSide.Close()
+
+	if err := writeSocks5Success(conn, clientSide.LocalAddr()); err != nil {
+		return
+	}
+	clearConnDeadline(conn)
+
+	var clientIP net.IP
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = remote.IP
+	}
+	relay := &udpRelay{
+		client:   clientSide,
+		upstream: upstreamSide,
+		clientIP: clientIP,
+		allow:    h.state.destinations().allows,
+		meter:    h.state.tunnelMeter(routing),
+	}
+	rules := h.state.destinations()
+	relay.resolve = func(target string) (string, error) {
+		return rules.resolve(target, next)
+	}
+	defer h.state.trackTunnel(conn, association.control)()
+	up, down := relay.run(conn, association.control)
+	recordUpstreamTraffic(h.rotator, routing, next.ProxyID, up, down)
+}
+
+// udpRelay moves datagrams between a client and an upstream association.
+// Only datagrams from the client's IP to destinations passing allow are
+// accepted; replies go to the port the client last sent from. Payload bytes
+// are passed to meter, and the association ends once it returns false.
+type udpRelay struct {
+	client   *net.UDPConn
+	upstream *net.UDPConn
+	clientIP net.IP
+	allow    func(host string, port uint16) bool
+	resolve  func(target string) (string, error)
+	meter    func(int64) bool
+
+	exhausted chan struct{}
+	exhaust   sync.Once
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+
+	up   atomic.Int64
+	down atomic.Int64
+}
+
+// run relays until either control connection closes and returns the payload
+// bytes sent by the client (up) and returned to it (down).
+func (r *udpRelay) run(clientControl, upstreamControl net.Conn) (int64, int64) {
+	r.exhausted = make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.forwardFromClient()
+	}()
+	go func() {
+		defer wg.Done()
+		r.forwardFromUpstream()
+	}()
+
+	closed := make(chan struct{}, 2)
+	watch := func(control net.Conn) {
+		_, _ = io.Copy(io.Discard, control)
+		closed <- struct{}{}
+	}
+	go watch(clientControl)
+	go watch(upstreamControl)
+	pending := 2
+	select {
+	case <-closed:
+		pending--
+	case <-r.exhausted:
+	}
+
+	_ = clientControl.Close()
+	_ = upstreamControl.Close()
+	_ = r.client.Close()
+	_ = r.upstream.Close()
+	for ; pending > 0; pending-- {
+		<-closed
+	}
+	wg.Wait()
+	return r.up.Load(), r.down.Load()
+}
+
+func (r *udpRelay) forwardFromClient() {
+	buf := make([]byte, udpRelayBufferSize)
+	for {
+		n, addr, err := r.client.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if r.clientIP != nil && !addr.IP.Equal(r.clientIP) {
+			continue
+		}
+		headerLen, ok := socks5UDPHeaderLength(buf[:n])
+		if !ok {
+			continue
+		}
+		if r.allow != nil && !r.allow(socks5UDPDestination(buf[:headerLen])) {
+			continue
+		}
+		datagram := buf[:n]
+		if datagram[3] == 0x03 && r.resolve != nil {
+			if datagram, headerLen, ok = r.resolveDatagram(datagram, headerLen); !ok {
+				continue
+			}
+		}
+
+		r.mu.Lock()
+		r.clientAddr = addr
+		r.mu.Unlock()
+
+		if _, err := r.upstream.Write(datagram); err == nil {
+			r.up.Add(int64(len(datagram) - headerLen))
+			r.charge(int64(len(datagram) - headerLen))
+		}
+	}
+}
+
+// resolveDatagram passes the host name a client datagram is addressed to
+// through resolve and rewrites the header to the returned address. Host
+// names resolve leaves to the upstream are kept; unresolvable or blocked
+// destinations drop the datagram.
+func (r *udpRelay) resolveDatagram(datagram []byte, headerLen int) ([]byte, int, bool) {
+	host, port := socks5UDPDestination(datagram[:headerLen])
+	resolved, err := r.resolve(net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, 0, false
+	}
+	resolvedHost, _, err := splitTargetAddress(resolved)
+	if err != nil || net.ParseIP(resolvedHost) == nil {
+		return datagram, headerLen, true
+	}
+	atyp, address, portBytes, err := encodeSocksAddress(resolvedHost, port)
+	if err != nil {
+		return nil, 0, false
+	}
+	header := append([]byte{0x00, 0x00, 0x00, atyp}, address...)
+	header = append(header, portBytes...)
+	return append(header, datagram[headerLen:]...), len(header), true
+}
+
+func (r *udpRelay) forwardFromUpstream() {
+	buf := make([]byte, udpRelayBufferSize)
+	for {
+		n, err := r.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		headerLen, ok := socks5UDPHeaderLength(buf[:n])
+		if !ok {
+			continue
+		}
+
+		r.mu.Lock()
+		clientAddr := r.clientAddr
+		r.mu.Unlock()
+		if clientAddr == nil {
+			continue
+		}
+
+		if _, err := r.client.WriteToUDP(buf[:n], clientAddr); err == nil {
+			r.down.Add(int64(n - headerLen))
+			r.charge(int64(n - headerLen))
+		}
+	}
+}
+
+// charge passes relayed payload bytes to the meter and ends the association
+// once the meter refuses them.
+func (r *udpRelay) charge(bytes int64) {
+	if r.meter != nil && !r.meter(bytes) {
+		r.exhaust.Do(func() { close(r.exhausted) })
+	}
+}
+
+// socks5UDPHeaderLength validates the header of a SOCKS5 UDP datagram and
+// returns its length. Fragmented datagrams are not supported.
+func socks5UDPHeaderLength(datagram []byte) (int, bool) {
+	if len(datagram) < 4 || datagram[0] != 0 || datagram[1] != 0 || datagram[2] != 0 {
+		return 0, false
+	}
+
+	var length int
+	switch datagram[3] {
+	case 0x01:
+		length = 4 + net.IPv4len + 2
+	case 0x04:
+		length = 4 + net.IPv6len + 2
+	case 0x03:
+		if len(datagram) < 5 {
+			return 0, false
+		}
+		length = 5 + int(datagram[4]) + 2
+	default:
+		return 0, false
+	}
+	if len(datagram) < length {
+		return 0, false
+	}
+	return length, true
+}
+
+// socks5UDPDestination returns the destination of a datagram whose header
+// passed socks5UDPHeaderLength.
+func socks5UDPDestination(header []byte) (string, uint16) {
+	port := binary.BigEndian.Uint16(header[len(header)-2:])
+	switch header[3] {
+	case 0x03:
+		return string(header[5 : len(header)-2]), port
+	default:
+		return net.IP(header[4 : len(header)-2]).String(), port
+	}
+}
@@ -0,0 +1,110 @@
+package rotatingproxy
+
+import (
+	"sync"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/support"
+)
+
+const (
+	envRotatingProxyStickySessionTTLSeconds = "ROTATING_PROXY_STICKY_SESSION_TTL_SECONDS"
+	defaultStickySessionTTL                 = 10 * time.Minute
+	stickySessionSweepInterval              = time.Minute
+)
+
+var defaultStickySessionTTLValue = loadDefaultStickySessionTTL()
+
+type stickySession struct {
+	upstream  *dto.RotatingProxyNext
+	expiresAt time.Time
+}
+
+// stickySessionStore pins client sessions to the upstream they were first
+// served by until the session TTL elapses.
+type stickySessionStore struct {
+	mu        sync.Mutex
+	entries   map[string]stickySession
+	lastSweep time.Time
+}
+
+func newStickySessionStore() *stickySessionStore {
+	return &stickySessionStore{entries: make(map[string]stickySession)}
+}
+
+func (s *stickySessionStore) get(key string, now time.Time) (*dto.RotatingProxyNext, bool) {
+	if s == nil || key == "" {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(s.entries, key)
+		return nil, false
+	}
+	return entry.upstream, true
+}
+
+func (s *stickySessionStore) put(key string, upstream *dto.RotatingProxyNext, ttl time.Duration, now time.Time) {
+	if s == nil || key == "" || upstream == nil || ttl <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= stickySessionSweepInterval {
+		for existingKey, entry := range s.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(s.entries, existingKey)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	s.entries[key] = stickySession{upstream: upstream, expiresAt: now.Add(ttl)}
+}
+
+func (s *stickySessionStore) forget(key string) {
+	if s == nil || key == "" {
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+}
+
+// clear drops every pinned session, e.g. after the rotator's filters changed
+// and the pinned upstreams may no longer qualify.
+func (s *stickySessionStore) clear() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	clear(s.entries)
+	s.mu.Unlock()
+}
+
+func stickySessionTTL(ttlSeconds int) time.Duration {
+	if ttlSeconds > 0 {
+		return time.Duration(ttlSeconds) * time.Second
+	}
+	return defaultStickySessionTTLValue
+}
+
+func loadDefaultStickySessionTTL() time.Duration {
+	seconds := support.GetEnvInt(envRotatingProxyStickySessionTTLSeconds, int(defaultStickySessionTTL/time.Second))
+	if seconds <= 0 {
+		return defaultStickySessionTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
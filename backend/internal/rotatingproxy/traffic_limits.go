@@ -0,0 +1,219 @@
+package rotatingproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+// Traffic limit names, used as the limit label of the
+// magpie_rotating_proxy_limit_rejections_total metric.
+const (
+	trafficLimitTunnels     = "tunnels"
+	trafficLimitConnections = "connections"
+	trafficLimitRequests    = "requests"
+)
+
+var (
+	errRotatorTunnelLimit    = errors.New("rotator tunnel limit reached")
+	errRotatorConnectionRate = errors.New("rotator connection rate exceeded")
+	errRotatorRequestRate    = errors.New("rotator request rate exceeded")
+)
+
+// trafficLimits enforces a rotator's concurrency and rate limits, either for
+// the whole rotator or per client IP. Rates are counted in fixed one-second
+// windows. The limits are read from the rotator on every call, so edits
+// apply to the next connection.
+type trafficLimits struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*trafficCounters
+	sweptAt int64
+}
+
+type trafficCounters struct {
+	tunnels     int
+	window      int64
+	connections int
+	requests    int
+}
+
+func newTrafficLimits() *trafficLimits {
+	return &trafficLimits{now: time.Now, entries: make(map[string]*trafficCounters)}
+}
+
+// admit counts a new client connection or HTTP request against its rate.
+func (l *trafficLimits) admit(rotator domain.RotatingProxy, remoteAddr, limit string) error {
+	perSecond, rateErr := rotator.ConnectionsPerSecond, errRotatorConnectionRate
+	if limit == trafficLimitRequests {
+		perSecond, rateErr = rotator.RequestsPerSecond, errRotatorRequestRate
+	}
+	if l == nil || perSecond <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := l.entry(rotator, remoteAddr)
+	counter := &entry.connections
+	if limit == trafficLimitRequests {
+		counter = &entry.requests
+	}
+	if *counter >= perSecond {
+		return rateErr
+	}
+	*counter++
+	return nil
+}
+
+// acquireTunnel takes one of the rotator's tunnel slots. The returned func
+// frees it again.
+func (l *trafficLimits) acquireTunnel(rotator domain.RotatingProxy, remoteAddr string) (func(), error) {
+	if l == nil || rotator.MaxTunnels <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := l.entry(rotator, remoteAddr)
+	if entry.tunnels >= rotator.MaxTunnels {
+		return nil, errRotatorTunnelLimit
+	}
+	entry.tunnels++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			entry.tunnels--
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// entry returns the counters of the client's scope with the rate counters of
+// the current window. Idle entries of past windows are dropped once per
+// window. It must be called with l.mu held.
+func (l *trafficLimits) entry(rotator domain.RotatingProxy, remoteAddr string) *trafficCounters {
+	window := l.now().Unix()
+	if window != l.sweptAt {
+		for key, entry := range l.entries {
+			if entry.tunnels == 0 && entry.window != window {
+				delete(l.entries, key)
+			}
+		}
+		l.sweptAt = window
+	}
+
+	key := ""
+	if strings.EqualFold(rotator.LimitScope, database.RotatingProxyLimitScopeClientIP) {
+		if addr, ok := parseRemoteAddr(remoteAddr); ok {
+			key = addr.String()
+		} else {
+			key = remoteAddr
+		}
+	}
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &trafficCounters{window: window}
+		l.entries[key] = entry
+	}
+	if entry.window != window {
+		entry.window = window
+		entry.connections = 0
+		entry.requests = 0
+	}
+	return entry
+}
+
+// admitConnection applies the connection rate to a new client connection.
+func (s *rotatorState) admitConnection(rotator domain.RotatingProxy, remoteAddr string) error {
+	if s == nil {
+		return nil
+	}
+	err := s.limits.admit(rotator, remoteAddr, trafficLimitConnections)
+	recordLimitRejection(rotator, trafficLimitConnections, err)
+	return err
+}
+
+// admitRequest applies the request rate to an HTTP request.
+func (s *rotatorState) admitRequest(rotator domain.RotatingProxy, remoteAddr string) error {
+	if s == nil {
+		return nil
+	}
+	err := s.limits.admit(rotator, remoteAddr, trafficLimitRequests)
+	recordLimitRejection(rotator, trafficLimitRequests, err)
+	return err
+}
+
+// acquireTunnel applies the tunnel limit to a CONNECT tunnel, SOCKS
+// connection or UDP association.
+func (s *rotatorState) acquireTunnel(rotator domain.RotatingProxy, remoteAddr string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release, err := s.limits.acquireTunnel(rotator, remoteAddr)
+	recordLimitRejection(rotator, trafficLimitTunnels, err)
+	return release, err
+}
+
+// acquireSocksConnection applies the connection rate and the tunnel limit to
+// a SOCKS client, whose connection carries a single tunnel.
+func (s *rotatorState) acquireSocksConnection(rotator domain.RotatingProxy, remoteAddr string) (func(), error) {
+	if err := s.admitConnection(rotator, remoteAddr); err != nil {
+		return nil, err
+	}
+	return s.acquireTunnel(rotator, remoteAddr)
+}
+
+type clientConnKey struct{}
+
+// clientConn marks whether a client connection of an HTTP listener already
+// passed the connection rate, so keep-alive requests are counted once.
+type clientConn struct {
+	admitted atomic.Bool
+}
+
+func withClientConn(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, &clientConn{})
+}
+
+// firstClientRequest reports whether r is the first request of its client
+// connection to get this far.
+func firstClientRequest(r *http.Request) bool {
+	conn, ok := r.Context().Value(clientConnKey{}).(*clientConn)
+	return ok && conn.admitted.CompareAndSwap(false, true)
+}
+
+// admitNewConnection applies the connection rate to the client connection
+// of r. Rejected connections get a 429 and are closed.
+func (h *proxyHandler) admitNewConnection(w http.ResponseWriter, r *http.Request) bool {
+	if err := h.state.admitConnection(h.rotator, r.RemoteAddr); err != nil {
+		w.Header().Set("Connection", "close")
+		writeTrafficLimitError(w, err)
+		return false
+	}
+	return true
+}
+
+func writeTrafficLimitError(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	switch {
+	case errors.Is(err, errRotatorTunnelLimit):
+		http.Error(w, "Too many open tunnels", http.StatusTooManyRequests)
+	case errors.Is(err, errRotatorConnectionRate):
+		http.Error(w, "Too many new connections", http.StatusTooManyRequests)
+	default:
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	}
+}
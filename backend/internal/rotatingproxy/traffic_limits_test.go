@@ -0,0 +1,140 @@
+package rotatingproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func TestTrafficLimits_RatesAndTunnels(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limits := newTrafficLimits()
+	limits.now = func() time.Time { return now }
+
+	rotator := domain.RotatingProxy{ID: 1, ConnectionsPerSecond: 2, RequestsPerSecond: 1, MaxTunnels: 1}
+	for i := range 2 {
+		if err := limits.admit(rotator, "198.51.100.1:4000", trafficLimitConnections); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+	}
+	if err := limits.admit(rotator, "198.51.100.2:4000", trafficLimitConnections); !errors.Is(err, errRotatorConnectionRate) {
+		t.Fatalf("third connection: err = %v, want errRotatorConnectionRate", err)
+	}
+	if err := limits.admit(rotator, "198.51.100.1:4000", trafficLimitRequests); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if err := limits.admit(rotator, "198.51.100.1:4000", trafficLimitRequests); !errors.Is(err, errRotatorRequestRate) {
+		t.Fatalf("second request: err = %v, want errRotatorRequestRate", err)
+	}
+
+	now = now.Add(time.Second)
+	if err := limits.admit(rotator, "198.51.100.1:4000", trafficLimitConnections); err != nil {
+		t.Fatalf("connection in the next window: %v", err)
+	}
+
+	release, err := limits.acquireTunnel(rotator, "198.51.100.1:4000")
+	if err != nil {
+		t.Fatalf("first tunnel: %v", err)
+	}
+	if _, err := limits.acquireTunnel(rotator, "198.51.100.2:4000"); !errors.Is(err, errRotatorTunnelLimit) {
+		t.Fatalf("second tunnel: err = %v, want errRotatorTunnelLimit", err)
+	}
+
+	rotator.LimitScope = database.RotatingProxyLimitScopeClientIP
+	releaseOther, err := limits.acquireTunnel(rotator, "198.51.100.2:4000")
+	if err != nil {
+		t.Fatalf("tunnel of another client ip: %v", err)
+	}
+	releaseOther()
+
+	rotator.LimitScope = database.RotatingProxyLimitScopeRotator
+	now = now.Add(time.Second)
+	release()
+	release()
+	if release, err := limits.acquireTunnel(rotator, "198.51.100.2:4000"); err != nil {
+		t.Fatalf("tunnel after release: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestHandlers_RejectTrafficAboveLimits(t *testing.T) {
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "")})
+	server := newProxyServer(domain.RotatingProxy{
+		ID:                   1,
+		Protocol:             domain.Protocol{Name: "http"},
+		ConnectionsPerSecond: 1,
+		RequestsPerSecond:    1,
+		MaxTunnels:           1,
+	})
+	t.Cleanup(server.Stop)
+	server.state.limits.now = func() time.Time { return time.Unix(1700000000, 0) }
+	rotator := server.config()
+
+	if err := server.state.admitRequest(rotator, "192.0.2.1:4000"); err != nil {
+		t.Fatalf("admitRequest: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	server.httpHandler.Load().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("request above rate: status = %d, want 429 with Retry-After", recorder.Code)
+	}
+
+	release, err := server.state.acquireTunnel(rotator, "192.0.2.1:4000")
+	if err != nil {
+		t.Fatalf("acquireTunnel: %v", err)
+	}
+	defer release()
+
+	client, conn := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	go server.socksHandler.Load().handleSocks5(conn)
+
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+		t.Fatalf("read greeting response: %v", err)
+	}
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x00, 0x50}); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x02 {
+		t.Fatalf("socks5 reply = %v, err = %v, want code 0x02", reply, err)
+	}
+}
+
+func TestProxyHandler_CountsConnectionRateOncePerConnection(t *testing.T) {
+	handler := &proxyHandler{
+		rotator: domain.RotatingProxy{ID: 1, ConnectionsPerSecond: 1},
+		state:   newRotatorState(),
+	}
+	handler.state.limits.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	first := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	first = first.WithContext(withClientConn(first.Context()))
+	if !firstClientRequest(first) || !handler.admitNewConnection(httptest.NewRecorder(), first) {
+		t.Fatal("first connection was not admitted")
+	}
+	if firstClientRequest(first) {
+		t.Fatal("keep-alive request was counted as a new connection")
+	}
+
+	second := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	second = second.WithContext(withClientConn(second.Context()))
+	recorder := httptest.NewRecorder()
+	if !firstClientRequest(second) || handler.admitNewConnection(recorder, second) {
+		t.Fatal("second connection within the same second was admitted")
+	}
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Connection") != "close" {
+		t.Fatalf("status = %d, connection = %q, want 429 and close", recorder.Code, recorder.Header().Get("Connection"))
+	}
+}
@@ -0,0 +1,244 @@
+package rotatingproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+
+	"magpie/internal/api/dto"
+)
+
+// isUpgradeRequest reports whether r asks the target to switch protocols,
+// e.g. a WebSocket handshake for a ws:// URL or an h2c upgrade.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.ProtoMajor != 1 || strings.TrimSpace(r.Header.Get("Upgrade")) == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for token := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleUpgrade forwards a plain HTTP request that asks to switch protocols.
+// Once the upstream answers 101 the client connection is hijacked and piped
+// to the upstream connection, which counts as a tunnel; any other answer is
+// relayed like a normal response.
+func (h *proxyHandler) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	targetURL := requestTargetURL(r)
+	defaultPort := uint16(80)
+	if strings.EqualFold(targetURL.Scheme, "https") {
+		defaultPort = 443
+	}
+	if !h.state.targetAllowed(targetURL.Host, defaultPort) {
+		http.Error(w, "Destination not allowed", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	releaseTunnel, err := h.state.acquireTunnel(h.rotator, r.RemoteAddr)
+	if err != nil {
+		writeTrafficLimitError(w, err)
+		return
+	}
+	defer releaseTunnel()
+
+	routing := clientRoutingFromContext(r.Context())
+	var tried []uint64
+	for attempt := 0; ; attempt++ {
+		next, err := h.state.nextUpstream(h.rotator, routing, tried...)
+		if err != nil {
+			if attempt == 0 {
+				recordUpstreamFailure(h.rotator, routing, 0, usageFailureNoUpstream)
+			}
+			http.Error(w, "failed to acquire upstream proxy", http.StatusBadGateway)
+			return
+		}
+
+		if !supportedUpstream(next.Protocol) {
+			http.Error(w, "upstream protocol not supported by rotator", http.StatusBadGateway)
+			return
+		}
+
+		if err := h.state.checkProxiedTarget(targetURL.Host, defaultPort, next); err != nil {
+			if errors.Is(err, errDestinationBlocked) {
+				http.Error(w, "Destination not allowed", http.StatusForbidden)
+				return
+			}
+			recordUpstreamFailure(h.rotator, routing, 0, usageFailureConnect)
+			http.Error(w, "failed to resolve target host", http.StatusBadGateway)
+			return
+		}
+
+		newReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL.String(), nil)
+		if err != nil {
+			http.Error(w, "failed to build upstream request", http.StatusInternalServerError)
+			return
+		}
+		newReq.Header = r.Header.Clone()
+		newReq.Header.Del("Proxy-Authorization")
+		applyRequestHeaderRules(h.rotator, newReq.Header)
+
+		// The upgraded connection belongs to the client afterwards, so it
+		// never comes from or returns to the keep-alive transports.
+		transport := observeUpstreamDials(buildHTTPTransportWithConnector(next, h.state.upstreamConnector()))
+		release := h.state.acquireUpstream(next.ProxyID)
+		resp, dialed, handshake, err := roundTripUpstream(newReq, transport)
+		if err == nil {
+			observeUpstream(next.ProxyID, true, handshake)
+			defer release()
+			h.relayUpgrade(w, hijacker, routing, next, resp)
+			return
+		}
+		release()
+
+		if r.Context().Err() != nil {
+			// The client left. Neither the upstream nor the target failed.
+			return
+		}
+		if errors.Is(err, errParentProxyFailed) {
+			recordUpstreamFailure(h.rotator, routing, 0, connectFailureCategory(err))
+			log.Warn("rotating proxy: parent proxy failed", "rotator_id", h.rotator.ID, "error", err)
+			http.Error(w, "parent proxy request failed", http.StatusBadGateway)
+			return
+		}
+		if errors.Is(err, errTargetUnresolved) {
+			recordUpstreamFailure(h.rotator, routing, 0, usageFailureConnect)
+			http.Error(w, "failed to resolve target host", http.StatusBadGateway)
+			return
+		}
+		if errors.Is(err, errDestinationBlocked) {
+			http.Error(w, "Destination not allowed", http.StatusForbidden)
+			return
+		}
+		if isTargetFailure(err) {
+			observeTargetFailure(next.ProxyID)
+			recordUpstreamFailure(h.rotator, routing, 0, usageFailureConnect)
+			setUpstreamHeaders(h.rotator, w.Header(), next)
+			http.Error(w, "upstream could not reach the target", http.StatusBadGateway)
+			return
+		}
+		if isUpstreamTimeout(r.Context(), err, dialed) {
+			recordUpstreamFailure(h.rotator, routing, next.ProxyID, usageFailureTimeout)
+			setUpstreamHeaders(h.rotator, w.Header(), next)
+			http.Error(w, "upstream proxy timed out", http.StatusGatewayTimeout)
+			return
+		}
+		if isTargetTLSError(err) {
+			observeTargetTLSError(next.ProxyID)
+		} else if !dialed {
+			observeUpstream(next.ProxyID, false, 0)
+		}
+		h.state.upstreamFailed(h.rotator, routing, next.ProxyID)
+		if dialed {
+			recordUpstreamFailure(h.rotator, routing, next.ProxyID, usageFailureResponse)
+		} else {
+			recordUpstreamFailure(h.rotator, routing, next.ProxyID, connectFailureCategory(err))
+		}
+
+		// Upgrade requests carry no body, so every failed handshake may be
+		// replayed on another upstream.
+		if attempt < rotatorFailoverRetries(h.rotator) && r.Context().Err() == nil {
+			tried = append(tried, next.ProxyID)
+			continue
+		}
+
+		log.Warn("rotating proxy: upstream upgrade failed",
+			"rotator_id", h.rotator.ID,
+			"upstream_protocol", next.Protocol,
+			"upstream", net.JoinHostPort(next.IP, strconv.Itoa(int(next.Port))),
+			"attempts", attempt+1,
+			"error", err,
+		)
+		setUpstreamHeaders(h.rotator, w.Header(), next)
+		http.Error(w, "upstream proxy request failed", http.StatusBadGateway)
+		return
+	}
+}
+
+// relayUpgrade hands the upstream's answer to an upgrade request to the
+// client. When the upstream switched protocols both connections are piped
+// until either side closes.
+func (h *proxyHandler) relayUpgrade(w http.ResponseWriter, hijacker http.Hijacker, routing clientRouting, next *dto.RotatingProxyNext, resp *http.Response) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		copyHeaders(w.Header(), resp.Header)
+		setUpstreamHeaders(h.rotator, w.Header(), next)
+		w.WriteHeader(resp.StatusCode)
+		down, err := io.Copy(w, resp.Body)
+		if err != nil {
+			log.Warn("rotating proxy: failed to copy response body", "rotator_id", h.rotator.ID, "error", err)
+		}
+		h.state.recordTraffic(h.rotator, routing, next.ProxyID, 0, down)
+		return
+	}
+
+	upConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "upstream connection cannot be upgraded", http.StatusBadGateway)
+		return
+	}
+
+	clientConn, buf, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "failed to hijack connection", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := clientConn.Close(); err != nil {
+			log.Debug("rotating proxy: client connection close", "error", err)
+		}
+	}()
+
+	setUpstreamHeaders(h.rotator, resp.Header, next)
+	applyConnDeadline(clientConn, rotatorHandshakeTimeout(h.rotator))
+	fmt.Fprintf(buf, "HTTP/1.1 %s\r\n", resp.Status)
+	_ = resp.Header.Write(buf)
+	_, _ = buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		return
+	}
+	clearConnDeadline(clientConn)
+
+	// Bytes the client sent right behind its request were already buffered
+	// by the server and have to reach the upstream before the relay starts.
+	var early int64
+	if buffered := buf.Reader.Buffered(); buffered > 0 {
+		pending, _ := buf.Reader.Peek(buffered)
+		n, err := upConn.Write(pending)
+		early = int64(n)
+		if err != nil {
+			h.state.recordTraffic(h.rotator, routing, next.ProxyID, early, 0)
+			return
+		}
+	}
+
+	meter := h.state.tunnelMeter(routing)
+	if meter != nil && !meter(early) {
+		recordUpstreamTraffic(h.rotator, routing, next.ProxyID, early, 0)
+		return
+	}
+
+	defer h.state.trackTunnel(clientConn, upConn)()
+	up, down := pipeMeteredConnections(clientConn, upConn, meter)
+	recordUpstreamTraffic(h.rotator, routing, next.ProxyID, early+up, down)
+}
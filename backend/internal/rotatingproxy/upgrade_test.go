@@ -0,0 +1,212 @@
+package rotatingproxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+const testWebSocketKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// newWebSocketEchoServer answers WebSocket handshakes and echoes every text
+// frame back to the client.
+func newWebSocketEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !isUpgradeRequest(r) || key == "" {
+			http.Error(w, "websocket handshake expected", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack echo connection: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+		if err := buf.Flush(); err != nil {
+			return
+		}
+		for {
+			payload, err := readWebSocketFrame(buf.Reader)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(webSocketFrame(payload, false)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// webSocketFrame encodes a short final text frame, masked as clients must.
+func webSocketFrame(payload []byte, masked bool) []byte {
+	frame := []byte{0x81, byte(len(payload))}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame[1] |= 0x80
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readWebSocketFrame decodes a short frame and unmasks its payload.
+func readWebSocketFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1] & 0x7f)
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(reader, mask); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if mask != nil {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return payload, nil
+}
+
+// stubDirectUpstream makes every upstream a SOCKS5 proxy that reaches the
+// target directly.
+func stubDirectUpstream(t *testing.T) {
+	t.Helper()
+	originalGetNext := getNextRotatingProxyFunc
+	getNextRotatingProxyFunc = func(uint, uint64, database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		return &dto.RotatingProxyNext{ProxyID: 17, IP: "192.0.2.10", Port: 1080, Protocol: "socks5"}, nil
+	}
+	t.Cleanup(func() { getNextRotatingProxyFunc = originalGetNext })
+
+	originalConnect := connectThroughUpstreamFunc
+	connectThroughUpstreamFunc = func(target string, _ *dto.RotatingProxyNext) (net.Conn, error) {
+		return net.DialTimeout("tcp", target, 2*time.Second)
+	}
+	t.Cleanup(func() { connectThroughUpstreamFunc = originalConnect })
+}
+
+func TestProxyHandler_RelaysWebSocketUpgrade(t *testing.T) {
+	stubDirectUpstream(t)
+	echo := newWebSocketEchoServer(t)
+	proxy := httptest.NewServer(&proxyHandler{rotator: domain.RotatingProxy{ID: 1, UpstreamIDHeader: "X-Magpie-Upstream-Id"}})
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target, _ := url.Parse(echo.URL)
+	request := "GET http://" + target.Host + "/echo HTTP/1.1\r\nHost: " + target.Host + "\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + testWebSocketKey + "\r\n\r\n"
+	// The first frame travels in the same write as the handshake and is
+	// buffered by the proxy before the connection is upgraded.
+	if _, err := conn.Write(append([]byte(request), webSocketFrame([]byte("early"), true)...)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		t.Fatalf("read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != webSocketAccept(testWebSocketKey) {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+	if got := resp.Header.Get("X-Magpie-Upstream-Id"); got != "17" {
+		t.Fatalf("X-Magpie-Upstream-Id = %q, want 17", got)
+	}
+
+	if payload, err := readWebSocketFrame(reader); err != nil || string(payload) != "early" {
+		t.Fatalf("echo of pipelined frame = %q, err = %v", payload, err)
+	}
+	if _, err := conn.Write(webSocketFrame([]byte("hello"), true)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+	if payload, err := readWebSocketFrame(reader); err != nil || string(payload) != "hello" {
+		t.Fatalf("echo = %q, err = %v, want hello", payload, err)
+	}
+}
+
+func TestProxyHandler_RelaysRejectedUpgrade(t *testing.T) {
+	stubDirectUpstream(t)
+	echo := newWebSocketEchoServer(t)
+	proxy := httptest.NewServer(&proxyHandler{rotator: domain.RotatingProxy{ID: 1}})
+	t.Cleanup(proxy.Close)
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	request, _ := http.NewRequest(http.MethodGet, echo.URL+"/echo", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || string(body) != "websocket handshake expected\n" {
+		t.Fatalf("status = %d, body = %q, want the echo server's 400", resp.StatusCode, body)
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	cases := []struct {
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{connection: "Upgrade", upgrade: "websocket", want: true},
+		{connection: "keep-alive, upgrade", upgrade: "h2c", want: true},
+		{connection: "keep-alive", upgrade: "websocket", want: false},
+		{connection: "Upgrade", upgrade: "", want: false},
+	}
+	for _, tc := range cases {
+		request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		request.Header.Set("Connection", tc.connection)
+		request.Header.Set("Upgrade", tc.upgrade)
+		if got := isUpgradeRequest(request); got != tc.want {
+			t.Errorf("isUpgradeRequest(Connection: %q, Upgrade: %q) = %v, want %v", tc.connection, tc.upgrade, got, tc.want)
+		}
+	}
+}
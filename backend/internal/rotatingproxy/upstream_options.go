@@ -0,0 +1,111 @@
+package rotatingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+// errTargetUnresolved marks targets a rotator in local DNS mode could not
+// resolve. The upstream is not at fault, so it is not cooled down.
+var errTargetUnresolved = errors.New("target host could not be resolved")
+
+var lookupTargetIPsFunc = net.DefaultResolver.LookupIPAddr
+
+// rotatorHandshakeTimeout bounds the handshakes of a rotator's clients and
+// upstreams.
+func rotatorHandshakeTimeout(rotator domain.RotatingProxy) time.Duration {
+	if rotator.HandshakeTimeoutMS > 0 {
+		return time.Duration(rotator.HandshakeTimeoutMS) * time.Millisecond
+	}
+	return handshakeTimeout
+}
+
+// rotatorUpstreamTimeout bounds a plain HTTP request of the rotator until
+// the upstream answered.
+func rotatorUpstreamTimeout(rotator domain.RotatingProxy) time.Duration {
+	if rotator.UpstreamTimeoutMS > 0 {
+		return time.Duration(rotator.UpstreamTimeoutMS) * time.Millisecond
+	}
+	return upstreamTimeout
+}
+
+func hopHandshakeTimeout(hop *dto.RotatingProxyNext) time.Duration {
+	if hop != nil && hop.HandshakeTimeout > 0 {
+		return hop.HandshakeTimeout
+	}
+	return handshakeTimeout
+}
+
+func hopUpstreamTimeout(hop *dto.RotatingProxyNext) time.Duration {
+	if hop != nil && hop.UpstreamTimeout > 0 {
+		return hop.UpstreamTimeout
+	}
+	return upstreamTimeout
+}
+
+// forRotator returns a copy of next that is dialed through the rotator's
+// parent proxy with the rotator's timeouts and DNS mode. Cached upstreams
+// are shared, so next itself is left alone.
+func forRotator(rotator domain.RotatingProxy, next *dto.RotatingProxyNext) *dto.RotatingProxyNext {
+	if next == nil {
+		return nil
+	}
+	bound := *viaParent(rotator, next)
+	bound.HandshakeTimeout = time.Duration(rotator.HandshakeTimeoutMS) * time.Millisecond
+	bound.UpstreamTimeout = time.Duration(rotator.UpstreamTimeoutMS) * time.Millisecond
+	bound.DNSMode = database.RotatingProxyDNSModeRemote
+	if strings.EqualFold(rotator.DNSMode, database.RotatingProxyDNSModeLocal) {
+		bound.DNSMode = database.RotatingProxyDNSModeLocal
+	}
+	if bound.Parent != nil {
+		bound.Parent.HandshakeTimeout = bound.HandshakeTimeout
+	}
+	return &bound
+}
+
+// resolveUpstreamTarget applies the DNS mode of next to target. In remote
+// mode host names go to the upstream unchanged. In local mode they are looked
+// up on this host and replaced by an address, IPv4 first since SOCKS4
+// upstreams take nothing else.
+func resolveUpstreamTarget(target string, next *dto.RotatingProxyNext) (string, error) {
+	if next == nil || next.DNSMode != database.RotatingProxyDNSModeLocal {
+		return target, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return target, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hopHandshakeTimeout(next))
+	defer cancel()
+	addresses, err := lookupTargetIPsFunc(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", errTargetUnresolved, host, err)
+	}
+
+	var picked net.IP
+	for _, address := range addresses {
+		if v4 := address.IP.To4(); v4 != nil {
+			picked = v4
+			break
+		}
+		if picked == nil {
+			picked = address.IP
+		}
+	}
+	if picked == nil {
+		return "", fmt.Errorf("%w: %s has no addresses", errTargetUnresolved, host)
+	}
+	return net.JoinHostPort(picked.String(), port), nil
+}
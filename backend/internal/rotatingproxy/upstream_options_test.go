@@ -0,0 +1,191 @@
+package rotatingproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func stubTargetLookup(t *testing.T, lookup func(context.Context, string) ([]net.IPAddr, error)) {
+	t.Helper()
+	original := lookupTargetIPsFunc
+	lookupTargetIPsFunc = lookup
+	t.Cleanup(func() { lookupTargetIPsFunc = original })
+}
+
+func TestForRotator_CarriesUpstreamOptions(t *testing.T) {
+	rotator := domain.RotatingProxy{
+		HandshakeTimeoutMS: 2500,
+		UpstreamTimeoutMS:  90000,
+		DNSMode:            "LOCAL",
+		ParentProtocol:     "http",
+		ParentHost:         "egress.internal",
+		ParentPort:         3128,
+	}
+	next := &dto.RotatingProxyNext{ProxyID: 1, IP: "192.0.2.10", Port: 1080, Protocol: "socks5"}
+
+	bound := forRotator(rotator, next)
+	if bound == next || next.Parent != nil || next.HandshakeTimeout != 0 {
+		t.Fatal("forRotator modified the shared upstream")
+	}
+	if bound.HandshakeTimeout != 2500*time.Millisecond || bound.UpstreamTimeout != 90*time.Second {
+		t.Fatalf("timeouts = %s, %s, want 2.5s, 1m30s", bound.HandshakeTimeout, bound.UpstreamTimeout)
+	}
+	if bound.DNSMode != database.RotatingProxyDNSModeLocal {
+		t.Fatalf("dns mode = %q, want local", bound.DNSMode)
+	}
+	if bound.Parent == nil || bound.Parent.HandshakeTimeout != bound.HandshakeTimeout {
+		t.Fatalf("parent = %+v, want the rotator's handshake timeout", bound.Parent)
+	}
+
+	transport := buildHTTPTransport(bound)
+	if transport.TLSHandshakeTimeout != 2500*time.Millisecond || transport.ResponseHeaderTimeout != 90*time.Second {
+		t.Fatalf("transport timeouts = %s, %s", transport.TLSHandshakeTimeout, transport.ResponseHeaderTimeout)
+	}
+	if got := rotatorUpstreamTimeout(domain.RotatingProxy{}); got != upstreamTimeout {
+		t.Fatalf("default upstream timeout = %s, want %s", got, upstreamTimeout)
+	}
+	if got := forRotator(domain.RotatingProxy{}, next).DNSMode; got != database.RotatingProxyDNSModeRemote {
+		t.Fatalf("default dns mode = %q, want remote", got)
+	}
+}
+
+func TestConnectThroughUpstream_DNSModes(t *testing.T) {
+	_, echoPort, err := net.SplitHostPort(serveEcho(t))
+	if err != nil {
+		t.Fatalf("split echo address: %v", err)
+	}
+	targets := make(chan string, 1)
+	proxyHost, proxyPort := serveSocks5Proxy(t, "user", "pass", targets)
+	upstream := func(mode string) *dto.RotatingProxyNext {
+		return forRotator(domain.RotatingProxy{DNSMode: mode}, &dto.RotatingProxyNext{
+			ProxyID: 1, IP: proxyHost, Port: proxyPort, Username: "user", Password: "pass", HasAuth: true, Protocol: "socks5",
+		})
+	}
+
+	stubTargetLookup(t, func(context.Context, string) ([]net.IPAddr, error) {
+		t.Error("remote dns mode looked up the target on this host")
+		return nil, errors.New("unexpected lookup")
+	})
+	conn, err := connectThroughUpstream(net.JoinHostPort("localhost", echoPort), upstream(database.RotatingProxyDNSModeRemote))
+	if err != nil {
+		t.Fatalf("remote mode: %v", err)
+	}
+	_ = conn.Close()
+	if got := <-targets; got != net.JoinHostPort("localhost", echoPort) {
+		t.Fatalf("remote mode sent %q, want the host name", got)
+	}
+
+	stubTargetLookup(t, func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host != "echo.test" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	})
+	conn, err = connectThroughUpstream(net.JoinHostPort("echo.test", echoPort), upstream(database.RotatingProxyDNSModeLocal))
+	if err != nil {
+		t.Fatalf("local mode: %v", err)
+	}
+	defer conn.Close()
+	if got := <-targets; got != net.JoinHostPort("127.0.0.1", echoPort) {
+		t.Fatalf("local mode sent %q, want the resolved IPv4 address", got)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo = %q, err = %v, want ping", reply, err)
+	}
+
+	_, err = connectThroughUpstream("unknown.test:80", upstream(database.RotatingProxyDNSModeLocal))
+	if !errors.Is(err, errTargetUnresolved) {
+		t.Fatalf("unresolvable target: err = %v, want errTargetUnresolved", err)
+	}
+	if reply := socks5FailureReply(err); reply != 0x04 {
+		t.Fatalf("socks5 reply = %#x, want host unreachable", reply)
+	}
+}
+
+func TestConnectWithFailover_DoesNotBlameUpstreamsForUnresolvedTargets(t *testing.T) {
+	selections := stubSequentialUpstreams(t)
+	stubTargetLookup(t, func(context.Context, string) ([]net.IPAddr, error) {
+		return nil, errors.New("no such host")
+	})
+
+	rotator := domain.RotatingProxy{ID: 1, DNSMode: database.RotatingProxyDNSModeLocal}
+	state := newRotatorState()
+	_, _, err := state.connectWithFailover(rotator, clientRouting{}, "example.invalid:443")
+	if !errors.Is(err, errTargetUnresolved) {
+		t.Fatalf("err = %v, want errTargetUnresolved", err)
+	}
+	if len(*selections) != 1 {
+		t.Fatalf("upstream selections = %d, want 1 without retries", len(*selections))
+	}
+	if cooling := state.exclusions.active(time.Now()); len(cooling) != 0 {
+		t.Fatalf("cooling upstreams = %v, want none", cooling)
+	}
+}
+
+func TestUDPRelay_ResolvesHostNamesInLocalMode(t *testing.T) {
+	stubTargetLookup(t, func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host == "internal.test" {
+			return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.7")}}, nil
+	})
+	rules := newDestinationRules(domain.RotatingProxy{BlockedDestinations: domain.StringList{"10.0.0.0/8"}})
+	relayFor := func(mode string) *udpRelay {
+		next := forRotator(domain.RotatingProxy{DNSMode: mode}, &dto.RotatingProxyNext{ProxyID: 1, Protocol: "socks5"})
+		return &udpRelay{resolve: func(target string) (string, error) { return rules.resolve(target, next) }}
+	}
+	datagramTo := func(host string) ([]byte, int) {
+		datagram := append([]byte{0x00, 0x00, 0x00, 0x03, byte(len(host))}, host...)
+		datagram = append(datagram, 0x00, 0x35, 'q')
+		return datagram, len(datagram) - 1
+	}
+
+	datagram, headerLen := datagramTo("dns.test")
+	rewritten, rewrittenLen, ok := relayFor(database.RotatingProxyDNSModeLocal).resolveDatagram(datagram, headerLen)
+	if !ok {
+		t.Fatal("local mode dropped a resolvable datagram")
+	}
+	if host, port := socks5UDPDestination(rewritten[:rewrittenLen]); host != "192.0.2.7" || port != 53 || string(rewritten[rewrittenLen:]) != "q" {
+		t.Fatalf("rewritten datagram = %s:%d %q, want 192.0.2.7:53 with the payload", host, port, rewritten[rewrittenLen:])
+	}
+
+	datagram, headerLen = datagramTo("internal.test")
+	if _, _, ok := relayFor(database.RotatingProxyDNSModeLocal).resolveDatagram(datagram, headerLen); ok {
+		t.Fatal("local mode relayed a datagram to a blocked address")
+	}
+
+	datagram, headerLen = datagramTo("dns.test")
+	kept, keptLen, ok := relayFor(database.RotatingProxyDNSModeRemote).resolveDatagram(datagram, headerLen)
+	if !ok || keptLen != headerLen || string(kept) != string(datagram) {
+		t.Fatalf("remote mode rewrote the datagram to %v", kept)
+	}
+}
+
+func TestDialProxyAddress_UsesHandshakeTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	next := forRotator(domain.RotatingProxy{HandshakeTimeoutMS: 200}, &dto.RotatingProxyNext{ProxyID: 1, Protocol: "socks5"})
+
+	started := time.Now()
+	// 192.0.2.0/24 is reserved for documentation and never answers.
+	conn, err := dialProxyWithFallback(ctx, "tcp", "192.0.2.1:9", next)
+	if err == nil {
+		_ = conn.Close()
+		t.Skip("the documentation range answered on this network")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("dial gave up after %s, want the 200ms handshake timeout", elapsed)
+	}
+}
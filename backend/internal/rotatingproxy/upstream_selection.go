@@ -0,0 +1,282 @@
+package rotatingproxy
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+// rotatorState holds the in-process state shared by every listener of a
+// single rotator.
+type rotatorState struct {
+	sessions    *stickySessionStore
+	pool        atomic.Pointer[candidatePool]
+	exclusions  *upstreamExclusions
+	rules       atomic.Pointer[destinationRules]
+	credentials *credentialLimits
+	holds       *rotationHolds
+	limits      *trafficLimits
+	transports  *upstreamTransports
+	tunnels     *openTunnels
+
+	activeMu sync.Mutex
+	active   map[uint64]int
+}
+
+func newRotatorState() *rotatorState {
+	return &rotatorState{
+		sessions:    newStickySessionStore(),
+		exclusions:  newUpstreamExclusions(),
+		credentials: newCredentialLimits(),
+		holds:       newRotationHolds(),
+		limits:      newTrafficLimits(),
+		transports:  newUpstreamTransports(),
+		tunnels:     newOpenTunnels(),
+		active:      make(map[uint64]int),
+	}
+}
+
+// newPooledRotatorState serves upstreams from an in-memory candidate pool
+// instead of a locking database transaction per connection.
+func newPooledRotatorState(rotator domain.RotatingProxy) *rotatorState {
+	state := newRotatorState()
+	state.pool.Store(newCandidatePool(rotator))
+	state.rules.Store(newDestinationRules(rotator))
+	state.credentials.sync(rotator.Credentials)
+	return state
+}
+
+// reconfigure switches the state to an edited rotator. The candidate pool is
+// rebuilt for the new filters, keeping its rotation cursor, and sticky
+// sessions and held upstreams are dropped because their upstreams may no
+// longer qualify.
+// Connections that already hold an upstream are not affected.
+func (s *rotatorState) reconfigure(rotator domain.RotatingProxy) {
+	if s == nil {
+		return
+	}
+
+	if previous := s.pool.Load(); previous != nil {
+		pool := newCandidatePool(rotator)
+		if cursor := previous.cursor(); cursor != nil {
+			pool.lastProxyID = cursor
+		}
+		if old := s.pool.Swap(pool); old != nil {
+			old.flushRotation()
+		}
+	}
+	s.sessions.clear()
+	s.holds.clear()
+	s.transports.clear()
+	s.rules.Store(newDestinationRules(rotator))
+	s.credentials.sync(rotator.Credentials)
+}
+
+func (s *rotatorState) close() {
+	if s == nil {
+		return
+	}
+	if pool := s.pool.Load(); pool != nil {
+		pool.flushRotation()
+	}
+	s.transports.clear()
+}
+
+func (s *rotatorState) stickySessions() *stickySessionStore {
+	if s == nil {
+		return nil
+	}
+	return s.sessions
+}
+
+// nextUpstream picks the upstream for a client connection. tried lists
+// upstreams that already failed for this connection and are never retried;
+// upstreams in the rotator-wide failover cooldown are skipped unless nothing
+// else is left. Unless the rotator rotates per request, the upstream picked
+// last for the client's login and filters is reused until rotation is due.
+// Pinned and held upstreams that were tried, are cooling down or left the
+// pool are released instead.
+// The returned upstream is dialed through the rotator's parent proxy, if any.
+func (s *rotatorState) nextUpstream(rotator domain.RotatingProxy, routing clientRouting, tried ...uint64) (*dto.RotatingProxyNext, error) {
+	sessions := s.stickySessions()
+	key := routing.sessionKey()
+	now := time.Now()
+
+	var cooling []uint64
+	if s != nil {
+		cooling = s.exclusions.active(now)
+	}
+	usable := func(proxyID uint64) bool {
+		return !slices.Contains(tried, proxyID) && !slices.Contains(cooling, proxyID) && s.poolContains(proxyID)
+	}
+
+	if next, ok := sessions.get(key, now); ok {
+		if usable(next.ProxyID) {
+			return forRotator(rotator, next), nil
+		}
+		sessions.forget(key)
+	}
+
+	selection := routing.selection()
+	if s != nil && rotator.SelectionStrategy == database.RotatingProxyStrategyLeastConnections {
+		selection.ActiveConnections = s.activeConnectionCounts()
+	}
+
+	rotation := database.RotatingProxyRotationOf(rotator)
+	holdKey := routing.rotationKey()
+	if s != nil {
+		held, ok := s.holds.take(rotation, holdKey, now, usable)
+		if ok {
+			sessions.put(key, held, stickySessionTTL(rotator.StickySessionTTLSeconds), now)
+			return forRotator(rotator, held), nil
+		}
+	}
+
+	selection.ExcludeProxyIDs = append(append([]uint64(nil), tried...), cooling...)
+	next, err := s.selectUpstream(rotator, selection)
+	if errors.Is(err, database.ErrRotatingProxyNoAliveProxies) && len(cooling) > 0 {
+		selection.ExcludeProxyIDs = tried
+		next, err = s.selectUpstream(rotator, selection)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s != nil {
+		s.holds.hold(rotation, holdKey, next, now)
+	}
+	sessions.put(key, next, stickySessionTTL(rotator.StickySessionTTLSeconds), now)
+	return forRotator(rotator, next), nil
+}
+
+// poolContains reports whether an upstream is still alive according to the
+// candidate pool. Without a pool the upstream is assumed alive.
+func (s *rotatorState) poolContains(proxyID uint64) bool {
+	if pool := s.pool.Load(); pool != nil {
+		return pool.contains(proxyID)
+	}
+	return true
+}
+
+func (s *rotatorState) selectUpstream(rotator domain.RotatingProxy, selection database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+	if s != nil {
+		if pool := s.pool.Load(); pool != nil {
+			return pool.next(selection)
+		}
+	}
+	return getNextRotatingProxyFunc(rotator.UserID, rotator.ID, selection)
+}
+
+// upstreamFailed releases a sticky session or held upstream that could not
+// be reached, drops its kept-alive connections and puts the upstream into the
+// failover cooldown so the client's next request is served by a fresh
+// upstream.
+func (s *rotatorState) upstreamFailed(rotator domain.RotatingProxy, routing clientRouting, proxyID uint64) {
+	s.stickySessions().forget(routing.sessionKey())
+	if s != nil {
+		s.holds.forget(proxyID)
+		s.transports.evict(proxyID)
+		s.exclusions.exclude(proxyID, time.Now(), rotatorFailoverCooldown(rotator))
+	}
+}
+
+// upstreamTransport returns the keep-alive transport for plain HTTP requests
+// through next. Without a state or with the cache disabled every request
+// gets its own transport that closes the connection afterwards.
+func (s *rotatorState) upstreamTransport(next *dto.RotatingProxyNext) *http.Transport {
+	if s != nil {
+		if transport := s.transports.get(next, time.Now(), s.poolContains, s.upstreamConnector()); transport != nil {
+			return transport
+		}
+	}
+	return observeUpstreamDials(buildHTTPTransportWithConnector(next, s.upstreamConnector()))
+}
+
+// destinations returns the parsed destination rules of the rotator, nil
+// when it has none.
+func (s *rotatorState) destinations() *destinationRules {
+	if s == nil {
+		return nil
+	}
+	return s.rules.Load()
+}
+
+// targetAllowed applies the rotator's destination rules to a host:port
+// target. Targets without a port default to defaultPort.
+func (s *rotatorState) targetAllowed(target string, defaultPort uint16) bool {
+	return s.destinations().allowsTarget(target, defaultPort)
+}
+
+// checkProxiedTarget applies the rotator's blocked address rules to a target
+// that net/http hands to an HTTP upstream without dialing it through
+// upstreamConnector.
+func (s *rotatorState) checkProxiedTarget(target string, defaultPort uint16, next *dto.RotatingProxyNext) error {
+	return s.destinations().checkProxied(target, defaultPort, next)
+}
+
+// upstreamConnector dials through upstreams with the rotator's current
+// destination rules applied to targets resolved on this host.
+func (s *rotatorState) upstreamConnector() upstreamConnectFunc {
+	connect := connectThroughUpstreamFunc
+	return func(target string, next *dto.RotatingProxyNext) (net.Conn, error) {
+		return s.destinations().connector(connect)(target, next)
+	}
+}
+
+// acquireUpstream records an open client connection on the upstream for the
+// least_connections strategy. The returned func releases it.
+func (s *rotatorState) acquireUpstream(proxyID uint64) func() {
+	if s == nil {
+		return func() {}
+	}
+
+	s.activeMu.Lock()
+	s.active[proxyID]++
+	s.activeMu.Unlock()
+
+	return func() {
+		s.activeMu.Lock()
+		if s.active[proxyID] <= 1 {
+			delete(s.active, proxyID)
+		} else {
+			s.active[proxyID]--
+		}
+		s.activeMu.Unlock()
+	}
+}
+
+// activeConnectionCounts returns a copy of the open connections per
+// upstream, the input of the least_connections strategy.
+func (s *rotatorState) activeConnectionCounts() map[uint64]int {
+	if s == nil {
+		return nil
+	}
+
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	return maps.Clone(s.active)
+}
+
+type clientRoutingContextKey struct{}
+
+func withClientRouting(ctx context.Context, routing clientRouting) context.Context {
+	return context.WithValue(ctx, clientRoutingContextKey{}, routing)
+}
+
+func clientRoutingFromContext(ctx context.Context) clientRouting {
+	if ctx == nil {
+		return clientRouting{}
+	}
+	routing, _ := ctx.Value(clientRoutingContextKey{}).(clientRouting)
+	return routing
+}
@@ -0,0 +1,229 @@
+package rotatingproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/support"
+)
+
+const (
+	envRotatingProxyTransportCacheSize = "ROTATING_PROXY_UPSTREAM_TRANSPORT_CACHE_SIZE"
+	defaultUpstreamTransportCacheSize  = 256
+	upstreamTransportIdleTTL           = 5 * time.Minute
+	upstreamTransportCleanupInterval   = 1 * time.Minute
+	upstreamIdleConnTimeout            = 30 * time.Second
+	upstreamMaxIdleConnsPerHost        = 8
+)
+
+var upstreamTransportCacheSize = loadUpstreamTransportCacheSize()
+
+// upstreamTransportKey identifies an upstream together with everything used
+// to reach it, so edited credentials or a new parent proxy get fresh
+// connections.
+type upstreamTransportKey struct {
+	proxyID  uint64
+	address  string
+	protocol string
+	username string
+	password string
+	parent   string
+}
+
+func upstreamTransportKeyOf(next *dto.RotatingProxyNext) upstreamTransportKey {
+	key := upstreamTransportKey{
+		proxyID:  next.ProxyID,
+		address:  net.JoinHostPort(next.IP, strconv.Itoa(int(next.Port))),
+		protocol: next.Protocol,
+		username: next.Username,
+		password: next.Password,
+	}
+	if parent := next.Parent; parent != nil {
+		key.parent = parent.Protocol + "://" + parent.Username + ":" + parent.Password + "@" +
+			net.JoinHostPort(parent.IP, strconv.Itoa(int(parent.Port)))
+	}
+	return key
+}
+
+type cachedUpstreamTransport struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+// upstreamTransports keeps one keep-alive transport per upstream of a
+// rotator, so plain HTTP requests reuse the connections of the upstream they
+// were rotated to. A connection is never shared between upstreams, which
+// keeps rotation intact. Transports of upstreams that left the candidate pool
+// or stayed idle are closed during maintenance, the least recently used one
+// once the cache is full.
+type upstreamTransports struct {
+	mu          sync.Mutex
+	entries     map[upstreamTransportKey]*cachedUpstreamTransport
+	nextCleanup time.Time
+}
+
+func newUpstreamTransports() *upstreamTransports {
+	return &upstreamTransports{
+		entries:     make(map[upstreamTransportKey]*cachedUpstreamTransport),
+		nextCleanup: time.Now().Add(upstreamTransportCleanupInterval),
+	}
+}
+
+// get returns the cached transport for next, creating it with connect when
+// needed. contains reports whether an upstream is still in the candidate
+// pool. It returns nil when the cache is disabled.
+func (c *upstreamTransports) get(next *dto.RotatingProxyNext, now time.Time, contains func(uint64) bool, connect upstreamConnectFunc) *http.Transport {
+	if c == nil || upstreamTransportCacheSize <= 0 || next == nil {
+		return nil
+	}
+	key := upstreamTransportKeyOf(next)
+
+	c.mu.Lock()
+	evicted := c.maintainLocked(now, contains)
+	entry, ok := c.entries[key]
+	if !ok {
+		for len(c.entries) >= upstreamTransportCacheSize {
+			evicted = append(evicted, c.evictOldestLocked())
+		}
+		entry = &cachedUpstreamTransport{transport: newKeepAliveUpstreamTransport(next, connect)}
+		c.entries[key] = entry
+	}
+	entry.lastUsed = now
+	transport := entry.transport
+	c.mu.Unlock()
+
+	closeUpstreamTransports(evicted)
+	return transport
+}
+
+// evict closes the transports of an upstream, e.g. after it failed.
+func (c *upstreamTransports) evict(proxyID uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	var evicted []*http.Transport
+	for key, entry := range c.entries {
+		if key.proxyID == proxyID {
+			delete(c.entries, key)
+			evicted = append(evicted, entry.transport)
+		}
+	}
+	c.mu.Unlock()
+
+	closeUpstreamTransports(evicted)
+}
+
+func (c *upstreamTransports) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	evicted := make([]*http.Transport, 0, len(c.entries))
+	for _, entry := range c.entries {
+		evicted = append(evicted, entry.transport)
+	}
+	c.entries = make(map[upstreamTransportKey]*cachedUpstreamTransport)
+	c.mu.Unlock()
+
+	closeUpstreamTransports(evicted)
+}
+
+func (c *upstreamTransports) maintainLocked(now time.Time, contains func(uint64) bool) []*http.Transport {
+	if now.Before(c.nextCleanup) {
+		return nil
+	}
+	c.nextCleanup = now.Add(upstreamTransportCleanupInterval)
+
+	var evicted []*http.Transport
+	for key, entry := range c.entries {
+		if now.Sub(entry.lastUsed) <= upstreamTransportIdleTTL && (contains == nil || contains(key.proxyID)) {
+			continue
+		}
+		delete(c.entries, key)
+		evicted = append(evicted, entry.transport)
+	}
+	return evicted
+}
+
+func (c *upstreamTransports) evictOldestLocked() *http.Transport {
+	var (
+		oldestKey upstreamTransportKey
+		oldest    *cachedUpstreamTransport
+	)
+	for key, entry := range c.entries {
+		if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	delete(c.entries, oldestKey)
+	return oldest.transport
+}
+
+func closeUpstreamTransports(transports []*http.Transport) {
+	for _, transport := range transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+func newKeepAliveUpstreamTransport(next *dto.RotatingProxyNext, connect upstreamConnectFunc) *http.Transport {
+	transport := buildHTTPTransportWithConnector(next, connect)
+	transport.DisableKeepAlives = false
+	transport.MaxIdleConnsPerHost = upstreamMaxIdleConnsPerHost
+	transport.IdleConnTimeout = upstreamIdleConnTimeout
+	return observeUpstreamDials(transport)
+}
+
+type upstreamRoundTripKey struct{}
+
+// upstreamRoundTrip records what happened on the way to the upstream during
+// one request. sent is set once a new connection was dialed or the request
+// was written to a reused one, i.e. once bytes may have reached the upstream.
+type upstreamRoundTrip struct {
+	sent      atomic.Bool
+	handshake atomic.Int64
+}
+
+// observeUpstreamDials reports dials of transport to the upstreamRoundTrip
+// of the request that caused them.
+func observeUpstreamDials(transport *http.Transport) *http.Transport {
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		started := time.Now()
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			if trip, ok := ctx.Value(upstreamRoundTripKey{}).(*upstreamRoundTrip); ok {
+				trip.handshake.Store(int64(time.Since(started)))
+				trip.sent.Store(true)
+			}
+		}
+		return conn, err
+	}
+	return transport
+}
+
+func withUpstreamRoundTrip(req *http.Request) (*http.Request, *upstreamRoundTrip) {
+	trip := &upstreamRoundTrip{}
+	ctx := context.WithValue(req.Context(), upstreamRoundTripKey{}, trip)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteHeaders: func() { trip.sent.Store(true) },
+	})
+	return req.WithContext(ctx), trip
+}
+
+func loadUpstreamTransportCacheSize() int {
+	size := support.GetEnvInt(envRotatingProxyTransportCacheSize, defaultUpstreamTransportCacheSize)
+	if size < 0 {
+		return defaultUpstreamTransportCacheSize
+	}
+	return size
+}
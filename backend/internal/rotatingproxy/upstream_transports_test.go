@@ -0,0 +1,100 @@
+package rotatingproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func TestHandleHTTP_ReusesConnectionsOfTheSelectedUpstream(t *testing.T) {
+	var connections atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Host))
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	host, portText, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	port, _ := strconv.Atoi(portText)
+
+	var selected atomic.Uint64
+	selected.Store(1)
+	originalGetNext := getNextRotatingProxyFunc
+	getNextRotatingProxyFunc = func(uint, uint64, database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		return &dto.RotatingProxyNext{ProxyID: selected.Load(), IP: host, Port: uint16(port), Protocol: "http"}, nil
+	}
+	t.Cleanup(func() { getNextRotatingProxyFunc = originalGetNext })
+
+	handler := &proxyHandler{rotator: domain.RotatingProxy{ID: 3}, state: newRotatorState()}
+	t.Cleanup(handler.state.close)
+
+	serve := func() {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handler.handleHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "example.com" {
+			t.Fatalf("status = %d, body = %q", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	for range 3 {
+		serve()
+	}
+	if got := connections.Load(); got != 1 {
+		t.Fatalf("upstream connections for one selected upstream = %d, want 1", got)
+	}
+
+	selected.Store(2)
+	serve()
+	if got := connections.Load(); got != 2 {
+		t.Fatalf("upstream connections after rotating = %d, want a new one for the new upstream", got)
+	}
+
+	handler.state.upstreamFailed(handler.rotator, clientRouting{}, 1)
+	selected.Store(1)
+	serve()
+	if got := connections.Load(); got != 3 {
+		t.Fatalf("upstream connections after a failure = %d, want the failed upstream to reconnect", got)
+	}
+}
+
+func TestUpstreamTransports_EvictsUpstreamsThatLeftThePool(t *testing.T) {
+	cache := newUpstreamTransports()
+	now := time.Now()
+	first := cache.get(&dto.RotatingProxyNext{ProxyID: 1, IP: "192.0.2.1", Port: 8080, Protocol: "http"}, now, nil, nil)
+	cache.get(&dto.RotatingProxyNext{ProxyID: 2, IP: "192.0.2.2", Port: 8080, Protocol: "http"}, now, nil, nil)
+
+	if again := cache.get(&dto.RotatingProxyNext{ProxyID: 1, IP: "192.0.2.1", Port: 8080, Protocol: "http"}, now, nil, nil); again != first {
+		t.Fatal("the same upstream got a second transport")
+	}
+	if changed := cache.get(&dto.RotatingProxyNext{ProxyID: 1, IP: "192.0.2.1", Port: 8080, Protocol: "http", Username: "u", HasAuth: true}, now, nil, nil); changed == first {
+		t.Fatal("an upstream with new credentials reused the old transport")
+	}
+
+	inPool := func(proxyID uint64) bool { return proxyID == 2 }
+	cache.get(&dto.RotatingProxyNext{ProxyID: 2, IP: "192.0.2.2", Port: 8080, Protocol: "http"}, now.Add(upstreamTransportCleanupInterval+time.Second), inPool, nil)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) != 1 {
+		t.Fatalf("cached transports = %d, want only the upstream still in the pool", len(cache.entries))
+	}
+	for key := range cache.entries {
+		if key.proxyID != 2 {
+			t.Fatalf("kept transport of upstream %d", key.proxyID)
+		}
+	}
+}
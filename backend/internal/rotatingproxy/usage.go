@@ -0,0 +1,301 @@
+package rotatingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"magpie/internal/database"
+	"magpie/internal/domain"
+	"magpie/internal/support"
+)
+
+const (
+	envRotatingProxyUsageFlushSeconds  = "ROTATING_PROXY_USAGE_FLUSH_SECONDS"
+	envRotatingProxyUsageRetentionDays = "ROTATING_PROXY_USAGE_RETENTION_DAYS"
+	defaultUsageFlushInterval          = 15 * time.Second
+	defaultUsageRetentionDays          = 90
+	usagePruneInterval                 = time.Hour
+)
+
+// Upstream failure categories, shared by the usage buckets and the
+// magpie_rotating_proxy_upstream_failures_total metric.
+const (
+	usageFailureNoUpstream = "no_upstream"
+	usageFailureConnect    = "connect"
+	usageFailureTimeout    = "timeout"
+	usageFailureResponse   = "response"
+)
+
+var (
+	addRotatingProxyUsageFunc   = database.AddRotatingProxyUsage
+	pruneRotatingProxyUsageFunc = database.PruneRotatingProxyUsage
+	usageFlushInterval          = loadUsageFlushInterval()
+	usageRetentionDays          = support.GetEnvInt(envRotatingProxyUsageRetentionDays, defaultUsageRetentionDays)
+
+	usage = newUsageRecorder()
+
+	usageMetricsOnce sync.Once
+
+	rotatingProxyConnectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "magpie_rotating_proxy_connections_total",
+			Help: "Client connections accepted by rotating proxy listeners.",
+		},
+		[]string{"rotator_id"},
+	)
+
+	rotatingProxyRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "magpie_rotating_proxy_requests_total",
+			Help: "HTTP requests and tunnels forwarded by rotating proxies.",
+		},
+		[]string{"rotator_id"},
+	)
+
+	rotatingProxyBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "magpie_rotating_proxy_bytes_total",
+			Help: "Bytes relayed by rotating proxies, by direction (up = client to upstream).",
+		},
+		[]string{"rotator_id", "direction"},
+	)
+
+	rotatingProxyUpstreamFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "magpie_rotating_proxy_upstream_failures_total",
+			Help: "Rotating proxy upstream failures grouped by category.",
+		},
+		[]string{"rotator_id", "category"},
+	)
+
+	rotatingProxyLimitRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "magpie_rotating_proxy_limit_rejections_total",
+			Help: "Client connections and requests refused by rotator traffic limits.",
+		},
+		[]string{"rotator_id", "limit"},
+	)
+)
+
+type usageKey struct {
+	rotatorID    uint64
+	proxyID      uint64
+	credentialID uint64
+	bucket       time.Time
+}
+
+// usageRecorder aggregates traffic counters in memory and periodically adds
+// them to the hourly usage buckets in the database.
+type usageRecorder struct {
+	mu        sync.Mutex
+	pending   map[usageKey]*domain.RotatingProxyUsage
+	startOnce sync.Once
+	lastPrune time.Time
+}
+
+func newUsageRecorder() *usageRecorder {
+	return &usageRecorder{pending: make(map[usageKey]*domain.RotatingProxyUsage)}
+}
+
+func (u *usageRecorder) add(rotator domain.RotatingProxy, credentialID, proxyID uint64, apply func(*domain.RotatingProxyUsage)) {
+	if rotator.ID == 0 {
+		return
+	}
+	u.startOnce.Do(func() { go u.flushLoop() })
+
+	key := usageKey{
+		rotatorID:    rotator.ID,
+		proxyID:      proxyID,
+		credentialID: credentialID,
+		bucket:       database.RotatingProxyUsageBucketStart(time.Now()),
+	}
+
+	u.mu.Lock()
+	entry, ok := u.pending[key]
+	if !ok {
+		entry = &domain.RotatingProxyUsage{
+			RotatingProxyID: rotator.ID,
+			ProxyID:         proxyID,
+			CredentialID:    credentialID,
+			BucketStart:     key.bucket,
+			UserID:          rotator.UserID,
+		}
+		u.pending[key] = entry
+	}
+	apply(entry)
+	u.mu.Unlock()
+}
+
+func (u *usageRecorder) flushLoop() {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.flush()
+	}
+}
+
+// flush writes the pending counters. Counters that could not be written are
+// kept and retried with the next flush.
+func (u *usageRecorder) flush() {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[usageKey]*domain.RotatingProxyUsage)
+	u.mu.Unlock()
+
+	if len(pending) > 0 {
+		entries := make([]domain.RotatingProxyUsage, 0, len(pending))
+		for _, entry := range pending {
+			entries = append(entries, *entry)
+		}
+		if err := addRotatingProxyUsageFunc(entries); err != nil {
+			log.Warn("rotating proxy usage: failed to store counters", "entries", len(entries), "error", err)
+			u.restore(pending)
+		}
+	}
+
+	u.prune(time.Now())
+}
+
+func (u *usageRecorder) restore(pending map[usageKey]*domain.RotatingProxyUsage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for key, entry := range pending {
+		current, ok := u.pending[key]
+		if !ok {
+			u.pending[key] = entry
+			continue
+		}
+		current.Connections += entry.Connections
+		current.Requests += entry.Requests
+		current.BytesUp += entry.BytesUp
+		current.BytesDown += entry.BytesDown
+		current.NoUpstreamFailures += entry.NoUpstreamFailures
+		current.ConnectFailures += entry.ConnectFailures
+		current.TimeoutFailures += entry.TimeoutFailures
+		current.ResponseFailures += entry.ResponseFailures
+	}
+}
+
+func (u *usageRecorder) prune(now time.Time) {
+	if usageRetentionDays <= 0 {
+		return
+	}
+	u.mu.Lock()
+	due := now.Sub(u.lastPrune) >= usagePruneInterval
+	if due {
+		u.lastPrune = now
+	}
+	u.mu.Unlock()
+	if !due {
+		return
+	}
+
+	cutoff := now.AddDate(0, 0, -usageRetentionDays)
+	if _, err := pruneRotatingProxyUsageFunc(cutoff); err != nil {
+		log.Warn("rotating proxy usage: failed to prune old buckets", "error", err)
+	}
+}
+
+func recordClientConnection(rotator domain.RotatingProxy) {
+	usage.add(rotator, 0, 0, func(entry *domain.RotatingProxyUsage) {
+		entry.Connections++
+	})
+	initUsageMetrics()
+	rotatingProxyConnectionsTotal.WithLabelValues(rotatorMetricLabel(rotator.ID)).Inc()
+}
+
+// recordUpstreamTraffic counts one HTTP request or tunnel served through
+// proxyID. up is the number of bytes sent by the client, down the number of
+// bytes returned to it.
+func recordUpstreamTraffic(rotator domain.RotatingProxy, routing clientRouting, proxyID uint64, up, down int64) {
+	usage.add(rotator, routing.CredentialID, proxyID, func(entry *domain.RotatingProxyUsage) {
+		entry.Requests++
+		entry.BytesUp += up
+		entry.BytesDown += down
+	})
+
+	initUsageMetrics()
+	label := rotatorMetricLabel(rotator.ID)
+	rotatingProxyRequestsTotal.WithLabelValues(label).Inc()
+	rotatingProxyBytesTotal.WithLabelValues(label, "up").Add(float64(up))
+	rotatingProxyBytesTotal.WithLabelValues(label, "down").Add(float64(down))
+}
+
+func recordUpstreamFailure(rotator domain.RotatingProxy, routing clientRouting, proxyID uint64, category string) {
+	usage.add(rotator, routing.CredentialID, proxyID, func(entry *domain.RotatingProxyUsage) {
+		switch category {
+		case usageFailureNoUpstream:
+			entry.NoUpstreamFailures++
+		case usageFailureTimeout:
+			entry.TimeoutFailures++
+		case usageFailureResponse:
+			entry.ResponseFailures++
+		default:
+			entry.ConnectFailures++
+		}
+	})
+	initUsageMetrics()
+	rotatingProxyUpstreamFailuresTotal.WithLabelValues(rotatorMetricLabel(rotator.ID), category).Inc()
+}
+
+// connectFailureCategory tells timeouts apart from other dial failures.
+func connectFailureCategory(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return usageFailureTimeout
+	}
+	return usageFailureConnect
+}
+
+// recordLimitRejection counts a connection or request refused by the
+// rotator's traffic limit. A nil err records nothing.
+func recordLimitRejection(rotator domain.RotatingProxy, limit string, err error) {
+	if err == nil {
+		return
+	}
+	initUsageMetrics()
+	rotatingProxyLimitRejectionsTotal.WithLabelValues(rotatorMetricLabel(rotator.ID), limit).Inc()
+}
+
+// forgetUsageMetrics drops the metric series of a removed rotator.
+func forgetUsageMetrics(rotatorID uint64) {
+	initUsageMetrics()
+	labels := prometheus.Labels{"rotator_id": rotatorMetricLabel(rotatorID)}
+	rotatingProxyConnectionsTotal.DeletePartialMatch(labels)
+	rotatingProxyRequestsTotal.DeletePartialMatch(labels)
+	rotatingProxyBytesTotal.DeletePartialMatch(labels)
+	rotatingProxyUpstreamFailuresTotal.DeletePartialMatch(labels)
+	rotatingProxyLimitRejectionsTotal.DeletePartialMatch(labels)
+}
+
+func initUsageMetrics() {
+	usageMetricsOnce.Do(func() {
+		prometheus.MustRegister(
+			rotatingProxyConnectionsTotal,
+			rotatingProxyRequestsTotal,
+			rotatingProxyBytesTotal,
+			rotatingProxyUpstreamFailuresTotal,
+			rotatingProxyLimitRejectionsTotal,
+		)
+	})
+}
+
+func rotatorMetricLabel(rotatorID uint64) string {
+	return strconv.FormatUint(rotatorID, 10)
+}
+
+func loadUsageFlushInterval() time.Duration {
+	seconds := support.GetEnvInt(envRotatingProxyUsageFlushSeconds, int(defaultUsageFlushInterval/time.Second))
+	if seconds <= 0 {
+		return defaultUsageFlushInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,110 @@
+package rotatingproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"magpie/internal/domain"
+)
+
+func pendingUsage(recorder *usageRecorder, rotatorID, proxyID uint64) domain.RotatingProxyUsage {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	var total domain.RotatingProxyUsage
+	for key, entry := range recorder.pending {
+		if key.rotatorID == rotatorID && key.proxyID == proxyID {
+			total.Requests += entry.Requests
+			total.BytesUp += entry.BytesUp
+			total.BytesDown += entry.BytesDown
+			total.ConnectFailures += entry.ConnectFailures
+			total.ResponseFailures += entry.ResponseFailures
+			total.UserID = entry.UserID
+		}
+	}
+	return total
+}
+
+func TestPipeConnections_CountsBytesPerDirection(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	upstream, upstreamPeer := net.Pipe()
+
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+		_, _ = io.ReadFull(client, make([]byte, 6))
+		_ = client.Close()
+	}()
+	go func() {
+		_, _ = io.ReadFull(upstream, make([]byte, 5))
+		_, _ = upstream.Write([]byte("world!"))
+	}()
+
+	up, down := pipeConnections(clientPeer, upstreamPeer)
+	if up != 5 || down != 6 {
+		t.Fatalf("pipeConnections = (%d, %d), want (5, 6)", up, down)
+	}
+}
+
+func TestHandleHTTP_RecordsUsagePerUpstream(t *testing.T) {
+	stubSequentialUpstreams(t)
+	stubBrokenThenHealthyUpstream(t)
+
+	// Listeners of other tests may still record into the shared recorder, so
+	// this test uses a rotator ID of its own instead of swapping it out.
+	const rotatorID = 4207
+	handler := &proxyHandler{rotator: domain.RotatingProxy{ID: rotatorID, UserID: 7}, state: newRotatorState()}
+	brokenBefore, healthyBefore := pendingUsage(usage, rotatorID, 1), pendingUsage(usage, rotatorID, 2)
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Host = "example.com"
+	handler.handleHTTP(httptest.NewRecorder(), request)
+
+	broken := pendingUsage(usage, rotatorID, 1)
+	if broken.ResponseFailures-brokenBefore.ResponseFailures != 1 || broken.Requests != brokenBefore.Requests {
+		t.Fatalf("broken upstream usage = %+v, want one response failure", broken)
+	}
+	healthy := pendingUsage(usage, rotatorID, 2)
+	if healthy.Requests-healthyBefore.Requests != 1 || healthy.BytesDown-healthyBefore.BytesDown != 2 || healthy.UserID != 7 {
+		t.Fatalf("healthy upstream usage = %+v, want one request with 2 bytes down for user 7", healthy)
+	}
+}
+
+func TestUsageRecorder_KeepsCountersWhenStoreFails(t *testing.T) {
+	recorder := newUsageRecorder()
+	recorder.startOnce.Do(func() {})
+	rotator := domain.RotatingProxy{ID: 3, UserID: 1}
+
+	var stored []domain.RotatingProxyUsage
+	failing := true
+	originalAdd := addRotatingProxyUsageFunc
+	addRotatingProxyUsageFunc = func(entries []domain.RotatingProxyUsage) error {
+		if failing {
+			return errors.New("database unavailable")
+		}
+		stored = append(stored, entries...)
+		return nil
+	}
+	originalRetention := usageRetentionDays
+	usageRetentionDays = 0
+	t.Cleanup(func() {
+		addRotatingProxyUsageFunc = originalAdd
+		usageRetentionDays = originalRetention
+	})
+
+	recorder.add(rotator, 0, 9, func(entry *domain.RotatingProxyUsage) { entry.BytesUp += 10 })
+	recorder.flush()
+	recorder.add(rotator, 0, 9, func(entry *domain.RotatingProxyUsage) { entry.BytesUp += 5 })
+
+	failing = false
+	recorder.flush()
+
+	if len(stored) != 1 || stored[0].BytesUp != 15 || stored[0].RotatingProxyID != 3 {
+		t.Fatalf("stored usage = %+v, want one entry with 15 bytes up", stored)
+	}
+	if pending := pendingUsage(recorder, 3, 9); pending.BytesUp != 0 {
+		t.Fatalf("pending usage after flush = %+v, want empty", pending)
+	}
+}
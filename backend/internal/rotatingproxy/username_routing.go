@@ -0,0 +1,130 @@
+package rotatingproxy
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"magpie/internal/database"
+)
+
+// Clients can append routing parameters to their proxy username, e.g.
+// "user-session-abc123-country-US-type-residential". Parameters are
+// key/value pairs separated by "-"; underscores in values stand for spaces.
+// The rotator parameter names the rotator by ID, which the shared gateway
+// listeners use to tell rotators with the same login apart.
+const (
+	routingKeySession = "session"
+	routingKeyCountry = "country"
+	routingKeyType    = "type"
+	routingKeyRotator = "rotator"
+)
+
+var (
+	errInvalidRoutingUsername = errors.New("invalid rotator username parameters")
+
+	routingValuePatterns = map[string]*regexp.Regexp{
+		routingKeySession: regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`),
+		routingKeyCountry: regexp.MustCompile(`^[A-Za-z_.']{2,56}$`),
+		routingKeyType:    regexp.MustCompile(`^[A-Za-z_]{1,20}$`),
+		routingKeyRotator: regexp.MustCompile(`^[0-9]{1,19}$`),
+	}
+)
+
+type clientRouting struct {
+	// CredentialID is the rotator credential the client logged in with, 0
+	// for the rotator's own login or unauthenticated clients.
+	CredentialID uint64
+	Username     string
+	Session      string
+	Country      string
+	Type         string
+	// Rotator is the rotator ID the client asked for, 0 if it did not.
+	Rotator uint64
+}
+
+func (r clientRouting) selection() database.RotatingProxySelection {
+	return database.RotatingProxySelection{
+		Country: r.Country,
+		Type:    r.Type,
+	}
+}
+
+func (r clientRouting) sessionKey() string {
+	if r.Session == "" {
+		return ""
+	}
+	return strings.Join([]string{r.Username, r.Session, strings.ToLower(r.Country), strings.ToLower(r.Type)}, "|")
+}
+
+// parseRotatorUsername splits a client username into the base username and
+// its routing parameters. When the rotator has a configured username, only
+// the suffix after "<base>-" is parsed so base usernames may contain dashes.
+func parseRotatorUsername(raw string, base string) (clientRouting, error) {
+	raw = strings.TrimSpace(raw)
+	base = strings.TrimSpace(base)
+
+	if base != "" {
+		if raw == base || !strings.HasPrefix(raw, base+"-") {
+			return clientRouting{Username: raw}, nil
+		}
+		routing := clientRouting{Username: base}
+		if err := routing.applyParameters(strings.Split(raw[len(base)+1:], "-")); err != nil {
+			return clientRouting{}, err
+		}
+		return routing, nil
+	}
+
+	tokens := strings.Split(raw, "-")
+	for idx, token := range tokens {
+		if _, ok := routingValuePatterns[strings.ToLower(token)]; !ok {
+			continue
+		}
+		routing := clientRouting{Username: strings.Join(tokens[:idx], "-")}
+		if err := routing.applyParameters(tokens[idx:]); err != nil {
+			return clientRouting{}, err
+		}
+		return routing, nil
+	}
+
+	return clientRouting{Username: raw}, nil
+}
+
+func (r *clientRouting) applyParameters(tokens []string) error {
+	if len(tokens)%2 != 0 {
+		return errInvalidRoutingUsername
+	}
+
+	seen := make(map[string]struct{}, len(tokens)/2)
+	for idx := 0; idx < len(tokens); idx += 2 {
+		key := strings.ToLower(tokens[idx])
+		value := tokens[idx+1]
+
+		pattern, ok := routingValuePatterns[key]
+		if !ok || !pattern.MatchString(value) {
+			return errInvalidRoutingUsername
+		}
+		if _, duplicate := seen[key]; duplicate {
+			return errInvalidRoutingUsername
+		}
+		seen[key] = struct{}{}
+
+		switch key {
+		case routingKeySession:
+			r.Session = value
+		case routingKeyCountry:
+			r.Country = strings.ReplaceAll(value, "_", " ")
+		case routingKeyType:
+			r.Type = strings.ReplaceAll(value, "_", " ")
+		case routingKeyRotator:
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || id == 0 {
+				return errInvalidRoutingUsername
+			}
+			r.Rotator = id
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package rotatingproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"magpie/internal/api/dto"
+	"magpie/internal/database"
+	"magpie/internal/domain"
+)
+
+func TestParseRotatorUsername(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     string
+		base    string
+		want    clientRouting
+		wantErr bool
+	}{
+		{
+			name: "plain username",
+			raw:  "proxy-user",
+			base: "proxy-user",
+			want: clientRouting{Username: "proxy-user"},
+		},
+		{
+			name: "all parameters with dashed base",
+			raw:  "proxy-user-session-abc123-country-US-type-residential",
+			base: "proxy-user",
+			want: clientRouting{Username: "proxy-user", Session: "abc123", Country: "US", Type: "residential"},
+		},
+		{
+			name: "underscores become spaces",
+			raw:  "user-country-united_states",
+			base: "user",
+			want: clientRouting{Username: "user", Country: "united states"},
+		},
+		{
+			name: "parameters without configured base",
+			raw:  "anything-session-s1",
+			want: clientRouting{Username: "anything", Session: "s1"},
+		},
+		{
+			name: "unrelated username is left untouched",
+			raw:  "other-session-s1",
+			base: "user",
+			want: clientRouting{Username: "other-session-s1"},
+		},
+		{
+			name:    "missing value",
+			raw:     "user-session",
+			base:    "user",
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			raw:     "user-city-berlin",
+			base:    "user",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate key",
+			raw:     "user-type-isp-type-datacenter",
+			base:    "user",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseRotatorUsername(tc.raw, tc.base)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseRotatorUsername(%q) succeeded, want error", tc.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRotatorUsername(%q) error: %v", tc.raw, err)
+			}
+			if got != tc.want {
+				t.Fatalf("parseRotatorUsername(%q) = %+v, want %+v", tc.raw, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateClient_AcceptsRoutingParameters(t *testing.T) {
+	handler := &proxyHandler{
+		rotator: domain.RotatingProxy{
+			AuthRequired: true,
+			AuthUsername: "proxy-user",
+			AuthPassword: "proxy-pass",
+		},
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	cred := base64.StdEncoding.EncodeToString([]byte("proxy-user-session-s1-country-DE:proxy-pass"))
+	request.Header.Set("Proxy-Authorization", "Basic "+cred)
+
+	routing, ok := handler.authenticateClient(httptest.NewRecorder(), request)
+	if !ok {
+		t.Fatal("authenticateClient rejected username with routing parameters")
+	}
+	if routing.Session != "s1" || routing.Country != "DE" {
+		t.Fatalf("routing = %+v, want session s1 and country DE", routing)
+	}
+}
+
+func TestRotatorState_PinsStickySessions(t *testing.T) {
+	var calls int
+	var lastSelection database.RotatingProxySelection
+	originalGetNext := getNextRotatingProxyFunc
+	getNextRotatingProxyFunc = func(userID uint, rotatorID uint64, selection database.RotatingProxySelection) (*dto.RotatingProxyNext, error) {
+		calls++
+		lastSelection = selection
+		return &dto.RotatingProxyNext{ProxyID: uint64(calls), Protocol: "http"}, nil
+	}
+	t.Cleanup(func() { getNextRotatingProxyFunc = originalGetNext })
+
+	state := newRotatorState()
+	rotator := domain.RotatingProxy{ID: 1, UserID: 2, StickySessionTTLSeconds: 60}
+	routing := clientRouting{Username: "user", Session: "abc", Country: "US"}
+
+	first, err := state.nextUpstream(rotator, routing)
+	if err != nil {
+		t.Fatalf("first selection: %v", err)
+	}
+	second, err := state.nextUpstream(rotator, routing)
+	if err != nil {
+		t.Fatalf("second selection: %v", err)
+	}
+	if first.ProxyID != second.ProxyID || calls != 1 {
+		t.Fatalf("sticky session was not reused: first=%d second=%d calls=%d", first.ProxyID, second.ProxyID, calls)
+	}
+	if lastSelection.Country != "US" {
+		t.Fatalf("selection country = %q, want US", lastSelection.Country)
+	}
+
+	state.upstreamFailed(rotator, routing, first.ProxyID)
+	third, err := state.nextUpstream(rotator, routing)
+	if err != nil {
+		t.Fatalf("third selection: %v", err)
+	}
+	if third.ProxyID == first.ProxyID {
+		t.Fatal("expected a fresh upstream after the pinned upstream failed")
+	}
+
+	if _, err := state.nextUpstream(rotator, clientRouting{Username: "user"}); err != nil {
+		t.Fatalf("unpinned selection: %v", err)
+	}
+	if _, err := state.nextUpstream(rotator, clientRouting{Username: "user"}); err != nil {
+		t.Fatalf("unpinned selection: %v", err)
+	}
+	if calls != 4 {
+		t.Fatalf("selection calls = %d, want 4", calls)
+	}
+}
+
+func TestRotatorState_ReleasesStickySessionLeavingThePool(t *testing.T) {
+	stubCandidatePool(t, []database.RotatingProxyCandidate{poolCandidate(1, "Germany"), poolCandidate(2, "Germany")})
+
+	rotator := domain.RotatingProxy{ID: 1, UserID: 2, StickySessionTTLSeconds: 60}
+	state := newRotatorState()
+	pool := newCandidatePool(rotator)
+	state.pool.Store(pool)
+	routing := clientRouting{Username: "user", Session: "abc"}
+
+	pinned, err := state.nextUpstream(rotator, routing)
+	if err != nil {
+		t.Fatalf("first selection: %v", err)
+	}
+
+	remaining := poolCandidate(3-pinned.ProxyID, "Germany")
+	loadRotatingProxyCandidatesFunc = func(domain.RotatingProxy) ([]database.RotatingProxyCandidate, error) {
+		return []database.RotatingProxyCandidate{remaining}, nil
+	}
+	proxyStatusVersionFunc = func() uint64 { return 1 }
+	if err := pool.refresh(); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	next, err := state.nextUpstream(rotator, routing)
+	if err != nil {
+		t.Fatalf("second selection: %v", err)
+	}
+	if next.ProxyID != remaining.Proxy.ID {
+		t.Fatalf("selected upstream %d, want %d after the pinned upstream left the pool", next.ProxyID, remaining.Proxy.ID)
+	}
+	if again, err := state.nextUpstream(rotator, routing); err != nil || again.ProxyID != next.ProxyID {
+		t.Fatalf("session was not pinned to the new upstream: %v, %v", again, err)
+	}
+}
+
+func TestStickySessionStore_ExpiresEntries(t *testing.T) {
+	store := newStickySessionStore()
+	now := time.Now()
+	store.put("key", &dto.RotatingProxyNext{ProxyID: 7}, time.Second, now)
+
+	if _, ok := store.get("key", now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("expected sticky session before expiry")
+	}
+	if _, ok := store.get("key", now.Add(2*time.Second)); ok {
+		t.Fatal("expected sticky session to expire")
+	}
+}
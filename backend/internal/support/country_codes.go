@@ -0,0 +1,255 @@
+package support
+
+import "strings"
+
+// countryNamesByCode maps ISO 3166-1 alpha-2 codes to the English names GeoLite
+// stores in proxies.country. Some entries carry aliases because the database
+// wording changed between releases.
+var countryNamesByCode = map[string][]string{
+	"AD": {"Andorra"},
+	"AE": {"United Arab Emirates"},
+	"AF": {"Afghanistan"},
+	"AG": {"Antigua and Barbuda"},
+	"AI": {"Anguilla"},
+	"AL": {"Albania"},
+	"AM": {"Armenia"},
+	"AO": {"Angola"},
+	"AQ": {"Antarctica"},
+	"AR": {"Argentina"},
+	"AS": {"American Samoa"},
+	"AT": {"Austria"},
+	"AU": {"Australia"},
+	"AW": {"Aruba"},
+	"AX": {"Åland", "Aland Islands"},
+	"AZ": {"Azerbaijan"},
+	"BA": {"Bosnia and Herzegovina"},
+	"BB": {"Barbados"},
+	"BD": {"Bangladesh"},
+	"BE": {"Belgium"},
+	"BF": {"Burkina Faso"},
+	"BG": {"Bulgaria"},
+	"BH": {"Bahrain"},
+	"BI": {"Burundi"},
+	"BJ": {"Benin"},
+	"BL": {"Saint Barthélemy"},
+	"BM": {"Bermuda"},
+	"BN": {"Brunei"},
+	"BO": {"Bolivia"},
+	"BQ": {"Bonaire, Sint Eustatius, and Saba"},
+	"BR": {"Brazil"},
+	"BS": {"Bahamas"},
+	"BT": {"Bhutan"},
+	"BW": {"Botswana"},
+	"BY": {"Belarus"},
+	"BZ": {"Belize"},
+	"CA": {"Canada"},
+	"CD": {"DR Congo", "Democratic Republic of the Congo"},
+	"CF": {"Central African Republic"},
+	"CG": {"Congo Republic", "Republic of the Congo"},
+	"CH": {"Switzerland"},
+	"CI": {"Ivory Coast", "Côte d'Ivoire"},
+	"CK": {"Cook Islands"},
+	"CL": {"Chile"},
+	"CM": {"Cameroon"},
+	"CN": {"China"},
+	"CO": {"Colombia"},
+	"CR": {"Costa Rica"},
+	"CU": {"Cuba"},
+	"CV": {"Cabo Verde", "Cape Verde"},
+	"CW": {"Curaçao"},
+	"CY": {"Cyprus"},
+	"CZ": {"Czechia", "Czech Republic"},
+	"DE": {"Germany"},
+	"DJ": {"Djibouti"},
+	"DK": {"Denmark"},
+	"DM": {"Dominica"},
+	"DO": {"Dominican Republic"},
+	"DZ": {"Algeria"},
+	"EC": {"Ecuador"},
+	"EE": {"Estonia"},
+	"EG": {"Egypt"},
+	"ER": {"Eritrea"},
+	"ES": {"Spain"},
+	"ET": {"Ethiopia"},
+	"FI": {"Finland"},
+	"FJ": {"Fiji"},
+	"FM": {"Federated States of Micronesia", "Micronesia"},
+	"FO": {"Faroe Islands"},
+	"FR": {"France"},
+	"GA": {"Gabon"},
+	"GB": {"United Kingdom"},
+	"GD": {"Grenada"},
+	"GE": {"Georgia"},
+	"GF": {"French Guiana"},
+	"GG": {"Guernsey"},
+	"GH": {"Ghana"},
+	"GI": {"Gibraltar"},
+	"GL": {"Greenland"},
+	"GM": {"Gambia"},
+	"GN": {"Guinea"},
+	"GP": {"Guadeloupe"},
+	"GQ": {"Equatorial Guinea"},
+	"GR": {"Greece"},
+	"GT": {"Guatemala"},
+	"GU": {"Guam"},
+	"GW": {"Guinea-Bissau"},
+	"GY": {"Guyana"},
+	"HK": {"Hong Kong"},
+	"HN": {"Honduras"},
+	"HR": {"Croatia"},
+	"HT": {"Haiti"},
+	"HU": {"Hungary"},
+	"ID": {"Indonesia"},
+	"IE": {"Ireland"},
+	"IL": {"Israel"},
+	"IM": {"Isle of Man"},
+	"IN": {"India"},
+	"IQ": {"Iraq"},
+	"IR": {"Iran"},
+	"IS": {"Iceland"},
+	"IT": {"Italy"},
+	"JE": {"Jersey"},
+	"JM": {"Jamaica"},
+	"JO": {"Hashemite Kingdom of Jordan", "Jordan"},
+	"JP": {"Japan"},
+	"KE": {"Kenya"},
+	"KG": {"Kyrgyzstan"},
+	"KH": {"Cambodia"},
+	"KI": {"Kiribati"},
+	"KM": {"Comoros"},
+	"KN": {"St Kitts and Nevis", "Saint Kitts and Nevis"},
+	"KP": {"North Korea"},
+	"KR": {"South Korea"},
+	"KW": {"Kuwait"},
+	"KY": {"Cayman Islands"},
+	"KZ": {"Kazakhstan"},
+	"LA": {"Laos"},
+	"LB": {"Lebanon"},
+	"LC": {"Saint Lucia"},
+	"LI": {"Liechtenstein"},
+	"LK": {"Sri Lanka"},
+	"LR": {"Liberia"},
+	"LS": {"Lesotho"},
+	"LT": {"Republic of Lithuania", "Lithuania"},
+	"LU": {"Luxembourg"},
+	"LV": {"Latvia"},
+	"LY": {"Libya"},
+	"MA": {"Morocco"},
+	"MC": {"Monaco"},
+	"MD": {"Republic of Moldova", "Moldova"},
+	"ME": {"Montenegro"},
+	"MF": {"Saint Martin"},
+	"MG": {"Madagascar"},
+	"MH": {"Marshall Islands"},
+	"MK": {"North Macedonia"},
+	"ML": {"Mali"},
+	"MM": {"Myanmar"},
+	"MN": {"Mongolia"},
+	"MO": {"Macao", "Macau"},
+	"MP": {"Northern Mariana Islands"},
+	"MQ": {"Martinique"},
+	"MR": {"Mauritania"},
+	"MS": {"Montserrat"},
+	"MT": {"Malta"},
+	"MU": {"Mauritius"},
+	"MV": {"Maldives"},
+	"MW": {"Malawi"},
+	"MX": {"Mexico"},
+	"MY": {"Malaysia"},
+	"MZ": {"Mozambique"},
+	"NA": {"Namibia"},
+	"NC": {"New Caledonia"},
+	"NE": {"Niger"},
+	"NG": {"Nigeria"},
+	"NI": {"Nicaragua"},
+	"NL": {"The Netherlands", "Netherlands"},
+	"NO": {"Norway"},
+	"NP": {"Nepal"},
+	"NR": {"Nauru"},
+	"NZ": {"New Zealand"},
+	"OM": {"Oman"},
+	"PA": {"Panama"},
+	"PE": {"Peru"},
+	"PF": {"French Polynesia"},
+	"PG": {"Papua New Guinea"},
+	"PH": {"Philippines"},
+	"PK": {"Pakistan"},
+	"PL": {"Poland"},
+	"PM": {"Saint Pierre and Miquelon"},
+	"PR": {"Puerto Rico"},
+	"PS": {"Palestine"},
+	"PT": {"Portugal"},
+	"PW": {"Palau"},
+	"PY": {"Paraguay"},
+	"QA": {"Qatar"},
+	"RE": {"Réunion"},
+	"RO": {"Romania"},
+	"RS": {"Serbia"},
+	"RU": {"Russia"},
+	"RW": {"Rwanda"},
+	"SA": {"Saudi Arabia"},
+	"SB": {"Solomon Islands"},
+	"SC": {"Seychelles"},
+	"SD": {"Sudan"},
+	"SE": {"Sweden"},
+	"SG": {"Singapore"},
+	"SI": {"Slovenia"},
+	"SK": {"Slovakia"},
+	"SL": {"Sierra Leone"},
+	"SM": {"San Marino"},
+	"SN": {"Senegal"},
+	"SO": {"Somalia"},
+	"SR": {"Suriname"},
+	"SS": {"South Sudan"},
+	"ST": {"São Tomé and Príncipe"},
+	"SV": {"El Salvador"},
+	"SX": {"Sint Maarten"},
+	"SY": {"Syria"},
+	"SZ": {"Eswatini", "Swaziland"},
+	"TC": {"Turks and Caicos Islands"},
+	"TD": {"Chad"},
+	"TG": {"Togo"},
+	"TH": {"Thailand"},
+	"TJ": {"Tajikistan"},
+	"TL": {"Timor-Leste", "East Timor"},
+	"TM": {"Turkmenistan"},
+	"TN": {"Tunisia"},
+	"TO": {"Tonga"},
+	"TR": {"Türkiye", "Turkey"},
+	"TT": {"Trinidad and Tobago"},
+	"TW": {"Taiwan"},
+	"TZ": {"Tanzania"},
+	"UA": {"Ukraine"},
+	"UG": {"Uganda"},
+	"US": {"United States"},
+	"UY": {"Uruguay"},
+	"UZ": {"Uzbekistan"},
+	"VA": {"Vatican City"},
+	"VC": {"Saint Vincent and the Grenadines"},
+	"VE": {"Venezuela"},
+	"VG": {"British Virgin Islands"},
+	"VI": {"U.S. Virgin Islands"},
+	"VN": {"Vietnam"},
+	"VU": {"Vanuatu"},
+	"WS": {"Samoa"},
+	"XK": {"Kosovo"},
+	"YE": {"Yemen"},
+	"ZA": {"South Africa"},
+	"ZM": {"Zambia"},
+	"ZW": {"Zimbabwe"},
+}
+
+// CountryMatchValues returns the lower-cased proxies.country values a country
+// filter should match: the value itself plus the names behind an ISO code.
+func CountryMatchValues(value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	values := []string{strings.ToLower(value)}
+	for _, name := range countryNamesByCode[strings.ToUpper(value)] {
+		values = append(values, strings.ToLower(name))
+	}
+	return values
+}
@@ -16,14 +16,28 @@ type Metrics struct {
 	EstimatedType     string
 	FailureStreak     uint16
 	SampleWindowHours float64
+	LiveTraffic       LiveTraffic
 }
 
+// LiveTraffic summarises what rotating proxies observed while relaying real
+// traffic through a proxy, as opposed to scheduled checks.
+type LiveTraffic struct {
+	Attempts       int
+	Successes      int
+	TLSErrors      int
+	AvgHandshakeMS float64
+}
+
+// Weights of the check based signals. LiveTraffic is the share of the final
+// score taken by the live traffic signal; it only applies once a proxy saw
+// enough live traffic.
 type Weights struct {
-	Uptime    float64
-	Recency   float64
-	Latency   float64
-	Anonymity float64
-	Failures  float64
+	Uptime      float64
+	Recency     float64
+	Latency     float64
+	Anonymity   float64
+	Failures    float64
+	LiveTraffic float64
 }
 
 type ScoreResult struct {
@@ -44,8 +58,14 @@ var defaultWeights = Weights{
 	Latency:   0.15,
 	Anonymity: 0.1,
 	Failures:  0.1,
+	// Applied on top of the weights above once live traffic is available.
+	LiveTraffic: 0.25,
 }
 
+// minLiveTrafficAttempts keeps a handful of live connections from outweighing
+// the scheduled checks.
+const minLiveTrafficAttempts = 5
+
 func Score(metrics Metrics, now time.Time, customWeights *Weights) ScoreResult {
 	w := defaultWeights
 	if customWeights != nil {
@@ -60,12 +80,18 @@ func Score(metrics Metrics, now time.Time, customWeights *Weights) ScoreResult {
 	failuresScore := calculateFailureScore(metrics)
 
 	score := clamp01(
-		w.Uptime*uptimeScore+
-			w.Recency*recencyScore+
-			w.Latency*latencyScore+
-			w.Anonymity*anonymityScore+
+		w.Uptime*uptimeScore +
+			w.Recency*recencyScore +
+			w.Latency*latencyScore +
+			w.Anonymity*anonymityScore +
 			w.Failures*failuresScore,
-	) * 100
+	)
+
+	liveScore, hasLive := calculateLiveTrafficScore(metrics)
+	if hasLive {
+		score = clamp01((1-w.LiveTraffic)*score + w.LiveTraffic*liveScore)
+	}
+	score *= 100
 
 	label := labelFromScore(score)
 
@@ -95,6 +121,17 @@ func Score(metrics Metrics, now time.Time, customWeights *Weights) ScoreResult {
 	if medianMs, ok := median(metrics.ResponseTimesMS); ok {
 		signals["latency_median_ms"] = medianMs
 	}
+	if live := metrics.LiveTraffic; live.Attempts > 0 {
+		signals["live_attempts"] = live.Attempts
+		signals["live_success_ratio"] = ratio(live.Successes, live.Attempts)
+		signals["live_tls_errors"] = live.TLSErrors
+		if live.AvgHandshakeMS > 0 {
+			signals["live_handshake_ms"] = live.AvgHandshakeMS
+		}
+		if hasLive {
+			signals["live_score"] = liveScore
+		}
+	}
 
 	result.Signals = signals
 	return result
@@ -111,6 +148,7 @@ func normaliseWeights(w *Weights) {
 	w.Latency /= total
 	w.Anonymity /= total
 	w.Failures /= total
+	w.LiveTraffic = clamp01(w.LiveTraffic)
 }
 
 func calculateUptimeScore(m Metrics) float64 {
@@ -192,6 +230,28 @@ func calculateFailureScore(m Metrics) float64 {
 	return clamp01(1 - float64(m.FailureStreak)/float64(maxPenaltyStreak))
 }
 
+// calculateLiveTrafficScore rates the connections rotating proxies made
+// through the proxy. Target TLS errors count against it even though the
+// connection itself succeeded, since they usually mean the proxy tampers
+// with the traffic.
+func calculateLiveTrafficScore(m Metrics) (float64, bool) {
+	live := m.LiveTraffic
+	if live.Attempts < minLiveTrafficAttempts {
+		return 0, false
+	}
+
+	reliability := ratio(live.Successes-live.TLSErrors, live.Attempts)
+	handshake := 1.0
+	switch {
+	case live.AvgHandshakeMS <= 500:
+	case live.AvgHandshakeMS >= 5000:
+		handshake = 0
+	default:
+		handshake = clamp01(1 - (live.AvgHandshakeMS-500)/4500)
+	}
+	return clamp01(0.8*reliability + 0.2*handshake), true
+}
+
 func labelFromScore(score float64) string {
 	switch {
 	case score >= 80:
@@ -0,0 +1,44 @@
+package reputation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScore_LiveTrafficSignal(t *testing.T) {
+	now := time.Now()
+	base := Metrics{
+		TotalChecks:      10,
+		SuccessfulChecks: 10,
+		ResponseTimesMS:  []uint16{200, 250},
+		LatestSuccess:    &now,
+		BestAnonymity:    "elite",
+		EstimatedType:    "residential",
+	}
+
+	checksOnly := Score(base, now, nil)
+
+	fewAttempts := base
+	fewAttempts.LiveTraffic = LiveTraffic{Attempts: minLiveTrafficAttempts - 1}
+	if got := Score(fewAttempts, now, nil).Score; got != checksOnly.Score {
+		t.Fatalf("score with too little live traffic = %v, want %v", got, checksOnly.Score)
+	}
+
+	failing := base
+	failing.LiveTraffic = LiveTraffic{Attempts: 20, Successes: 2, AvgHandshakeMS: 300}
+	failingResult := Score(failing, now, nil)
+	if failingResult.Score >= checksOnly.Score {
+		t.Fatalf("failing live traffic score = %v, want below %v", failingResult.Score, checksOnly.Score)
+	}
+	if _, ok := failingResult.Signals["live_score"]; !ok {
+		t.Fatalf("expected live_score signal, got %v", failingResult.Signals)
+	}
+
+	tampering := base
+	tampering.LiveTraffic = LiveTraffic{Attempts: 20, Successes: 20, TLSErrors: 10, AvgHandshakeMS: 300}
+	healthy := base
+	healthy.LiveTraffic = LiveTraffic{Attempts: 20, Successes: 20, AvgHandshakeMS: 300}
+	if Score(tampering, now, nil).Score >= Score(healthy, now, nil).Score {
+		t.Fatal("expected target TLS errors to lower the score")
+	}
+}
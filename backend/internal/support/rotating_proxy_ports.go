@@ -1,18 +1,28 @@
 package support
 
-import "sync"
+import (
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
 
 const (
 	defaultRotatingProxyPortStart = 20000
 	defaultRotatingProxyPortEnd   = 20100
 	envPortStart                  = "ROTATING_PROXY_PORT_START"
 	envPortEnd                    = "ROTATING_PROXY_PORT_END"
+	envGatewayHTTPPort            = "ROTATING_PROXY_GATEWAY_HTTP_PORT"
+	envGatewaySOCKS5Port          = "ROTATING_PROXY_GATEWAY_SOCKS5_PORT"
 )
 
 var (
 	portRangeOnce sync.Once
 	portStart     int
 	portEnd       int
+
+	gatewayPortsOnce  sync.Once
+	gatewayHTTPPort   int
+	gatewaySOCKS5Port int
 )
 
 func loadRotatingProxyPortRange() {
@@ -37,3 +47,33 @@ func GetRotatingProxyPortRange() (int, int) {
 	portRangeOnce.Do(loadRotatingProxyPortRange)
 	return portStart, portEnd
 }
+
+// GetRotatingProxyGatewayPorts returns the ports of the shared gateway
+// listeners that serve every rotator of this instance, 0 for a disabled
+// gateway. Ports inside the rotator port range are ignored.
+func GetRotatingProxyGatewayPorts() (int, int) {
+	gatewayPortsOnce.Do(loadRotatingProxyGatewayPorts)
+	return gatewayHTTPPort, gatewaySOCKS5Port
+}
+
+func loadRotatingProxyGatewayPorts() {
+	start, end := GetRotatingProxyPortRange()
+	load := func(key string) int {
+		port := GetEnvInt(key, 0)
+		if port == 0 {
+			return 0
+		}
+		if port < 0 || port > 65535 || (port >= start && port <= end) {
+			log.Warn("Ignoring rotating proxy gateway port outside 1-65535 or inside the rotator port range", "env", key, "port", port)
+			return 0
+		}
+		return port
+	}
+
+	gatewayHTTPPort = load(envGatewayHTTPPort)
+	gatewaySOCKS5Port = load(envGatewaySOCKS5Port)
+	if gatewaySOCKS5Port != 0 && gatewaySOCKS5Port == gatewayHTTPPort {
+		log.Warn("Ignoring rotating proxy SOCKS5 gateway port already used by the HTTP gateway", "port", gatewaySOCKS5Port)
+		gatewaySOCKS5Port = 0
+	}
+}
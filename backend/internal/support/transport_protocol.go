@@ -6,6 +6,9 @@ const (
 	TransportTCP   = "tcp"
 	TransportQUIC  = "quic"
 	TransportHTTP3 = "http3"
+	// TransportTLS is TCP wrapped in TLS. It is only offered for rotator
+	// listeners, upstream connections and checks do not use it.
+	TransportTLS = "tls"
 )
 
 var transportProtocolSet = map[string]struct{}{
@@ -22,6 +25,15 @@ func NormalizeTransportProtocol(value string) string {
 	return TransportTCP
 }
 
+// NormalizeListenTransportProtocol is NormalizeTransportProtocol for rotator
+// listeners, which also accept TransportTLS.
+func NormalizeListenTransportProtocol(value string) string {
+	if strings.EqualFold(strings.TrimSpace(value), TransportTLS) {
+		return TransportTLS
+	}
+	return NormalizeTransportProtocol(value)
+}
+
 func ResolveCheckerTransportProtocol(value string) string {
 	return NormalizeTransportProtocol(value)
 }
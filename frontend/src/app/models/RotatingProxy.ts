@@ -47,6 +47,8 @@ export interface RotatingProxyInstance {
   used_ports: number;
   free_ports: number;
   total_ports: number;
+  gateway_http_port?: number;
+  gateway_socks5_port?: number;
 }
 
 export interface RotatingProxyNext {
@@ -65,11 +65,14 @@ export class RotatingProxiesComponent implements OnInit, OnDestroy {
   ];
   readonly transportProtocolTooltip =
     'TCP uses standard HTTP over TCP. QUIC and HTTP/3 both use HTTP/3 over QUIC; QUIC enables HTTP/3 datagrams (unreliable messages), HTTP/3 uses streams only.';
+  readonly listenTransportProtocolTooltip =
+    `${this.transportProtocolTooltip} TLS serves HTTP proxy clients over TLS (https:// proxy URLs).`;
   createForm: FormGroup;
   rotatingProxies = signal<RotatingProxy[]>([]);
   protocolOptions = signal<{ label: string; value: string }[]>([]);
   listenProtocolOptions = signal<{ label: string; value: string }[]>([...this.protocolOptionList]);
   transportProtocolOptions = [...this.transportProtocolOptionList];
+  listenTransportProtocolOptions = [...this.transportProtocolOptionList, {label: 'TLS', value: 'tls'}];
   instanceOptions = signal<RotatorInstanceOption[]>([]);
   hasAvailableInstances = signal(false);
   loading = signal(false);
@@ -208,7 +211,8 @@ export class RotatingProxiesComponent implements OnInit, OnDestroy {
           if (!currentTransport || !transportValues.includes(currentTransport)) {
             this.createForm.patchValue({transportProtocol: transportValues[0] ?? 'tcp'}, {emitEvent: false});
           }
-          if (!currentListenTransport || !transportValues.includes(currentListenTransport)) {
+          const listenTransportValues = this.listenTransportProtocolOptions.map(opt => opt.value);
+          if (!currentListenTransport || !listenTransportValues.includes(currentListenTransport)) {
             this.createForm.patchValue({listenTransportProtocol: transportValues[0] ?? 'tcp'}, {emitEvent: false});
           }
           const availableInstances = this.instanceOptions().map(option => option.value);
@@ -481,6 +485,8 @@ export class RotatingProxiesComponent implements OnInit, OnDestroy {
         return 'QUIC';
       case 'http3':
         return 'HTTP/3';
+      case 'tls':
+        return 'TLS';
       default:
         return value?.toUpperCase() ?? '';
     }